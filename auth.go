@@ -0,0 +1,136 @@
+package main
+
+import (
+    "crypto/sha256"
+    "crypto/subtle"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+)
+
+// apiKeyHeader is the request header carrying the client's API key
+const apiKeyHeader = "X-API-Key"
+
+// callerKey is the gin context key holding the caller set by keyring.identify
+const callerKey = "caller"
+
+// caller is who a request's API key belongs to
+type caller struct {
+    // user is the owner of a USER_API_KEYS key, empty for an API_KEYS key
+    user string
+}
+
+// admin reports whether the caller used one of the API_KEYS, which may act
+// on every user's receipts
+func (c caller) admin() bool {
+    return c.user == ""
+}
+
+// keyring holds the API keys the server accepts
+type keyring struct {
+    // hashes[i] is the SHA-256 of a key; users[i] is its user, empty for an
+    // API_KEYS key
+    hashes [][sha256.Size]byte
+    users  []string
+}
+
+// newKeyring creates a keyring from the configured keys
+// Input: API_KEYS entries and USER_API_KEYS parsed by Config.userAPIKeys
+// Output: *keyring; empty if both are
+func newKeyring(apiKeys []string, userKeys map[string]string) *keyring {
+    k := &keyring{}
+    // Comparing hashes keeps ConstantTimeCompare from leaking key lengths
+    for _, key := range apiKeys {
+        k.hashes = append(k.hashes, sha256.Sum256([]byte(key)))
+        k.users = append(k.users, "")
+    }
+    for key, user := range userKeys {
+        k.hashes = append(k.hashes, sha256.Sum256([]byte(key)))
+        k.users = append(k.users, user)
+    }
+    return k
+}
+
+// empty reports whether no keys are configured, so authentication is off
+func (k *keyring) empty() bool {
+    return len(k.hashes) == 0
+}
+
+// lookup finds who a key belongs to
+// Input: key from the X-API-Key header
+// Output: its caller and true, or false if no configured key matches
+func (k *keyring) lookup(key string) (caller, bool) {
+    given := sha256.Sum256([]byte(key))
+    match := -1
+    // Check every key so the time taken doesn't reveal which one matched
+    for i, hash := range k.hashes {
+        if subtle.ConstantTimeCompare(given[:], hash[:]) == 1 {
+            match = i
+        }
+    }
+    if match < 0 {
+        return caller{}, false
+    }
+    return caller{user: k.users[match]}, true
+}
+
+// identify records who the request's API key belongs to, on every endpoint,
+// so read endpoints can check receipt ownership
+// Input: none
+// Output: gin middleware answering 403 INVALID_API_KEY when the X-API-Key
+//         header doesn't match any key; requests without one pass through
+func (k *keyring) identify() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        key := c.GetHeader(apiKeyHeader)
+        if key == "" {
+            c.Next()
+            return
+        }
+        who, ok := k.lookup(key)
+        if !ok {
+            respondError(c, http.StatusForbidden, codeInvalidAPIKey, "invalid API key")
+            return
+        }
+        c.Set(callerKey, who)
+        c.Next()
+    }
+}
+
+// requestCaller returns who the request's API key belongs to
+// Input: request context, after keyring.identify
+// Output: the caller and true, or false if the request carried no key
+func requestCaller(c *gin.Context) (caller, bool) {
+    value, ok := c.Get(callerKey)
+    if !ok {
+        return caller{}, false
+    }
+    return value.(caller), true
+}
+
+// apiKeyAuth rejects requests that didn't carry one of the configured keys
+// Input: none; keyring.identify must run first
+// Output: gin middleware answering 401 MISSING_API_KEY when the X-API-Key
+//         header is absent
+func apiKeyAuth() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if _, ok := requestCaller(c); !ok {
+            respondError(c, http.StatusUnauthorized, codeMissingAPIKey, "missing API key")
+            return
+        }
+        c.Next()
+    }
+}
+
+// adminOnly keeps user keys away from endpoints acting on every receipt,
+// such as rescoring or importing
+// Input: none; apiKeyAuth must run first
+// Output: gin middleware answering 403 ADMIN_KEY_REQUIRED for a USER_API_KEYS key
+func adminOnly() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if who, _ := requestCaller(c); !who.admin() {
+            respondError(c, http.StatusForbidden, codeAdminKeyRequired, "this endpoint requires an API_KEYS key")
+            return
+        }
+        c.Next()
+    }
+}
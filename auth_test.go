@@ -0,0 +1,54 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.APIKeys = "key-one,key-two"
+    router := newTestRouterWith(t, cfg)
+    body := receiptJSON(t, exampleReceipt)
+
+    tests := []struct {
+        name, key  string
+        wantStatus int
+        wantCode   string
+    }{
+        {"missing key", "", http.StatusUnauthorized, codeMissingAPIKey},
+        {"unknown key", "key-three", http.StatusForbidden, codeInvalidAPIKey},
+        {"prefix of a key", "key-on", http.StatusForbidden, codeInvalidAPIKey},
+        {"key with a suffix", "key-one ", http.StatusForbidden, codeInvalidAPIKey},
+        {"first key", "key-one", http.StatusOK, ""},
+        {"second key", "key-two", http.StatusOK, ""},
+    }
+    for _, tt := range tests {
+        status, resp := serveAs(t, router, tt.key, http.MethodPost, "/receipts/process", body)
+        if status != tt.wantStatus {
+            t.Errorf("%s: process returned %d %v, want %d", tt.name, status, resp, tt.wantStatus)
+            continue
+        }
+        if tt.wantCode != "" && errorDetail(resp)["code"] != tt.wantCode {
+            t.Errorf("%s: process returned %v, want code %s", tt.name, resp, tt.wantCode)
+        }
+    }
+
+    // Deleting needs a key too; reading a receipt doesn't
+    _, resp := serveAs(t, router, "key-one", http.MethodPost, "/receipts/process", body)
+    id, _ := resp["id"].(string)
+    if status, _ := serve(t, router, http.MethodGet, "/receipts/"+id+"/points", ""); status != http.StatusOK {
+        t.Errorf("get points without a key returned %d, want 200", status)
+    }
+    if status, _ := serve(t, router, http.MethodDelete, "/receipts/"+id, ""); status != http.StatusUnauthorized {
+        t.Errorf("delete without a key returned %d, want 401", status)
+    }
+    if status, _ := serveAs(t, router, "key-two", http.MethodDelete, "/receipts/"+id, ""); status != http.StatusNoContent {
+        t.Errorf("delete with a key returned %d, want 204", status)
+    }
+
+    // With no keys configured, writes are open
+    if status, resp := serve(t, newTestRouter(t), http.MethodPost, "/receipts/process", body); status != http.StatusOK {
+        t.Errorf("process without configured keys returned %d %v, want 200", status, resp)
+    }
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "time"
+
+    bolt "go.etcd.io/bbolt"
+)
+
+var (
+    // boltReceipts maps receipt id to the JSON encoded ReceiptRecord
+    boltReceipts = []byte("receipts")
+    // boltOrder maps an increasing sequence number to a receipt id,
+    // so List can return ids in insertion order
+    boltOrder = []byte("order")
+    // boltOrderIndex maps receipt id to its sequence number in boltOrder
+    boltOrderIndex = []byte("order_index")
+    // boltRedemptions maps an increasing sequence number to the JSON
+    // encoded Redemption
+    boltRedemptions = []byte("redemptions")
+)
+
+// BoltStore is a Store backed by an embedded bbolt database file
+// bbolt serializes write transactions itself, so no extra lock is needed
+type BoltStore struct {
+    db *bolt.DB
+}
+
+// NewBoltStore opens the bbolt database at path and creates its buckets
+// Input: path of the database file; it is created if it doesn't exist
+// Output: *BoltStore, or an error if the file can't be opened
+func NewBoltStore(path string) (*BoltStore, error) {
+    // Timeout stops a second process from blocking forever on the file lock
+    db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+    if err != nil {
+        return nil, err
+    }
+    err = db.Update(func(tx *bolt.Tx) error {
+        for _, name := range [][]byte{boltReceipts, boltOrder, boltOrderIndex, boltRedemptions} {
+            if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return &BoltStore{db: db}, nil
+}
+
+// Put stores a record under id
+// Input: context, receipt id and record
+// Output: nil, or a database error
+func (s *BoltStore) Put(ctx context.Context, id string, record ReceiptRecord) error {
+    return s.PutBatch(ctx, []string{id}, []ReceiptRecord{record})
+}
+
+// PutBatch stores several records in one transaction
+// bbolt has no context support; the context is checked once the write
+// lock is held, which is where a slow store makes callers wait
+// Input: context, receipt ids and records, matched by index
+// Output: nil, or a database or context error; on error nothing is stored
+func (s *BoltStore) PutBatch(ctx context.Context, ids []string, records []ReceiptRecord) error {
+    return s.db.Update(func(tx *bolt.Tx) error {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        receipts := tx.Bucket(boltReceipts)
+        order := tx.Bucket(boltOrder)
+        index := tx.Bucket(boltOrderIndex)
+        for i, id := range ids {
+            data, err := json.Marshal(records[i])
+            if err != nil {
+                return err
+            }
+            // Only new ids get a place in the insertion order
+            if index.Get([]byte(id)) == nil {
+                seq, err := order.NextSequence()
+                if err != nil {
+                    return err
+                }
+                key := make([]byte, 8)
+                binary.BigEndian.PutUint64(key, seq)
+                if err := order.Put(key, []byte(id)); err != nil {
+                    return err
+                }
+                if err := index.Put([]byte(id), key); err != nil {
+                    return err
+                }
+            }
+            if err := receipts.Put([]byte(id), data); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// Get returns the record stored under id
+// Input: context and receipt id
+// Output: the record and true, an empty record and false if it doesn't exist,
+//         or a database or context error
+func (s *BoltStore) Get(ctx context.Context, id string) (ReceiptRecord, bool, error) {
+    if err := ctx.Err(); err != nil {
+        return ReceiptRecord{}, false, err
+    }
+    var record ReceiptRecord
+    exists := false
+    err := s.db.View(func(tx *bolt.Tx) error {
+        data := tx.Bucket(boltReceipts).Get([]byte(id))
+        if data == nil {
+            return nil
+        }
+        exists = true
+        // data is only valid inside the transaction, so decode it here
+        return json.Unmarshal(data, &record)
+    })
+    if err != nil {
+        return ReceiptRecord{}, false, err
+    }
+    return record, exists, nil
+}
+
+// Delete removes the record stored under id
+// Input: context and receipt id
+// Output: nil, ErrNotFound if the id doesn't exist, or a database or context error
+func (s *BoltStore) Delete(ctx context.Context, id string) error {
+    return s.db.Update(func(tx *bolt.Tx) error {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        receipts := tx.Bucket(boltReceipts)
+        if receipts.Get([]byte(id)) == nil {
+            return ErrNotFound
+        }
+        if err := receipts.Delete([]byte(id)); err != nil {
+            return err
+        }
+        index := tx.Bucket(boltOrderIndex)
+        if key := index.Get([]byte(id)); key != nil {
+            if err := tx.Bucket(boltOrder).Delete(key); err != nil {
+                return err
+            }
+        }
+        return index.Delete([]byte(id))
+    })
+}
+
+// List returns all stored ids in insertion order
+// Input: context
+// Output: slice of ids, or a database or context error
+func (s *BoltStore) List(ctx context.Context) ([]string, error) {
+    ids := []string{}
+    err := s.db.View(func(tx *bolt.Tx) error {
+        // big-endian sequence keys iterate in insertion order
+        return tx.Bucket(boltOrder).ForEach(func(_, id []byte) error {
+            ids = append(ids, string(id))
+            return ctx.Err()
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+    return ids, nil
+}
+
+// PutRedemption stores a points redemption
+// Input: context and redemption
+// Output: nil, or a database or context error
+func (s *BoltStore) PutRedemption(ctx context.Context, redemption Redemption) error {
+    data, err := json.Marshal(redemption)
+    if err != nil {
+        return err
+    }
+    return s.db.Update(func(tx *bolt.Tx) error {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        redemptions := tx.Bucket(boltRedemptions)
+        seq, err := redemptions.NextSequence()
+        if err != nil {
+            return err
+        }
+        key := make([]byte, 8)
+        binary.BigEndian.PutUint64(key, seq)
+        return redemptions.Put(key, data)
+    })
+}
+
+// Redemptions returns every stored redemption, oldest first
+// Input: context
+// Output: slice of redemptions, or a database or context error
+func (s *BoltStore) Redemptions(ctx context.Context) ([]Redemption, error) {
+    redemptions := []Redemption{}
+    err := s.db.View(func(tx *bolt.Tx) error {
+        return tx.Bucket(boltRedemptions).ForEach(func(_, data []byte) error {
+            var redemption Redemption
+            if err := json.Unmarshal(data, &redemption); err != nil {
+                return err
+            }
+            redemptions = append(redemptions, redemption)
+            return ctx.Err()
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+    return redemptions, nil
+}
+
+// Count returns the number of stored receipts
+// Input: context
+// Output: receipt count, or a database or context error
+func (s *BoltStore) Count(ctx context.Context) (int, error) {
+    if err := ctx.Err(); err != nil {
+        return 0, err
+    }
+    n := 0
+    err := s.db.View(func(tx *bolt.Tx) error {
+        n = tx.Bucket(boltReceipts).Stats().KeyN
+        return nil
+    })
+    return n, err
+}
+
+// Ping checks that the database is open
+// Input: context
+// Output: nil, or an error if the database was closed or the context is done
+func (s *BoltStore) Ping(ctx context.Context) error {
+    return s.db.View(func(tx *bolt.Tx) error {
+        return ctx.Err()
+    })
+}
+
+// Close closes the database file and releases its lock
+// Input: none
+// Output: nil, or a database error
+func (s *BoltStore) Close() error {
+    return s.db.Close()
+}
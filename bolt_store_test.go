@@ -0,0 +1,62 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "path/filepath"
+    "reflect"
+    "sync"
+    "testing"
+)
+
+func TestBoltStoreSurvivesReopen(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "receipts.db")
+    store, err := NewBoltStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    router := newTestRouterOn(t, defaultConfig(), store)
+
+    // Concurrent posts are serialized by bbolt
+    const n = 20
+    ids := make([]string, n)
+    points := make([]any, n)
+    var wg sync.WaitGroup
+    for i := range n {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            status, body := serve(t, router, http.MethodPost, "/receipts/process?includePoints=true", receiptJSON(t, statsReceipt(i)))
+            if status != http.StatusOK {
+                t.Errorf("receipt %d: process returned %d %v", i, status, body)
+                return
+            }
+            ids[i], _ = body["id"].(string)
+            points[i] = body["points"]
+        }()
+    }
+    wg.Wait()
+    _, stored := serve(t, router, http.MethodGet, "/receipts/"+ids[0], "")
+    if err := store.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    // The reopened file serves the same receipts and points
+    store, err = NewBoltStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { store.Close() })
+    if count, err := store.Count(context.Background()); err != nil || count != n {
+        t.Fatalf("reopened store counts %d receipts (%v), want %d", count, err, n)
+    }
+    router = newTestRouterOn(t, defaultConfig(), store)
+    for i, id := range ids {
+        if status, body := serve(t, router, http.MethodGet, "/receipts/"+id+"/points", ""); status != http.StatusOK || body["points"] != points[i] {
+            t.Errorf("receipt %d after reopening: got %d %v, want %v points", i, status, body, points[i])
+        }
+    }
+    if _, again := serve(t, router, http.MethodGet, "/receipts/"+ids[0], ""); !reflect.DeepEqual(again, stored) {
+        t.Errorf("receipt after reopening: %v, want %v", again, stored)
+    }
+}
@@ -0,0 +1,948 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "maps"
+    "math"
+    "net"
+    "os"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Config holds the server settings
+// Each field is read from an environment variable and can be
+// overridden by the matching command line flag
+type Config struct {
+    // PORT: port the HTTP server listens on
+    Port string
+    // GIN_MODE: gin mode, one of debug, release or test
+    GinMode string
+    // MAX_BATCH_SIZE: maximum number of receipts accepted by POST /receipts/batch
+    MaxBatchSize int
+    // MAX_BODY_BYTES: largest request body accepted, in bytes
+    MaxBodyBytes int64
+    // MAX_ITEMS: maximum number of items on one receipt
+    MaxItems int
+    // MAX_TOTAL_AMOUNT: largest receipt total accepted, in cents (dollars in
+    // the variable and flag); 0 means no limit
+    MaxTotalAmount int64
+    // STORAGE_BACKEND: where receipts are kept, memory, file, sqlite, bolt, redis or wal
+    StorageBackend string
+    // DATA_FILE: JSON file used by the file storage backend
+    DataFile string
+    // DB_PATH: database file used by the sqlite storage backend
+    DBPath string
+    // BOLT_PATH: database file used by the bolt storage backend
+    BoltPath string
+    // REDIS_ADDR: host:port of the server used by the redis storage backend
+    RedisAddr string
+    // WAL_PATH: append-only log used by the wal storage backend
+    WALPath string
+    // WAL_SYNC: when the wal backend fsyncs, always (every write) or interval (every second)
+    WALSync string
+    // DEDUP_RECEIPTS: answer a receipt identical to a stored one with the
+    // stored id instead of storing it again
+    DedupReceipts bool
+    // STRICT_TOTALS: reject receipts whose total doesn't equal the sum of item prices
+    StrictTotals bool
+    // REJECT_UNKNOWN_FIELDS: reject request bodies with fields the API doesn't
+    // define, such as a misspelled "retailor", instead of ignoring them
+    RejectUnknownFields bool
+    // LEGACY_ERRORS: send "error" as a plain message string, with "code" and
+    // "field" beside it, instead of the {"code", "message", "field"} object;
+    // off by default, kept for clients that haven't moved to the object
+    LegacyErrors bool
+    // REQUIRE_JSON_CONTENT_TYPE: answer 415 to request bodies whose
+    // Content-Type isn't application/json
+    RequireJSONContentType bool
+    // SNAPSHOT_PATH: file the memory backend is periodically saved to and
+    // loaded from on startup; empty disables snapshots
+    SnapshotPath string
+    // SNAPSHOT_INTERVAL: time between snapshots, e.g. 30s
+    SnapshotInterval time.Duration
+    // MAX_RECEIPT_AGE_DAYS: oldest purchaseDate accepted, in days before
+    // today; 0 accepts any age
+    MaxReceiptAgeDays int
+    // MAX_CLOCK_SKEW: how far past the server's clock a purchaseDate and
+    // purchaseTime may be; receipts carry their store's local time with no
+    // zone, so the default of 14h covers stores east of the server
+    MaxClockSkew time.Duration
+    // PURCHASE_TIMEZONE: IANA zone, e.g. America/New_York, that purchaseDate
+    // and purchaseTime are read in and that a purchaseDateTime is converted
+    // to before the day and hour rules look at it
+    PurchaseTimezone string
+    // MAX_RECEIPTS: receipts kept by the memory backend before the least
+    // recently accessed ones are evicted; 0 means unlimited
+    MaxReceipts int
+    // RECEIPT_TTL: how long receipts are kept, e.g. 72h; 0 keeps them forever
+    ReceiptTTL time.Duration
+    // IDEMPOTENCY_TTL: how long an Idempotency-Key is remembered, e.g. 24h
+    IdempotencyTTL time.Duration
+    // RATE_LIMIT_RPS: requests per second allowed per client IP; 0 disables rate limiting
+    RateLimitRPS float64
+    // RATE_LIMIT_BURST: requests a client IP may send at once before RATE_LIMIT_RPS applies
+    RateLimitBurst int
+    // TRUSTED_PROXIES: comma-separated proxy IPs or CIDRs whose X-Forwarded-For
+    // is believed; empty means the client IP is always the connection's address
+    TrustedProxies string
+    // API_KEYS: comma-separated keys accepted in the X-API-Key header of
+    // write endpoints; empty disables authentication
+    APIKeys string
+    // USER_API_KEYS: comma-separated user:key pairs; a user's key works like
+    // an API key and stores the receipts it submits under that user
+    UserAPIKeys string
+    // ENFORCE_RECEIPT_OWNERSHIP: only a receipt's owner or an API_KEYS key
+    // may read or change a receipt that has an owner
+    EnforceReceiptOwnership bool
+    // CORS_ALLOWED_ORIGINS: comma-separated origins browsers may call from; "*" allows any
+    CORSAllowedOrigins string
+    // CORS_ALLOWED_METHODS: comma-separated methods allowed in CORS preflights
+    CORSAllowedMethods string
+    // CORS_ALLOW_CREDENTIALS: allow cookies and auth headers on cross-origin requests
+    CORSAllowCredentials bool
+    // RULES_FILE: YAML or JSON file overriding the default points rules and
+    // values; RULE_*, POINTS_* and the other rule variables override the file
+    RulesFile string
+    // SHUTDOWN_TIMEOUT: how long in-flight requests may take to finish on shutdown
+    ShutdownTimeout time.Duration
+    // REQUEST_TIMEOUT: how long a request may take before it is answered
+    // with 503; 0 disables the timeout
+    RequestTimeout time.Duration
+    // Rules: which points rules are applied, see PointsRuleConfig
+    Rules PointsRuleConfig
+    // Values: how many points each rule awards, see PointsValues
+    Values PointsValues
+}
+
+// PointsRuleConfig selects which of the ten points rules are applied
+// Each field is read from the environment variable in its comment
+type PointsRuleConfig struct {
+    // RULE_RETAILER_ALPHANUMERIC: Rule 1, one point per alphanumeric retailer character
+    EnableRetailerAlphanumeric bool
+    // RULE_ROUND_DOLLAR: Rule 2, 50 points for a round dollar total
+    EnableRoundDollar bool
+    // RULE_QUARTER_MULTIPLE: Rule 3, 25 points for a total that is a multiple of 0.25
+    EnableQuarterMultiple bool
+    // RULE_ITEM_PAIRS: Rule 4, 5 points for every two items
+    EnableItemPairs bool
+    // RULE_ITEM_DESCRIPTION: Rule 5, price * 0.2 for descriptions whose length is a multiple of 3
+    EnableItemDescription bool
+    // RULE_ODD_DAY: Rule 6, 6 points for an odd purchase day
+    EnableOddDay bool
+    // RULE_AFTERNOON: Rule 7, 10 points for a purchase in the afternoon window
+    EnableAfternoon bool
+    // RULE_WEEKEND: Rule 8, points for a purchase on a Saturday or Sunday
+    EnableWeekendBonus bool
+    // RULE_LARGE_PURCHASE: Rule 9, points for a total at or above a threshold
+    EnableLargePurchaseBonus bool
+    // RULE_TOTAL_OVER_TEN: Rule 10, points for a total greater than 10.00
+    EnableTotalOverTen bool
+    // AFTERNOON_WINDOW_START: Rule 7 window start as HH:MM, stored as the
+    // offset from midnight; a purchase must be after it
+    AfternoonWindowStart time.Duration
+    // AFTERNOON_WINDOW_END: Rule 7 window end as HH:MM, exclusive
+    AfternoonWindowEnd time.Duration
+    // AFTERNOON_WINDOW_START_INCLUSIVE: a purchase exactly at the window
+    // start earns the bonus too, as it did in earlier versions
+    AfternoonWindowStartInclusive bool
+}
+
+// PointsValues holds the points awarded by each rule
+// Each field is read from the environment variable in its comment
+type PointsValues struct {
+    // POINTS_ROUND_DOLLAR: Rule 2, points for a round dollar total
+    RoundDollarBonus int
+    // POINTS_QUARTER_MULTIPLE: Rule 3, points for a total that is a multiple of 0.25
+    QuarterMultipleBonus int
+    // POINTS_ITEM_PAIR: Rule 4, points for every two items
+    ItemPairBonus int
+    // POINTS_ODD_DAY: Rule 6, points for an odd purchase day
+    OddDayBonus int
+    // POINTS_AFTERNOON: Rule 7, points for a purchase in the afternoon window
+    AfternoonBonus int
+    // POINTS_WEEKEND: Rule 8, points for a purchase on a Saturday or Sunday
+    WeekendBonus int
+    // POINTS_LARGE_PURCHASE: Rule 9, points for a total at or above LargePurchaseThreshold
+    LargePurchaseBonus int
+    // LARGE_PURCHASE_THRESHOLD: Rule 9, smallest total earning the bonus, in
+    // dollars, e.g. 100.00; stored in cents
+    LargePurchaseThreshold int64
+    // POINTS_TOTAL_OVER_TEN: Rule 10, points for a total greater than 10.00
+    TotalOverTenBonus int
+    // POINTS_ITEM_DESCRIPTION_MULTIPLIER: Rule 5, multiplied by the item price;
+    // precision beyond 4 decimal places is rounded away
+    ItemDescriptionMultiplier float64
+}
+
+// defaultValues returns the points awarded by the original rules
+// Input: none
+// Output: PointsValues with 50, 25, 5, 6, 10, 15, 20 and 5 points, a 0.2
+//         multiplier and a 100.00 large purchase threshold
+func defaultValues() PointsValues {
+    return PointsValues{
+        RoundDollarBonus:          50,
+        QuarterMultipleBonus:      25,
+        ItemPairBonus:             5,
+        OddDayBonus:               6,
+        AfternoonBonus:            10,
+        WeekendBonus:              15,
+        LargePurchaseBonus:        20,
+        LargePurchaseThreshold:    10000,
+        TotalOverTenBonus:         5,
+        ItemDescriptionMultiplier: 0.2,
+    }
+}
+
+// valueEnvVars pairs each whole-number PointsValues field with its environment variable
+// Input: values to bind
+// Output: map from environment variable to the field it sets
+func valueEnvVars(values *PointsValues) map[string]*int {
+    return map[string]*int{
+        "POINTS_ROUND_DOLLAR":     &values.RoundDollarBonus,
+        "POINTS_QUARTER_MULTIPLE": &values.QuarterMultipleBonus,
+        "POINTS_ITEM_PAIR":        &values.ItemPairBonus,
+        "POINTS_ODD_DAY":          &values.OddDayBonus,
+        "POINTS_AFTERNOON":        &values.AfternoonBonus,
+        "POINTS_WEEKEND":          &values.WeekendBonus,
+        "POINTS_LARGE_PURCHASE":   &values.LargePurchaseBonus,
+        "POINTS_TOTAL_OVER_TEN":   &values.TotalOverTenBonus,
+    }
+}
+
+// multiplierBasisPoints returns ItemDescriptionMultiplier in ten-thousandths
+// Input: none
+// Output: e.g. 2000 for 0.2
+func (v PointsValues) multiplierBasisPoints() int64 {
+    return int64(math.Round(v.ItemDescriptionMultiplier * 10000))
+}
+
+// ruleEnvVars pairs each PointsRuleConfig field with its environment variable
+// Input: rules to bind
+// Output: map from environment variable to the field it sets
+func ruleEnvVars(rules *PointsRuleConfig) map[string]*bool {
+    return map[string]*bool{
+        "RULE_RETAILER_ALPHANUMERIC": &rules.EnableRetailerAlphanumeric,
+        "RULE_ROUND_DOLLAR":          &rules.EnableRoundDollar,
+        "RULE_QUARTER_MULTIPLE":      &rules.EnableQuarterMultiple,
+        "RULE_ITEM_PAIRS":            &rules.EnableItemPairs,
+        "RULE_ITEM_DESCRIPTION":      &rules.EnableItemDescription,
+        "RULE_ODD_DAY":               &rules.EnableOddDay,
+        "RULE_AFTERNOON":             &rules.EnableAfternoon,
+        "RULE_WEEKEND":               &rules.EnableWeekendBonus,
+        "RULE_LARGE_PURCHASE":        &rules.EnableLargePurchaseBonus,
+        "RULE_TOTAL_OVER_TEN":        &rules.EnableTotalOverTen,
+    }
+}
+
+// allRules returns a PointsRuleConfig with the seven original rules enabled
+// Input: none
+// Output: PointsRuleConfig applying rules 1-7 with the afternoon window
+//         after 14:00 and before 16:00; the Rule 8, 9 and 10 bonuses are
+//         opt-in, so default scores match the original challenge
+func allRules() PointsRuleConfig {
+    return PointsRuleConfig{
+        EnableRetailerAlphanumeric: true,
+        EnableRoundDollar:          true,
+        EnableQuarterMultiple:      true,
+        EnableItemPairs:            true,
+        EnableItemDescription:      true,
+        EnableOddDay:               true,
+        EnableAfternoon:            true,
+        EnableWeekendBonus:         false,
+        EnableLargePurchaseBonus:   false,
+        EnableTotalOverTen:         false,
+        AfternoonWindowStart:       14 * time.Hour,
+        AfternoonWindowEnd:         16 * time.Hour,
+    }
+}
+
+// parseClock parses a time of day into its offset from midnight
+// Input: time as HH:MM, e.g. "14:30"
+// Output: offset from midnight, e.g. 14h30m, or an error for other formats
+func parseClock(value string) (time.Duration, error) {
+    t, err := time.Parse("15:04", value)
+    if err != nil {
+        return 0, err
+    }
+    return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseDollars parses a dollar amount from the configuration into cents
+// Input: amount such as "100", "100.0" or "99.99"
+// Output: amount in cents, or an error if it isn't a non-negative number
+func parseDollars(value string) (int64, error) {
+    f, err := strconv.ParseFloat(value, 64)
+    if err != nil {
+        return 0, err
+    }
+    if f < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+        return 0, fmt.Errorf("amount must be a non-negative number, got %q", value)
+    }
+    return int64(math.Round(f * 100)), nil
+}
+
+// formatClock formats an offset from midnight as HH:MM
+// Input: offset from midnight, e.g. 14h30m
+// Output: time of day, e.g. "14:30"
+func formatClock(offset time.Duration) string {
+    return fmt.Sprintf("%02d:%02d", int(offset.Hours()), int(offset.Minutes())%60)
+}
+
+// trustedProxies splits TrustedProxies into its entries
+// Input: none
+// Output: proxy IPs or CIDRs, nil if none are configured
+func (cfg Config) trustedProxies() []string {
+    return splitList(cfg.TrustedProxies)
+}
+
+// purchaseLocation loads PurchaseTimezone
+// Input: none
+// Output: the zone receipts' purchase times are read in, or an error if
+//         it can't be loaded
+func (cfg Config) purchaseLocation() (*time.Location, error) {
+    return loadTimezone(cfg.PurchaseTimezone)
+}
+
+// apiKeys splits APIKeys into its entries
+// Input: none
+// Output: accepted API keys, nil if authentication is disabled
+func (cfg Config) apiKeys() []string {
+    return splitList(cfg.APIKeys)
+}
+
+// userAPIKeys parses UserAPIKeys
+// Input: none
+// Output: userAPIKeys[key] = user id, nil if there are none, or an error
+//         naming the first malformed entry
+func (cfg Config) userAPIKeys() (map[string]string, error) {
+    var keys map[string]string
+    for i, entry := range splitList(cfg.UserAPIKeys) {
+        user, key, ok := strings.Cut(entry, ":")
+        // The entry isn't quoted, it may be a bare key
+        if !ok || key == "" || !userIDPattern.MatchString(user) {
+            return nil, fmt.Errorf("user API key %d must be user:key with a user id of letters, digits, '.', '_', '@' or '-'", i+1)
+        }
+        if _, exists := keys[key]; exists {
+            return nil, fmt.Errorf("user API keys of %s and %s are the same", keys[key], user)
+        }
+        if keys == nil {
+            keys = make(map[string]string)
+        }
+        keys[key] = user
+    }
+    return keys, nil
+}
+
+// String formats the configuration for the startup log with the API keys
+// redacted, since they are secrets
+// Input: none
+// Output: the fields as %+v prints them, with each key replaced by "***";
+//         user ids are kept so the log shows which users have keys
+func (cfg Config) String() string {
+    // plainConfig has no String method, so formatting it doesn't recurse
+    type plainConfig Config
+    redacted := plainConfig(cfg)
+    keys := splitList(cfg.APIKeys)
+    for i := range keys {
+        keys[i] = "***"
+    }
+    redacted.APIKeys = strings.Join(keys, ",")
+    users := splitList(cfg.UserAPIKeys)
+    for i, entry := range users {
+        user, _, _ := strings.Cut(entry, ":")
+        users[i] = user + ":***"
+    }
+    redacted.UserAPIKeys = strings.Join(users, ",")
+    return fmt.Sprintf("%+v", redacted)
+}
+
+// splitList splits a comma-separated setting, dropping blank entries
+// Input: setting value, e.g. "a, b,,c"
+// Output: trimmed entries, e.g. ["a", "b", "c"], or nil if there are none
+func splitList(value string) []string {
+    var entries []string
+    for _, entry := range strings.Split(value, ",") {
+        if entry = strings.TrimSpace(entry); entry != "" {
+            entries = append(entries, entry)
+        }
+    }
+    return entries
+}
+
+// anyEnabled reports whether at least one rule is enabled
+// Input: none
+// Output: true if any field is true
+func (r PointsRuleConfig) anyEnabled() bool {
+    return r.EnableRetailerAlphanumeric || r.EnableRoundDollar || r.EnableQuarterMultiple ||
+        r.EnableItemPairs || r.EnableItemDescription || r.EnableOddDay || r.EnableAfternoon ||
+        r.EnableWeekendBonus || r.EnableLargePurchaseBonus || r.EnableTotalOverTen
+}
+
+// rulesVersion identifies a rules and values configuration
+// Input: rule switches and point values
+// Output: first 12 hex digits of the SHA-256 of both, the same for the same
+//         configuration across restarts
+func rulesVersion(rules PointsRuleConfig, values PointsValues) string {
+    encoded, _ := json.Marshal(struct {
+        Rules  PointsRuleConfig
+        Values PointsValues
+    }{rules, values})
+    sum := sha256.Sum256(encoded)
+    return hex.EncodeToString(sum[:])[:12]
+}
+
+// defaultConfig returns the settings used when nothing is configured
+// Input: none
+// Output: Config with default values
+func defaultConfig() Config {
+    return Config{
+        Port:                 "8080",
+        GinMode:              gin.ReleaseMode,
+        MaxBatchSize:         100,
+        MaxBodyBytes:         1 << 20,
+        MaxItems:             200,
+        MaxTotalAmount:       10000000,
+        StorageBackend:       "memory",
+        DataFile:             "receipts.json",
+        DBPath:               "receipts.db",
+        BoltPath:             "receipts.bolt",
+        RedisAddr:            "localhost:6379",
+        WALPath:              "receipts.wal",
+        WALSync:              walSyncAlways,
+        StrictTotals:         false,
+        RejectUnknownFields:  true,
+        LegacyErrors:         false,
+        RequireJSONContentType: true,
+        DedupReceipts:        true,
+        SnapshotInterval:     30 * time.Second,
+        MaxReceiptAgeDays:    365,
+        MaxClockSkew:         14 * time.Hour,
+        PurchaseTimezone:     "UTC",
+        IdempotencyTTL:       24 * time.Hour,
+        RateLimitRPS:         0,
+        RateLimitBurst:       20,
+        CORSAllowedOrigins:   "*",
+        CORSAllowedMethods:   "GET,POST,PUT,PATCH,DELETE",
+        CORSAllowCredentials: false,
+        ShutdownTimeout:      10 * time.Second,
+        RequestTimeout:       10 * time.Second,
+        Rules:                allRules(),
+        Values:               defaultValues(),
+    }
+}
+
+// LoadConfig reads the configuration from environment variables
+// Input: none, reads PORT, GIN_MODE, MAX_BATCH_SIZE, MAX_BODY_BYTES, MAX_ITEMS, MAX_TOTAL_AMOUNT,
+//        STORAGE_BACKEND, DATA_FILE, DB_PATH, BOLT_PATH, REDIS_ADDR, WAL_PATH, WAL_SYNC,
+//        STRICT_TOTALS, REJECT_UNKNOWN_FIELDS, LEGACY_ERRORS, REQUIRE_JSON_CONTENT_TYPE, DEDUP_RECEIPTS, SNAPSHOT_PATH, SNAPSHOT_INTERVAL,
+//        MAX_RECEIPT_AGE_DAYS, MAX_CLOCK_SKEW, PURCHASE_TIMEZONE, MAX_RECEIPTS, RECEIPT_TTL, IDEMPOTENCY_TTL, RATE_LIMIT_RPS, RATE_LIMIT_BURST,
+//        TRUSTED_PROXIES, API_KEYS, USER_API_KEYS, ENFORCE_RECEIPT_OWNERSHIP,
+//        CORS_ALLOWED_ORIGINS, CORS_ALLOWED_METHODS,
+//        CORS_ALLOW_CREDENTIALS, SHUTDOWN_TIMEOUT, REQUEST_TIMEOUT, RULES_FILE,
+//        AFTERNOON_WINDOW_START, AFTERNOON_WINDOW_END, AFTERNOON_WINDOW_START_INCLUSIVE
+//        and the RULE_* and POINTS_* variables
+// Output: Config with defaults for unset variables, or an error for invalid values
+func LoadConfig() (Config, error) {
+    cfg := defaultConfig()
+
+    if v := os.Getenv("PORT"); v != "" {
+        cfg.Port = v
+    }
+    if v := os.Getenv("GIN_MODE"); v != "" {
+        cfg.GinMode = v
+    }
+    if v := os.Getenv("MAX_BATCH_SIZE"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid MAX_BATCH_SIZE %q", v)
+        }
+        cfg.MaxBatchSize = n
+    }
+    if v := os.Getenv("MAX_BODY_BYTES"); v != "" {
+        n, err := strconv.ParseInt(v, 10, 64)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid MAX_BODY_BYTES %q", v)
+        }
+        cfg.MaxBodyBytes = n
+    }
+    if v := os.Getenv("MAX_ITEMS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid MAX_ITEMS %q", v)
+        }
+        cfg.MaxItems = n
+    }
+    if v := os.Getenv("MAX_TOTAL_AMOUNT"); v != "" {
+        cents, err := parseDollars(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid MAX_TOTAL_AMOUNT %q", v)
+        }
+        cfg.MaxTotalAmount = cents
+    }
+    if v := os.Getenv("STORAGE_BACKEND"); v != "" {
+        cfg.StorageBackend = v
+    }
+    if v := os.Getenv("DATA_FILE"); v != "" {
+        cfg.DataFile = v
+    }
+    if v := os.Getenv("DB_PATH"); v != "" {
+        cfg.DBPath = v
+    }
+    if v := os.Getenv("BOLT_PATH"); v != "" {
+        cfg.BoltPath = v
+    }
+    if v := os.Getenv("REDIS_ADDR"); v != "" {
+        cfg.RedisAddr = v
+    }
+    if v := os.Getenv("WAL_PATH"); v != "" {
+        cfg.WALPath = v
+    }
+    if v := os.Getenv("WAL_SYNC"); v != "" {
+        cfg.WALSync = v
+    }
+    if v := os.Getenv("STRICT_TOTALS"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid STRICT_TOTALS %q", v)
+        }
+        cfg.StrictTotals = b
+    }
+    if v := os.Getenv("REJECT_UNKNOWN_FIELDS"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid REJECT_UNKNOWN_FIELDS %q", v)
+        }
+        cfg.RejectUnknownFields = b
+    }
+    if v := os.Getenv("LEGACY_ERRORS"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid LEGACY_ERRORS %q", v)
+        }
+        cfg.LegacyErrors = b
+    }
+    if v := os.Getenv("REQUIRE_JSON_CONTENT_TYPE"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid REQUIRE_JSON_CONTENT_TYPE %q", v)
+        }
+        cfg.RequireJSONContentType = b
+    }
+    if v := os.Getenv("DEDUP_RECEIPTS"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid DEDUP_RECEIPTS %q", v)
+        }
+        cfg.DedupReceipts = b
+    }
+    if v := os.Getenv("SNAPSHOT_PATH"); v != "" {
+        cfg.SnapshotPath = v
+    }
+    if v := os.Getenv("SNAPSHOT_INTERVAL"); v != "" {
+        d, err := time.ParseDuration(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid SNAPSHOT_INTERVAL %q", v)
+        }
+        cfg.SnapshotInterval = d
+    }
+    if v := os.Getenv("MAX_RECEIPT_AGE_DAYS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid MAX_RECEIPT_AGE_DAYS %q", v)
+        }
+        cfg.MaxReceiptAgeDays = n
+    }
+    if v := os.Getenv("MAX_CLOCK_SKEW"); v != "" {
+        d, err := time.ParseDuration(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid MAX_CLOCK_SKEW %q", v)
+        }
+        cfg.MaxClockSkew = d
+    }
+    if v := os.Getenv("PURCHASE_TIMEZONE"); v != "" {
+        cfg.PurchaseTimezone = v
+    }
+    if v := os.Getenv("MAX_RECEIPTS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid MAX_RECEIPTS %q", v)
+        }
+        cfg.MaxReceipts = n
+    }
+    if v := os.Getenv("RECEIPT_TTL"); v != "" {
+        d, err := time.ParseDuration(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid RECEIPT_TTL %q", v)
+        }
+        cfg.ReceiptTTL = d
+    }
+    if v := os.Getenv("IDEMPOTENCY_TTL"); v != "" {
+        d, err := time.ParseDuration(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid IDEMPOTENCY_TTL %q", v)
+        }
+        cfg.IdempotencyTTL = d
+    }
+    if v := os.Getenv("RATE_LIMIT_RPS"); v != "" {
+        f, err := strconv.ParseFloat(v, 64)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid RATE_LIMIT_RPS %q", v)
+        }
+        cfg.RateLimitRPS = f
+    }
+    if v := os.Getenv("RATE_LIMIT_BURST"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid RATE_LIMIT_BURST %q", v)
+        }
+        cfg.RateLimitBurst = n
+    }
+    if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+        cfg.TrustedProxies = v
+    }
+    if v := os.Getenv("API_KEYS"); v != "" {
+        cfg.APIKeys = v
+    }
+    if v := os.Getenv("USER_API_KEYS"); v != "" {
+        cfg.UserAPIKeys = v
+    }
+    if v := os.Getenv("ENFORCE_RECEIPT_OWNERSHIP"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid ENFORCE_RECEIPT_OWNERSHIP %q", v)
+        }
+        cfg.EnforceReceiptOwnership = b
+    }
+    if v := os.Getenv("CORS_ALLOWED_ORIGINS"); v != "" {
+        cfg.CORSAllowedOrigins = v
+    }
+    if v := os.Getenv("CORS_ALLOWED_METHODS"); v != "" {
+        cfg.CORSAllowedMethods = v
+    }
+    if v := os.Getenv("CORS_ALLOW_CREDENTIALS"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid CORS_ALLOW_CREDENTIALS %q", v)
+        }
+        cfg.CORSAllowCredentials = b
+    }
+    if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+        d, err := time.ParseDuration(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid SHUTDOWN_TIMEOUT %q", v)
+        }
+        cfg.ShutdownTimeout = d
+    }
+    if v := os.Getenv("REQUEST_TIMEOUT"); v != "" {
+        d, err := time.ParseDuration(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid REQUEST_TIMEOUT %q", v)
+        }
+        cfg.RequestTimeout = d
+    }
+    // The rules file comes first so RULE_* and POINTS_* variables override it
+    if v := os.Getenv("RULES_FILE"); v != "" {
+        if err := loadRulesFile(v, &cfg.Rules, &cfg.Values); err != nil {
+            return Config{}, err
+        }
+        cfg.RulesFile = v
+    }
+    rules := ruleEnvVars(&cfg.Rules)
+    for _, name := range slices.Sorted(maps.Keys(rules)) {
+        enabled := rules[name]
+        if v := os.Getenv(name); v != "" {
+            b, err := strconv.ParseBool(v)
+            if err != nil {
+                return Config{}, fmt.Errorf("invalid %s %q", name, v)
+            }
+            *enabled = b
+        }
+    }
+    values := valueEnvVars(&cfg.Values)
+    for _, name := range slices.Sorted(maps.Keys(values)) {
+        value := values[name]
+        if v := os.Getenv(name); v != "" {
+            n, err := strconv.Atoi(v)
+            if err != nil {
+                return Config{}, fmt.Errorf("invalid %s %q", name, v)
+            }
+            *value = n
+        }
+    }
+    if v := os.Getenv("AFTERNOON_WINDOW_START"); v != "" {
+        d, err := parseClock(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid AFTERNOON_WINDOW_START %q", v)
+        }
+        cfg.Rules.AfternoonWindowStart = d
+    }
+    if v := os.Getenv("AFTERNOON_WINDOW_END"); v != "" {
+        d, err := parseClock(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid AFTERNOON_WINDOW_END %q", v)
+        }
+        cfg.Rules.AfternoonWindowEnd = d
+    }
+    if v := os.Getenv("AFTERNOON_WINDOW_START_INCLUSIVE"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid AFTERNOON_WINDOW_START_INCLUSIVE %q", v)
+        }
+        cfg.Rules.AfternoonWindowStartInclusive = b
+    }
+    if v := os.Getenv("LARGE_PURCHASE_THRESHOLD"); v != "" {
+        cents, err := parseDollars(v)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid LARGE_PURCHASE_THRESHOLD %q", v)
+        }
+        cfg.Values.LargePurchaseThreshold = cents
+    }
+    if v := os.Getenv("POINTS_ITEM_DESCRIPTION_MULTIPLIER"); v != "" {
+        f, err := strconv.ParseFloat(v, 64)
+        if err != nil {
+            return Config{}, fmt.Errorf("invalid POINTS_ITEM_DESCRIPTION_MULTIPLIER %q", v)
+        }
+        cfg.Values.ItemDescriptionMultiplier = f
+    }
+
+    return cfg, cfg.validate()
+}
+
+// registerFlags binds command line flags to the config fields
+// Input: flag set; the current field values become the flag defaults
+// Output: none, the fields are updated when the flag set is parsed
+func (cfg *Config) registerFlags(fs *flag.FlagSet) {
+    fs.StringVar(&cfg.Port, "port", cfg.Port, "port the HTTP server listens on")
+    fs.StringVar(&cfg.GinMode, "gin-mode", cfg.GinMode, "gin mode: debug, release or test")
+    fs.IntVar(&cfg.MaxBatchSize, "max-batch-size", cfg.MaxBatchSize, "maximum number of receipts accepted by POST /receipts/batch")
+    fs.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", cfg.MaxBodyBytes, "largest request body accepted, in bytes")
+    fs.IntVar(&cfg.MaxItems, "max-items", cfg.MaxItems, "maximum number of items on one receipt")
+    fs.Func("max-total-amount", "largest receipt total accepted, in dollars; 0 means no limit (default "+formatCents(cfg.MaxTotalAmount)+")", func(v string) error {
+        cents, err := parseDollars(v)
+        if err != nil {
+            return err
+        }
+        cfg.MaxTotalAmount = cents
+        return nil
+    })
+    fs.StringVar(&cfg.StorageBackend, "store", cfg.StorageBackend, "storage backend: memory, file, sqlite, bolt, redis or wal")
+    fs.StringVar(&cfg.DataFile, "data-file", cfg.DataFile, "JSON file used by the file storage backend")
+    fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "database file used by the sqlite storage backend")
+    fs.StringVar(&cfg.BoltPath, "bolt-path", cfg.BoltPath, "database file used by the bolt storage backend")
+    fs.StringVar(&cfg.RedisAddr, "redis-addr", cfg.RedisAddr, "host:port of the server used by the redis storage backend")
+    fs.StringVar(&cfg.WALPath, "wal-path", cfg.WALPath, "append-only log used by the wal storage backend")
+    fs.StringVar(&cfg.WALSync, "wal-sync", cfg.WALSync, "when the wal storage backend fsyncs: always or interval")
+    fs.BoolVar(&cfg.StrictTotals, "strict-totals", cfg.StrictTotals, "reject receipts whose total doesn't equal the sum of item prices")
+    fs.BoolVar(&cfg.RejectUnknownFields, "reject-unknown-fields", cfg.RejectUnknownFields, "reject request bodies with fields the API doesn't define; -reject-unknown-fields=false ignores them")
+    fs.BoolVar(&cfg.RequireJSONContentType, "require-json-content-type", cfg.RequireJSONContentType, "answer 415 to request bodies that aren't Content-Type application/json; -require-json-content-type=false accepts any")
+    fs.BoolVar(&cfg.LegacyErrors, "legacy-errors", cfg.LegacyErrors, "send \"error\" as a plain message string, with code and field beside it, instead of the {code, message, field} object")
+    fs.BoolVar(&cfg.DedupReceipts, "dedup", cfg.DedupReceipts, "answer receipts identical to a stored one with the stored id; -dedup=false stores duplicates")
+    fs.StringVar(&cfg.SnapshotPath, "snapshot-path", cfg.SnapshotPath, "file the memory storage backend is periodically saved to; empty disables snapshots")
+    fs.DurationVar(&cfg.SnapshotInterval, "snapshot-interval", cfg.SnapshotInterval, "time between snapshots")
+    fs.IntVar(&cfg.MaxReceiptAgeDays, "max-receipt-age-days", cfg.MaxReceiptAgeDays, "oldest purchaseDate accepted, in days before today; 0 accepts any age")
+    fs.DurationVar(&cfg.MaxClockSkew, "max-clock-skew", cfg.MaxClockSkew, "how far past the server clock a purchaseDate and purchaseTime may be")
+    fs.StringVar(&cfg.PurchaseTimezone, "purchase-timezone", cfg.PurchaseTimezone, "IANA zone purchaseDate and purchaseTime are read in and purchaseDateTime is converted to, e.g. America/New_York")
+    fs.IntVar(&cfg.MaxReceipts, "max-receipts", cfg.MaxReceipts, "receipts kept by the memory storage backend before the least recently accessed are evicted; 0 means unlimited")
+    fs.DurationVar(&cfg.ReceiptTTL, "receipt-ttl", cfg.ReceiptTTL, "how long receipts are kept; 0 keeps them forever")
+    fs.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", cfg.IdempotencyTTL, "how long an Idempotency-Key is remembered")
+    fs.Float64Var(&cfg.RateLimitRPS, "rate-limit-rps", cfg.RateLimitRPS, "requests per second allowed per client IP; 0, the default, disables rate limiting")
+    fs.IntVar(&cfg.RateLimitBurst, "rate-limit-burst", cfg.RateLimitBurst, "requests a client IP may send at once")
+    fs.StringVar(&cfg.TrustedProxies, "trusted-proxies", cfg.TrustedProxies, "comma-separated proxy IPs or CIDRs whose X-Forwarded-For is trusted")
+    fs.StringVar(&cfg.APIKeys, "api-keys", cfg.APIKeys, "comma-separated API keys required by write endpoints; prefer API_KEYS, flags are visible in the process list")
+    fs.StringVar(&cfg.UserAPIKeys, "user-api-keys", cfg.UserAPIKeys, "comma-separated user:key pairs identifying the user receipts are stored under; prefer USER_API_KEYS")
+    fs.BoolVar(&cfg.EnforceReceiptOwnership, "enforce-receipt-ownership", cfg.EnforceReceiptOwnership, "only let a receipt's owner or an API_KEYS key read or change an owned receipt")
+    fs.StringVar(&cfg.CORSAllowedOrigins, "cors-allowed-origins", cfg.CORSAllowedOrigins, "comma-separated origins browsers may call from; * allows any")
+    fs.StringVar(&cfg.CORSAllowedMethods, "cors-allowed-methods", cfg.CORSAllowedMethods, "comma-separated methods allowed in CORS preflights")
+    fs.BoolVar(&cfg.CORSAllowCredentials, "cors-allow-credentials", cfg.CORSAllowCredentials, "allow cookies and auth headers on cross-origin requests")
+    fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "how long in-flight requests may take to finish on shutdown")
+    fs.DurationVar(&cfg.RequestTimeout, "request-timeout", cfg.RequestTimeout, "how long a request may take before it is answered with 503; 0 disables the timeout")
+    // Flags are applied in command line order, so rule flags after -rules
+    // override the file and rule flags before it are overridden by it
+    fs.Func("rules", "YAML or JSON file with points rule settings", func(v string) error {
+        if err := loadRulesFile(v, &cfg.Rules, &cfg.Values); err != nil {
+            return err
+        }
+        cfg.RulesFile = v
+        return nil
+    })
+    // RULE_ROUND_DOLLAR becomes -rule-round-dollar, and so on; the maps are
+    // walked in sorted order so flags are registered the same way every run
+    rules := ruleEnvVars(&cfg.Rules)
+    for _, name := range slices.Sorted(maps.Keys(rules)) {
+        enabled := rules[name]
+        flagName := strings.ReplaceAll(strings.ToLower(name), "_", "-")
+        fs.BoolVar(enabled, flagName, *enabled, "apply points rule "+name)
+    }
+    fs.Func("afternoon-window-start", "Rule 7 window start as HH:MM, exclusive unless -afternoon-window-start-inclusive (default "+formatClock(cfg.Rules.AfternoonWindowStart)+")", func(v string) error {
+        d, err := parseClock(v)
+        if err != nil {
+            return err
+        }
+        cfg.Rules.AfternoonWindowStart = d
+        return nil
+    })
+    fs.Func("afternoon-window-end", "Rule 7 window end as HH:MM, exclusive (default "+formatClock(cfg.Rules.AfternoonWindowEnd)+")", func(v string) error {
+        d, err := parseClock(v)
+        if err != nil {
+            return err
+        }
+        cfg.Rules.AfternoonWindowEnd = d
+        return nil
+    })
+    fs.BoolVar(&cfg.Rules.AfternoonWindowStartInclusive, "afternoon-window-start-inclusive", cfg.Rules.AfternoonWindowStartInclusive, "give the Rule 7 bonus to a purchase exactly at the window start, as earlier versions did")
+    values := valueEnvVars(&cfg.Values)
+    for _, name := range slices.Sorted(maps.Keys(values)) {
+        value := values[name]
+        flagName := strings.ReplaceAll(strings.ToLower(name), "_", "-")
+        fs.IntVar(value, flagName, *value, "points awarded by "+name)
+    }
+    fs.Func("large-purchase-threshold", "smallest total earning the Rule 9 bonus, in dollars (default "+formatCents(cfg.Values.LargePurchaseThreshold)+")", func(v string) error {
+        cents, err := parseDollars(v)
+        if err != nil {
+            return err
+        }
+        cfg.Values.LargePurchaseThreshold = cents
+        return nil
+    })
+    fs.Float64Var(&cfg.Values.ItemDescriptionMultiplier, "points-item-description-multiplier", cfg.Values.ItemDescriptionMultiplier, "multiplied by the item price for Rule 5")
+}
+
+// validate checks that the config values can be used
+// Input: none
+// Output: nil, or an error describing the first invalid value
+func (cfg Config) validate() error {
+    switch cfg.GinMode {
+    case gin.DebugMode, gin.ReleaseMode, gin.TestMode:
+    default:
+        return fmt.Errorf("invalid gin mode %q", cfg.GinMode)
+    }
+    if cfg.MaxBatchSize < 1 {
+        return fmt.Errorf("max batch size must be at least 1, got %d", cfg.MaxBatchSize)
+    }
+    if cfg.MaxBodyBytes < 1 {
+        return fmt.Errorf("max body bytes must be at least 1, got %d", cfg.MaxBodyBytes)
+    }
+    if cfg.MaxItems < 1 {
+        return fmt.Errorf("max items must be at least 1, got %d", cfg.MaxItems)
+    }
+    if cfg.SnapshotPath != "" {
+        if cfg.StorageBackend != "memory" {
+            return fmt.Errorf("snapshots require the memory storage backend, got %q", cfg.StorageBackend)
+        }
+        if cfg.SnapshotInterval <= 0 {
+            return fmt.Errorf("snapshot interval must be positive, got %s", cfg.SnapshotInterval)
+        }
+    }
+    if cfg.MaxReceiptAgeDays < 0 {
+        return fmt.Errorf("max receipt age must not be negative, got %d", cfg.MaxReceiptAgeDays)
+    }
+    if cfg.MaxClockSkew < 0 {
+        return fmt.Errorf("max clock skew must not be negative, got %s", cfg.MaxClockSkew)
+    }
+    if _, err := loadTimezone(cfg.PurchaseTimezone); err != nil {
+        return fmt.Errorf("purchase timezone must be an IANA zone such as UTC or America/New_York, got %q", cfg.PurchaseTimezone)
+    }
+    if cfg.MaxReceipts < 0 {
+        return fmt.Errorf("max receipts must not be negative, got %d", cfg.MaxReceipts)
+    }
+    if cfg.MaxReceipts > 0 && cfg.StorageBackend != "memory" {
+        return fmt.Errorf("max receipts requires the memory storage backend, got %q", cfg.StorageBackend)
+    }
+    if cfg.ReceiptTTL < 0 {
+        return fmt.Errorf("receipt ttl must not be negative, got %s", cfg.ReceiptTTL)
+    }
+    if cfg.IdempotencyTTL <= 0 {
+        return fmt.Errorf("idempotency ttl must be positive, got %s", cfg.IdempotencyTTL)
+    }
+    if cfg.RateLimitRPS < 0 || math.IsNaN(cfg.RateLimitRPS) {
+        return fmt.Errorf("rate limit must not be negative, got %v", cfg.RateLimitRPS)
+    }
+    if cfg.RateLimitRPS > 0 && cfg.RateLimitBurst < 1 {
+        return fmt.Errorf("rate limit burst must be at least 1, got %d", cfg.RateLimitBurst)
+    }
+    for _, proxy := range cfg.trustedProxies() {
+        if net.ParseIP(proxy) == nil {
+            if _, _, err := net.ParseCIDR(proxy); err != nil {
+                return fmt.Errorf("trusted proxy must be an IP or CIDR, got %q", proxy)
+            }
+        }
+    }
+    userKeys, err := cfg.userAPIKeys()
+    if err != nil {
+        return err
+    }
+    for _, key := range cfg.apiKeys() {
+        if user, exists := userKeys[key]; exists {
+            return fmt.Errorf("the user API key of %s is also an API key", user)
+        }
+    }
+    if cfg.EnforceReceiptOwnership && len(cfg.apiKeys()) == 0 && len(userKeys) == 0 {
+        return fmt.Errorf("enforcing receipt ownership requires API keys or user API keys")
+    }
+    // Any website could make credentialed calls otherwise
+    if cfg.CORSAllowCredentials && slices.Contains(splitList(cfg.CORSAllowedOrigins), "*") {
+        return fmt.Errorf("cors allow credentials requires a list of cors allowed origins, not *")
+    }
+    if cfg.ShutdownTimeout <= 0 {
+        return fmt.Errorf("shutdown timeout must be positive, got %s", cfg.ShutdownTimeout)
+    }
+    if cfg.RequestTimeout < 0 {
+        return fmt.Errorf("request timeout must not be negative, got %s", cfg.RequestTimeout)
+    }
+    if !cfg.Rules.anyEnabled() {
+        return fmt.Errorf("at least one points rule must be enabled")
+    }
+    if cfg.Rules.AfternoonWindowStart >= cfg.Rules.AfternoonWindowEnd {
+        return fmt.Errorf("afternoon window start %s must be before its end %s",
+            formatClock(cfg.Rules.AfternoonWindowStart), formatClock(cfg.Rules.AfternoonWindowEnd))
+    }
+    // Sorted, so the same config always reports the same value first
+    values := valueEnvVars(&cfg.Values)
+    for _, name := range slices.Sorted(maps.Keys(values)) {
+        value := values[name]
+        if *value < 0 {
+            return fmt.Errorf("%s must not be negative, got %d", name, *value)
+        }
+    }
+    if cfg.Values.ItemDescriptionMultiplier < 0 || math.IsNaN(cfg.Values.ItemDescriptionMultiplier) {
+        return fmt.Errorf("item description multiplier must not be negative, got %v", cfg.Values.ItemDescriptionMultiplier)
+    }
+    switch cfg.StorageBackend {
+    case "memory":
+    case "file":
+        if cfg.DataFile == "" {
+            return fmt.Errorf("file storage backend requires a data file")
+        }
+    case "sqlite":
+        if cfg.DBPath == "" {
+            return fmt.Errorf("sqlite storage backend requires a database path")
+        }
+    case "bolt":
+        if cfg.BoltPath == "" {
+            return fmt.Errorf("bolt storage backend requires a database path")
+        }
+    case "redis":
+        if cfg.RedisAddr == "" {
+            return fmt.Errorf("redis storage backend requires an address")
+        }
+    case "wal":
+        if cfg.WALPath == "" {
+            return fmt.Errorf("wal storage backend requires a log path")
+        }
+        if cfg.WALSync != walSyncAlways && cfg.WALSync != walSyncInterval {
+            return fmt.Errorf("invalid wal sync policy %q", cfg.WALSync)
+        }
+    default:
+        return fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+    }
+    return nil
+}
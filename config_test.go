@@ -0,0 +1,173 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "testing"
+    "time"
+)
+
+// parseFlags registers the flags on a fresh FlagSet over the defaults and parses args
+func parseFlags(t *testing.T, args ...string) (Config, error) {
+    t.Helper()
+    cfg := defaultConfig()
+    fs := flag.NewFlagSet("receipt-processor", flag.ContinueOnError)
+    fs.SetOutput(io.Discard)
+    cfg.registerFlags(fs)
+    err := fs.Parse(args)
+    return cfg, err
+}
+
+func TestFlags(t *testing.T) {
+    cfg, err := parseFlags(t,
+        "-port", "9000",
+        "-max-total-amount", "50.25",
+        "-rule-round-dollar=false",
+        "-rule-weekend",
+        "-points-odd-day", "12",
+        "-afternoon-window-start", "13:30",
+        "-large-purchase-threshold", "75",
+        "-legacy-errors",
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+    checks := []struct {
+        name string
+        ok   bool
+    }{
+        {"port", cfg.Port == "9000"},
+        {"max total amount", cfg.MaxTotalAmount == 5025},
+        {"round dollar rule", !cfg.Rules.EnableRoundDollar},
+        {"weekend rule", cfg.Rules.EnableWeekendBonus},
+        {"odd day points", cfg.Values.OddDayBonus == 12},
+        {"afternoon window start", cfg.Rules.AfternoonWindowStart == 13*time.Hour+30*time.Minute},
+        {"large purchase threshold", cfg.Values.LargePurchaseThreshold == 7500},
+        {"legacy errors", cfg.LegacyErrors},
+        // flags that weren't given keep their defaults
+        {"max items", cfg.MaxItems == defaultConfig().MaxItems},
+    }
+    for _, check := range checks {
+        if !check.ok {
+            t.Errorf("%s not set by its flag: %+v", check.name, cfg)
+        }
+    }
+
+    for _, args := range [][]string{
+        {"-max-total-amount", "lots"},
+        {"-afternoon-window-start", "2pm"},
+        {"-points-odd-day", "six"},
+        {"-no-such-flag"},
+    } {
+        if _, err := parseFlags(t, args...); err == nil {
+            t.Errorf("%v parsed without an error", args)
+        }
+    }
+}
+
+func TestLoadConfig(t *testing.T) {
+    // Unset variables keep their defaults
+    for _, name := range []string{"PORT", "GIN_MODE", "MAX_BATCH_SIZE", "STORAGE_BACKEND", "MAX_ITEMS"} {
+        t.Setenv(name, "")
+    }
+    cfg, err := LoadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := defaultConfig()
+    if cfg.Port != "8080" || cfg.GinMode != "release" || cfg.MaxBatchSize != 100 || cfg.StorageBackend != "memory" || cfg.MaxItems != want.MaxItems {
+        t.Errorf("defaults are %+v", cfg)
+    }
+
+    t.Setenv("PORT", "9090")
+    t.Setenv("GIN_MODE", "debug")
+    t.Setenv("MAX_BATCH_SIZE", "25")
+    t.Setenv("STORAGE_BACKEND", "file")
+    t.Setenv("STRICT_TOTALS", "true")
+    t.Setenv("SHUTDOWN_TIMEOUT", "3s")
+    t.Setenv("RULE_ROUND_DOLLAR", "false")
+    t.Setenv("POINTS_ODD_DAY", "12")
+    t.Setenv("AFTERNOON_WINDOW_END", "17:00")
+    cfg, err = LoadConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    checks := []struct {
+        name string
+        ok   bool
+    }{
+        {"PORT", cfg.Port == "9090"},
+        {"GIN_MODE", cfg.GinMode == "debug"},
+        {"MAX_BATCH_SIZE", cfg.MaxBatchSize == 25},
+        {"STORAGE_BACKEND", cfg.StorageBackend == "file"},
+        {"STRICT_TOTALS", cfg.StrictTotals},
+        {"SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout == 3*time.Second},
+        {"RULE_ROUND_DOLLAR", !cfg.Rules.EnableRoundDollar},
+        {"POINTS_ODD_DAY", cfg.Values.OddDayBonus == 12},
+        {"AFTERNOON_WINDOW_END", cfg.Rules.AfternoonWindowEnd == 17*time.Hour},
+        {"MAX_ITEMS unset", cfg.MaxItems == want.MaxItems},
+    }
+    for _, check := range checks {
+        if !check.ok {
+            t.Errorf("%s not applied: %+v", check.name, cfg)
+        }
+    }
+
+    // A malformed value is an error naming the variable
+    for name, value := range map[string]string{
+        "MAX_BATCH_SIZE":       "lots",
+        "STRICT_TOTALS":        "maybe",
+        "SHUTDOWN_TIMEOUT":     "soon",
+        "POINTS_ODD_DAY":       "six",
+        "AFTERNOON_WINDOW_END": "5pm",
+    } {
+        good := os.Getenv(name)
+        os.Setenv(name, value)
+        if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), name) {
+            t.Errorf("%s=%s: got error %v, want one naming %s", name, value, err, name)
+        }
+        os.Setenv(name, good)
+    }
+}
+
+func TestConfigStringRedactsKeys(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.APIKeys = "admin-secret, ops-secret"
+    cfg.UserAPIKeys = "alice:alice-secret,bob:bob-secret"
+    got := cfg.String()
+    if strings.Contains(got, "secret") {
+        t.Errorf("config string shows a key: %s", got)
+    }
+    for _, want := range []string{"APIKeys:***,***", "UserAPIKeys:alice:***,bob:***", "Port:8080"} {
+        if !strings.Contains(got, want) {
+            t.Errorf("config string %s lacks %q", got, want)
+        }
+    }
+    // the startup log formats it with %s
+    if logged := fmt.Sprintf("config: %s", cfg); strings.Contains(logged, "secret") {
+        t.Errorf("logged config shows a key: %s", logged)
+    }
+}
+
+func TestConfigErrorsAreStable(t *testing.T) {
+    // Two bad values: the sorted walk always reports the same one
+    for range 20 {
+        cfg := defaultConfig()
+        cfg.Values.WeekendBonus = -1
+        cfg.Values.AfternoonBonus = -1
+        if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "POINTS_AFTERNOON") {
+            t.Fatalf("validate() = %v, want POINTS_AFTERNOON reported first", err)
+        }
+    }
+
+    t.Setenv("RULE_WEEKEND", "maybe")
+    t.Setenv("RULE_ODD_DAY", "nope")
+    for range 20 {
+        if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "RULE_ODD_DAY") {
+            t.Fatalf("LoadConfig() = %v, want RULE_ODD_DAY reported first", err)
+        }
+    }
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+    "container/heap"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "log/slog"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// dedupStripes is how many locks dedupIndex spreads fingerprints over
+const dedupStripes = 64
+
+// dedupIndex maps receipt fingerprints to the id the receipt was first stored under
+type dedupIndex struct {
+    // guards the maps and expiry; only held briefly, never across a store call
+    mu  sync.Mutex
+    ttl time.Duration
+    // ids[fingerprint] = receipt id
+    ids map[string]string
+    // entries[receipt id] = the fingerprint it holds in ids, for removing it
+    entries map[string]dedupEntry
+    // expiry orders the entries by when their receipts expire; only kept
+    // when ttl is set
+    expiry expiryHeap
+    // stripes are held from the duplicate check until the new receipt is
+    // stored, so two identical receipts arriving together can't both be
+    // stored; receipts whose fingerprints fall on other stripes don't wait
+    stripes [dedupStripes]sync.Mutex
+}
+
+// dedupEntry is the fingerprint a receipt holds in dedupIndex.ids
+type dedupEntry struct {
+    fingerprint string
+    storedAt    time.Time
+}
+
+// newDedupIndex creates an index holding the receipts already in store
+// Input: store to index, and the receipt TTL; 0 means receipts never
+//        expire. If the store can't be read the index is partial and a
+//        warning is logged
+// Output: *dedupIndex ready for use
+func newDedupIndex(store Store, ttl time.Duration) *dedupIndex {
+    d := &dedupIndex{ttl: ttl, ids: make(map[string]string), entries: make(map[string]dedupEntry)}
+    err := forEachRecord(context.Background(), store, func(id string, record ReceiptRecord) {
+        // set keeps the first id if duplicates were stored while detection was off
+        d.set(id, record)
+    })
+    if err != nil {
+        slog.Warn("duplicate detection may miss stored receipts, failed to read them", "error", err.Error())
+    }
+    return d
+}
+
+// set records the fingerprint of a receipt that was just stored, replacing
+// the one it had; a fingerprint already held by another receipt keeps that
+// receipt's id
+// Input: receipt id and its stored record
+// Output: none
+func (d *dedupIndex) set(id string, record ReceiptRecord) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.remove(id)
+    fp := fingerprint(record.Receipt)
+    if _, taken := d.ids[fp]; taken {
+        return
+    }
+    d.ids[fp] = id
+    d.entries[id] = dedupEntry{fingerprint: fp, storedAt: record.StoredAt}
+    // Records without StoredAt, from before TTLs existed, never expire
+    if d.ttl > 0 && !record.StoredAt.IsZero() {
+        heap.Push(&d.expiry, expiringReceipt{id: id, storedAt: record.StoredAt})
+    }
+}
+
+// delete drops a receipt that was deleted or evicted from the store
+// Input: receipt id
+// Output: none
+func (d *dedupIndex) delete(id string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.remove(id)
+}
+
+// remove drops the fingerprint a receipt holds, if any
+// Its entry in expiry is left behind and skipped once it comes up
+// The caller must hold d.mu
+func (d *dedupIndex) remove(id string) {
+    entry, exists := d.entries[id]
+    if !exists {
+        return
+    }
+    delete(d.entries, id)
+    delete(d.ids, entry.fingerprint)
+}
+
+// lookup returns the id of the receipt holding a fingerprint
+// Receipts older than the TTL are dropped first, whether or not the
+// janitor has swept them from the store yet
+// Input: receipt fingerprint
+// Output: the id and true, or false if no receipt holds it
+func (d *dedupIndex) lookup(fp string) (string, bool) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    for len(d.expiry) > 0 {
+        next := d.expiry[0]
+        if !(ReceiptRecord{StoredAt: next.storedAt}).expired(d.ttl) {
+            break
+        }
+        heap.Pop(&d.expiry)
+        // Skip receipts removed since, or stored again under the same id
+        if entry, exists := d.entries[next.id]; exists && entry.storedAt.Equal(next.storedAt) {
+            d.remove(next.id)
+        }
+    }
+    id, exists := d.ids[fp]
+    return id, exists
+}
+
+// lockFingerprints takes the stripes of the given fingerprints, in
+// ascending order so two batches can't each wait for the other
+// Input: receipt fingerprints, repeats allowed
+// Output: function releasing the stripes
+func (d *dedupIndex) lockFingerprints(fps []string) func() {
+    var taken [dedupStripes]bool
+    for _, fp := range fps {
+        taken[stripeOf(fp)] = true
+    }
+    var locked []*sync.Mutex
+    for i := range taken {
+        if taken[i] {
+            d.stripes[i].Lock()
+            locked = append(locked, &d.stripes[i])
+        }
+    }
+    return func() {
+        for _, mu := range locked {
+            mu.Unlock()
+        }
+    }
+}
+
+// lockAll takes every stripe, for an import whose fingerprints aren't
+// known up front
+// Input: none
+// Output: function releasing the stripes
+func (d *dedupIndex) lockAll() func() {
+    for i := range d.stripes {
+        d.stripes[i].Lock()
+    }
+    return func() {
+        for i := range d.stripes {
+            d.stripes[i].Unlock()
+        }
+    }
+}
+
+// stripeOf picks the stripe of a fingerprint
+// Input: hex fingerprint from fingerprint
+// Output: index into dedupIndex.stripes
+func stripeOf(fp string) int {
+    n, _ := strconv.ParseUint(fp[:4], 16, 16)
+    return int(n % dedupStripes)
+}
+
+// fingerprint identifies a receipt by its content
+// Input: parsed Receipt
+// Output: hex SHA-256 of retailer, purchase instant, total, items, owner
+//         and notes; item order doesn't matter, so a re-sent receipt with its
+//         items shuffled has the same fingerprint, but the same receipt
+//         submitted by two users doesn't. The purchase time is hashed as a
+//         UTC instant, so 14:00 in New York and 14:00 in Tokyo differ, while
+//         a purchase sent as a local date and time or as a purchaseDateTime
+//         with an offset matches
+func fingerprint(receipt Receipt) string {
+    items := make([]string, len(receipt.Items))
+    for i, item := range receipt.Items {
+        items[i] = fmt.Sprintf("%q:%d", item.ShortDescription, item.Price)
+    }
+    sort.Strings(items)
+    canonical := fmt.Sprintf("%q|%s|%d|%s",
+        receipt.Retailer,
+        receipt.PurchasedAt.UTC().Format(time.RFC3339),
+        receipt.Total,
+        strings.Join(items, ","),
+    )
+    // Receipts without an owner keep the fingerprints they had before owners existed
+    if receipt.UserID != "" {
+        canonical += fmt.Sprintf("|%q", receipt.UserID)
+    }
+    // Otherwise a receipt re-sent with other notes would get the stored one
+    // back, and the new notes would be lost
+    if receipt.Notes != "" {
+        canonical += fmt.Sprintf("|notes:%q", receipt.Notes)
+    }
+    sum := sha256.Sum256([]byte(canonical))
+    return hex.EncodeToString(sum[:])
+}
+
+// findDuplicate returns the stored receipt with the given fingerprint
+// The caller must hold the fingerprint's stripe, see lockFingerprints
+// Input: context for the store call and receipt fingerprint
+// Output: its id and record and true, false if no live receipt has it, or a
+//         store error; ids whose receipt was deleted or expired are dropped
+func (s *Server) findDuplicate(ctx context.Context, fp string) (string, ReceiptRecord, bool, error) {
+    id, exists := s.dedup.lookup(fp)
+    if !exists {
+        return "", ReceiptRecord{}, false, nil
+    }
+    record, exists, err := s.store.Get(ctx, id)
+    if err != nil {
+        return "", ReceiptRecord{}, false, err
+    }
+    if !exists || record.expired(s.cfg.ReceiptTTL) {
+        // Removed without the index hearing of it, e.g. by another instance
+        s.dedup.delete(id)
+        return "", ReceiptRecord{}, false, nil
+    }
+    return id, record, true, nil
+}
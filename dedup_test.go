@@ -0,0 +1,243 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "slices"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// dedupRecord parses a receipt into a record stored at storedAt
+func dedupRecord(t *testing.T, input ReceiptInput, storedAt time.Time) ReceiptRecord {
+    t.Helper()
+    receipt, err := parseReceipt(input, parseOptions{maxItems: 10, loc: time.UTC})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return ReceiptRecord{Receipt: receipt, StoredAt: storedAt}
+}
+
+func TestDedupIndexForgetsRemovedReceipts(t *testing.T) {
+    ttl := time.Hour
+    d := newDedupIndex(NewMemoryStore(), ttl)
+    other := exampleReceipt
+    other.Retailer = "Walgreens"
+    d.set("deleted", dedupRecord(t, exampleReceipt, time.Now()))
+    d.set("expired", dedupRecord(t, other, time.Now().Add(-2*ttl)))
+
+    d.delete("deleted")
+    // lookup sweeps the expired receipt before answering
+    if _, exists := d.lookup(fingerprint(dedupRecord(t, other, time.Time{}).Receipt)); exists {
+        t.Error("an expired receipt is still found")
+    }
+    if len(d.ids) != 0 || len(d.entries) != 0 {
+        t.Errorf("index still holds %v and %v", d.ids, d.entries)
+    }
+
+    // A replaced receipt gives up its old fingerprint
+    d.set("replaced", dedupRecord(t, exampleReceipt, time.Now()))
+    d.set("replaced", dedupRecord(t, other, time.Now()))
+    if id, _ := d.lookup(fingerprint(dedupRecord(t, exampleReceipt, time.Time{}).Receipt)); id != "" {
+        t.Errorf("the old content still resolves to %q", id)
+    }
+    if id, _ := d.lookup(fingerprint(dedupRecord(t, other, time.Time{}).Receipt)); id != "replaced" {
+        t.Errorf("the new content resolves to %q, want replaced", id)
+    }
+}
+
+func TestDedupIndexForgetsEvictedReceipts(t *testing.T) {
+    store := NewBoundedMemoryStore(2)
+    router := newTestRouterOn(t, defaultConfig(), store)
+    for i := range 5 {
+        input := exampleReceipt
+        input.Retailer = "Shop " + strings.Repeat("x", i)
+        serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, input))
+    }
+    // The first receipt was evicted, so it is stored again under a new id
+    input := exampleReceipt
+    input.Retailer = "Shop "
+    if _, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, input)); body["duplicate"] == true {
+        t.Errorf("an evicted receipt was reported as a duplicate: %v", body)
+    }
+
+    d := newDedupIndex(NewMemoryStore(), 0)
+    store = NewBoundedMemoryStore(1)
+    store.onEvict(d.delete)
+    for i, retailer := range []string{"Target", "Walgreens"} {
+        input := exampleReceipt
+        input.Retailer = retailer
+        record := dedupRecord(t, input, time.Now())
+        store.Put(context.Background(), retailer, record)
+        d.set(retailer, record)
+        if len(d.ids) != 1 || len(d.entries) != 1 {
+            t.Errorf("after storing %d receipts in a store holding 1: index holds %v", i+1, d.ids)
+        }
+    }
+}
+
+func TestDedupConcurrentIdenticalReceipts(t *testing.T) {
+    store := NewMemoryStore()
+    router := newTestRouterOn(t, defaultConfig(), store)
+    ids := make([]string, 20)
+    var wg sync.WaitGroup
+    for i := range ids {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            w := httptest.NewRecorder()
+            req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(receiptJSON(t, exampleReceipt)))
+            req.Header.Set("Content-Type", "application/json")
+            router.ServeHTTP(w, req)
+            var body struct{ ID string }
+            json.Unmarshal(w.Body.Bytes(), &body)
+            ids[i] = body.ID
+        }()
+    }
+    wg.Wait()
+    if count, _ := store.Count(context.Background()); count != 1 {
+        t.Errorf("%d identical receipts were stored, want 1", count)
+    }
+    for _, id := range ids {
+        if id != ids[0] {
+            t.Errorf("responses carry ids %s and %s, want one id", ids[0], id)
+        }
+    }
+}
+
+// blockingStore is a MemoryStore whose Put of a receipt from the retailer
+// "Slow" waits until release is closed
+type blockingStore struct {
+    *MemoryStore
+    entered, release chan struct{}
+}
+
+func (s blockingStore) Put(ctx context.Context, id string, record ReceiptRecord) error {
+    if record.Retailer == "Slow" {
+        close(s.entered)
+        <-s.release
+    }
+    return s.MemoryStore.Put(ctx, id, record)
+}
+
+func TestDedupDoesNotWaitForOtherReceipts(t *testing.T) {
+    store := blockingStore{NewMemoryStore(), make(chan struct{}), make(chan struct{})}
+    router := newTestRouterOn(t, defaultConfig(), store)
+    slow := exampleReceipt
+    slow.Retailer = "Slow"
+    // A receipt whose fingerprint is on another stripe than the slow one's
+    fast := exampleReceipt
+    for i := 0; stripeOf(fingerprint(dedupRecord(t, fast, time.Time{}).Receipt)) == stripeOf(fingerprint(dedupRecord(t, slow, time.Time{}).Receipt)); i++ {
+        fast.Retailer = "Fast " + strings.Repeat("x", i)
+    }
+
+    post := func(input ReceiptInput) <-chan int {
+        done := make(chan int, 1)
+        go func() {
+            w := httptest.NewRecorder()
+            req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(receiptJSON(t, input)))
+            req.Header.Set("Content-Type", "application/json")
+            router.ServeHTTP(w, req)
+            done <- w.Code
+        }()
+        return done
+    }
+    slowDone := post(slow)
+    <-store.entered
+    select {
+    case status := <-post(fast):
+        if status != http.StatusOK {
+            t.Errorf("fast receipt: got %d, want 200", status)
+        }
+    case <-time.After(2 * time.Second):
+        t.Error("a receipt waited for another receipt's store write")
+    }
+    close(store.release)
+    if status := <-slowDone; status != http.StatusOK {
+        t.Errorf("slow receipt: got %d, want 200", status)
+    }
+}
+
+func TestDedupComparesPurchaseInstants(t *testing.T) {
+    router := newTestRouter(t)
+    process := func(input ReceiptInput) (string, bool) {
+        t.Helper()
+        status, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, input))
+        if status != http.StatusOK {
+            t.Fatalf("process returned %d %v", status, body)
+        }
+        duplicate, _ := body["duplicate"].(bool)
+        return body["id"].(string), duplicate
+    }
+
+    // 13:01 on the same day, in two zones
+    inNewYork := exampleReceipt
+    inNewYork.Timezone = "America/New_York"
+    inTokyo := exampleReceipt
+    inTokyo.Timezone = "Asia/Tokyo"
+    id, _ := process(inNewYork)
+    if other, duplicate := process(inTokyo); duplicate || other == id {
+        t.Fatalf("the same local time in another zone was taken for a duplicate of %s", id)
+    }
+
+    // the New York purchase again, as a timestamp with its offset
+    sameInstant := exampleReceipt
+    sameInstant.PurchaseDate, sameInstant.PurchaseTime = "", ""
+    sameInstant.PurchaseDateTime = "2022-01-01T13:01:00-05:00"
+    if other, duplicate := process(sameInstant); !duplicate || other != id {
+        t.Fatalf("the New York purchase sent with its offset got %s, duplicate %v, want a duplicate of %s", other, duplicate, id)
+    }
+}
+
+func TestDedupExactAndNearDuplicates(t *testing.T) {
+    router := newTestRouter(t)
+    _, first := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt))
+    id, _ := first["id"].(string)
+    if first["duplicate"] != nil {
+        t.Fatalf("first receipt answered %v, want no duplicate flag", first)
+    }
+
+    // The same receipt again gets the first id back
+    status, again := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt))
+    if status != http.StatusOK || again["id"] != id || again["duplicate"] != true {
+        t.Fatalf("exact duplicate answered %d %v, want 200 with id %s and duplicate true", status, again, id)
+    }
+
+    // and so does the same receipt with its items in another order
+    shuffled := exampleReceipt
+    shuffled.Items = slices.Clone(exampleReceipt.Items)
+    slices.Reverse(shuffled.Items)
+    if _, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, shuffled)); body["id"] != id || body["duplicate"] != true {
+        t.Fatalf("shuffled items answered %v, want id %s and duplicate true", body, id)
+    }
+
+    // Changing any one field makes a new receipt
+    changes := map[string]func(*ReceiptInput){
+        "retailer":      func(r *ReceiptInput) { r.Retailer = "Target Express" },
+        "purchase date": func(r *ReceiptInput) { r.PurchaseDate = "2022-01-02" },
+        "purchase time": func(r *ReceiptInput) { r.PurchaseTime = "13:02" },
+        "total":         func(r *ReceiptInput) { r.Total = "35.36" },
+        "item price":    func(r *ReceiptInput) { r.Items[0].Price = "6.50" },
+        "description":   func(r *ReceiptInput) { r.Items[0].ShortDescription = "Mountain Dew 6PK" },
+        "item removed":  func(r *ReceiptInput) { r.Items = r.Items[1:] },
+    }
+    seen := map[string]bool{id: true}
+    for name, change := range changes {
+        input := exampleReceipt
+        input.Items = slices.Clone(exampleReceipt.Items)
+        change(&input)
+        status, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, input))
+        newID, _ := body["id"].(string)
+        if status != http.StatusOK || body["duplicate"] != nil || seen[newID] {
+            t.Errorf("%s changed: answered %d %v, want a new receipt", name, status, body)
+        }
+        seen[newID] = true
+    }
+    if _, body := serve(t, router, http.MethodGet, "/receipts", ""); body["count"] != float64(1+len(changes)) {
+        t.Errorf("store lists %v receipts, want %d", body["count"], 1+len(changes))
+    }
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+    "slices"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Error codes, returned in the "code" of every error response so clients
+// can branch without matching messages. Receipt validation codes are the
+// upper-cased rejection reasons, e.g. invalid_total becomes INVALID_TOTAL
+const (
+    codeInvalidJSON          = "INVALID_JSON"
+    codeBodyTooLarge         = "BODY_TOO_LARGE"
+    codeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+    codeBatchTooLarge        = "BATCH_TOO_LARGE"
+    codeInvalidParameter     = "INVALID_PARAMETER"
+    codeInvalidReceiptID     = "INVALID_RECEIPT_ID"
+    codeInvalidUserID        = "INVALID_USER_ID"
+    codeInvalidRedemption    = "INVALID_REDEMPTION"
+    codeReceiptNotFound      = "RECEIPT_NOT_FOUND"
+    codeReceiptExists        = "RECEIPT_EXISTS"
+    codeDuplicateReceipt     = "DUPLICATE_RECEIPT"
+    codeIdempotencyKeyReused = "IDEMPOTENCY_KEY_REUSED"
+    codeInsufficientPoints   = "INSUFFICIENT_POINTS"
+    codeReceiptVoided        = "RECEIPT_VOIDED"
+    codeRulesChanged         = "RULES_CHANGED"
+    codeMissingAPIKey        = "MISSING_API_KEY"
+    codeInvalidAPIKey        = "INVALID_API_KEY"
+    codeAdminKeyRequired     = "ADMIN_KEY_REQUIRED"
+    codeNotOwner             = "NOT_OWNER"
+    codeRateLimited          = "RATE_LIMITED"
+    codeNotFound             = "NOT_FOUND"
+    codeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+    codeStoreUnavailable     = "STORE_UNAVAILABLE"
+    codeRequestTimeout       = "REQUEST_TIMEOUT"
+    codeInternalError        = "INTERNAL_ERROR"
+)
+
+// structuredErrorsKey is the gin context key set by errorFormat
+const structuredErrorsKey = "structuredErrors"
+
+// errorFormat selects the error response layout for the request
+// Input: whether the legacy layout with a flat "error" string is kept
+// Output: gin middleware; requests it hasn't run on get the legacy layout
+func errorFormat(legacy bool) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.Set(structuredErrorsKey, !legacy)
+        c.Next()
+    }
+}
+
+// errorBody builds an error response body
+// Input: request context, error code, client-facing message and the request
+//        field at fault, empty if none
+// Output: {"error": {"code": "...", "message": "...", "field": "..."}}, or with
+//         legacy errors {"error": "message", "code": "...", "field": "..."}
+func errorBody(c *gin.Context, code, message, field string) gin.H {
+    return newErrorBody(c.GetBool(structuredErrorsKey), code, message, field)
+}
+
+// newErrorBody builds an error response body in the given layout
+// Input: true for the structured layout, then as errorBody
+// Output: as errorBody
+func newErrorBody(structured bool, code, message, field string) gin.H {
+    if structured {
+        detail := gin.H{"code": code, "message": message}
+        if field != "" {
+            detail["field"] = field
+        }
+        return gin.H{"error": detail}
+    }
+    body := gin.H{"error": message, "code": code}
+    if field != "" {
+        body["field"] = field
+    }
+    return body
+}
+
+// respondError sends an error response and stops the handler chain
+// Input: request context, HTTP status, error code and client-facing message
+// Output: none
+func respondError(c *gin.Context, status int, code, message string) {
+    c.AbortWithStatusJSON(status, errorBody(c, code, message, ""))
+}
+
+// respondStoreError answers a request whose store call failed
+// Input: request context, the store error and a client-facing message such
+//        as "failed to read receipt"
+// Output: none, sends 503 STORE_UNAVAILABLE or 500 INTERNAL_ERROR,
+//         503 REQUEST_TIMEOUT if the request context ended first, or
+//         400 BATCH_TOO_LARGE for a batch the store can't hold at once
+func respondStoreError(c *gin.Context, err error, message string) {
+    status, body := storeErrorBody(c, err, message)
+    c.AbortWithStatusJSON(status, body)
+}
+
+// storeErrorBody builds the response to a failed store call
+// Input: as respondStoreError
+// Output: the status and body respondStoreError sends
+func storeErrorBody(c *gin.Context, err error, message string) (int, gin.H) {
+    if contextError(err) {
+        return http.StatusServiceUnavailable, errorBody(c, codeRequestTimeout, "request timeout", "")
+    }
+    if errors.Is(err, ErrBatchTooLarge) {
+        return http.StatusBadRequest, errorBody(c, codeBatchTooLarge, err.Error(), "")
+    }
+    status := storeErrorStatus(err)
+    return status, errorBody(c, storeErrorCode(status), message, "")
+}
+
+// storeErrorCode is the error code for a status picked by storeErrorStatus
+// Input: 503 or 500
+// Output: STORE_UNAVAILABLE or INTERNAL_ERROR
+func storeErrorCode(status int) string {
+    if status == http.StatusServiceUnavailable {
+        return codeStoreUnavailable
+    }
+    return codeInternalError
+}
+
+// validationCode is the error code of a receipt rejection reason
+// Input: reason such as "invalid_total"
+// Output: code such as "INVALID_TOTAL"
+func validationCode(reason string) string {
+    return strings.ToUpper(reason)
+}
+
+// noRoute answers requests for paths no endpoint serves
+// Input: request context
+// Output: none, sends 404 NOT_FOUND
+func noRoute(c *gin.Context) {
+    respondError(c, http.StatusNotFound, codeNotFound, "no endpoint at "+c.Request.URL.Path)
+}
+
+// noMethod answers requests for a known path with an unsupported method
+// Input: request context
+// Output: none, sends 405 METHOD_NOT_ALLOWED; gin sets the Allow header
+func noMethod(c *gin.Context) {
+    respondError(c, http.StatusMethodNotAllowed, codeMethodNotAllowed, c.Request.Method+" is not allowed on "+c.Request.URL.Path)
+}
+
+// staticRoutes maps each path registered without parameters to its methods
+type staticRoutes map[string][]string
+
+// newStaticRoutes collects the parameterless routes of a router
+// Input: router with all routes registered
+// Output: staticRoutes["/receipts/process"] = ["POST"], etc.
+func newStaticRoutes(router *gin.Engine) staticRoutes {
+    routes := make(staticRoutes)
+    for _, route := range router.Routes() {
+        if !strings.ContainsAny(route.Path, ":*") {
+            routes[route.Path] = append(routes[route.Path], route.Method)
+        }
+    }
+    return routes
+}
+
+// methodCheck answers 405 when a parameter route matched a path that is
+// really a static route for other methods; GET /receipts/:id matches
+// /receipts/process, which only exists for POST, so gin can't tell by itself
+// Input: pointer to the routes, filled in once the router is set up
+// Output: gin middleware
+func methodCheck(routes *staticRoutes) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if strings.Contains(c.FullPath(), ":") {
+            methods, ok := (*routes)[c.Request.URL.Path]
+            if ok && !slices.Contains(methods, c.Request.Method) {
+                c.Header("Allow", strings.Join(methods, ", "))
+                noMethod(c)
+                return
+            }
+        }
+        c.Next()
+    }
+}
+
+// errorCodes lists every code an error response can carry, for the OpenAPI spec
+// Input: none
+// Output: request-level codes followed by the receipt validation codes
+func errorCodes() []string {
+    return []string{
+        codeInvalidJSON, codeBodyTooLarge, codeUnsupportedMediaType, codeBatchTooLarge, codeInvalidParameter,
+        codeInvalidReceiptID, codeInvalidUserID, codeInvalidRedemption, codeReceiptNotFound, codeReceiptExists,
+        codeDuplicateReceipt, codeIdempotencyKeyReused, codeInsufficientPoints, codeReceiptVoided, codeRulesChanged,
+        codeMissingAPIKey, codeInvalidAPIKey, codeAdminKeyRequired, codeNotOwner, codeRateLimited, codeNotFound,
+        codeMethodNotAllowed, codeStoreUnavailable, codeRequestTimeout, codeInternalError,
+        "UNKNOWN_FIELD", "INVALID_RETAILER", "INVALID_PURCHASE_DATE", "INVALID_PURCHASE_TIME",
+        "INVALID_PURCHASE_DATE_TIME", "PURCHASE_DATE_TIME_MISMATCH", "INVALID_TIMEZONE", "USER_MISMATCH",
+        "NOTES_TOO_LONG", "INVALID_TOTAL", "TOTAL_TOO_LARGE", "NO_ITEMS", "TOO_MANY_ITEMS", "BLANK_DESCRIPTION",
+        "INVALID_DESCRIPTION", "INVALID_PRICE", "TOTAL_MISMATCH", "DATE_IN_FUTURE", "DATE_TOO_OLD",
+    }
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+)
+
+func TestErrorFormats(t *testing.T) {
+    badDate := exampleReceipt
+    badDate.PurchaseDate = "01/01/2022"
+    tests := []struct {
+        name   string
+        method string
+        path   string
+        body   string
+        status int
+        code   string
+        field  string
+    }{
+        {"invalid JSON", http.MethodPost, "/receipts/process", `{`, http.StatusBadRequest, codeInvalidJSON, ""},
+        {"invalid receipt", http.MethodPost, "/receipts/process", receiptJSON(t, badDate), http.StatusBadRequest, "INVALID_PURCHASE_DATE", "purchaseDate"},
+        {"unknown field", http.MethodPost, "/receipts/process", `{"retailor": "Target"}`, http.StatusBadRequest, "UNKNOWN_FIELD", "retailor"},
+        {"invalid id", http.MethodGet, "/receipts/not-a-uuid/points", "", http.StatusBadRequest, codeInvalidReceiptID, ""},
+        {"missing receipt", http.MethodGet, "/receipts/00000000-0000-0000-0000-000000000000/points", "", http.StatusNotFound, codeReceiptNotFound, ""},
+        {"invalid limit", http.MethodGet, "/receipts?limit=0", "", http.StatusBadRequest, codeInvalidParameter, ""},
+        {"invalid search date", http.MethodGet, "/receipts/search?from=yesterday", "", http.StatusBadRequest, codeInvalidParameter, "from"},
+        {"unknown path", http.MethodGet, "/receipt", "", http.StatusNotFound, codeNotFound, ""},
+        {"unknown method", http.MethodPost, "/health", "", http.StatusMethodNotAllowed, codeMethodNotAllowed, ""},
+    }
+
+    structuredRouter := newTestRouter(t)
+    cfg := defaultConfig()
+    cfg.LegacyErrors = true
+    legacyRouter := newTestRouterWith(t, cfg)
+    for _, tt := range tests {
+        status, legacy := serve(t, legacyRouter, tt.method, tt.path, tt.body)
+        if status != tt.status {
+            t.Errorf("%s: got %d %v, want %d", tt.name, status, legacy, tt.status)
+            continue
+        }
+        message, ok := legacy["error"].(string)
+        if !ok || message == "" || legacy["code"] != tt.code || (tt.field != "" && legacy["field"] != tt.field) {
+            t.Errorf("%s: legacy body is %v, want a message with code %s and field %q", tt.name, legacy, tt.code, tt.field)
+        }
+
+        status, structured := serve(t, structuredRouter, tt.method, tt.path, tt.body)
+        want := map[string]any{"code": tt.code, "message": message}
+        if tt.field != "" {
+            want["field"] = tt.field
+        }
+        if status != tt.status || !reflect.DeepEqual(structured["error"], want) {
+            t.Errorf("%s: structured response is %d %v, want %d with error %v", tt.name, status, structured, tt.status, want)
+        }
+        if _, ok := structured["code"]; ok {
+            t.Errorf("%s: structured body %v repeats the code outside error", tt.name, structured)
+        }
+    }
+}
+
+func TestUnknownRoutes(t *testing.T) {
+    tests := []struct {
+        method string
+        path   string
+        status int
+        code   string
+        allow  string
+    }{
+        // GET /receipts/:id would otherwise take "process" for an id
+        {http.MethodGet, "/receipts/process", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST"},
+        {http.MethodPut, "/receipts/process", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST"},
+        {http.MethodDelete, "/receipts/stats", http.StatusMethodNotAllowed, codeMethodNotAllowed, "GET"},
+        {http.MethodPost, "/receipts/xyz/points", http.StatusMethodNotAllowed, codeMethodNotAllowed, "GET"},
+        {http.MethodPost, "/health", http.StatusMethodNotAllowed, codeMethodNotAllowed, "GET"},
+        {http.MethodGet, "/no/such/path", http.StatusNotFound, codeNotFound, ""},
+        // Parameter routes still work for real ids
+        {http.MethodGet, "/receipts/xyz", http.StatusBadRequest, codeInvalidReceiptID, ""},
+    }
+    router := newTestRouter(t)
+    for _, tt := range tests {
+        req, err := http.NewRequest(tt.method, tt.path, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        w := httptest.NewRecorder()
+        router.ServeHTTP(w, req)
+        var body map[string]any
+        if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+            t.Errorf("%s %s: response is not JSON: %q", tt.method, tt.path, w.Body.String())
+            continue
+        }
+        if w.Code != tt.status || errorDetail(body)["code"] != tt.code || w.Header().Get("Allow") != tt.allow {
+            t.Errorf("%s %s: got %d %v with Allow %q, want %d %s with Allow %q",
+                tt.method, tt.path, w.Code, body, w.Header().Get("Allow"), tt.status, tt.code, tt.allow)
+        }
+    }
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// exportedReceipt is a single receipt in GET /receipts/export
+// It has the shape POST /receipts/import accepts, so an export can be
+// imported elsewhere as it is
+type exportedReceipt struct {
+    ID string `json:"id"`
+    receiptResponse
+    // PurchaseDateTime repeats purchaseDate and purchaseTime with the
+    // seconds, which purchaseTime can't hold, so they survive an import
+    PurchaseDateTime string `json:"purchaseDateTime"`
+}
+
+// exportReceipts streams every stored receipt as a downloadable JSON file
+// Receipts are written one at a time as they are read, so the whole export
+// is never held in memory
+// Input: none
+// Output:
+//   - Success: JSON {"exportedAt": "RFC 3339 time", "receipts": [{"id": "uuid-id", ...}], "count": n}
+//              as an attachment named receipts-export-YYYY-MM-DD.json; count
+//              comes last because it is only known once every receipt is written
+//   - Error: JSON with error message {"error": "message"} if the receipts
+//            can't be listed; a store error after the first receipt was
+//            sent cuts the response short, leaving invalid JSON
+func (s *Server) exportReceipts(c *gin.Context) {
+    ids, err := s.store.List(c.Request.Context())
+    if err != nil {
+        respondStoreError(c, err, "failed to list receipts")
+        return
+    }
+    now := s.now().UTC()
+    exportedAt, err := json.Marshal(now.Format(time.RFC3339))
+    if err != nil {
+        panic(err)
+    }
+
+    c.Header("Content-Type", "application/json")
+    c.Header("Content-Disposition", `attachment; filename="receipts-export-`+now.Format("2006-01-02")+`.json"`)
+    c.Status(http.StatusOK)
+    w := c.Writer
+    w.WriteString(`{"exportedAt":` + string(exportedAt) + `,"receipts":[`)
+    encoder := json.NewEncoder(w)
+    count := 0
+    s.streamRecords(c, ids, func(id string, record ReceiptRecord) error {
+        if count > 0 {
+            w.WriteString(",")
+        }
+        count++
+        return encoder.Encode(exportedReceipt{
+            ID:               id,
+            receiptResponse:  newReceiptResponse(record.Receipt),
+            PurchaseDateTime: record.PurchasedAt.Format(time.RFC3339Nano),
+        })
+    })
+    w.WriteString(`],"count":` + strconv.Itoa(count) + "}\n")
+}
+
+// exportReceiptsCSV streams every stored receipt as a CSV spreadsheet
+// Input: none
+// Output:
+//   - Success: text/csv attachment named receipts.csv with a header row
+//              id,retailer,purchaseDate,purchaseTime,total,itemCount,points
+//              and one row per receipt, e.g.
+//              7fb1377b-...,Target,2022-01-01,13:01,35.35,5,28
+//   - Error: JSON with error message {"error": "message"} if the receipts
+//            can't be listed; a later store error cuts the file short
+func (s *Server) exportReceiptsCSV(c *gin.Context) {
+    ids, err := s.store.List(c.Request.Context())
+    if err != nil {
+        respondStoreError(c, err, "failed to list receipts")
+        return
+    }
+
+    c.Header("Content-Type", "text/csv; charset=utf-8")
+    c.Header("Content-Disposition", `attachment; filename="receipts.csv"`)
+    c.Status(http.StatusOK)
+    w := csv.NewWriter(c.Writer)
+    w.Write([]string{"id", "retailer", "purchaseDate", "purchaseTime", "total", "itemCount", "points"})
+    s.streamRecords(c, ids, func(id string, record ReceiptRecord) error {
+        err := w.Write([]string{
+            id,
+            record.Retailer,
+            record.PurchasedAt.Format("2006-01-02"),
+            record.PurchasedAt.Format("15:04"),
+            formatCents(record.Total),
+            strconv.Itoa(len(record.Items)),
+            strconv.Itoa(record.Points),
+        })
+        if err != nil {
+            return err
+        }
+        // Flush per row, or csv.Writer buffers rows until the end
+        w.Flush()
+        return w.Error()
+    })
+    w.Flush()
+}
+
+// streamRecords calls fn for every live receipt of an export whose response
+// has already started
+// Input: request context, ids from Store.List and the function writing one
+//        receipt; an error from fn means the client went away and stops the export
+// Output: none; on a store error the connection is dropped, since the status
+//         is already sent and that is the only way left to tell the client
+//         the export is incomplete
+func (s *Server) streamRecords(c *gin.Context, ids []string, fn func(id string, record ReceiptRecord) error) {
+    for _, id := range ids {
+        record, exists, err := peekRecord(c.Request.Context(), s.store, id)
+        if contextError(err) {
+            // the client went away
+            return
+        }
+        if err != nil {
+            slog.Error("export cut short, failed to read receipt",
+                "id", id,
+                "error", err.Error(),
+                "requestId", c.GetString("requestId"),
+            )
+            panic(http.ErrAbortHandler)
+        }
+        // deleted since the ids were listed, or waiting to be swept
+        if !exists || record.expired(s.cfg.ReceiptTTL) {
+            continue
+        }
+        if err := fn(id, record); err != nil {
+            return
+        }
+    }
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func TestExportReceipts(t *testing.T) {
+    router := newTestRouter(t)
+    receipts := make([]ImportReceipt, 10)
+    for i := range receipts {
+        receipts[i] = ImportReceipt{ReceiptInput: exampleReceipt}
+        // Distinct retailers, so none is skipped as a duplicate
+        receipts[i].Retailer = "Target " + strconv.Itoa(i)
+    }
+    if status, body := serve(t, router, http.MethodPost, "/receipts/import", importJSON(t, receipts...)); status != http.StatusOK || body["imported"] != 10.0 {
+        t.Fatalf("import: got %d %v, want 10 imported", status, body)
+    }
+
+    req := httptest.NewRequest(http.MethodGet, "/receipts/export", nil)
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, req)
+    if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Disposition"), `attachment; filename="receipts-export-`) {
+        t.Fatalf("got %d with Content-Disposition %q, want 200 and an attachment", w.Code, w.Header().Get("Content-Disposition"))
+    }
+    var export struct {
+        ExportedAt string          `json:"exportedAt"`
+        Count      int             `json:"count"`
+        Receipts   []ImportReceipt `json:"receipts"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &export); err != nil {
+        t.Fatalf("export is not valid JSON: %v\n%s", err, w.Body.String())
+    }
+    if export.Count != 10 || len(export.Receipts) != 10 || export.ExportedAt == "" {
+        t.Fatalf("export has count %d and %d receipts, want 10", export.Count, len(export.Receipts))
+    }
+    for i, receipt := range export.Receipts {
+        if receipt.Retailer != receipts[i].Retailer || receipt.ID == "" {
+            t.Errorf("receipt %d is %+v, want %s with its id", i, receipt, receipts[i].Retailer)
+        }
+    }
+
+    // The export can be imported elsewhere as it is, keeping the ids
+    other := newTestRouter(t)
+    status, body := serve(t, other, http.MethodPost, "/receipts/import", w.Body.String())
+    if status != http.StatusOK || body["imported"] != 10.0 {
+        t.Fatalf("re-import: got %d %v, want 10 imported", status, body)
+    }
+    if status, _ := serve(t, other, http.MethodGet, "/receipts/"+export.Receipts[0].ID, ""); status != http.StatusOK {
+        t.Errorf("re-imported receipt %s: got %d, want 200", export.Receipts[0].ID, status)
+    }
+}
+
+func TestExportKeepsPurchaseSeconds(t *testing.T) {
+    router := newTestRouter(t)
+    input := exampleReceipt
+    input.PurchaseDate, input.PurchaseTime = "", ""
+    input.PurchaseDateTime = "2022-01-01T14:00:30Z"
+    serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, input))
+
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/receipts/export", nil))
+    if !strings.Contains(w.Body.String(), `"purchaseDateTime":"2022-01-01T14:00:30Z"`) {
+        t.Errorf("export lacks the purchase time with its seconds:\n%s", w.Body.String())
+    }
+    other := newTestRouter(t)
+    serve(t, other, http.MethodPost, "/receipts/import", w.Body.String())
+    _, body := serve(t, other, http.MethodGet, "/receipts", "")
+    receipts, _ := body["receipts"].([]any)
+    if len(receipts) != 1 || receipts[0].(map[string]any)["points"] != 38.0 {
+        t.Errorf("re-imported receipts %v, want one with 38 points", receipts)
+    }
+}
+
+func TestExportReceiptsCSV(t *testing.T) {
+    router := newTestRouter(t)
+    mm := ReceiptInput{
+        Retailer:     "M&M Corner Market",
+        PurchaseDate: "2022-03-20",
+        PurchaseTime: "14:33",
+        Items:        []ItemInput{{"Gatorade", "2.25"}, {"Gatorade", "2.25"}, {"Gatorade", "2.25"}, {"Gatorade", "2.25"}},
+        Total:        "9.00",
+    }
+    walgreens := ReceiptInput{
+        Retailer:     "Walgreens",
+        PurchaseDate: "2022-01-02",
+        PurchaseTime: "08:13",
+        Items:        []ItemInput{{"Pepsi - 12-oz", "1.25"}, {"Dasani", "1.40"}},
+        Total:        "2.65",
+    }
+    want := [][]string{{"id", "retailer", "purchaseDate", "purchaseTime", "total", "itemCount", "points"}}
+    for _, tt := range []struct {
+        input  ReceiptInput
+        points string
+    }{{exampleReceipt, "28"}, {mm, "109"}, {walgreens, "15"}} {
+        status, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, tt.input))
+        if status != http.StatusOK {
+            t.Fatalf("process %s: got %d %v", tt.input.Retailer, status, body)
+        }
+        want = append(want, []string{body["id"].(string), tt.input.Retailer, tt.input.PurchaseDate, tt.input.PurchaseTime,
+            string(tt.input.Total), strconv.Itoa(len(tt.input.Items)), tt.points})
+    }
+
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/receipts/export.csv", nil))
+    if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") ||
+        w.Header().Get("Content-Disposition") != `attachment; filename="receipts.csv"` {
+        t.Fatalf("got %d with headers %v, want a 200 text/csv attachment", w.Code, w.Header())
+    }
+    rows, err := csv.NewReader(w.Body).ReadAll()
+    if err != nil {
+        t.Fatalf("export is not valid CSV: %v", err)
+    }
+    if !reflect.DeepEqual(rows, want) {
+        t.Errorf("rows are\n%v\nwant\n%v", rows, want)
+    }
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "os"
+    "path/filepath"
+    "sync"
+)
+
+// FileStore is a Store that keeps receipts in memory and
+// writes them all to a JSON file after every change
+type FileStore struct {
+    // serializes writes so the file always matches the latest change
+    writeMu sync.Mutex
+    path    string
+    mem     *MemoryStore
+}
+
+// fileStoreData is the on-disk format of a FileStore
+type fileStoreData struct {
+    // ids in insertion order
+    Order    []string                 `json:"order"`
+    Receipts map[string]ReceiptRecord `json:"receipts"`
+    // points redemptions, oldest first
+    Redemptions []Redemption `json:"redemptions,omitempty"`
+}
+
+// NewFileStore creates a FileStore backed by path
+// Input: path of the JSON file; it is loaded if it already exists
+// Output: *FileStore, or an error if the existing file can't be read
+func NewFileStore(path string) (*FileStore, error) {
+    s := &FileStore{path: path, mem: NewMemoryStore()}
+
+    content, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return s, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var data fileStoreData
+    if err := json.Unmarshal(content, &data); err != nil {
+        return nil, err
+    }
+    for _, id := range data.Order {
+        if record, exists := data.Receipts[id]; exists {
+            s.mem.put(id, record)
+        }
+    }
+    s.mem.redemptions = data.Redemptions
+    return s, nil
+}
+
+// Put stores a record under id and rewrites the file
+// Input: context, receipt id and record
+// Output: nil, or an error if the file can't be written or the context
+//         ended while waiting for another write
+func (s *FileStore) Put(ctx context.Context, id string, record ReceiptRecord) error {
+    s.writeMu.Lock()
+    defer s.writeMu.Unlock()
+    if err := s.mem.Put(ctx, id, record); err != nil {
+        return err
+    }
+    return s.persist()
+}
+
+// PutBatch stores several records and rewrites the file once
+// Input: context, receipt ids and records, matched by index
+// Output: nil, or an error if the file can't be written or the context
+//         ended while waiting for another write
+func (s *FileStore) PutBatch(ctx context.Context, ids []string, records []ReceiptRecord) error {
+    s.writeMu.Lock()
+    defer s.writeMu.Unlock()
+    if err := s.mem.PutBatch(ctx, ids, records); err != nil {
+        return err
+    }
+    return s.persist()
+}
+
+// PutRedemption stores a points redemption and rewrites the file
+// Input: context and redemption
+// Output: nil, or an error if the file can't be written or the context
+//         ended while waiting for another write
+func (s *FileStore) PutRedemption(ctx context.Context, redemption Redemption) error {
+    s.writeMu.Lock()
+    defer s.writeMu.Unlock()
+    if err := s.mem.PutRedemption(ctx, redemption); err != nil {
+        return err
+    }
+    return s.persist()
+}
+
+// Redemptions returns every stored redemption, oldest first
+// Input: context
+// Output: slice owned by the caller
+func (s *FileStore) Redemptions(ctx context.Context) ([]Redemption, error) {
+    return s.mem.Redemptions(ctx)
+}
+
+// Get returns the record stored under id
+// Input: context and receipt id
+// Output: the record and true, or an empty record and false if it doesn't exist
+func (s *FileStore) Get(ctx context.Context, id string) (ReceiptRecord, bool, error) {
+    return s.mem.Get(ctx, id)
+}
+
+// Delete removes the record stored under id and rewrites the file
+// Input: context and receipt id
+// Output: nil, ErrNotFound if the id doesn't exist, or a file or context error
+func (s *FileStore) Delete(ctx context.Context, id string) error {
+    s.writeMu.Lock()
+    defer s.writeMu.Unlock()
+    if err := s.mem.Delete(ctx, id); err != nil {
+        return err
+    }
+    return s.persist()
+}
+
+// List returns a snapshot of all stored ids in insertion order
+// Input: context
+// Output: slice of ids owned by the caller
+func (s *FileStore) List(ctx context.Context) ([]string, error) {
+    return s.mem.List(ctx)
+}
+
+// Count returns the number of stored receipts
+// Input: context
+// Output: receipt count
+func (s *FileStore) Count(ctx context.Context) (int, error) {
+    return s.mem.Count(ctx)
+}
+
+// Ping reports whether the store is initialized
+// Input: context
+// Output: nil, or an error if the in-memory copy is not initialized
+func (s *FileStore) Ping(ctx context.Context) error {
+    return s.mem.Ping(ctx)
+}
+
+// persist writes every record to a temp file and renames it over the
+// store file, so a crash never leaves a half-written file behind
+// The caller must hold writeMu
+func (s *FileStore) persist() error {
+    content, err := json.Marshal(s.mem.snapshot())
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(s.path, content)
+}
+
+// writeFileAtomic replaces the file at path with content via a temp file
+// in the same directory and a rename
+// Input: destination path and file content
+// Output: nil, or an error if the file can't be written; the old file is
+//         left untouched on error
+func writeFileAtomic(path string, content []byte) error {
+    tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(content); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
+
+// Close waits for an in-progress write to finish
+// Input: none
+// Output: always nil
+func (s *FileStore) Close() error {
+    // Every change is already on disk; wait for a write in progress
+    s.writeMu.Lock()
+    defer s.writeMu.Unlock()
+    return nil
+}
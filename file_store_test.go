@@ -0,0 +1,93 @@
+package main
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "reflect"
+    "slices"
+    "testing"
+    "time"
+)
+
+func TestFileStoreRoundTrip(t *testing.T) {
+    ctx := context.Background()
+    path := filepath.Join(t.TempDir(), "receipts.json")
+    store, err := NewFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // a missing file is an empty store
+    if count, err := store.Count(ctx); err != nil || count != 0 {
+        t.Fatalf("new store counts %d receipts (%v), want 0", count, err)
+    }
+
+    records := map[string]ReceiptRecord{}
+    for i, input := range []ReceiptInput{exampleReceipt, mmReceipt, walgreensReceipt} {
+        receipt, err := parseReceipt(input, parseOptions{maxItems: 1000, loc: time.UTC})
+        if err != nil {
+            t.Fatal(err)
+        }
+        id := []string{"a", "b", "c"}[i]
+        records[id] = ReceiptRecord{
+            Receipt:      receipt,
+            Points:       calculatePoints(receipt, allRules(), defaultValues()),
+            StoredAt:     time.Date(2024, 6, 15, 12, 0, i, 0, time.UTC),
+            RulesVersion: "v1",
+        }
+    }
+    voided := records["c"]
+    voided.Voided, voided.UserID, voided.Notes = true, "alice", "business expense"
+    records["c"] = voided
+    for _, id := range []string{"a", "b", "c"} {
+        if err := store.Put(ctx, id, records[id]); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := store.Delete(ctx, "b"); err != nil {
+        t.Fatal(err)
+    }
+    redemption := Redemption{ID: "r1", UserID: "alice", Points: 10, Reason: "coffee", RedeemedAt: time.Date(2024, 6, 16, 9, 30, 0, 0, time.UTC)}
+    if err := store.PutRedemption(ctx, redemption); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    // A new store on the same file has the same receipts in the same order
+    store, err = NewFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ids, err := store.List(ctx); err != nil || !slices.Equal(ids, []string{"a", "c"}) {
+        t.Fatalf("reloaded store lists %v (%v), want [a c]", ids, err)
+    }
+    for _, id := range []string{"a", "c"} {
+        record, ok, err := store.Get(ctx, id)
+        if err != nil || !ok || !reflect.DeepEqual(record, records[id]) {
+            t.Errorf("receipt %s reloaded as %+v (%v), want %+v", id, record, err, records[id])
+        }
+    }
+    if _, ok, _ := store.Get(ctx, "b"); ok {
+        t.Error("deleted receipt came back after reloading")
+    }
+    if redemptions, err := store.Redemptions(ctx); err != nil || !reflect.DeepEqual(redemptions, []Redemption{redemption}) {
+        t.Errorf("reloaded redemptions %v (%v), want %v", redemptions, err, redemption)
+    }
+
+    // the temp files are renamed over the store file, never left behind
+    if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+        t.Errorf("store directory holds %d files, want only the store file", len(entries))
+    }
+}
+
+func TestFileStoreRejectsCorruptFile(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "receipts.json")
+    if err := os.WriteFile(path, []byte(`{"order": ["a"], "receipts": `), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := NewFileStore(path); err == nil {
+        t.Error("NewFileStore loaded a truncated file")
+    }
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "testing"
+    "time"
+)
+
+// FuzzProcessReceipt decodes arbitrary request bodies the way processReceipt
+// does and checks that validation and scoring never panic and agree with
+// each other
+// Run with: go test -fuzz FuzzProcessReceipt -fuzztime 30s
+func FuzzProcessReceipt(f *testing.F) {
+    seeds := []string{
+        receiptJSONSeed(exampleReceipt),
+        `{"retailer":"M&M Corner Market","purchaseDate":"2022-03-20","purchaseTime":"14:33","items":[{"shortDescription":"Gatorade","price":"2.25"},{"shortDescription":"Gatorade","price":"2.25"}],"total":"4.50"}`,
+        `{"retailer":"","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[{"shortDescription":"a","price":"1.00"}],"total":"1.00"}`,
+        `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[{"shortDescription":"a","price":"-1.00"}],"total":"1.00"}`,
+        `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[{"shortDescription":"a","price":"1.00"}],"total":"NaN"}`,
+        `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[{"shortDescription":"a","price":"99999999999999999999.99"}],"total":"1.00"}`,
+        `{"retailer":"Target","purchaseDate":"2022-02-30","purchaseTime":"24:00","items":[],"total":"1.00"}`,
+        `{"retailer":"Target","purchaseDateTime":"2022-01-01T13:01:30-05:00","purchaseDate":"2022-01-01","items":[{"shortDescription":"a","price":"1.00"}],"total":"1.00"}`,
+        `{"retailer":"Target","items":[[[[[[{"shortDescription":"a"}]]]]]]}`,
+        `{"retailer":"Target","items":null,"total":null}`,
+        `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[{"shortDescription":"a","price":1.5}],"total":1.505}`,
+        `[]`,
+        `{`,
+    }
+    for _, seed := range seeds {
+        f.Add([]byte(seed), false)
+    }
+    f.Add([]byte(receiptJSONSeed(exampleReceipt)), true)
+
+    f.Fuzz(func(t *testing.T, body []byte, strict bool) {
+        var input ReceiptInput
+        if err := json.Unmarshal(body, &input); err != nil {
+            // processReceipt answers these with 400 invalid JSON
+            return
+        }
+        receipt, err := parseReceipt(input, parseOptions{strict: strict, maxItems: 1000, loc: time.UTC})
+        if err != nil {
+            var errs validationErrors
+            if !errors.As(err, &errs) || len(errs) == 0 {
+                t.Fatalf("parseReceipt returned %v (%T), want validationErrors", err, err)
+            }
+            if fieldErrors(err)[0].Message != err.Error() {
+                t.Fatalf("first field error %v doesn't match error %q", fieldErrors(err)[0], err.Error())
+            }
+            return
+        }
+        if len(receipt.Items) == 0 || len(receipt.Items) != len(input.Items) {
+            t.Fatalf("accepted a receipt with %d items from %d inputs", len(receipt.Items), len(input.Items))
+        }
+        if receipt.Total < 0 {
+            t.Fatalf("accepted a negative total %d", receipt.Total)
+        }
+        points := calculatePoints(receipt, allRules(), defaultValues())
+        if points < 0 {
+            t.Fatalf("scored %d points", points)
+        }
+        if breakdown := calculatePointsBreakdown(receipt, allRules(), defaultValues()); breakdown.Total != points {
+            t.Fatalf("breakdown total %d doesn't match %d points", breakdown.Total, points)
+        }
+    })
+}
+
+// receiptJSONSeed encodes a receipt input for the fuzz corpus
+func receiptJSONSeed(input ReceiptInput) string {
+    body, err := json.Marshal(input)
+    if err != nil {
+        panic(err)
+    }
+    return string(body)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// downStore is a memory store whose backend can't be reached
+type downStore struct {
+    *MemoryStore
+}
+
+func (downStore) Ping(context.Context) error {
+    return errors.New("connection refused")
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+    router := newTestRouter(t)
+    status, body := serve(t, router, http.MethodGet, "/healthz", "")
+    if status != http.StatusOK || body["status"] != "ok" || body["uptime"] == nil {
+        t.Errorf("healthz returned %d %v, want 200 ok with the uptime", status, body)
+    }
+    if status, body := serve(t, router, http.MethodGet, "/readyz", ""); status != http.StatusOK || body["status"] != "ready" {
+        t.Errorf("readyz returned %d %v, want 200 ready", status, body)
+    }
+
+    // A store that can't be reached makes the server unready, but not dead
+    router = newTestRouterOn(t, defaultConfig(), downStore{NewMemoryStore()})
+    if status, body := serve(t, router, http.MethodGet, "/readyz", ""); status != http.StatusServiceUnavailable ||
+        body["status"] != "not ready" || body["error"] != "connection refused" {
+        t.Errorf("readyz with the store down returned %d %v, want 503 not ready with the reason", status, body)
+    }
+    if status, body := serve(t, router, http.MethodGet, "/healthz", ""); status != http.StatusOK {
+        t.Errorf("healthz with the store down returned %d %v, want 200", status, body)
+    }
+}
+
+func TestProbesBypassMiddleware(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.APIKeys = "secret"
+    cfg.RateLimitRPS = 0.01
+    cfg.RateLimitBurst = 1
+    router := newTestRouterWith(t, cfg)
+
+    // No key is needed and polling is never rate limited
+    for range 5 {
+        for _, path := range []string{"/healthz", "/readyz"} {
+            if status, body := serve(t, router, http.MethodGet, path, ""); status != http.StatusOK {
+                t.Fatalf("%s returned %d %v, want 200", path, status, body)
+            }
+        }
+    }
+    // nor counted in the request metrics
+    w := httptest.NewRecorder()
+    newTestRouter(t).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+    for _, path := range []string{"/healthz", "/readyz"} {
+        if strings.Contains(w.Body.String(), `route="`+path+`"`) {
+            t.Errorf("metrics count requests to %s", path)
+        }
+    }
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// idempotencyKeyHeader is the request header clients set to make
+// POST /receipts/process safe to retry
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyEntry is the result of the first request made with a key
+type idempotencyEntry struct {
+    // hash of the request body, to spot a key reused for another receipt
+    bodyHash [sha256.Size]byte
+    // response of the first request; nil while it is still running
+    status   int
+    response gin.H
+    expires  time.Time
+    // closed once the first request has finished or given up
+    done chan struct{}
+}
+
+// idempotencyCache remembers the response each idempotency key produced
+type idempotencyCache struct {
+    // lock for thread safe
+    mu   sync.Mutex
+    ttl  time.Duration
+    // keys[callerKey] = entry, see scopedKey
+    keys map[string]*idempotencyEntry
+    // when expired keys were last removed
+    lastSweep time.Time
+}
+
+// newIdempotencyCache creates an empty cache
+// Input: how long a key is remembered after its first use
+// Output: *idempotencyCache ready for use
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+    return &idempotencyCache{ttl: ttl, keys: make(map[string]*idempotencyEntry)}
+}
+
+// hashBody hashes a decoded request body, along with any flags it carries
+// Input: request body decoded into its struct
+// Output: SHA-256 of its JSON encoding, so whitespace and key order don't matter
+func hashBody(body any) [sha256.Size]byte {
+    encoded, _ := json.Marshal(body)
+    return sha256.Sum256(encoded)
+}
+
+// scopedKey keys an Idempotency-Key by the API key that sent it, so callers
+// picking the same key never get each other's receipts
+// Input: request context and the client supplied idempotency key
+// Output: cache key made of the API key's SHA-256 and the idempotency key
+func scopedKey(c *gin.Context, key string) string {
+    apiKey := sha256.Sum256([]byte(c.GetHeader(apiKeyHeader)))
+    return hex.EncodeToString(apiKey[:]) + ":" + key
+}
+
+// begin claims key for a new request, or returns the request that claimed it
+// Input: idempotency key from scopedKey and hash of the request body and flags
+// Output: the key's entry and true if the caller claimed it and must call
+//         finish or abandon; otherwise the existing entry and false, whose
+//         done channel is closed once its response is known
+func (c *idempotencyCache) begin(key string, bodyHash [sha256.Size]byte) (*idempotencyEntry, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    now := time.Now()
+    // Sweep at most once a minute so the map stays bounded by the keys
+    // seen within one TTL without scanning it on every request
+    if now.Sub(c.lastSweep) >= time.Minute {
+        for k, entry := range c.keys {
+            if entry.response != nil && now.After(entry.expires) {
+                delete(c.keys, k)
+            }
+        }
+        c.lastSweep = now
+    }
+    if entry, exists := c.keys[key]; exists && (entry.response == nil || !now.After(entry.expires)) {
+        return entry, false
+    }
+    entry := &idempotencyEntry{bodyHash: bodyHash, done: make(chan struct{})}
+    c.keys[key] = entry
+    return entry, true
+}
+
+// finish records the response for a claimed key and wakes up waiting retries
+// Input: entry returned by begin, response status and body
+// Output: none
+func (c *idempotencyCache) finish(entry *idempotencyEntry, status int, response gin.H) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    entry.status = status
+    entry.response = response
+    entry.expires = time.Now().Add(c.ttl)
+    close(entry.done)
+}
+
+// abandon releases a claimed key whose request failed, so a retry can run again
+// Input: client supplied idempotency key and the entry returned by begin
+// Output: none
+func (c *idempotencyCache) abandon(key string, entry *idempotencyEntry) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.keys[key] == entry {
+        delete(c.keys, key)
+    }
+    close(entry.done)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// panickingStore is a MemoryStore whose first Put panics
+type panickingStore struct {
+    *MemoryStore
+    puts *atomic.Int32
+}
+
+func (s panickingStore) Put(ctx context.Context, id string, record ReceiptRecord) error {
+    if s.puts.Add(1) == 1 {
+        panic("store blew up")
+    }
+    return s.MemoryStore.Put(ctx, id, record)
+}
+
+func TestIdempotencyKeyReleasedAfterPanic(t *testing.T) {
+    router := newTestRouterOn(t, defaultConfig(), panickingStore{NewMemoryStore(), new(atomic.Int32)})
+    post := func() *httptest.ResponseRecorder {
+        // A retry stuck waiting on the key gives up with the context
+        ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+        defer cancel()
+        req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(receiptJSON(t, exampleReceipt))).WithContext(ctx)
+        req.Header.Set("Content-Type", "application/json")
+        req.Header.Set(idempotencyKeyHeader, "retry-me")
+        w := httptest.NewRecorder()
+        router.ServeHTTP(w, req)
+        return w
+    }
+    if w := post(); w.Code != http.StatusInternalServerError {
+        t.Fatalf("first request: got %d %s, want the recovered 500", w.Code, w.Body.String())
+    }
+    if w := post(); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"id"`) {
+        t.Errorf("retry after the panic: got %d %q, want 200 with an id", w.Code, w.Body.String())
+    }
+}
+
+// postWithKey sends a receipt to the process endpoint with an Idempotency-Key
+func postWithKey(t *testing.T, router http.Handler, key string, input ReceiptInput) (int, string) {
+    t.Helper()
+    req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(receiptJSON(t, input)))
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set(idempotencyKeyHeader, key)
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, req)
+    return w.Code, w.Body.String()
+}
+
+func TestIdempotencyKey(t *testing.T) {
+    cfg := defaultConfig()
+    // so only the key can make a retry return the first id
+    cfg.DedupReceipts = false
+    cfg.IdempotencyTTL = 200 * time.Millisecond
+    router := newTestRouterWith(t, cfg)
+
+    status, first := postWithKey(t, router, "order-1", exampleReceipt)
+    if status != http.StatusOK || !strings.Contains(first, `"id"`) {
+        t.Fatalf("first call: got %d %s, want 200 with an id", status, first)
+    }
+    // A retry answers the first response without storing the receipt again
+    if status, retry := postWithKey(t, router, "order-1", exampleReceipt); status != http.StatusOK || retry != first {
+        t.Errorf("retry: got %d %s, want the first response %s", status, retry, first)
+    }
+    if _, body := serve(t, router, http.MethodGet, "/receipts", ""); body["count"] != 1.0 {
+        t.Errorf("store holds %v receipts after a retry, want 1", body["count"])
+    }
+    // Another key is another request
+    if _, other := postWithKey(t, router, "order-2", exampleReceipt); other == first {
+        t.Errorf("another key got the first response %s", other)
+    }
+    // The same key with another receipt is refused
+    changed := exampleReceipt
+    changed.Retailer = "Walgreens"
+    if status, body := postWithKey(t, router, "order-1", changed); status != http.StatusConflict || !strings.Contains(body, codeIdempotencyKeyReused) {
+        t.Errorf("key reused for another receipt: got %d %s, want 409 %s", status, body, codeIdempotencyKeyReused)
+    }
+
+    // Once the key expires it is processed as a new request
+    time.Sleep(2 * cfg.IdempotencyTTL)
+    if status, again := postWithKey(t, router, "order-1", exampleReceipt); status != http.StatusOK || again == first {
+        t.Errorf("after the key expired: got %d %s, want a new id", status, again)
+    }
+}
+
+func TestIdempotencyCacheSweepsExpiredKeys(t *testing.T) {
+    cache := newIdempotencyCache(time.Millisecond)
+    for _, key := range []string{"a", "b"} {
+        entry, claimed := cache.begin(key, hashBody(key))
+        if !claimed {
+            t.Fatalf("fresh key %s was not claimed", key)
+        }
+        cache.finish(entry, http.StatusOK, gin.H{"id": key})
+    }
+    // a request still running is kept however old it is
+    cache.begin("running", hashBody("running"))
+    time.Sleep(5 * time.Millisecond)
+
+    cache.lastSweep = time.Time{}
+    cache.begin("c", hashBody("c"))
+    if _, ok := cache.keys["a"]; ok || len(cache.keys) != 2 {
+        t.Errorf("cache holds %d keys after a sweep, want running and c", len(cache.keys))
+    }
+}
+
+func TestIdempotencyKeyPerCaller(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.DedupReceipts = false
+    cfg.UserAPIKeys = "alice:alice-key,bob:bob-key"
+    router := newTestRouterWith(t, cfg)
+    post := func(apiKey, query string) (int, string) {
+        req := httptest.NewRequest(http.MethodPost, "/receipts/process"+query, strings.NewReader(receiptJSON(t, exampleReceipt)))
+        req.Header.Set("Content-Type", "application/json")
+        req.Header.Set(apiKeyHeader, apiKey)
+        req.Header.Set(idempotencyKeyHeader, "order-1")
+        w := httptest.NewRecorder()
+        router.ServeHTTP(w, req)
+        return w.Code, w.Body.String()
+    }
+
+    _, alice := post("alice-key", "")
+    // Another caller with the same key and body gets its own receipt
+    if status, bob := post("bob-key", ""); status != http.StatusOK || bob == alice {
+        t.Errorf("bob reusing alice's key: got %d %s, want a new id", status, bob)
+    }
+    if _, retry := post("alice-key", ""); retry != alice {
+        t.Errorf("alice's retry: got %s, want %s", retry, alice)
+    }
+    // The flags are part of the request, so changing them is refused
+    for _, query := range []string{"?includePoints=true", "?strict=true"} {
+        if status, body := post("alice-key", query); status != http.StatusConflict || !strings.Contains(body, codeIdempotencyKeyReused) {
+            t.Errorf("retry with %s: got %d %s, want 409 %s", query, status, body, codeIdempotencyKeyReused)
+        }
+    }
+}
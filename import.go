@@ -0,0 +1,140 @@
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+)
+
+// maxImportSize caps how many receipts a single import request may carry
+const maxImportSize = 500
+
+// ImportReceipt is one receipt in an import request
+type ImportReceipt struct {
+    // ID is optional; a receipt without one gets a new uuid-id
+    ID string `json:"id,omitempty"`
+    ReceiptInput
+}
+
+// ImportRequest is the JSON body accepted by POST /receipts/import
+type ImportRequest struct {
+    Receipts []ImportReceipt `json:"receipts"`
+    // ExportedAt and Count are ignored; they are accepted so the output of
+    // GET /receipts/export can be imported as it is
+    ExportedAt string `json:"exportedAt,omitempty"`
+    Count      int    `json:"count,omitempty"`
+}
+
+// importReceipts seeds the store with receipts exported from another system
+// Input:
+//   JSON ImportRequest with at most maxImportSize receipts, each in the same
+//   format as processReceipt plus an optional "id"
+// Output:
+//   - Success: JSON {"imported": n, "skipped": n, "errors": [{"index": n, "error": "message"}]}
+//              with the status processReceipt would return on rejected receipts
+//              with one errors entry per skipped receipt; the imported
+//              receipts are stored together, so either all of them are or none
+//   - Error: JSON with error message {"error": "message"} if the body is
+//            invalid, has too many receipts or the store fails
+func (s *Server) importReceipts(c *gin.Context) {
+    var request ImportRequest
+    if err := s.bindJSON(c, &request); err != nil {
+        respondBindError(c, err)
+        return
+    }
+    if len(request.Receipts) > maxImportSize {
+        respondError(c, http.StatusBadRequest, codeBatchTooLarge, "import exceeds maximum size of "+strconv.Itoa(maxImportSize))
+        return
+    }
+
+    // Held until the receipts are stored, so an id checked as free can't be
+    // taken by a concurrent import, nor a receipt checked as new be stored
+    // meanwhile by a concurrent process request
+    defer s.lockForUpdate()()
+    if s.dedup != nil {
+        defer s.dedup.lockAll()()
+    }
+
+    errs := make([]gin.H, 0)
+    skip := func(i int, body gin.H) {
+        body["index"] = i
+        errs = append(errs, body)
+    }
+    var ids []string
+    var records []ReceiptRecord
+    // seen[id] and seenFP[fingerprint] are the receipts imported by this request
+    seen := make(map[string]bool)
+    seenFP := make(map[string]bool)
+    now := time.Now()
+    for i, input := range request.Receipts {
+        receipt, err := parseReceipt(input.ReceiptInput, s.parseOptions(c))
+        if err == nil {
+            // Imports are historical, so only future dates are rejected
+            err = s.checkPurchaseDateWithin(receipt, 0)
+        }
+        if err != nil {
+            recordRejection(c, rejectionReason(err), err)
+            body := rejectionBody(c, err)
+            body["status"] = rejectionStatus(err)
+            skip(i, body)
+            continue
+        }
+
+        id := uuid.New().String()
+        if input.ID != "" {
+            parsed, err := uuid.Parse(input.ID)
+            if err != nil {
+                skip(i, errorBody(c, codeInvalidReceiptID, "invalid receipt id", "id"))
+                continue
+            }
+            id = parsed.String()
+            record, exists, err := s.store.Get(c.Request.Context(), id)
+            if err != nil {
+                respondStoreError(c, err, "failed to read receipt")
+                return
+            }
+            if seen[id] || (exists && !record.expired(s.cfg.ReceiptTTL)) {
+                skip(i, errorBody(c, codeReceiptExists, "receipt "+id+" already exists", "id"))
+                continue
+            }
+        }
+
+        if s.dedup != nil {
+            fp := fingerprint(receipt)
+            existing, _, exists, err := s.findDuplicate(c.Request.Context(), fp)
+            if err != nil {
+                respondStoreError(c, err, "failed to read receipt")
+                return
+            }
+            if exists || seenFP[fp] {
+                message := "receipt is a duplicate of an earlier one in this import"
+                if exists {
+                    message = "receipt is already stored as " + existing
+                }
+                skip(i, errorBody(c, codeDuplicateReceipt, message, ""))
+                continue
+            }
+            seenFP[fp] = true
+        }
+        seen[id] = true
+        ids = append(ids, id)
+        records = append(records, s.newRecord(receipt, now))
+    }
+
+    if err := s.store.PutBatch(c.Request.Context(), ids, records); err != nil {
+        respondStoreError(c, err, "failed to store receipts")
+        return
+    }
+    for i, record := range records {
+        s.indexReceipt(ids[i], record)
+    }
+    receiptsProcessed.Add(float64(len(records)))
+    for _, record := range records {
+        pointsCalculated.Observe(float64(record.Points))
+    }
+
+    c.JSON(http.StatusOK, gin.H{"imported": len(ids), "skipped": len(errs), "errors": errs})
+}
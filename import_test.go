@@ -0,0 +1,73 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+// importJSON encodes an import request body
+func importJSON(t *testing.T, receipts ...ImportReceipt) string {
+    t.Helper()
+    body, err := json.Marshal(ImportRequest{Receipts: receipts})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(body)
+}
+
+func TestImportReceipts(t *testing.T) {
+    router := newTestRouter(t)
+    const givenID = "6f1e0a9c-3b2d-4c5e-8f7a-1b2c3d4e5f60"
+    other := exampleReceipt
+    other.Retailer = "Walgreens"
+    invalid := exampleReceipt
+    invalid.PurchaseDate = "2022-02-30"
+    future := exampleReceipt
+    future.PurchaseDate = "2999-01-01"
+
+    status, body := serve(t, router, http.MethodPost, "/receipts/import", importJSON(t,
+        ImportReceipt{ID: strings.ToUpper(givenID), ReceiptInput: exampleReceipt},
+        ImportReceipt{ReceiptInput: other},
+        ImportReceipt{ReceiptInput: invalid},
+        ImportReceipt{ID: "not-a-uuid", ReceiptInput: exampleReceipt},
+        ImportReceipt{ReceiptInput: exampleReceipt},
+        ImportReceipt{ReceiptInput: future},
+    ))
+    if status != http.StatusOK || body["imported"] != 2.0 || body["skipped"] != 4.0 {
+        t.Fatalf("got %d %v, want 2 imported and 4 skipped", status, body)
+    }
+    wantCodes := map[float64]string{2: "INVALID_PURCHASE_DATE", 3: codeInvalidReceiptID, 4: codeDuplicateReceipt, 5: "DATE_IN_FUTURE"}
+    errs, _ := body["errors"].([]any)
+    for _, e := range errs {
+        entry, _ := e.(map[string]any)
+        index, _ := entry["index"].(float64)
+        if errorDetail(entry)["code"] != wantCodes[index] {
+            t.Errorf("receipt %v skipped with %v, want code %s", index, entry, wantCodes[index])
+        }
+    }
+
+    // The given id is kept, in its canonical form
+    if status, body := serve(t, router, http.MethodGet, "/receipts/"+givenID+"/points", ""); status != http.StatusOK || body["points"] != 28.0 {
+        t.Errorf("imported receipt: got %d %v, want 28 points", status, body)
+    }
+
+    // Importing over an existing id skips the receipt rather than replacing it
+    status, body = serve(t, router, http.MethodPost, "/receipts/import", importJSON(t, ImportReceipt{ID: givenID, ReceiptInput: other}))
+    errs, _ = body["errors"].([]any)
+    if status != http.StatusOK || body["imported"] != 0.0 || len(errs) != 1 || errorDetail(errs[0].(map[string]any))["code"] != codeReceiptExists {
+        t.Errorf("re-import: got %d %v, want the receipt skipped as RECEIPT_EXISTS", status, body)
+    }
+}
+
+func TestImportReceiptsLimit(t *testing.T) {
+    receipts := make([]ImportReceipt, maxImportSize+1)
+    for i := range receipts {
+        receipts[i] = ImportReceipt{ReceiptInput: exampleReceipt}
+    }
+    status, body := serve(t, newTestRouter(t), http.MethodPost, "/receipts/import", importJSON(t, receipts...))
+    if status != http.StatusBadRequest || errorDetail(body)["code"] != codeBatchTooLarge {
+        t.Errorf("got %d %v, want 400 BATCH_TOO_LARGE", status, body)
+    }
+}
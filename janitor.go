@@ -0,0 +1,88 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "time"
+)
+
+// janitorBatchSize is how many receipts the janitor checks between store calls,
+// so no lock is held for a whole scan of a large store
+const janitorBatchSize = 500
+
+// expired reports whether a record is older than ttl
+// Input: receipt TTL; 0 means receipts never expire
+// Output: true if the record should no longer be served
+func (r ReceiptRecord) expired(ttl time.Duration) bool {
+    return ttl > 0 && !r.StoredAt.IsZero() && time.Since(r.StoredAt) > ttl
+}
+
+// runJanitor removes expired receipts from the store until ctx is done
+// Input: context, store to sweep and the receipt TTL, which must be positive
+// Output: none, failed sweeps are logged and retried on the next tick; a
+//         sweep in progress is cut short when ctx is done
+func runJanitor(ctx context.Context, store Store, ttl time.Duration) {
+    // Sweep often enough that expired receipts don't pile up for long
+    ticker := time.NewTicker(min(ttl, time.Minute))
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+        removed, err := sweepExpired(ctx, store, ttl)
+        if contextError(err) {
+            return
+        }
+        if err != nil {
+            slog.Error("failed to sweep expired receipts", "error", err.Error())
+        }
+        if removed > 0 {
+            slog.Info("swept expired receipts", "removed", removed)
+        }
+    }
+}
+
+// sweepExpired deletes every receipt older than ttl
+// Input: context for the store calls, store to sweep and the receipt TTL
+// Output: number of receipts removed, and the first store error, if any
+func sweepExpired(ctx context.Context, store Store, ttl time.Duration) (int, error) {
+    ids, err := store.List(ctx)
+    if err != nil {
+        return 0, err
+    }
+    removed := 0
+    for start := 0; start < len(ids); start += janitorBatchSize {
+        var expired []string
+        for _, id := range ids[start:min(start+janitorBatchSize, len(ids))] {
+            record, exists, err := peekRecord(ctx, store, id)
+            if err != nil {
+                return removed, err
+            }
+            if exists && record.expired(ttl) {
+                expired = append(expired, id)
+            }
+        }
+
+        // The memory store can drop a whole batch under one lock
+        if mem, ok := store.(*MemoryStore); ok {
+            mem.deleteBatch(expired)
+            removed += len(expired)
+            continue
+        }
+        for _, id := range expired {
+            err := store.Delete(ctx, id)
+            if errors.Is(err, ErrNotFound) {
+                // deleted by a client in the meantime
+                continue
+            }
+            if err != nil {
+                return removed, err
+            }
+            removed++
+        }
+    }
+    return removed, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+)
+
+// maxRedemptionReasonLength caps the free-text reason of a redemption, in characters
+const maxRedemptionReasonLength = 200
+
+// Redemption is points a user spent; it is stored on its own, apart from
+// the receipts that earned the points, and never changed afterwards
+type Redemption struct {
+    ID         string
+    UserID     string
+    Points     int
+    Reason     string `json:",omitempty"`
+    RedeemedAt time.Time
+}
+
+// redeemInput is the body of POST /users/:id/redeem
+type redeemInput struct {
+    // Points is a json.Number so a fraction or a string gets
+    // INVALID_REDEMPTION rather than INVALID_JSON
+    Points json.Number `json:"points"`
+    Reason string      `json:"reason"`
+}
+
+// ledgerEntry is one line of a user's points history
+type ledgerEntry struct {
+    // Type is "earn" for a receipt and "redeem" for a redemption
+    Type string `json:"type"`
+    // ID is the receipt id or the redemption id
+    ID string `json:"id"`
+    // Points is positive when earned and negative when redeemed
+    Points int    `json:"points"`
+    Reason string `json:"reason,omitempty"`
+    At     time.Time `json:"at"`
+    // Balance is the user's points after this entry
+    Balance int `json:"balance"`
+}
+
+// ledger returns a user's points history, oldest first
+// Input: user id and the receipt TTL
+// Output: one entry per receipt that isn't voided or expired and one per
+//         redemption; at the same time earnings come first
+func (x *ownerIndex) ledger(userID string, ttl time.Duration) []ledgerEntry {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.dropExpired(userID, ttl)
+    user, exists := x.users[userID]
+    if !exists {
+        return []ledgerEntry{}
+    }
+    entries := make([]ledgerEntry, 0, user.count+len(user.redemptions))
+    for id, owned := range user.receipts {
+        if !owned.voided {
+            entries = append(entries, ledgerEntry{Type: "earn", ID: id, Points: owned.points, At: owned.storedAt})
+        }
+    }
+    for _, redemption := range user.redemptions {
+        entries = append(entries, ledgerEntry{
+            Type:   "redeem",
+            ID:     redemption.ID,
+            Points: -redemption.Points,
+            Reason: redemption.Reason,
+            At:     redemption.RedeemedAt,
+        })
+    }
+    sort.SliceStable(entries, func(i, j int) bool {
+        a, b := entries[i], entries[j]
+        if !a.At.Equal(b.At) {
+            return a.At.Before(b.At)
+        }
+        if a.Type != b.Type {
+            return a.Type == "earn"
+        }
+        // Redemptions keep the order they were made in
+        return a.Type == "earn" && a.ID < b.ID
+    })
+    balance := 0
+    for i := range entries {
+        balance += entries[i].Points
+        entries[i].Balance = balance
+    }
+    return entries
+}
+
+// redeemPoints spends points from a user's balance
+// Redemptions are serialized by redeemMu from the balance check until the
+// index has the redemption, so two redemptions can't both spend the same points.
+// The lock and the balances are this process's own: instances sharing a Redis
+// server don't see each other's redemptions, so they could overspend; points
+// must be redeemed through a single instance
+// Input:
+//   - user id in the URL path
+//   - JSON {"points": 150, "reason": "gift card"}; reason is optional, up to
+//     maxRedemptionReasonLength characters
+// Output:
+//   - Success: JSON {"id": "uuid-id", "userId": "id", "points": number, "balance": number}
+//              with the balance left
+//   - Error: JSON with error message {"error": "message"}; 400 INVALID_REDEMPTION
+//            for bad points or reason, 403 NOT_OWNER for another user's key,
+//            409 INSUFFICIENT_POINTS when the balance doesn't cover the points
+func (s *Server) redeemPoints(c *gin.Context) {
+    user, ok := userID(c)
+    if !ok {
+        return
+    }
+    // Spending is never left open to other users' keys, enforced ownership or not
+    if who, ok := requestCaller(c); ok && !who.admin() && who.user != user {
+        respondError(c, http.StatusForbidden, codeNotOwner, "API key belongs to another user")
+        return
+    }
+    var input redeemInput
+    if err := s.bindJSON(c, &input); err != nil {
+        respondBindError(c, err)
+        return
+    }
+    points, err := strconv.Atoi(input.Points.String())
+    if err != nil || points < 1 {
+        c.AbortWithStatusJSON(http.StatusBadRequest, errorBody(c, codeInvalidRedemption, "points must be a positive integer", "points"))
+        return
+    }
+    reason := strings.TrimSpace(input.Reason)
+    if utf8.RuneCountInString(reason) > maxRedemptionReasonLength {
+        message := fmt.Sprintf("reason exceeds %d characters", maxRedemptionReasonLength)
+        c.AbortWithStatusJSON(http.StatusBadRequest, errorBody(c, codeInvalidRedemption, message, "reason"))
+        return
+    }
+
+    s.redeemMu.Lock()
+    defer s.redeemMu.Unlock()
+    balance, _, _ := s.owners.balance(user, s.cfg.ReceiptTTL)
+    if balance < points {
+        message := fmt.Sprintf("balance of %d points doesn't cover %d", max(balance, 0), points)
+        c.AbortWithStatusJSON(http.StatusConflict, errorBody(c, codeInsufficientPoints, message, "points"))
+        return
+    }
+    redemption := Redemption{
+        ID:         uuid.NewString(),
+        UserID:     user,
+        Points:     points,
+        Reason:     reason,
+        RedeemedAt: time.Now(),
+    }
+    if err := s.store.PutRedemption(c.Request.Context(), redemption); err != nil {
+        respondStoreError(c, err, "failed to store redemption")
+        return
+    }
+    s.owners.redeem(redemption)
+    c.JSON(http.StatusOK, gin.H{"id": redemption.ID, "userId": user, "points": points, "balance": balance - points})
+}
+
+// getUserLedger lists a user's points earned and redeemed
+// Input:
+//   - user id in the URL path
+//   - limit, offset, page: optional query parameters, as for GET /receipts
+// Output:
+//   - Success: JSON {"userId": "id", "balance": number, "entries": [...],
+//              "count": number, "limit": number, "offset": number}, oldest
+//              first; each entry is {"type": "earn" or "redeem", "id": "...",
+//              "points": number, "reason": "...", "at": "time", "balance": number}
+//   - Error: as getUserPoints
+func (s *Server) getUserLedger(c *gin.Context) {
+    user, ok := userID(c)
+    if !ok || !s.checkOwner(c, user) {
+        return
+    }
+    limit, offset, ok := pagination(c)
+    if !ok {
+        return
+    }
+    entries := s.owners.ledger(user, s.cfg.ReceiptTTL)
+    balance := 0
+    if len(entries) > 0 {
+        balance = entries[len(entries)-1].Balance
+    }
+    count := len(entries)
+    start := min(offset, count)
+    end := min(start+limit, count)
+
+    c.JSON(http.StatusOK, gin.H{
+        "userId":  user,
+        "balance": balance,
+        "entries": entries[start:end],
+        "count":   count,
+        "limit":   limit,
+        "offset":  offset,
+    })
+}
@@ -1,57 +1,696 @@
 package main
 
 import (
-    "math"
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "log"
+    "log/slog"
+    "net"
     "net/http"
+    "os"
+    "os/signal"
+    "regexp"
     "strconv"
     "strings"
     "sync"
+    "syscall"
     "time"
-    "unicode"
+    "unicode/utf8"
 
     "github.com/gin-gonic/gin"
     "github.com/google/uuid"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Receipt represents the structure of a receipt
 type Receipt struct {
     Retailer     string
-    PurchaseDate time.Time
-    PurchaseTime time.Time
+    // PurchasedAt is when the purchase was made, in the zone its date and
+    // time are read in (PURCHASE_TIMEZONE); the rules use its calendar day
+    // and clock time in that zone
+    PurchasedAt time.Time
+    // Timezone is the zone named on the receipt, empty if it had none
+    Timezone string `json:",omitempty"`
+    // UserID is the user the receipt belongs to, empty if it has no owner
+    UserID string `json:",omitempty"`
+    // Notes is free text from the user, e.g. "business expense"; it
+    // doesn't affect the points
+    Notes string `json:",omitempty"`
     Items        []Item
-    Total        float64
+    // Total in cents
+    Total        int64
+}
+
+// purchaseDay is the receipt's calendar date in its own zone
+// Input: none
+// Output: midnight UTC on that date, comparable with dates from time.Parse
+func (r Receipt) purchaseDay() time.Time {
+    year, month, day := r.PurchasedAt.Date()
+    return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
 }
 
 // Item represents a single item on a receipt
 type Item struct {
     ShortDescription string
-    Price            float64
+    // Price in cents
+    Price            int64
+}
+
+// ReceiptInput is the JSON body accepted by the process endpoints
+type ReceiptInput struct {
+    Retailer     string      `json:"retailer"`
+    PurchaseDate string      `json:"purchaseDate"`
+    PurchaseTime string      `json:"purchaseTime"`
+    // PurchaseDateTime is an RFC 3339 timestamp that may be sent instead of
+    // PurchaseDate and PurchaseTime; if both forms are sent they must agree
+    PurchaseDateTime string  `json:"purchaseDateTime,omitempty"`
+    // Timezone is the IANA zone of the store, e.g. America/New_York; the
+    // server's PURCHASE_TIMEZONE is used when it is left out
+    Timezone string `json:"timezone,omitempty"`
+    // UserID names the receipt's owner; a USER_API_KEYS key sets it to its
+    // own user when it is left out
+    UserID string `json:"userId,omitempty"`
+    // Notes is an optional memo of up to maxNotesLength characters
+    Notes string `json:"notes,omitempty"`
+    Items        []ItemInput `json:"items"`
+    Total        Amount      `json:"total"`
+    // IncludePoints asks processReceipt to return the points with the id
+    IncludePoints bool `json:"includePoints,omitempty"`
+}
+
+// ItemInput is a single item in ReceiptInput
+type ItemInput struct {
+    ShortDescription string `json:"shortDescription"`
+    Price            Amount `json:"price"`
+}
+
+// Amount is a dollar amount from a request body, e.g. "12.25"
+// It is sent as a string, as in api.yml, but some POS exporters send a
+// JSON number, so 12.25 is accepted too and converted to "12.25"
+type Amount string
+
+// UnmarshalJSON reads an amount sent as a string or a number
+// Input: JSON string, number or null
+// Output: nil, or an error for any other JSON value; a number is written
+//         with two decimals, e.g. 9.5 becomes "9.50", while one with more
+//         decimals or an exponent is kept as sent and fails validation
+func (a *Amount) UnmarshalJSON(data []byte) error {
+    if string(data) == "null" {
+        return nil
+    }
+    if len(data) > 0 && data[0] == '"' {
+        return json.Unmarshal(data, (*string)(a))
+    }
+    var number json.Number
+    if err := json.Unmarshal(data, &number); err != nil {
+        return err
+    }
+    whole, frac, _ := strings.Cut(number.String(), ".")
+    // 9.250 has no more precision than 9.25
+    for len(frac) > 2 && strings.HasSuffix(frac, "0") {
+        frac = frac[:len(frac)-1]
+    }
+    if len(frac) > 2 || strings.ContainsAny(number.String(), "eE") {
+        *a = Amount(number)
+        return nil
+    }
+    *a = Amount(whole + "." + frac + strings.Repeat("0", 2-len(frac)))
+    return nil
+}
+
+// ReceiptRecord is a stored receipt together with its precomputed points
+type ReceiptRecord struct {
+    Receipt
+    Points int
+    // StoredAt is when the receipt was stored, used for ReceiptTTL;
+    // zero for receipts stored before it was recorded, which never expire
+    StoredAt time.Time
+    // RulesVersion identifies the rules and values Points was calculated
+    // with; empty for receipts stored before it was recorded
+    RulesVersion string `json:",omitempty"`
+    // Voided is set by POST /receipts/:id/void; a voided receipt stays
+    // stored but no longer earns points
+    Voided bool `json:",omitempty"`
+}
+
+// UnmarshalJSON reads a stored record
+// Records stored before PurchasedAt existed have a separate PurchaseDate
+// and PurchaseTime, both read as UTC; they are combined into PurchasedAt
+// Input: JSON record as written by json.Marshal
+// Output: nil, or a JSON error
+func (r *ReceiptRecord) UnmarshalJSON(data []byte) error {
+    // plain has no UnmarshalJSON method, so decoding into it doesn't recurse
+    type plain ReceiptRecord
+    var record struct {
+        plain
+        PurchaseDate time.Time
+        PurchaseTime time.Time
+    }
+    if err := json.Unmarshal(data, &record); err != nil {
+        return err
+    }
+    *r = ReceiptRecord(record.plain)
+    if r.PurchasedAt.IsZero() && !record.PurchaseDate.IsZero() {
+        r.PurchasedAt = record.PurchaseDate.Add(
+            time.Duration(record.PurchaseTime.Hour())*time.Hour +
+                time.Duration(record.PurchaseTime.Minute())*time.Minute)
+    }
+    return nil
+}
+
+// PointsBreakdown holds the points awarded by each rule for one receipt
+type PointsBreakdown struct {
+    RetailerAlphanumeric int `json:"retailerAlphanumeric"`
+    RoundDollar          int `json:"roundDollar"`
+    QuarterMultiple      int `json:"quarterMultiple"`
+    ItemPairBonus        int `json:"itemPairBonus"`
+    ItemDescriptionBonus int `json:"itemDescriptionBonus"`
+    OddDay               int `json:"oddDay"`
+    AfternoonWindow      int `json:"afternoonWindow"`
+    WeekendBonus         int `json:"weekendBonus"`
+    LargePurchaseBonus   int `json:"largePurchaseBonus"`
+    TotalOverTenBonus    int `json:"totalOverTenBonus"`
+    // Other[name] = points awarded by a rule added with RegisterRule
+    Other                map[string]int `json:"other,omitempty"`
+    Total                int `json:"total"`
+}
+
+// ruleContribution is the number of points a single rule awarded
+// Item is set to the item index for per-item rules
+type ruleContribution struct {
+    Rule   string `json:"rule"`
+    Points int    `json:"points"`
+    Item   *int   `json:"item,omitempty"`
+    // Detail explains the points, e.g. "purchase day 1 is odd"
+    Detail string `json:"detail,omitempty"`
+}
+
+// receiptResponse is the JSON representation of a stored receipt
+// It mirrors the shape accepted by POST /receipts/process
+type receiptResponse struct {
+    Retailer     string         `json:"retailer"`
+    PurchaseDate string         `json:"purchaseDate"`
+    PurchaseTime string         `json:"purchaseTime"`
+    Timezone     string         `json:"timezone,omitempty"`
+    UserID       string         `json:"userId,omitempty"`
+    Notes        string         `json:"notes,omitempty"`
+    Items        []itemResponse `json:"items"`
+    Total        string         `json:"total"`
+}
+
+// receiptSummary is a single entry in the GET /receipts listing
+type receiptSummary struct {
+    ID       string  `json:"id"`
+    Retailer string  `json:"retailer"`
+    Total    float64 `json:"total"`
+    Points   int     `json:"points"`
+    Voided   bool    `json:"voided,omitempty"`
+}
+
+const (
+    // defaultPageLimit is used when GET /receipts has no limit parameter
+    defaultPageLimit = 20
+    // maxPageLimit caps how many receipts a single page may return
+    maxPageLimit = 100
+)
+
+// itemResponse is the JSON representation of a stored receipt item
+type itemResponse struct {
+    ShortDescription string `json:"shortDescription"`
+    Price            string `json:"price"`
+}
+
+// startTime is when the server started, used to report uptime
+var startTime time.Time
+
+// Server holds the dependencies shared by the HTTP handlers
+type Server struct {
+    cfg   Config
+    store Store
+    // receipt ids already returned for each Idempotency-Key
+    idempotency *idempotencyCache
+    // receipt ids by content fingerprint; nil when duplicate detection is off
+    dedup *dedupIndex
+    // receipts and points balance of each user
+    owners *ownerIndex
+    // aggregates served by GET /receipts/stats
+    stats *statsIndex
+    // version of cfg.Rules and cfg.Values, stamped on stored receipts
+    rulesVersion string
+    // zone purchase dates and times are read in, from cfg.PurchaseTimezone
+    location *time.Location
+    // serializes PUT, PATCH, DELETE, voids, imports and rescoring, see
+    // lockForUpdate; processing new receipts doesn't take it
+    updateMu sync.Mutex
+    // serializes redemptions, see redeemPoints
+    redeemMu sync.Mutex
+    // clock returns the current time for date checks; nil means time.Now,
+    // tests set it so they don't depend on the wall clock
+    clock func() time.Time
+}
+
+// validationError is a receipt validation failure
+// message is returned to the client; reason is a fixed, short name for the
+// failure, used to label the receipts_rejected_total metric
+type validationError struct {
+    // field is the request body field at fault, e.g. "total"; empty for
+    // problems with the receipt as a whole
+    field   string
+    reason  string
+    message string
+}
+
+// Error returns the client-facing message
+func (e *validationError) Error() string {
+    return e.message
+}
+
+// invalid creates a validationError
+// Input: metrics reason, e.g. "invalid_total", and client-facing message
+// Output: error wrapping both
+func invalid(reason, message string) error {
+    return &validationError{reason: reason, message: message}
+}
+
+// validationErrors is every problem found in one receipt, in field order
+type validationErrors []*validationError
+
+// add records a problem with a field
+// Input: field name as in the request body, e.g. "items[2].price", metrics
+//        reason and client-facing message
+// Output: none
+func (e *validationErrors) add(field, reason, message string) {
+    *e = append(*e, &validationError{field: field, reason: reason, message: message})
+}
+
+// Error returns the first problem's message, which is what the process
+// endpoints report
+func (e validationErrors) Error() string {
+    return e[0].message
+}
+
+// Unwrap exposes each problem, so errors.As finds the first one
+func (e validationErrors) Unwrap() []error {
+    errs := make([]error, len(e))
+    for i, verr := range e {
+        errs[i] = verr
+    }
+    return errs
+}
+
+// fieldError is one problem with a receipt, as reported to clients
+type fieldError struct {
+    // Field is empty for problems with the receipt as a whole
+    Field   string `json:"field,omitempty"`
+    Code    string `json:"code"`
+    Message string `json:"message"`
+}
+
+// fieldErrors lists the problems in a validation error
+// Input: error returned by parseReceipt or checkPurchaseDate
+// Output: one fieldError per problem, in field order
+func fieldErrors(err error) []fieldError {
+    var errs validationErrors
+    if errors.As(err, &errs) {
+        list := make([]fieldError, len(errs))
+        for i, verr := range errs {
+            list[i] = verr.fieldError()
+        }
+        return list
+    }
+    var verr *validationError
+    if errors.As(err, &verr) {
+        return []fieldError{verr.fieldError()}
+    }
+    return []fieldError{{Code: codeInvalidJSON, Message: err.Error()}}
+}
+
+// fieldError converts the problem to its client form
+func (e *validationError) fieldError() fieldError {
+    return fieldError{Field: e.field, Code: validationCode(e.reason), Message: e.message}
+}
+
+// rejectionBody is the JSON answer for a rejected receipt
+// Input: request context, for the error format, and the error returned by
+//        parseReceipt or checkPurchaseDate
+// Output: the first problem as in errorBody, plus every problem in "errors":
+//         {"error": {...}, "errors": [{"field": "total", "code": "INVALID_TOTAL", "message": "invalid total"}]}
+func rejectionBody(c *gin.Context, err error) gin.H {
+    return newRejectionBody(c.GetBool(structuredErrorsKey), err)
+}
+
+// newRejectionBody builds the JSON answer for a rejected receipt in the given layout
+// Input: true for the structured layout, and the validation error
+// Output: as rejectionBody
+func newRejectionBody(structured bool, err error) gin.H {
+    errs := fieldErrors(err)
+    body := newErrorBody(structured, errs[0].Code, errs[0].Message, errs[0].Field)
+    body["errors"] = errs
+    return body
 }
 
+// rejectionReason returns the metrics reason of a validation error
+// Input: error returned by parseReceipt or checkPurchaseDate
+// Output: its reason, or "invalid" for other errors
+func rejectionReason(err error) string {
+    var verr *validationError
+    if errors.As(err, &verr) {
+        return verr.reason
+    }
+    return "invalid"
+}
+
+// rejectionStatus returns the HTTP status of a rejected receipt
+// Input: error returned by parseReceipt or checkPurchaseDate
+// Output: 422 for a well-formed receipt whose purchaseDate is out of range,
+//         400 otherwise
+func rejectionStatus(err error) int {
+    switch rejectionReason(err) {
+    case "date_in_future", "date_too_old":
+        return http.StatusUnprocessableEntity
+    }
+    return http.StatusBadRequest
+}
+
+// recordRejection counts a rejected receipt and logs why it was rejected
+// Input: request context, metrics reason and the validation error
+// Output: none, increments receipts_rejected_total and logs at warn level
+//         with the request id
+func recordRejection(c *gin.Context, reason string, err error) {
+    receiptsRejected.WithLabelValues(reason).Inc()
+    slog.Warn("receipt rejected",
+        "reason", reason,
+        "error", err.Error(),
+        "path", c.Request.URL.Path,
+        "requestId", c.GetString("requestId"),
+    )
+}
+
+// Field patterns from the API spec (api.yml)
 var (
-    // receipts[id] = receipt
-    receipts = make(map[string]Receipt)
-    // lock for thread safe
-    mu       sync.Mutex
+    retailerPattern    = regexp.MustCompile(`^[\w\s\-&]+$`)
+    descriptionPattern = regexp.MustCompile(`^[\w\s\-]+$`)
+    amountPattern      = regexp.MustCompile(`^\d+\.\d{2}$`)
 )
 
+// userIDPattern matches the user ids receipts are stored under, e.g. an
+// account number or an email address
+var userIDPattern = regexp.MustCompile(`^[\w.@-]{1,64}$`)
+
+// maxNotesLength caps a receipt's notes, in characters
+const maxNotesLength = 500
+
 // main initializes the server
-// The application exposes two main endpoints:
+// The application exposes the following endpoints:
 // - POST /receipts/process: Processes new receipts
+// - POST /receipts/process/bulk: Processes an array of receipts
+// - POST /receipts/batch: Processes an array of receipts, storing them together
+// - POST /receipts/validate: Reports every problem with a receipt without storing it
+// - GET /receipts: Lists stored receipts in insertion order
+// - GET /receipts/:id: Retrieves a stored receipt
 // - GET /receipts/:id/points: Retrieves points for a specific receipt
 //                             id: [uuid-id]
-// Input: none
-// Output: starts HTTP server on port 8080
+// - GET /receipts/:id/points/breakdown: Explains which rules awarded points
+// - GET /receipts/:id/breakdown: Returns the points awarded by each rule
+// - PUT /receipts/:id: Replaces a stored receipt with a corrected one
+// - PATCH /receipts/:id: Corrects some fields of a stored receipt
+// - DELETE /receipts/:id: Removes a stored receipt
+// - GET /health: Reports server status and uptime
+// - GET /ready: Reports whether the storage layer is ready
+// - GET /healthz, GET /readyz: Same as /health and /ready, without request logs or metrics
+// - GET /metrics: Prometheus metrics
+// Input: environment variables and command line flags, see Config
+// Output: starts HTTP server on the configured port (default 8080); on SIGINT or
+//         SIGTERM it drains in-flight requests and closes the store before exiting
 
 func main() {
+    startTime = time.Now()
+    // JSON logs, one line per entry
+    slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+    cfg, err := LoadConfig()
+    if err != nil {
+        log.Fatalf("invalid configuration: %v", err)
+    }
+    cfg.registerFlags(flag.CommandLine)
+    flag.Parse()
+    if err := cfg.validate(); err != nil {
+        log.Fatalf("invalid configuration: %v", err)
+    }
+    log.Printf("config: %s", cfg)
+
+    store, err := newStore(cfg)
+    if err != nil {
+        log.Fatalf("failed to open %s store: %v", cfg.StorageBackend, err)
+    }
+
+    registerStoreMetrics(store)
+    ln, err := net.Listen("tcp", ":"+cfg.Port)
+    if err != nil {
+        closeStore(cfg, store)
+        log.Fatalf("failed to listen on port %s: %v", cfg.Port, err)
+    }
+    gin.SetMode(cfg.GinMode)
+    if err := run(cfg, store, ln); err != nil {
+        log.Fatalf("server failed: %v", err)
+    }
+}
+
+// run serves requests on ln until SIGINT or SIGTERM, then shuts down in order:
+// it drains in-flight requests, stops the janitor and snapshots, and closes
+// the store
+// Input: validated Config, the store it selects and the listener to serve on
+// Output: nil after a signal, or the error that stopped the server; the
+//         store is closed either way
+func run(cfg Config, store Store, ln net.Listener) error {
+    // Wait for Ctrl-C or a SIGTERM from the orchestrator
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    routerCtx, stopRouter := context.WithCancel(context.Background())
+    defer stopRouter()
+    router, err := setupRouter(routerCtx, cfg, store)
+    if err != nil {
+        closeStore(cfg, store)
+        return err
+    }
+    stopBackground := startBackground(cfg, store)
+    srv := &http.Server{Handler: router}
+    served := make(chan error, 1)
+    go func() {
+        served <- srv.Serve(ln)
+    }()
+
+    select {
+    case err = <-served:
+        slog.Error("server failed, shutting down", "error", err.Error())
+    case <-ctx.Done():
+        slog.Info("shutting down", "drainTimeout", cfg.ShutdownTimeout.String())
+    }
+    stop()
+
+    // Shutdown stops accepting connections and waits for in-flight requests
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+    defer cancel()
+    if err := srv.Shutdown(shutdownCtx); err != nil {
+        slog.Error("requests still in flight after drain timeout", "error", err.Error())
+    }
+    // Nothing may write to the store once it is closed
+    stopRouter()
+    stopBackground()
+    closeStore(cfg, store)
+    return err
+}
+
+// startBackground starts the janitor and periodic snapshots the config asks for
+// Input: Config and the store they work on
+// Output: function stopping them, which returns once they have stopped
+func startBackground(cfg Config, store Store) func() {
+    ctx, cancel := context.WithCancel(context.Background())
+    var wg sync.WaitGroup
+    if cfg.ReceiptTTL > 0 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            runJanitor(ctx, store, cfg.ReceiptTTL)
+        }()
+    }
+    if mem, ok := store.(*MemoryStore); ok && cfg.SnapshotPath != "" {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            runSnapshots(ctx, mem, cfg.SnapshotPath, cfg.SnapshotInterval)
+        }()
+    }
+    return func() {
+        cancel()
+        wg.Wait()
+    }
+}
+
+// closeStore flushes and closes the store once no more requests are served
+// Input: Config and the store to close
+// Output: none, failures are logged
+func closeStore(cfg Config, store Store) {
+    // Save receipts stored since the last periodic snapshot
+    if mem, ok := store.(*MemoryStore); ok && cfg.SnapshotPath != "" {
+        if err := writeSnapshot(cfg.SnapshotPath, mem); err != nil {
+            slog.Error("failed to write final snapshot", "path", cfg.SnapshotPath, "error", err.Error())
+        }
+    }
+    if err := store.Close(); err != nil {
+        slog.Error("failed to close store", "error", err.Error())
+    }
+}
+
+// newStore creates the storage backend selected by the config
+// Input: Config with a validated StorageBackend
+// Output: Store, or an error if the backend can't be opened
+func newStore(cfg Config) (Store, error) {
+    switch cfg.StorageBackend {
+    case "file":
+        return NewFileStore(cfg.DataFile)
+    case "sqlite":
+        return NewSQLiteStore(cfg.DBPath)
+    case "bolt":
+        return NewBoltStore(cfg.BoltPath)
+    case "redis":
+        slog.Warn("balances, redemption checks, statistics and duplicate detection are kept per instance; redeem points through a single instance")
+        return NewRedisStore(cfg.RedisAddr), nil
+    case "wal":
+        return NewWALStore(cfg.WALPath, cfg.WALSync)
+    default:
+        store := NewMemoryStore()
+        if cfg.MaxReceipts > 0 {
+            store = NewBoundedMemoryStore(cfg.MaxReceipts)
+        }
+        // startBackground takes the periodic snapshots from here on
+        if cfg.SnapshotPath != "" {
+            loadSnapshot(cfg.SnapshotPath, store)
+        }
+        return store, nil
+    }
+}
+
+// setupRouter registers all endpoints on a new router
+// Input: context ending the router's background work, such as the rate
+//        limiter's cleanup, then Config and Store used by the handlers
+// Output: *gin.Engine ready to serve, or an error for a config that
+//         validate would have refused, such as a malformed trusted proxy
+func setupRouter(ctx context.Context, cfg Config, store Store) (*gin.Engine, error) {
+    location, err := cfg.purchaseLocation()
+    if err != nil {
+        return nil, fmt.Errorf("purchase timezone: %w", err)
+    }
+    router := gin.New()
+    // X-Forwarded-For is only honoured from configured proxies, otherwise any
+    // client could pick its own IP and dodge the rate limiter
+    if err := router.SetTrustedProxies(cfg.trustedProxies()); err != nil {
+        return nil, fmt.Errorf("trusted proxies: %w", err)
+    }
+
+    s := &Server{
+        cfg:          cfg,
+        store:        store,
+        idempotency:  newIdempotencyCache(cfg.IdempotencyTTL),
+        rulesVersion: rulesVersion(cfg.Rules, cfg.Values),
+        location:     location,
+    }
+    if cfg.DedupReceipts {
+        s.dedup = newDedupIndex(store, cfg.ReceiptTTL)
+    }
+    s.owners = newOwnerIndex(store)
+    s.stats = newStatsIndex(store, cfg.ReceiptTTL)
+    if mem, ok := store.(*MemoryStore); ok {
+        mem.onEvict(s.unindexReceipt)
+    }
+    // Orchestrator probes are registered before the middleware below, so
+    // frequent polling doesn't show up in request logs or metrics
+    router.GET("/healthz", errorFormat(cfg.LegacyErrors), recoveryMiddleware(), s.health)
+    router.GET("/readyz", errorFormat(cfg.LegacyErrors), recoveryMiddleware(), s.ready)
+
+    // CORS comes first so preflights are answered before any other work
+    router.Use(corsMiddleware(cfg.CORSAllowedOrigins, cfg.CORSAllowedMethods, cfg.CORSAllowCredentials))
     // Logger middleware
-    router := gin.Default()
+    router.Use(errorFormat(cfg.LegacyErrors), requestLogger(), recoveryMiddleware(), metricsMiddleware())
+    // After the logger and metrics, so rejected requests are still recorded
+    if cfg.RateLimitRPS > 0 {
+        router.Use(newRateLimiter(ctx, cfg.RateLimitRPS, cfg.RateLimitBurst).middleware())
+    }
+    router.Use(bodyLimit(cfg.MaxBodyBytes))
+    // Filled in below, once every route is registered
+    var static staticRoutes
+    router.Use(methodCheck(&static))
+    if cfg.RequireJSONContentType {
+        router.Use(requireJSON())
+    }
+    if cfg.RequestTimeout > 0 {
+        // Exports and rescoring all receipts scale with the store, so they
+        // are left to run for as long as they take
+        router.Use(requestTimeout(cfg.RequestTimeout,
+            "/receipts/export", "/receipts/export.csv", "/receipts/recalculate-all", "/admin/recalculate"))
+    }
     /*
         
     */
-    router.POST("/receipts/process", processReceipt)
-    router.GET("/receipts/:id/points", getPoints)
-    router.Run(":8080")
+    // validate already checked USER_API_KEYS
+    userKeys, _ := cfg.userAPIKeys()
+    keys := newKeyring(cfg.apiKeys(), userKeys)
+    if !keys.empty() {
+        // Every endpoint learns whose key it got, for receipt ownership
+        router.Use(keys.identify())
+    }
+    // Endpoints that change the store need an API key when keys are
+    // configured; those acting on every receipt need one of the API_KEYS
+    writes := router.Group("/")
+    admin := router.Group("/")
+    if !keys.empty() {
+        writes.Use(apiKeyAuth())
+        admin.Use(apiKeyAuth(), adminOnly())
+    }
+    writes.POST("/receipts/process", s.processReceipt)
+    writes.POST("/receipts/process/bulk", s.processReceiptsBulk)
+    writes.POST("/receipts/batch", s.processReceiptsBatch)
+    admin.POST("/receipts/import", s.importReceipts)
+    writes.POST("/receipts/:id/recalculate", s.recalculateReceipt)
+    writes.POST("/receipts/:id/void", s.voidReceipt)
+    admin.POST("/receipts/recalculate-all", s.recalculateAllReceipts)
+    admin.POST("/admin/recalculate", s.recalculateAllReceipts)
+    // Validation stores nothing, so it stays open like the read endpoints
+    router.POST("/receipts/validate", s.validateReceipt)
+    router.GET("/receipts", s.listReceipts)
+    // Stats and exports cover every user's receipts, so they take an
+    // admin key; listings are filtered by owner instead
+    admin.GET("/receipts/stats", s.getStats)
+    router.GET("/receipts/search", s.searchReceipts)
+    admin.GET("/receipts/export", s.exportReceipts)
+    admin.GET("/receipts/export.csv", s.exportReceiptsCSV)
+    router.GET("/receipts/:id", s.getReceipt)
+    router.GET("/receipts/:id/points", s.getPoints)
+    router.GET("/receipts/:id/points/breakdown", s.getPointsBreakdown)
+    router.GET("/receipts/:id/breakdown", s.getBreakdown)
+    writes.PUT("/receipts/:id", s.replaceReceipt)
+    writes.PATCH("/receipts/:id", s.patchReceipt)
+    writes.DELETE("/receipts/:id", s.deleteReceipt)
+    router.GET("/users/:id/points", s.getUserPoints)
+    router.GET("/users/:id/receipts", s.listUserReceipts)
+    router.GET("/users/:id/ledger", s.getUserLedger)
+    writes.POST("/users/:id/redeem", s.redeemPoints)
+    router.GET("/health", s.health)
+    router.GET("/ready", s.ready)
+    router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+    router.GET("/openapi.json", serveOpenAPI(cfg))
+    router.GET("/docs", serveDocs)
+    // Unknown paths and methods get the same error body as everything else
+    // rather than gin's plain-text 404
+    router.HandleMethodNotAllowed = true
+    router.NoRoute(noRoute)
+    router.NoMethod(noMethod)
+    static = newStaticRoutes(router)
+    return router, nil
 }
 
 // processReceipt processes a new receipt
@@ -62,154 +701,1218 @@ func main() {
 //   - purchaseTime: string (HH:MM)
 //   - items: array of {shortDescription: string, price: string}
 //   - total: string
+//   - userId: optional string, the receipt's owner; a USER_API_KEYS key
+//     stores the receipt under its own user
+//   - notes: optional string of up to maxNotesLength characters; null
+//     bytes are stripped and the points don't depend on it
+//   - includePoints: optional bool, same as the includePoints=true query parameter
+//   Optional Idempotency-Key header; a retry with the same key gets the
+//   response of the first request instead of storing the receipt again;
+//   keys are per API key and cover the includePoints and strict flags
+//   Optional dryRun=true query parameter to validate and score the receipt
+//   without storing it
 // Output: 
-//   - Success: JSON with receipt ID {"id": "uuid-id"}
-//   - Error: JSON with error message {"error": "message"}
-func processReceipt(c *gin.Context) {
+//   - Success: JSON with receipt ID {"id": "uuid-id"},
+//              or {"id": "uuid-id", "points": number} when points are requested,
+//              or {"points": number, "breakdown": {...}} for a dry run
+//   - Error: JSON with error message {"error": "message"};
+//            422 if the purchase is in the future or older than MaxReceiptAgeDays,
+//            409 if the Idempotency-Key was used with a different body or flags
+func (s *Server) processReceipt(c *gin.Context) {
     // Input template
-    var input struct {
-        Retailer     string `json:"retailer"`
-        PurchaseDate string `json:"purchaseDate"`
-        PurchaseTime string `json:"purchaseTime"`
-        Items        []struct {
-            ShortDescription string `json:"shortDescription"`
-            Price            string `json:"price"`
-        } `json:"items"`
-        Total string `json:"total"`
-    }
-    // c.ShouldBindJSON for parsing JSON
-    if err := c.ShouldBindJSON(&input); err != nil {
+    var input ReceiptInput
+    // s.bindJSON for parsing JSON
+    if err := s.bindJSON(c, &input); err != nil {
         // c.JSON for responses
         // gin.H is a shorthand for map[string]interface{}
-        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
+        respondBindError(c, err)
         return
     }
 
-    // Validate and parse receipt data
-    purchaseDate, err := time.Parse("2006-01-02", input.PurchaseDate)
-    if err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid purchaseDate format"})
+    key := c.GetHeader(idempotencyKeyHeader)
+    // A dry run stores nothing, so there is nothing for a retry to replay
+    if key == "" || dryRun(c) {
+        c.JSON(s.processInput(c, input))
         return
     }
-    
-    // Validate and parse receipt time
-    purchaseTime, err := time.Parse("15:04", input.PurchaseTime)
+
+    key = scopedKey(c, key)
+    // The flags change the response, so a retry must send the same ones
+    bodyHash := hashBody(struct {
+        Input         ReceiptInput
+        IncludePoints bool
+        Strict        bool
+    }{input, c.Query("includePoints") == "true", s.strictMode(c)})
+    for {
+        entry, claimed := s.idempotency.begin(key, bodyHash)
+        if claimed {
+            s.processClaimed(c, input, key, entry)
+            return
+        }
+        if entry.bodyHash != bodyHash {
+            respondError(c, http.StatusConflict, codeIdempotencyKeyReused, "Idempotency-Key was already used with a different request")
+            return
+        }
+        // A concurrent request with the same key is running; wait for its result
+        select {
+        case <-entry.done:
+        case <-c.Request.Context().Done():
+            return
+        }
+        if entry.response != nil {
+            c.JSON(entry.status, entry.response)
+            return
+        }
+        // The first request failed and released the key, so try to claim it
+    }
+}
+
+// processClaimed processes a receipt whose Idempotency-Key this request
+// claimed, and records the response for retries or releases the key
+// Input: gin context, the decoded body, the key and the entry begin returned
+// Output: none, sends the response; the key is released even if
+//         processInput panics, so retries waiting on it don't hang
+func (s *Server) processClaimed(c *gin.Context, input ReceiptInput, key string, entry *idempotencyEntry) {
+    settled := false
+    defer func() {
+        if !settled {
+            s.idempotency.abandon(key, entry)
+        }
+    }()
+    status, response := s.processInput(c, input)
+    // Only successes are replayed; after an error the client may retry
+    if status == http.StatusOK {
+        s.idempotency.finish(entry, status, response)
+    } else {
+        s.idempotency.abandon(key, entry)
+    }
+    settled = true
+    c.JSON(status, response)
+}
+
+// processInput validates and stores one receipt from processReceipt
+// Input: gin context, for the strict query parameter, and the decoded body
+// Output: HTTP status and JSON response body
+func (s *Server) processInput(c *gin.Context, input ReceiptInput) (int, gin.H) {
+    receipt, err := parseReceipt(input, s.parseOptions(c))
+    if err == nil {
+        receipt.UserID, err = ownerFor(c, receipt.UserID, "")
+    }
     if err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid purchaseTime format"})
+        recordRejection(c, rejectionReason(err), err)
+        return http.StatusBadRequest, rejectionBody(c, err)
+    }
+    // The receipt is well formed, so a bad date is 422 rather than 400
+    if err := s.checkPurchaseDate(receipt); err != nil {
+        recordRejection(c, rejectionReason(err), err)
+        return http.StatusUnprocessableEntity, rejectionBody(c, err)
+    }
+    if dryRun(c) {
+        breakdown := calculatePointsBreakdown(receipt, s.cfg.Rules, s.cfg.Values)
+        return http.StatusOK, gin.H{"points": breakdown.Total, "breakdown": breakdown}
+    }
+
+    id, points, duplicate, err := s.storeReceipt(c.Request.Context(), receipt)
+    if err != nil {
+        return storeErrorBody(c, err, "failed to store receipt")
+    }
+    response := gin.H{"id": id}
+    if input.IncludePoints || c.Query("includePoints") == "true" {
+        response["points"] = points
+    }
+    if duplicate {
+        response["duplicate"] = true
+    }
+    return http.StatusOK, response
+}
+
+// bindJSON decodes the request body into dst
+// Unlike c.ShouldBindJSON, fields dst doesn't define are rejected when
+// RejectUnknownFields is set, so a typo like "retailor" isn't silently dropped
+// Input: gin context and a pointer to decode into
+// Output: nil, or the decoding error for respondBindError
+func (s *Server) bindJSON(c *gin.Context, dst any) error {
+    decoder := json.NewDecoder(c.Request.Body)
+    if s.cfg.RejectUnknownFields {
+        decoder.DisallowUnknownFields()
+    }
+    return decoder.Decode(dst)
+}
+
+// respondBindError answers a request whose body couldn't be decoded
+// Input: gin context and the error returned by bindJSON
+// Output: 413 {"error": "request body exceeds n bytes"} if the body hit
+//         MaxBodyBytes, 400 {"error": "unknown field \"name\"", "errors": [...]}
+//         for an unknown field, otherwise 400 {"error": "invalid JSON"}
+func respondBindError(c *gin.Context, err error) {
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        recordRejection(c, "body_too_large", err)
+        respondError(c, http.StatusRequestEntityTooLarge, codeBodyTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
         return
     }
-    // Validate and parse receipt total price
-    total, err := strconv.ParseFloat(input.Total, 64)
+    // encoding/json has no error type for unknown fields, only this message
+    if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+        verr := &validationError{
+            field:   strings.Trim(name, `"`),
+            reason:  "unknown_field",
+            message: "unknown field " + name,
+        }
+        recordRejection(c, verr.reason, verr)
+        c.JSON(http.StatusBadRequest, rejectionBody(c, verr))
+        return
+    }
+    recordRejection(c, "invalid_json", err)
+    respondError(c, http.StatusBadRequest, codeInvalidJSON, "invalid JSON")
+}
+
+// processReceiptsBulk processes an array of receipts in one request
+// Input: 
+//   JSON array of receipt objects, each in the same format as processReceipt
+// Output: 
+//   - Success: JSON array with one result per receipt, in request order:
+//              {"id": "uuid-id"} or {"error": "message", "index": n, "status": 400},
+//              where status is what processReceipt would have returned
+//   - Error: JSON with error message {"error": "message"} if the body is not a JSON array
+func (s *Server) processReceiptsBulk(c *gin.Context) {
+    var inputs []ReceiptInput
+    if err := s.bindJSON(c, &inputs); err != nil {
+        respondBindError(c, err)
+        return
+    }
+
+    // Each receipt is validated and stored on its own,
+    // so one bad receipt doesn't fail the rest of the batch
+    results := make([]gin.H, len(inputs))
+    for i, input := range inputs {
+        receipt, err := parseReceipt(input, s.parseOptions(c))
+        if err == nil {
+            receipt.UserID, err = ownerFor(c, receipt.UserID, "")
+        }
+        if err == nil {
+            err = s.checkPurchaseDate(receipt)
+        }
+        if err != nil {
+            recordRejection(c, rejectionReason(err), err)
+            results[i] = rejectionBody(c, err)
+            results[i]["index"] = i
+            results[i]["status"] = rejectionStatus(err)
+            continue
+        }
+        id, _, duplicate, err := s.storeReceipt(c.Request.Context(), receipt)
+        if err != nil {
+            _, results[i] = storeErrorBody(c, err, "failed to store receipt")
+            results[i]["index"] = i
+            continue
+        }
+        results[i] = gin.H{"id": id}
+        if duplicate {
+            results[i]["duplicate"] = true
+        }
+    }
+
+    c.JSON(http.StatusOK, results)
+}
+
+// processReceiptsBatch processes an array of receipts, storing all valid ones together
+// Input: 
+//   JSON array of at most MaxBatchSize receipt objects, each in the same format as processReceipt
+// Output: 
+//   - Success: JSON array with one result per receipt, in request order:
+//              {"index": n, "id": "uuid-id"} or {"index": n, "error": "message", "status": 422},
+//              where status is what processReceipt would have returned
+//   - Error: JSON with error message {"error": "message"} if the body is not a JSON array
+//            or the batch is too large
+func (s *Server) processReceiptsBatch(c *gin.Context) {
+    var inputs []ReceiptInput
+    if err := s.bindJSON(c, &inputs); err != nil {
+        respondBindError(c, err)
+        return
+    }
+    if len(inputs) > s.cfg.MaxBatchSize {
+        respondError(c, http.StatusBadRequest, codeBatchTooLarge, "batch exceeds maximum size of "+strconv.Itoa(s.cfg.MaxBatchSize))
+        return
+    }
+
+    // Validate everything first, then store the valid receipts under one lock
+    results := make([]gin.H, len(inputs))
+    var valid []Receipt
+    var validIndexes []int
+    for i, input := range inputs {
+        receipt, err := parseReceipt(input, s.parseOptions(c))
+        if err == nil {
+            receipt.UserID, err = ownerFor(c, receipt.UserID, "")
+        }
+        if err == nil {
+            err = s.checkPurchaseDate(receipt)
+        }
+        if err != nil {
+            recordRejection(c, rejectionReason(err), err)
+            results[i] = rejectionBody(c, err)
+            results[i]["index"] = i
+            results[i]["status"] = rejectionStatus(err)
+            continue
+        }
+        valid = append(valid, receipt)
+        validIndexes = append(validIndexes, i)
+    }
+    ids, duplicates, err := s.storeReceipts(c.Request.Context(), valid)
     if err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid total"})
+        respondStoreError(c, err, "failed to store receipts")
         return
     }
+    for i, id := range ids {
+        results[validIndexes[i]] = gin.H{"index": validIndexes[i], "id": id}
+        if duplicates[i] {
+            results[validIndexes[i]]["duplicate"] = true
+        }
+    }
+
+    c.JSON(http.StatusOK, results)
+}
+
+// parseOptions are the limits and settings parseReceipt validates against
+type parseOptions struct {
+    // strict: whether the total must equal the sum of the item prices
+    strict bool
+    // maxItems: maximum number of items allowed on the receipt
+    maxItems int
+    // maxTotal: largest total accepted, in cents; 0 means no limit
+    maxTotal int64
+    // loc: zone purchaseDate and purchaseTime are read in, and
+    // purchaseDateTime is converted to, unless the receipt names its own timezone
+    loc *time.Location
+}
+
+// parseOptions returns the options receipts of this request are parsed with
+// Input: request context, for the strict query parameter
+// Output: parseOptions from the server configuration
+func (s *Server) parseOptions(c *gin.Context) parseOptions {
+    return parseOptions{
+        strict:   s.strictMode(c),
+        maxItems: s.cfg.MaxItems,
+        maxTotal: s.cfg.MaxTotalAmount,
+        loc:      s.location,
+    }
+}
+
+// parseReceipt validates receipt input and converts it to a Receipt
+// Input: 
+//   - input: ReceiptInput decoded from the request body
+//   - opts: limits and settings to validate against
+// Output: 
+//   - Success: parsed Receipt, nil
+//   - Error: empty Receipt, validationErrors listing every problem found;
+//            its message is the first problem's
+func parseReceipt(input ReceiptInput, opts parseOptions) (Receipt, error) {
+    var errs validationErrors
+    loc := opts.loc
+    // Validate retailer name
+    if !retailerPattern.MatchString(input.Retailer) {
+        errs.add("retailer", "invalid_retailer", "invalid retailer")
+    }
+    if input.Timezone != "" {
+        zone, err := loadTimezone(input.Timezone)
+        if err != nil {
+            errs.add("timezone", "invalid_timezone", "invalid timezone, expected an IANA zone such as America/New_York")
+        } else {
+            loc = zone
+        }
+    }
+    purchasedAt := parsePurchasedAt(input, loc, &errs)
+    if input.UserID != "" && !userIDPattern.MatchString(input.UserID) {
+        errs.add("userId", "invalid_user_id", "invalid userId, expected at most 64 letters, digits, '.', '_', '@' or '-'")
+    }
+    // Null bytes are dropped rather than rejected; they are never meant and
+    // break some log and database tools
+    notes := strings.ReplaceAll(input.Notes, "\x00", "")
+    if utf8.RuneCountInString(notes) > maxNotesLength {
+        errs.add("notes", "notes_too_long", fmt.Sprintf("notes exceed %d characters", maxNotesLength))
+    }
+    // Validate and parse receipt total price
+    total, ok := parseAmount(string(input.Total))
+    if !ok {
+        errs.add("total", "invalid_total", "invalid total")
+    } else if opts.maxTotal > 0 && total > opts.maxTotal {
+        errs.add("total", "total_too_large", fmt.Sprintf("total %s exceeds maximum total amount of %s", formatCents(total), formatCents(opts.maxTotal)))
+    }
     // Validate receipt's purchase items > 0
     if len(input.Items) == 0 {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "at least one item required"})
-        return
+        errs.add("items", "no_items", "at least one item required")
+    }
+    if len(input.Items) > opts.maxItems {
+        // Checking every item of an oversized receipt would be wasted work
+        errs.add("items", "too_many_items", fmt.Sprintf("receipt exceeds maximum item count of %d", opts.maxItems))
+        return Receipt{}, errs
     }
     // Validate and parse receipt purchase items
     items := make([]Item, len(input.Items))
+    var itemSumCents int64
     for i, item := range input.Items {
-        price, err := strconv.ParseFloat(item.Price, 64)
-        if err != nil || price < 0 {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item price"})
-            return
+        field := fmt.Sprintf("items[%d]", i)
+        if strings.TrimSpace(item.ShortDescription) == "" {
+            errs.add(field+".shortDescription", "blank_description", fmt.Sprintf("item %d shortDescription must not be blank", i))
+        } else if !descriptionPattern.MatchString(item.ShortDescription) {
+            errs.add(field+".shortDescription", "invalid_description", "invalid item shortDescription")
+        }
+        price, ok := parseAmount(string(item.Price))
+        if !ok {
+            errs.add(field+".price", "invalid_price", "invalid item price")
         }
         items[i] = Item{
             ShortDescription: item.ShortDescription,
             Price:            price,
         }
+        itemSumCents += price
+    }
+    if len(errs) > 0 {
+        return Receipt{}, errs
+    }
+    // In strict mode the total must equal the item prices to the cent; only
+    // checked once every amount is valid, so the sum means something
+    if opts.strict && total != itemSumCents {
+        errs.add("total", "total_mismatch", fmt.Sprintf("total %s does not match item sum %s", input.Total, formatCents(itemSumCents)))
+        return Receipt{}, errs
     }
     // Map parsed receipt items
-    receipt := Receipt{
-        Retailer:     input.Retailer,
-        PurchaseDate: purchaseDate,
-        PurchaseTime: purchaseTime,
-        Items:        items,
-        Total:        total,
+    return Receipt{
+        Retailer:    input.Retailer,
+        PurchasedAt: purchasedAt,
+        Timezone:    input.Timezone,
+        UserID:      input.UserID,
+        Notes:       notes,
+        Items:       items,
+        Total:       total,
+    }, nil
+}
+
+// timezones caches the zones loaded by loadTimezone; only valid IANA
+// names are stored, so it can't grow past the zone database
+var timezones sync.Map
+
+// loadTimezone loads an IANA zone named in the configuration or on a receipt
+// Input: zone name, e.g. America/New_York
+// Output: the zone, or an error for an unknown name, and for "" and "Local",
+//         which would make points depend on the server host's zone
+func loadTimezone(name string) (*time.Location, error) {
+    if name == "" || name == "Local" {
+        return nil, fmt.Errorf("%q is not an IANA zone", name)
+    }
+    if loc, ok := timezones.Load(name); ok {
+        return loc.(*time.Location), nil
+    }
+    loc, err := time.LoadLocation(name)
+    if err != nil {
+        return nil, err
+    }
+    timezones.Store(name, loc)
+    return loc, nil
+}
+
+// parsePurchasedAt reads when a receipt's purchase was made
+// Input: receipt input with purchaseDate and purchaseTime, purchaseDateTime
+//        or both, the zone to read them in, and the errors to add problems to
+// Output: the purchase time in loc; zero if a problem was added. A
+//         purchaseDateTime keeps its seconds, and must fall in the same
+//         minute as purchaseDate and purchaseTime when those are sent too
+func parsePurchasedAt(input ReceiptInput, loc *time.Location, errs *validationErrors) time.Time {
+    var purchasedAt time.Time
+    valid := true
+    if input.PurchaseDateTime != "" {
+        t, err := time.Parse(time.RFC3339, input.PurchaseDateTime)
+        if err != nil {
+            errs.add("purchaseDateTime", "invalid_purchase_date_time", "invalid purchaseDateTime format, expected RFC 3339")
+            valid = false
+        }
+        purchasedAt = t.In(loc)
+    }
+    // Without a purchaseDateTime the separate fields are required
+    if input.PurchaseDateTime != "" && input.PurchaseDate == "" && input.PurchaseTime == "" {
+        return purchasedAt
+    }
+
+    // Validate and parse receipt data
+    date, err := time.Parse("2006-01-02", input.PurchaseDate)
+    if err != nil {
+        errs.add("purchaseDate", "invalid_purchase_date", "invalid purchaseDate format")
+        valid = false
+    }
+    // Validate and parse receipt time
+    clock, err := time.Parse("15:04", input.PurchaseTime)
+    if err != nil {
+        errs.add("purchaseTime", "invalid_purchase_time", "invalid purchaseTime format")
+        valid = false
+    }
+    if !valid {
+        return time.Time{}
+    }
+    local := time.Date(date.Year(), date.Month(), date.Day(), clock.Hour(), clock.Minute(), 0, 0, loc)
+    if input.PurchaseDateTime == "" {
+        return local
+    }
+    if !local.Equal(purchasedAt.Truncate(time.Minute)) {
+        errs.add("purchaseDateTime", "purchase_date_time_mismatch",
+            fmt.Sprintf("purchaseDateTime %s is %s in %s, but purchaseDate and purchaseTime say %s %s",
+                input.PurchaseDateTime, purchasedAt.Format("2006-01-02 15:04"), loc, input.PurchaseDate, input.PurchaseTime))
+        return time.Time{}
+    }
+    return purchasedAt
+}
+
+// strictMode reports whether totals are checked against item prices for this request
+// Input: request context, reads the optional strict=true query parameter
+// Output: true if the server runs with -strict-totals or the request asks for it
+func (s *Server) strictMode(c *gin.Context) bool {
+    return s.cfg.StrictTotals || c.Query("strict") == "true"
+}
+
+// dryRun reports whether the request asks to validate without storing
+// Input: request context
+// Output: true if the dryRun=true query parameter is set
+func dryRun(c *gin.Context) bool {
+    return c.Query("dryRun") == "true"
+}
+
+// checkPurchaseDate checks that a receipt's purchase is neither in the
+// future nor older than the configured look-back window
+// Input: receipt parsed by parseReceipt
+// Output: nil, or a validationError for purchaseDate saying which bound
+//         was crossed; both ends of the window are inclusive
+func (s *Server) checkPurchaseDate(receipt Receipt) error {
+    return s.checkPurchaseDateWithin(receipt, s.cfg.MaxReceiptAgeDays)
+}
+
+// checkPurchaseDateWithin is checkPurchaseDate with its own look-back window
+// Input: receipt parsed by parseReceipt and the window in days, 0 for any age
+// Output: as checkPurchaseDate
+func (s *Server) checkPurchaseDateWithin(receipt Receipt, maxAgeDays int) error {
+    now := s.now()
+    if receipt.PurchasedAt.After(now.Add(s.cfg.MaxClockSkew)) {
+        return &validationError{
+            field:   "purchaseDate",
+            reason:  "date_in_future",
+            message: fmt.Sprintf("purchaseDate %s is in the future",
+                receipt.PurchasedAt.Format("2006-01-02 15:04")),
+        }
+    }
+    if maxAgeDays == 0 {
+        return nil
+    }
+    // Compare calendar dates in the purchase's zone, so any time on the
+    // earliest day counts
+    year, month, day := now.In(receipt.PurchasedAt.Location()).Date()
+    earliest := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -maxAgeDays)
+    if receipt.purchaseDay().Before(earliest) {
+        return &validationError{
+            field:   "purchaseDate",
+            reason:  "date_too_old",
+            message: fmt.Sprintf("purchaseDate %s is more than %d days old",
+                receipt.PurchasedAt.Format("2006-01-02"), maxAgeDays),
+        }
+    }
+    return nil
+}
+
+// checkCorrectedPurchaseDate is checkPurchaseDate for a correction of a
+// stored receipt
+// A receipt that aged out of the window, or was imported from before it, can
+// still be corrected as long as its purchase time is left alone
+// Input: the corrected receipt and the stored one it replaces
+// Output: as checkPurchaseDate, without the look-back window when the
+//         purchase instant is unchanged
+func (s *Server) checkCorrectedPurchaseDate(receipt, old Receipt) error {
+    if receipt.PurchasedAt.Equal(old.PurchasedAt) {
+        return s.checkPurchaseDateWithin(receipt, 0)
+    }
+    return s.checkPurchaseDate(receipt)
+}
+
+// now returns the current time from the server's clock
+// Input: none
+// Output: s.clock(), or time.Now() if no clock is set
+func (s *Server) now() time.Time {
+    if s.clock != nil {
+        return s.clock()
+    }
+    return time.Now()
+}
+
+// parseAmount validates a dollar amount from a receipt and parses it into cents
+// Input: amount from the request body, e.g. "12.25"
+// Output: amount in cents and true, or false if it doesn't match amountPattern
+//         or is too large
+func parseAmount(amount string) (int64, bool) {
+    if !amountPattern.MatchString(amount) {
+        return 0, false
+    }
+    cents, err := parseCents(amount)
+    return cents, err == nil
+}
+
+// parseCents parses a dollar amount string into cents
+// Input: amount already matching amountPattern, e.g. "12.25"
+// Output: amount in cents, e.g. 1225
+func parseCents(amount string) (int64, error) {
+    return strconv.ParseInt(strings.Replace(amount, ".", "", 1), 10, 64)
+}
+
+// formatCents formats cents as a dollar amount string
+// Input: amount in cents, e.g. 1225
+// Output: amount with two decimals, e.g. "12.25"
+func formatCents(cents int64) string {
+    return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// newRecord scores a receipt with the current rules for storing
+// Input: parsed Receipt and the time it is stored
+// Output: ReceiptRecord stamped with the current rules version
+func (s *Server) newRecord(receipt Receipt, storedAt time.Time) ReceiptRecord {
+    return ReceiptRecord{
+        Receipt:      receipt,
+        Points:       calculatePoints(receipt, s.cfg.Rules, s.cfg.Values),
+        StoredAt:     storedAt,
+        RulesVersion: s.rulesVersion,
+    }
+}
+
+// storeReceipt saves a parsed receipt under a new id, unless duplicate
+// detection finds the same receipt already stored
+// Input: context for the store calls and parsed Receipt
+// Output: the receipt's uuid-id, the points awarded and whether it was a
+//         duplicate of a stored receipt, or a store error
+func (s *Server) storeReceipt(ctx context.Context, receipt Receipt) (string, int, bool, error) {
+    if s.dedup != nil {
+        fp := fingerprint(receipt)
+        defer s.dedup.lockFingerprints([]string{fp})()
+        id, record, exists, err := s.findDuplicate(ctx, fp)
+        if err != nil {
+            return "", 0, false, err
+        }
+        if exists {
+            receiptsDuplicate.Inc()
+            return id, record.Points, true, nil
+        }
     }
+
+    // Points are deterministic for a receipt, so compute them once here
+    record := s.newRecord(receipt, time.Now())
     // Generating new uuid-id
     id := uuid.New().String()
-    // Lock for thread safe while modifying data
-    mu.Lock()
     // map receipt with its unique uuid-id
-    receipts[id] = receipt
-    mu.Unlock()
+    if err := s.store.Put(ctx, id, record); err != nil {
+        return "", 0, false, err
+    }
+    s.indexReceipt(id, record)
+    receiptsProcessed.Inc()
+    pointsCalculated.Observe(float64(record.Points))
+    return id, record.Points, false, nil
+}
+
+// storeReceipts saves several parsed receipts in one store call; receipts
+// already stored, or repeated within the batch, keep their first id
+// Input: context for the store calls and parsed Receipts
+// Output: the uuid-ids in the same order and which of them are duplicates,
+//         or a store error
+func (s *Server) storeReceipts(ctx context.Context, batch []Receipt) ([]string, []bool, error) {
+    ids := make([]string, len(batch))
+    duplicates := make([]bool, len(batch))
+    var newIDs []string
+    var records []ReceiptRecord
+    fingerprints := make([]string, len(batch))
+    if s.dedup != nil {
+        for i, receipt := range batch {
+            fingerprints[i] = fingerprint(receipt)
+        }
+        defer s.dedup.lockFingerprints(fingerprints)()
+    }
+    // batchIDs[fingerprint] = id given to an earlier receipt in this batch
+    batchIDs := make(map[string]string)
+    now := time.Now()
+    for i, receipt := range batch {
+        ids[i] = uuid.New().String()
+        if s.dedup != nil {
+            fp := fingerprints[i]
+            id, _, exists, err := s.findDuplicate(ctx, fp)
+            if err != nil {
+                return nil, nil, err
+            }
+            if !exists {
+                id, exists = batchIDs[fp]
+            }
+            if exists {
+                ids[i] = id
+                duplicates[i] = true
+                continue
+            }
+            batchIDs[fp] = ids[i]
+        }
+        newIDs = append(newIDs, ids[i])
+        records = append(records, s.newRecord(receipt, now))
+    }
+    if err := s.store.PutBatch(ctx, newIDs, records); err != nil {
+        return nil, nil, err
+    }
+    for i, record := range records {
+        s.indexReceipt(newIDs[i], record)
+    }
+    receiptsProcessed.Add(float64(len(records)))
+    receiptsDuplicate.Add(float64(len(batch) - len(records)))
+    for _, record := range records {
+        pointsCalculated.Observe(float64(record.Points))
+    }
+    return ids, duplicates, nil
+}
 
-    c.JSON(http.StatusOK, gin.H{"id": id})
+// storeErrorStatus picks the HTTP status for an error returned by the store
+// Input: non-nil error from a Store method
+// Output: 503 if the store's server is unreachable, otherwise 500
+func storeErrorStatus(err error) int {
+    if errors.Is(err, ErrUnavailable) {
+        return http.StatusServiceUnavailable
+    }
+    return http.StatusInternalServerError
+}
+
+// receiptID reads the receipt id from the URL path
+// Input: request context with an :id path parameter
+// Output: the id in the canonical lowercase form it is stored under and
+//         true, or false after a 400 {"error": "invalid receipt id"} was
+//         sent for an id that isn't a UUID, so a mangled id isn't mistaken
+//         for a missing receipt
+func receiptID(c *gin.Context) (string, bool) {
+    id, err := uuid.Parse(c.Param("id"))
+    if err != nil {
+        respondError(c, http.StatusBadRequest, codeInvalidReceiptID, "invalid receipt id")
+        return "", false
+    }
+    return id.String(), true
+}
+
+// lookup reads a receipt from the store, answering the request on failure
+// Input: request context and receipt id
+// Output: the record and true, or false after a 404 or 500 response was
+//         sent, or a 401 or 403 when the receipt belongs to another user
+//         and ownership is enforced
+func (s *Server) lookup(c *gin.Context, id string) (ReceiptRecord, bool) {
+    record, exists, err := s.store.Get(c.Request.Context(), id)
+    if err != nil {
+        respondStoreError(c, err, "failed to read receipt")
+        return ReceiptRecord{}, false
+    }
+    // Expired receipts may not have been swept yet
+    if !exists || record.expired(s.cfg.ReceiptTTL) {
+        respondError(c, http.StatusNotFound, codeReceiptNotFound, "receipt not found")
+        return ReceiptRecord{}, false
+    }
+    if !s.checkOwner(c, record.UserID) {
+        return ReceiptRecord{}, false
+    }
+    return record, true
 }
 
 // getPoints retrieves points for a receipt
 // Input: 
 //   - [uuid-id]: receipt ID in URL path parameter
+//   - rulesVersion: optional query parameter; "current" scores the receipt
+//     with the live rules instead of returning the stored points
 // Output:
-//   - Success: JSON with points {"points": number}
-//   - Error: JSON with error {"error": "receipt not found"}
-func getPoints(c *gin.Context) {
-    // c.Param for URL parameters
-    id := c.Param("id")
-    // Lock for thread safe while Accessing data
-    mu.Lock()
-    receipt, exists := receipts[id]
-    mu.Unlock()
+//   - Success: JSON with points {"points": number, "rulesVersion": "version"}
+//   - Error: JSON with error {"error": "receipt not found"}, or 422
+//            {"error": "receipt has been voided"}
+func (s *Server) getPoints(c *gin.Context) {
+    // c.Param for URL parameters, checked by receiptID
+    id, ok := receiptID(c)
+    if !ok {
+        return
+    }
+    record, ok := s.lookup(c, id)
+    if !ok || rejectVoided(c, record) {
+        return
+    }
 
-    if !exists {
-        c.JSON(http.StatusNotFound, gin.H{"error": "receipt not found"})
+    switch c.Query("rulesVersion") {
+    case "":
+        // Points were calculated when the receipt was processed, so
+        // changing the rules doesn't change points already issued
+        c.JSON(http.StatusOK, gin.H{"points": record.Points, "rulesVersion": record.RulesVersion})
+    case "current":
+        points := calculatePoints(record.Receipt, s.cfg.Rules, s.cfg.Values)
+        c.JSON(http.StatusOK, gin.H{"points": points, "rulesVersion": s.rulesVersion})
+    default:
+        respondError(c, http.StatusBadRequest, codeInvalidParameter, "rulesVersion must be current")
+    }
+}
+
+// getPointsBreakdown explains how a receipt's points were awarded
+// Input: 
+//   - [uuid-id]: receipt ID in URL path parameter
+//   - rulesVersion: optional query parameter; "current" explains the points
+//     the live rules give, as GET /receipts/:id/points?rulesVersion=current
+// Output:
+//   - Success: JSON {"points": number, "rules": [{"rule": name, "points": number, "item": index}]}
+//              rules that awarded no points are omitted; "item" is only set for per-item rules;
+//              the rule points add up to "points"
+//   - Error: JSON with error {"error": "receipt not found"}, 422
+//            {"error": "receipt has been voided"}, or 409 RULES_CHANGED
+func (s *Server) getPointsBreakdown(c *gin.Context) {
+    id, ok := receiptID(c)
+    if !ok {
+        return
+    }
+    record, ok := s.lookup(c, id)
+    if !ok || rejectVoided(c, record) {
         return
     }
 
-    points := calculatePoints(receipt)
-    
-    c.JSON(http.StatusOK, gin.H{"points": points})
+    contributions := pointsContributions(record.Receipt, s.cfg.Rules, s.cfg.Values)
+    total := 0
+    for _, contribution := range contributions {
+        total += contribution.Points
+    }
+    if !s.breakdownMatches(c, record, total) {
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"points": total, "rules": contributions})
 }
 
-// calculatePoints calculates total points for a receipt
-// Input: Receipt struct containing receipt details
-// Output: integer 
-func calculatePoints(receipt Receipt) int {
-    points := 0
+// getBreakdown returns the points awarded by each rule for a receipt
+// Input: 
+//   - [uuid-id]: receipt ID in URL path parameter
+//   - rulesVersion: optional query parameter, as for getPointsBreakdown
+// Output:
+//   - Success: JSON PointsBreakdown, e.g. {"retailerAlphanumeric": 6, ..., "total": 28}
+//   - Error: JSON with error {"error": "receipt not found"}, 422
+//            {"error": "receipt has been voided"}, or 409 RULES_CHANGED
+func (s *Server) getBreakdown(c *gin.Context) {
+    id, ok := receiptID(c)
+    if !ok {
+        return
+    }
+    record, ok := s.lookup(c, id)
+    if !ok || rejectVoided(c, record) {
+        return
+    }
+
+    breakdown := calculatePointsBreakdown(record.Receipt, s.cfg.Rules, s.cfg.Values)
+    if !s.breakdownMatches(c, record, breakdown.Total) {
+        return
+    }
+    c.JSON(http.StatusOK, breakdown)
+}
 
-    // Rule 1: Retailer name alphanumeric characters
-    for _, r := range receipt.Retailer {
-        if unicode.IsLetter(r) || unicode.IsDigit(r) {
-            points++
+// breakdownMatches checks that a breakdown by the live rules explains the
+// points the request asks about
+// Only the live rules can be broken down, so by default they must give the
+// stored points, which GET /receipts/:id/points returns; with
+// rulesVersion=current the live points are wanted and they always do
+// Input: request context, for the rulesVersion query parameter, the stored
+//        record and the total of the live rules' breakdown
+// Output: true, or false after a 400 for an unsupported rulesVersion or a
+//         409 RULES_CHANGED for a receipt scored by rules that gave other points
+func (s *Server) breakdownMatches(c *gin.Context, record ReceiptRecord, total int) bool {
+    switch c.Query("rulesVersion") {
+    case "current":
+        return true
+    case "":
+    default:
+        respondError(c, http.StatusBadRequest, codeInvalidParameter, "rulesVersion must be current")
+        return false
+    }
+    if total != record.Points {
+        respondError(c, http.StatusConflict, codeRulesChanged,
+            fmt.Sprintf("receipt was scored %d points by rules version %s; pass rulesVersion=current or recalculate it", record.Points, record.RulesVersion))
+        return false
+    }
+    return true
+}
+
+// pagination reads the limit, offset and page query parameters
+// Input: request context
+// Output: page size and number of receipts to skip, and true; or false
+//         after a 400 response was sent for an invalid parameter
+func pagination(c *gin.Context) (int, int, bool) {
+    limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageLimit)))
+    if err != nil || limit < 1 || limit > maxPageLimit {
+        respondError(c, http.StatusBadRequest, codeInvalidParameter, "invalid limit")
+        return 0, 0, false
+    }
+    offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+    if err != nil || offset < 0 {
+        respondError(c, http.StatusBadRequest, codeInvalidParameter, "invalid offset")
+        return 0, 0, false
+    }
+    // page is an alternative to offset, counted from 1
+    if pageParam, ok := c.GetQuery("page"); ok {
+        page, err := strconv.Atoi(pageParam)
+        if err != nil || page < 1 || c.Query("offset") != "" {
+            respondError(c, http.StatusBadRequest, codeInvalidParameter, "invalid page")
+            return 0, 0, false
         }
+        offset = (page - 1) * limit
+    }
+    return limit, offset, true
+}
+
+// summarize builds the list entry of a stored receipt
+// Input: receipt id and record
+// Output: receiptSummary with the total in dollars
+func summarize(id string, record ReceiptRecord) receiptSummary {
+    return receiptSummary{
+        ID:       id,
+        Retailer: record.Retailer,
+        Total:    float64(record.Total) / 100,
+        Points:   record.Points,
+        Voided:   record.Voided,
+    }
+}
+
+// listReceipts lists stored receipts in insertion order
+// The count comes from the statsIndex and only the receipts up to the end of
+// the page are read, O(offset + limit) store reads plus listing the ids. A
+// key that may only see some receipts has every receipt read to count them
+// Input: 
+//   - limit: optional query parameter, page size (default 20, max 100)
+//   - offset: optional query parameter, number of receipts to skip (default 0)
+//   - page: optional query parameter, 1-based page number; can't be combined with offset
+//   - includeVoided: optional query parameter, true to list voided receipts too
+// Output:
+//   - Success: JSON {"receipts": [{id, retailer, total, points}], "count": number, "limit": number, "offset": number}
+//              count is the number of receipts listed across all pages;
+//              voided receipts carry "voided": true. With
+//              ENFORCE_RECEIPT_OWNERSHIP only the key's own and unowned
+//              receipts are listed, or every receipt for an admin key
+//   - Error: JSON with error {"error": "invalid limit"}, {"error": "invalid offset"} or {"error": "invalid page"}
+func (s *Server) listReceipts(c *gin.Context) {
+    limit, offset, ok := pagination(c)
+    if !ok {
+        return
     }
+    includeVoided := c.Query("includeVoided") == "true"
+    readAll := s.mayReadAll(c)
+
+    ids, err := s.store.List(c.Request.Context())
+    if err != nil {
+        respondStoreError(c, err, "failed to list receipts")
+        return
+    }
+    summaries := []receiptSummary{}
+    matched := 0
+    for _, id := range ids {
+        if readAll && matched >= offset+limit {
+            break
+        }
+        record, exists, err := peekRecord(c.Request.Context(), s.store, id)
+        if err != nil {
+            respondStoreError(c, err, "failed to list receipts")
+            return
+        }
+        // Deleted since the ids were listed, or expired but not swept yet
+        if !exists || record.expired(s.cfg.ReceiptTTL) || (record.Voided && !includeVoided) || !s.mayRead(c, record.UserID) {
+            continue
+        }
+        if matched >= offset && matched < offset+limit {
+            summaries = append(summaries, summarize(id, record))
+        }
+        matched++
+    }
+    count := matched
+    if readAll {
+        count = s.stats.listed(includeVoided)
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "receipts": summaries,
+        "count":    count,
+        "limit":    limit,
+        "offset":   offset,
+    })
+}
 
-    // Rule 2: Round dollar amount
-    if receipt.Total == math.Trunc(receipt.Total) {
-        points += 50
+// getReceipt retrieves a stored receipt
+// Input: 
+//   - [uuid-id]: receipt ID in URL path parameter
+// Output:
+//   - Success: JSON with the stored receipt data
+//   - Error: JSON with error {"error": "receipt not found"}
+func (s *Server) getReceipt(c *gin.Context) {
+    id, ok := receiptID(c)
+    if !ok {
+        return
+    }
+    record, ok := s.lookup(c, id)
+    if !ok {
+        return
     }
 
-    // Rule 3: Multiple of 0.25
-    if math.Mod(receipt.Total, 0.25) == 0 {
-        points += 25
+    c.JSON(http.StatusOK, newReceiptResponse(record.Receipt))
+}
+
+// replaceReceipt corrects a stored receipt, e.g. a mistyped retailer or total
+// Input: 
+//   - [uuid-id]: receipt ID in URL path parameter
+//   - JSON receipt in the same format as processReceipt, validated the same
+//     way, except that a receipt keeping its stored purchase time may be
+//     older than MAX_RECEIPT_AGE_DAYS
+// Output:
+//   - Success: JSON {"id": "uuid-id"}, with "points" when points are requested
+//   - Error: JSON with error message {"error": "message"}; 404 if the id
+//            doesn't exist, since ids are only ever assigned by the server
+func (s *Server) replaceReceipt(c *gin.Context) {
+    id, ok := receiptID(c)
+    if !ok {
+        return
+    }
+    var input ReceiptInput
+    if err := s.bindJSON(c, &input); err != nil {
+        respondBindError(c, err)
+        return
+    }
+    receipt, err := parseReceipt(input, s.parseOptions(c))
+    if err != nil {
+        recordRejection(c, rejectionReason(err), err)
+        c.JSON(http.StatusBadRequest, rejectionBody(c, err))
+        return
     }
 
-    // Rule 4: 5 points per two items
-    points += (len(receipt.Items) / 2) * 5
+    unlock := s.lockForUpdate()
+    defer unlock()
+    old, ok := s.lookup(c, id)
+    if !ok {
+        return
+    }
+    if err := s.checkCorrectedPurchaseDate(receipt, old.Receipt); err != nil {
+        recordRejection(c, rejectionReason(err), err)
+        c.JSON(http.StatusUnprocessableEntity, rejectionBody(c, err))
+        return
+    }
+    if receipt.UserID, err = ownerFor(c, receipt.UserID, old.UserID); err != nil {
+        recordRejection(c, rejectionReason(err), err)
+        c.JSON(http.StatusBadRequest, rejectionBody(c, err))
+        return
+    }
+    s.respondReplaced(c, id, old, receipt, input.IncludePoints)
+}
 
-    // Rule 5: Item description length multiple of 3
-    for _, item := range receipt.Items {
-        // TrimSpace removes leading and trailing white space
-        trimmed := strings.TrimSpace(item.ShortDescription)
-        if len(trimmed)%3 == 0 {
-            points += int(math.Ceil(item.Price * 0.2))
+// indexReceipt brings the user, statistics and duplicate indexes up to
+// date with a receipt that was just stored
+// Input: receipt id and its stored record
+// Output: none
+func (s *Server) indexReceipt(id string, record ReceiptRecord) {
+    s.owners.set(id, record)
+    s.stats.set(id, record)
+    if s.dedup != nil {
+        s.dedup.set(id, record)
+    }
+}
+
+// unindexReceipt drops a receipt that was deleted or evicted from the
+// user, statistics and duplicate indexes
+// Input: receipt id
+// Output: none
+func (s *Server) unindexReceipt(id string) {
+    s.owners.delete(id)
+    s.stats.delete(id)
+    if s.dedup != nil {
+        s.dedup.delete(id)
+    }
+}
+
+// lockForUpdate is held while a stored receipt is read and rewritten, so a
+// PATCH can't overwrite a concurrent change and the indexes see changes in
+// the order the store made them
+// Input: none
+// Output: function releasing the lock
+func (s *Server) lockForUpdate() func() {
+    s.updateMu.Lock()
+    return s.updateMu.Unlock
+}
+
+// respondReplaced stores a corrected receipt over an existing one and
+// answers the request; the caller must hold lockForUpdate
+// Input: request context, receipt id, its stored record, the validated
+//        correction and whether the body asked for points
+// Output: none, sends {"id": "uuid-id"} with optional "points", or a store error
+func (s *Server) respondReplaced(c *gin.Context, id string, old ReceiptRecord, receipt Receipt, includePoints bool) {
+    // StoredAt is kept, so a correction doesn't extend the receipt's TTL
+    record := s.newRecord(receipt, old.StoredAt)
+    // A correction doesn't bring a voided receipt back
+    record.Voided = old.Voided
+    if err := s.store.Put(c.Request.Context(), id, record); err != nil {
+        respondStoreError(c, err, "failed to store receipt")
+        return
+    }
+    // The old content no longer resolves to this id in the duplicate index
+    s.indexReceipt(id, record)
+
+    response := gin.H{"id": id}
+    if includePoints || c.Query("includePoints") == "true" {
+        response["points"] = record.Points
+    }
+    c.JSON(http.StatusOK, response)
+}
+
+// deleteReceipt removes a stored receipt
+// Input: 
+//   - [uuid-id]: receipt ID in URL path parameter
+// Output:
+//   - Success: 204 with no body
+//   - Error: JSON with error {"error": "receipt not found"}
+func (s *Server) deleteReceipt(c *gin.Context) {
+    id, ok := receiptID(c)
+    if !ok {
+        return
+    }
+    // Held so the indexes see the delete in the same order as the store
+    // does relative to a concurrent PUT, PATCH or void
+    defer s.lockForUpdate()()
+    // Only the owner may delete an owned receipt, so it must be read first
+    if s.cfg.EnforceReceiptOwnership {
+        if _, ok := s.lookup(c, id); !ok {
+            return
         }
     }
+    if err := s.store.Delete(c.Request.Context(), id); err != nil {
+        if errors.Is(err, ErrNotFound) {
+            respondError(c, http.StatusNotFound, codeReceiptNotFound, "receipt not found")
+            return
+        }
+        respondStoreError(c, err, "failed to delete receipt")
+        return
+    }
+    s.unindexReceipt(id)
 
-    // Rule 6: Odd purchase day
-    if receipt.PurchaseDate.Day()%2 != 0 {
-        points += 6
+    c.Status(http.StatusNoContent)
+}
+
+// health reports that the server is running
+// Input: none
+// Output: JSON {"status": "ok", "uptime": "3h22m5s"}
+func (s *Server) health(c *gin.Context) {
+    c.JSON(http.StatusOK, gin.H{
+        "status": "ok",
+        "uptime": time.Since(startTime).Round(time.Second).String(),
+    })
+}
+
+// ready reports whether the storage layer can serve requests
+// Input: none
+// Output:
+//   - Success: JSON {"status": "ready"}
+//   - Error: 503 with JSON {"status": "not ready", "error": "message"}
+func (s *Server) ready(c *gin.Context) {
+    if s.store == nil {
+        c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "error": "store not initialized"})
+        return
+    }
+    if err := s.store.Ping(c.Request.Context()); err != nil {
+        c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "error": err.Error()})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// newReceiptResponse formats a receipt the same way it was submitted
+// Input: Receipt struct
+// Output: receiptResponse with YYYY-MM-DD dates, HH:MM times and 2-decimal amounts
+func newReceiptResponse(receipt Receipt) receiptResponse {
+    items := make([]itemResponse, len(receipt.Items))
+    for i, item := range receipt.Items {
+        items[i] = itemResponse{
+            ShortDescription: item.ShortDescription,
+            Price:            formatCents(item.Price),
+        }
+    }
+    return receiptResponse{
+        Retailer:     receipt.Retailer,
+        PurchaseDate: receipt.PurchasedAt.Format("2006-01-02"),
+        PurchaseTime: receipt.PurchasedAt.Format("15:04"),
+        Timezone:     receipt.Timezone,
+        UserID:       receipt.UserID,
+        Notes:        receipt.Notes,
+        Items:        items,
+        Total:        formatCents(receipt.Total),
     }
+}
 
-    // Rule 7: Purchase time between 2pm and 4pm
-    hour := receipt.PurchaseTime.Hour()
-    if hour >= 14 && hour < 16 {
-        points += 10
+// calculatePoints calculates total points for a receipt
+// Input: Receipt struct containing receipt details, the rules to apply and
+//        the points each rule awards
+// Output: integer 
+func calculatePoints(receipt Receipt, rules PointsRuleConfig, values PointsValues) int {
+    total := 0
+    for _, rule := range buildRules(rules, values) {
+        points, _ := rule.Apply(receipt)
+        total += points
     }
+    return total
+}
 
-    return points
-}
\ No newline at end of file
+// calculatePointsBreakdown applies each enabled rule to a receipt
+// Input: Receipt struct containing receipt details, the rules to apply and
+//        the points each rule awards
+// Output: PointsBreakdown with the points awarded by each rule and their total;
+//         disabled rules award 0
+func calculatePointsBreakdown(receipt Receipt, rules PointsRuleConfig, values PointsValues) PointsBreakdown {
+    var breakdown PointsBreakdown
+    for _, rule := range buildRules(rules, values) {
+        points, _ := rule.Apply(receipt)
+        breakdown.Total += points
+        switch rule.Name() {
+        case ruleRetailerAlphanumeric:
+            breakdown.RetailerAlphanumeric = points
+        case ruleRoundDollar:
+            breakdown.RoundDollar = points
+        case ruleQuarterMultiple:
+            breakdown.QuarterMultiple = points
+        case ruleItemPairs:
+            breakdown.ItemPairBonus = points
+        case ruleItemDescription:
+            breakdown.ItemDescriptionBonus = points
+        case ruleOddDay:
+            breakdown.OddDay = points
+        case ruleAfternoon:
+            breakdown.AfternoonWindow = points
+        case ruleWeekend:
+            breakdown.WeekendBonus = points
+        case ruleLargePurchase:
+            breakdown.LargePurchaseBonus = points
+        case ruleTotalOverTen:
+            breakdown.TotalOverTenBonus = points
+        default:
+            // Registered rules have no field of their own
+            if breakdown.Other == nil {
+                breakdown.Other = make(map[string]int)
+            }
+            breakdown.Other[rule.Name()] += points
+        }
+    }
+    return breakdown
+}
+
+// pointsContributions lists the rules that awarded points to a receipt
+// Input: Receipt struct containing receipt details, the rules to apply and
+//        the points each rule awards
+// Output: one ruleContribution per rule that awarded points, in rule order;
+//         per-item rules such as Rule 5 yield one entry per matching item
+func pointsContributions(receipt Receipt, rules PointsRuleConfig, values PointsValues) []ruleContribution {
+    contributions := []ruleContribution{}
+    for _, rule := range buildRules(rules, values) {
+        if perItem, ok := rule.(itemRule); ok {
+            for i, points := range perItem.ApplyItems(receipt) {
+                if points > 0 {
+                    index := i
+                    contributions = append(contributions, ruleContribution{
+                        Rule:   rule.Name(),
+                        Points: points,
+                        Item:   &index,
+                    })
+                }
+            }
+            continue
+        }
+        if points, detail := rule.Apply(receipt); points > 0 {
+            contributions = append(contributions, ruleContribution{Rule: rule.Name(), Points: points, Detail: detail})
+        }
+    }
+    return contributions
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+    "context"
+    "math"
+    "strconv"
+    "sync/atomic"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics exposed at GET /metrics
+var (
+    httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "http_requests_total",
+        Help: "Number of HTTP requests by method, route and status code.",
+    }, []string{"method", "route", "code"})
+    httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "http_request_duration_seconds",
+        Help:    "Latency of HTTP requests by method and route.",
+        Buckets: prometheus.DefBuckets,
+    }, []string{"method", "route"})
+    processTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "receipt_process_total",
+        Help: "Number of POST /receipts/process requests by status code.",
+    }, []string{"code"})
+    processDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+        Name:    "receipt_process_duration_seconds",
+        Help:    "Latency of POST /receipts/process requests.",
+        Buckets: prometheus.DefBuckets,
+    })
+    pointsGetTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "receipt_points_get_total",
+        Help: "Number of GET /receipts/:id/points requests by status code.",
+    }, []string{"code"})
+    pointsGetDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+        Name:    "receipt_points_get_duration_seconds",
+        Help:    "Latency of GET /receipts/:id/points requests.",
+        Buckets: prometheus.DefBuckets,
+    })
+    pointsCalculated = promauto.NewHistogram(prometheus.HistogramOpts{
+        Name:    "receipt_points_calculated",
+        Help:    "Distribution of points awarded to processed receipts.",
+        Buckets: []float64{10, 25, 50, 75, 100, 150, 200, 300, 500},
+    })
+    receiptsProcessed = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "receipts_processed_total",
+        Help: "Number of receipts validated and stored by any process endpoint.",
+    })
+    receiptsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "receipts_rejected_total",
+        Help: "Number of receipts rejected by validation, by reason.",
+    }, []string{"reason"})
+    receiptsDuplicate = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "receipts_duplicate_total",
+        Help: "Number of submitted receipts matching one already stored, answered with the existing id.",
+    })
+    receiptsEvicted = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "receipts_evicted_total",
+        Help: "Number of receipts evicted from the memory store by the -max-receipts cap.",
+    })
+)
+
+// storedStore holds the store the receipts_stored gauge counts, as a storeRef
+var storedStore atomic.Value
+
+// storeRef wraps a Store, since atomic.Value needs one concrete type
+type storeRef struct {
+    Store
+}
+
+// receiptsStored reports the number of receipts held by the store set by
+// registerStoreMetrics, or NaN before one is set or while it can't be counted
+var receiptsStored = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+    Name: "receipts_stored",
+    Help: "Number of receipts currently stored.",
+}, func() float64 {
+    ref, ok := storedStore.Load().(storeRef)
+    if !ok {
+        return math.NaN()
+    }
+    n, err := ref.Count(context.Background())
+    if err != nil {
+        return math.NaN()
+    }
+    return float64(n)
+})
+
+// registerStoreMetrics points the receipts_stored gauge at a store
+// Input: the store the server uses
+// Output: none, the gauge is registered once, so calling this again only
+//         swaps the store it counts
+func registerStoreMetrics(store Store) {
+    storedStore.Store(storeRef{store})
+}
+
+// metricsMiddleware records request counts and latency for every route,
+// plus dedicated series for the process and points endpoints
+// Input: none
+// Output: gin middleware that observes the request after the handler ran
+func metricsMiddleware() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        start := time.Now()
+        c.Next()
+
+        code := strconv.Itoa(c.Writer.Status())
+        elapsed := time.Since(start).Seconds()
+        // FullPath is the route pattern, so every receipt id maps to one series
+        route := c.FullPath()
+        if route == "" {
+            // unknown paths share one series instead of one per path
+            route = "unmatched"
+        }
+        httpRequestsTotal.WithLabelValues(c.Request.Method, route, code).Inc()
+        httpRequestDuration.WithLabelValues(c.Request.Method, route).Observe(elapsed)
+
+        switch c.Request.Method + " " + route {
+        case "POST /receipts/process":
+            processTotal.WithLabelValues(code).Inc()
+            processDuration.Observe(elapsed)
+        case "GET /receipts/:id/points":
+            pointsGetTotal.WithLabelValues(code).Inc()
+            pointsGetDuration.Observe(elapsed)
+        }
+    }
+}
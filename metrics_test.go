@@ -0,0 +1,65 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+
+    "github.com/gin-gonic/gin"
+)
+
+// scrape reads /metrics into a map from each sample, e.g.
+// `receipt_process_total{code="200"}`, to its value
+func scrape(t *testing.T, router *gin.Engine) map[string]float64 {
+    t.Helper()
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+    samples := map[string]float64{}
+    for _, line := range strings.Split(w.Body.String(), "\n") {
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        i := strings.LastIndexByte(line, ' ')
+        value, err := strconv.ParseFloat(line[i+1:], 64)
+        if err != nil {
+            t.Fatalf("metrics line %q: %v", line, err)
+        }
+        samples[line[:i]] = value
+    }
+    return samples
+}
+
+func TestRequestMetrics(t *testing.T) {
+    router := newTestRouter(t)
+    before := scrape(t, router)
+
+    _, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt))
+    serve(t, router, http.MethodGet, "/receipts/"+body["id"].(string)+"/points", "")
+    serve(t, router, http.MethodGet, "/receipts/"+body["id"].(string)+"/points", "")
+    serve(t, router, http.MethodGet, "/receipts/00000000-0000-0000-0000-000000000000/points", "")
+    invalid := exampleReceipt
+    invalid.Total = "35"
+    serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, invalid))
+
+    after := scrape(t, router)
+    // Counters are labelled by status code, and each request is timed
+    want := map[string]float64{
+        `receipt_process_total{code="200"}`:         1,
+        `receipt_process_total{code="400"}`:         1,
+        `receipt_process_duration_seconds_count`:    2,
+        `receipt_points_get_total{code="200"}`:      2,
+        `receipt_points_get_total{code="404"}`:      1,
+        `receipt_points_get_duration_seconds_count`: 3,
+        `receipt_points_calculated_count`:           1,
+        `receipt_points_calculated_sum`:             28,
+        `receipt_points_calculated_bucket{le="25"}`: 0,
+        `receipt_points_calculated_bucket{le="50"}`: 1,
+    }
+    for sample, delta := range want {
+        if got := after[sample] - before[sample]; got != delta {
+            t.Errorf("%s went up by %v, want %v", sample, got, delta)
+        }
+    }
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "mime"
+    "net/http"
+    "runtime/debug"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+)
+
+// requestIDHeader is the request and response header carrying the request id
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds client supplied request ids
+const maxRequestIDLength = 128
+
+// requestLogger assigns every request an id and logs it as one JSON line
+// Input: none, logs through slog.Default()
+// Output: gin middleware that sets "requestId" in the context and the
+//         X-Request-Id response header, then logs method, path, status,
+//         duration in milliseconds, client IP and request id once the
+//         request completes
+//         A valid X-Request-Id sent by the client is reused, so ids can be
+//         followed across services
+func requestLogger() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        start := time.Now()
+        requestID := c.GetHeader(requestIDHeader)
+        if !validRequestID(requestID) {
+            requestID = uuid.New().String()
+        }
+        c.Set("requestId", requestID)
+        c.Header(requestIDHeader, requestID)
+
+        c.Next()
+
+        slog.Info("request",
+            "method", c.Request.Method,
+            "path", c.Request.URL.Path,
+            "status", c.Writer.Status(),
+            "durationMs", float64(time.Since(start).Microseconds())/1000,
+            "clientIp", c.ClientIP(),
+            "requestId", requestID,
+        )
+    }
+}
+
+// validRequestID reports whether a client supplied request id can be reused
+// Input: X-Request-Id header value
+// Output: true if it is non-empty, at most maxRequestIDLength long and only
+//         contains printable ASCII, so it can't forge log lines or headers
+func validRequestID(id string) bool {
+    if id == "" || len(id) > maxRequestIDLength {
+        return false
+    }
+    for i := 0; i < len(id); i++ {
+        if id[i] < 0x21 || id[i] > 0x7e {
+            return false
+        }
+    }
+    return true
+}
+
+// corsMiddleware adds CORS headers for allowed origins and answers preflights
+// Input: comma-separated allowed origins ("*" allows any), comma-separated
+//        allowed methods, and whether credentials are allowed; credentials
+//        are never allowed with "*", since every website could send them
+// Output: gin middleware; requests from other origins get no CORS headers,
+//         so the browser blocks them, and OPTIONS preflights end with 204
+func corsMiddleware(allowedOrigins, allowedMethods string, allowCredentials bool) gin.HandlerFunc {
+    origins := make(map[string]bool)
+    anyOrigin := false
+    for _, origin := range strings.Split(allowedOrigins, ",") {
+        origin = strings.TrimSpace(origin)
+        if origin == "*" {
+            anyOrigin = true
+        }
+        origins[origin] = true
+    }
+    methods := strings.ReplaceAll(allowedMethods, " ", "")
+
+    return func(c *gin.Context) {
+        origin := c.GetHeader("Origin")
+        if origin == "" {
+            c.Next()
+            return
+        }
+        c.Header("Vary", "Origin")
+        if !anyOrigin && !origins[origin] {
+            c.Next()
+            return
+        }
+
+        if anyOrigin {
+            c.Header("Access-Control-Allow-Origin", "*")
+        } else {
+            c.Header("Access-Control-Allow-Origin", origin)
+            if allowCredentials {
+                c.Header("Access-Control-Allow-Credentials", "true")
+            }
+        }
+        c.Header("Access-Control-Expose-Headers", requestIDHeader+", Retry-After")
+
+        if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+            c.Header("Access-Control-Allow-Methods", methods)
+            c.Header("Access-Control-Allow-Headers", "Content-Type, "+apiKeyHeader+", "+idempotencyKeyHeader+", "+requestIDHeader)
+            c.Header("Access-Control-Max-Age", "600")
+            c.AbortWithStatus(http.StatusNoContent)
+            return
+        }
+        c.Next()
+    }
+}
+
+// recoveryMiddleware turns a panicking handler into a JSON 500 response
+// Input: none, logs through slog.Default()
+// Output: gin middleware that logs the panic value and stack trace and answers
+//         an INTERNAL_ERROR error with "requestId": "..."
+func recoveryMiddleware() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        defer func() {
+            recovered := recover()
+            if recovered == nil {
+                return
+            }
+            // net/http uses this panic to abort a response on purpose
+            if recovered == http.ErrAbortHandler {
+                panic(recovered)
+            }
+            requestID := c.GetString("requestId")
+            slog.Error("panic recovered",
+                "panic", fmt.Sprint(recovered),
+                "stack", string(debug.Stack()),
+                "path", c.Request.URL.Path,
+                "requestId", requestID,
+            )
+            body := errorBody(c, codeInternalError, "internal server error", "")
+            body["requestId"] = requestID
+            c.AbortWithStatusJSON(http.StatusInternalServerError, body)
+        }()
+        c.Next()
+    }
+}
+
+// bodyLimit caps how much of a request body handlers can read
+// Input: maximum body size in bytes
+// Output: gin middleware; reading past the limit fails with *http.MaxBytesError,
+//         which handlers turn into a 413
+func bodyLimit(maxBytes int64) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+        c.Next()
+    }
+}
+
+// requestTimeout bounds how long a request may take
+// The request context gets the deadline, so store calls made with it give
+// up once it passes
+// Input: timeout, and the route paths exempt from it, such as exports that
+//        stream for as long as the store takes to read
+// Output: gin middleware answering 503 REQUEST_TIMEOUT if the context ended
+//         before the handler sent a response
+func requestTimeout(timeout time.Duration, exempt ...string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if slices.Contains(exempt, c.FullPath()) {
+            c.Next()
+            return
+        }
+        ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+        defer cancel()
+        c.Request = c.Request.WithContext(ctx)
+        c.Next()
+        if ctx.Err() != nil && !c.Writer.Written() {
+            respondError(c, http.StatusServiceUnavailable, codeRequestTimeout, "request timeout")
+        }
+    }
+}
+
+// contextError reports whether err comes from a cancelled or expired context
+// Input: error from a store call
+// Output: true for context.Canceled and context.DeadlineExceeded
+func contextError(err error) bool {
+    return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// requireJSON rejects request bodies that aren't declared as JSON
+// Requests without a body, such as POST /receipts/:id/recalculate, pass
+// Input: none
+// Output: gin middleware answering 415 UNSUPPORTED_MEDIA_TYPE unless the
+//         Content-Type is application/json, optionally with charset=utf-8
+func requireJSON() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if c.Request.ContentLength == 0 {
+            c.Next()
+            return
+        }
+        mediaType, params, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+        // JSON is always UTF-8 (RFC 8259), so no other charset makes sense
+        charset, hasCharset := params["charset"]
+        if err != nil || mediaType != "application/json" || (hasCharset && !strings.EqualFold(charset, "utf-8")) {
+            respondError(c, http.StatusUnsupportedMediaType, codeUnsupportedMediaType,
+                "Content-Type must be application/json, got "+strconv.Quote(c.GetHeader("Content-Type")))
+            return
+        }
+        c.Next()
+    }
+}
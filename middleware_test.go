@@ -0,0 +1,148 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/gin-gonic/gin"
+)
+
+// sendFrom sends a request with an Origin header and optional extra headers
+// Input: router, method, path, origin (empty for none) and header pairs
+// Output: the recorded response
+func sendFrom(router http.Handler, method, path, origin string, headers ...string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(method, path, nil)
+    if origin != "" {
+        req.Header.Set("Origin", origin)
+    }
+    for i := 0; i+1 < len(headers); i += 2 {
+        req.Header.Set(headers[i], headers[i+1])
+    }
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, req)
+    return w
+}
+
+func TestCORSPreflight(t *testing.T) {
+    preflight := func(router http.Handler, origin string) *httptest.ResponseRecorder {
+        return sendFrom(router, http.MethodOptions, "/receipts/process", origin,
+            "Access-Control-Request-Method", http.MethodPost,
+            "Access-Control-Request-Headers", "Content-Type, X-API-Key")
+    }
+
+    // By default any origin may call, without credentials
+    w := preflight(newTestRouter(t), "https://app.example.com")
+    if w.Code != http.StatusNoContent {
+        t.Fatalf("preflight returned %d, want 204", w.Code)
+    }
+    want := map[string]string{
+        "Access-Control-Allow-Origin":  "*",
+        "Access-Control-Allow-Methods": defaultConfig().CORSAllowedMethods,
+        "Access-Control-Max-Age":       "600",
+        "Vary":                         "Origin",
+    }
+    for header, value := range want {
+        if got := w.Header().Get(header); got != value {
+            t.Errorf("preflight %s = %q, want %q", header, got, value)
+        }
+    }
+    if got := w.Header().Get("Access-Control-Allow-Headers"); got == "" {
+        t.Error("preflight lists no allowed headers")
+    }
+    if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+        t.Errorf("preflight allows credentials %q by default", got)
+    }
+
+    // With a list of origins and credentials, the origin is echoed
+    cfg := defaultConfig()
+    cfg.CORSAllowedOrigins = "https://app.example.com, https://admin.example.com"
+    cfg.CORSAllowedMethods = "GET, POST"
+    cfg.CORSAllowCredentials = true
+    router := newTestRouterWith(t, cfg)
+    w = preflight(router, "https://admin.example.com")
+    if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://admin.example.com" ||
+        w.Header().Get("Access-Control-Allow-Credentials") != "true" || w.Header().Get("Access-Control-Allow-Methods") != "GET,POST" {
+        t.Errorf("preflight from a listed origin returned %d %v", w.Code, w.Header())
+    }
+    // An unlisted origin gets no CORS headers, so the browser blocks it
+    w = preflight(router, "https://evil.example.com")
+    if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+        t.Errorf("preflight from an unlisted origin allowed %q", got)
+    }
+}
+
+func TestCORSAnyOriginWithoutCredentials(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.CORSAllowCredentials = true
+    // the configuration is refused at startup
+    if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "cors allow credentials") {
+        t.Errorf("validate() = %v, want credentials with any origin refused", err)
+    }
+    // and a router built without validating never echoes an origin with
+    // credentials
+    w := sendFrom(newTestRouterWith(t, cfg), http.MethodOptions, "/receipts/process", "https://evil.example.com",
+        "Access-Control-Request-Method", http.MethodPost)
+    if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+        t.Errorf("preflight with any origin and credentials returned %v, want * without credentials", w.Header())
+    }
+}
+
+func TestCORSCrossOriginGet(t *testing.T) {
+    router := newTestRouter(t)
+    _, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt))
+    path := "/receipts/" + body["id"].(string) + "/points"
+
+    w := sendFrom(router, http.MethodGet, path, "https://app.example.com")
+    if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+        t.Fatalf("cross-origin GET returned %d with Access-Control-Allow-Origin %q", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+    }
+    // the request id and Retry-After can be read by scripts
+    if got := w.Header().Get("Access-Control-Expose-Headers"); got != requestIDHeader+", Retry-After" {
+        t.Errorf("Access-Control-Expose-Headers = %q", got)
+    }
+    var points map[string]any
+    if err := json.Unmarshal(w.Body.Bytes(), &points); err != nil || points["points"] != 28.0 {
+        t.Errorf("cross-origin GET body %q, want the receipt's 28 points", w.Body.String())
+    }
+
+    // Same-origin requests carry no Origin and get no CORS headers
+    w = sendFrom(router, http.MethodGet, path, "")
+    if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+        t.Errorf("GET without an Origin returned %d with %v", w.Code, w.Header())
+    }
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+    for _, legacy := range []bool{false, true} {
+        gin.SetMode(gin.TestMode)
+        router := gin.New()
+        router.Use(errorFormat(legacy), requestLogger(), recoveryMiddleware())
+        router.GET("/panic", func(*gin.Context) { panic("handler bug") })
+
+        w := sendFrom(router, http.MethodGet, "/panic", "", requestIDHeader, "trace-123")
+        if w.Code != http.StatusInternalServerError {
+            t.Fatalf("legacy %v: panicking handler returned %d, want 500", legacy, w.Code)
+        }
+        if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+            t.Errorf("legacy %v: Content-Type %q, want JSON", legacy, ct)
+        }
+        var body map[string]any
+        if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+            t.Fatalf("legacy %v: body %q is not JSON", legacy, w.Body.String())
+        }
+        // the response names the request so it can be found in the logs
+        if body["requestId"] != "trace-123" || w.Header().Get(requestIDHeader) != "trace-123" {
+            t.Errorf("legacy %v: body %v and header %q, want request id trace-123", legacy, body, w.Header().Get(requestIDHeader))
+        }
+        detail := errorDetail(body)
+        if legacy {
+            detail = map[string]any{"code": body["code"], "message": body["error"]}
+        }
+        if detail["code"] != codeInternalError || detail["message"] != "internal server error" {
+            t.Errorf("legacy %v: body %v, want %s internal server error", legacy, body, codeInternalError)
+        }
+    }
+}
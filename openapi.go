@@ -0,0 +1,708 @@
+package main
+
+import (
+    "net/http"
+    "reflect"
+    "strconv"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+)
+
+// exampleReceipt is the request example published in the OpenAPI document;
+// it earns 28 points under the default rules
+var exampleReceipt = ReceiptInput{
+    Retailer:     "Target",
+    PurchaseDate: "2022-01-01",
+    PurchaseTime: "13:01",
+    Items: []ItemInput{
+        {ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+        {ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+        {ShortDescription: "Knorr Creamy Chicken", Price: "1.26"},
+        {ShortDescription: "Doritos Nacho Cheese", Price: "3.35"},
+        {ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+    },
+    Total: "35.35",
+}
+
+// serveOpenAPI answers GET /openapi.json
+// Input: server configuration, for the limits described in the document
+// Output: gin handler returning the OpenAPI 3 document, built once
+func serveOpenAPI(cfg Config) gin.HandlerFunc {
+    spec := openAPISpec(cfg)
+    return func(c *gin.Context) {
+        c.JSON(http.StatusOK, spec)
+    }
+}
+
+// docsPage is the Swagger UI page served at GET /docs; the UI itself is
+// loaded from a CDN, so the page needs internet access in the browser
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Receipt Processor API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
+
+// serveDocs answers GET /docs with an interactive view of /openapi.json
+// Input: none
+// Output: HTML page rendering the OpenAPI document with Swagger UI
+func serveDocs(c *gin.Context) {
+    c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(docsPage))
+}
+
+// openAPISpec builds the OpenAPI 3 document describing the API
+// Request and response schemas are derived from the structs the handlers
+// encode and decode, and field patterns from the validation regexps, so
+// the document follows the code
+// Input: server configuration
+// Output: the document as nested maps, ready to encode as JSON
+func openAPISpec(cfg Config) gin.H {
+    item := schemaFor(reflect.TypeOf(ItemInput{}))
+    item["required"] = []string{"shortDescription", "price"}
+    setPattern(item, "shortDescription", descriptionPattern.String())
+    item["properties"].(gin.H)["price"] = amountSchema()
+
+    receipt := schemaFor(reflect.TypeOf(ReceiptInput{}))
+    receipt["required"] = []string{"retailer", "items", "total"}
+    // purchaseDateTime may stand in for purchaseDate and purchaseTime
+    receipt["anyOf"] = []gin.H{
+        {"required": []string{"purchaseDate", "purchaseTime"}},
+        {"required": []string{"purchaseDateTime"}},
+    }
+    receipt["example"] = exampleReceipt
+    props := receipt["properties"].(gin.H)
+    setPattern(receipt, "retailer", retailerPattern.String())
+    setPattern(receipt, "userId", userIDPattern.String())
+    props["total"] = amountSchema()
+    props["purchaseDate"].(gin.H)["format"] = "date"
+    props["purchaseTime"].(gin.H)["pattern"] = `^\d{2}:\d{2}$`
+    props["purchaseDateTime"].(gin.H)["format"] = "date-time"
+    props["notes"].(gin.H)["maxLength"] = maxNotesLength
+    props["items"] = gin.H{"type": "array", "items": ref("Item"), "minItems": 1, "maxItems": cfg.MaxItems}
+
+    // Same fields as Receipt, all optional
+    // A skipped receipt of an import, in the configured error layout
+    importError := newRejectionBody(!cfg.LegacyErrors, &validationError{
+        field: "purchaseDate", reason: "invalid_purchase_date", message: "invalid purchaseDate format",
+    })
+    importError["index"] = 2
+    importError["status"] = http.StatusBadRequest
+    patch := gin.H{
+        "type": "object",
+        "properties": gin.H{
+            "retailer":      props["retailer"],
+            "purchaseDate":  props["purchaseDate"],
+            "purchaseTime":  props["purchaseTime"],
+            "purchaseDateTime": props["purchaseDateTime"],
+            "timezone":      props["timezone"],
+            "notes":         props["notes"],
+            "items":         props["items"],
+            "total":         props["total"],
+            "includePoints": props["includePoints"],
+        },
+        "example": gin.H{"retailer": "Target"},
+    }
+
+    schemas := gin.H{
+        "Item":             item,
+        "Receipt":          receipt,
+        "ReceiptResponse":  schemaFor(reflect.TypeOf(receiptResponse{})),
+        "ReceiptPatch":     patch,
+        "ImportRequest": gin.H{
+            "type":     "object",
+            "required": []string{"receipts"},
+            "properties": gin.H{
+                "receipts": gin.H{
+                    "type":     "array",
+                    "maxItems": maxImportSize,
+                    // A receipt with an optional id to keep
+                    "items": gin.H{"allOf": []gin.H{
+                        ref("Receipt"),
+                        {"type": "object", "properties": gin.H{"id": gin.H{"type": "string", "format": "uuid"}}},
+                    }},
+                },
+            },
+        },
+        "ImportResult": gin.H{
+            "type":     "object",
+            "required": []string{"imported", "skipped", "errors"},
+            "properties": gin.H{
+                "imported": gin.H{"type": "integer"},
+                "skipped":  gin.H{"type": "integer"},
+                "errors":   gin.H{"type": "array", "items": gin.H{"type": "object"}},
+            },
+            "example": gin.H{"imported": 5, "skipped": 1, "errors": []gin.H{importError}},
+        },
+        "ReceiptSummary":   schemaFor(reflect.TypeOf(receiptSummary{})),
+        "PointsBreakdown":  schemaFor(reflect.TypeOf(PointsBreakdown{})),
+        "RuleContribution": schemaFor(reflect.TypeOf(ruleContribution{})),
+        "LedgerEntry": gin.H{
+            "type": "object",
+            "properties": gin.H{
+                "type":    gin.H{"type": "string", "enum": []string{"earn", "redeem"}},
+                "id":      gin.H{"type": "string", "description": "Receipt id for earn, redemption id for redeem"},
+                "points":  gin.H{"type": "integer", "description": "Negative for redeem"},
+                "reason":  gin.H{"type": "string"},
+                "at":      gin.H{"type": "string", "format": "date-time"},
+                "balance": gin.H{"type": "integer", "description": "Balance after the entry"},
+            },
+        },
+        "ProcessReceiptResponse": gin.H{
+            "type": "object",
+            "properties": gin.H{
+                "id":        gin.H{"type": "string", "format": "uuid"},
+                "points":    gin.H{"type": "integer"},
+                "duplicate": gin.H{"type": "boolean"},
+                "breakdown": ref("PointsBreakdown"),
+            },
+        },
+        "GetPointsResponse": gin.H{
+            "type":     "object",
+            "required": []string{"points"},
+            "properties": gin.H{
+                "points":       gin.H{"type": "integer"},
+                "rulesVersion": gin.H{"type": "string"},
+            },
+            "example": gin.H{"points": 28, "rulesVersion": "4cf6e4335ac1"},
+        },
+        "ValidationResult": gin.H{
+            "type":     "object",
+            "required": []string{"valid"},
+            "properties": gin.H{
+                "valid":  gin.H{"type": "boolean"},
+                "errors": gin.H{"type": "array", "items": schemaFor(reflect.TypeOf(fieldError{}))},
+            },
+            "example": gin.H{"valid": false, "errors": []fieldError{{Field: "total", Code: "INVALID_TOTAL", Message: "invalid total"}}},
+        },
+        "Error": errorSchema(cfg.LegacyErrors),
+    }
+
+    idParam := gin.H{"name": "id", "in": "path", "required": true, "schema": gin.H{"type": "string"}}
+    userParam := gin.H{"name": "id", "in": "path", "required": true, "schema": gin.H{"type": "string", "pattern": userIDPattern.String()}}
+    receiptBody := gin.H{"required": true, "content": jsonContent(ref("Receipt"))}
+    receiptsBody := gin.H{"required": true, "content": jsonContent(gin.H{"type": "array", "items": ref("Receipt")})}
+    batchResults := jsonContent(gin.H{"type": "array", "items": gin.H{"type": "object"}})
+    notFound := response("Receipt not found", ref("Error"))
+    voided := response("The receipt has been voided", ref("Error"))
+    rulesChanged := response("The receipt was scored by rules that gave other points; pass rulesVersion=current or recalculate it", ref("Error"))
+    breakdownVersion := queryParam("rulesVersion", "string", "current to break down the points the live rules give instead of the stored points")
+    receiptPage := gin.H{
+        "type": "object",
+        "properties": gin.H{
+            "receipts": gin.H{"type": "array", "items": ref("ReceiptSummary")},
+            "count":    gin.H{"type": "integer"},
+            "limit":    gin.H{"type": "integer"},
+            "offset":   gin.H{"type": "integer"},
+        },
+    }
+    recalculateAll := gin.H{
+        "summary": "Rescore every stored receipt with the current rules",
+        "responses": gin.H{
+            "200": response("Counts of rescored receipts", gin.H{
+                "type": "object",
+                "properties": gin.H{
+                    "recalculated": gin.H{"type": "integer"},
+                    "changed":      gin.H{"type": "integer"},
+                    "failed":       gin.H{"type": "integer"},
+                },
+            }),
+        },
+    }
+
+    paths := gin.H{
+        "/receipts/process": gin.H{"post": gin.H{
+            "summary": "Submit a receipt for processing",
+            "parameters": []gin.H{
+                queryParam("includePoints", "boolean", "Return the points with the id"),
+                queryParam("strict", "boolean", "Reject the receipt if the total doesn't equal the item sum"),
+                queryParam("dryRun", "boolean", "Validate and score the receipt without storing it"),
+                {"name": idempotencyKeyHeader, "in": "header", "schema": gin.H{"type": "string"}},
+            },
+            "requestBody": receiptBody,
+            "responses": gin.H{
+                "200": gin.H{
+                    "description": "Receipt stored, or scored for a dry run",
+                    "content":     gin.H{"application/json": gin.H{"schema": ref("ProcessReceiptResponse"), "example": gin.H{"id": "7fb1377b-b223-49d9-a31a-5a02701dd310"}}},
+                },
+                "400": response("The receipt is invalid", ref("Error")),
+                "409": response("Idempotency-Key reused with a different body or flags", ref("Error")),
+                "413": response("Request body too large", ref("Error")),
+                "422": response("purchaseDate out of acceptable range", ref("Error")),
+            },
+        }},
+        "/receipts/process/bulk": gin.H{"post": gin.H{
+            "summary":     "Submit several receipts, each validated and stored on its own",
+            "requestBody": receiptsBody,
+            "responses": gin.H{
+                "200": gin.H{"description": "One result per receipt, in request order", "content": batchResults},
+                "400": response("The body is not a JSON array", ref("Error")),
+            },
+        }},
+        "/receipts/batch": gin.H{"post": gin.H{
+            "summary":     "Submit several receipts, storing all valid ones together",
+            "description": "At most " + strconv.Itoa(cfg.MaxBatchSize) + " receipts per request.",
+            "requestBody": receiptsBody,
+            "responses": gin.H{
+                "200": gin.H{"description": "One result per receipt, with its index", "content": batchResults},
+                "400": response("The body is not a JSON array or the batch is too large", ref("Error")),
+            },
+        }},
+        "/receipts/export": gin.H{"get": gin.H{
+            "summary":     "Download every stored receipt",
+            "description": "Streamed as an attachment named receipts-export-YYYY-MM-DD.json, in the format POST /receipts/import accepts.",
+            "responses": gin.H{
+                "200": response("Every stored receipt with its id", gin.H{
+                    "type": "object",
+                    "properties": gin.H{
+                        "exportedAt": gin.H{"type": "string", "format": "date-time"},
+                        "receipts": gin.H{"type": "array", "items": gin.H{"allOf": []gin.H{
+                            ref("Receipt"),
+                            {"type": "object", "properties": gin.H{"id": gin.H{"type": "string", "format": "uuid"}}},
+                        }}},
+                        "count": gin.H{"type": "integer"},
+                    },
+                }),
+            },
+        }},
+        "/receipts/export.csv": gin.H{"get": gin.H{
+            "summary":     "Download every stored receipt as a spreadsheet",
+            "description": "Streamed as an attachment named receipts.csv, with columns id, retailer, purchaseDate, purchaseTime, total, itemCount and points.",
+            "responses": gin.H{
+                "200": gin.H{"description": "One row per receipt after a header row", "content": gin.H{"text/csv": gin.H{"schema": gin.H{"type": "string"}}}},
+            },
+        }},
+        "/receipts/import": gin.H{"post": gin.H{
+            "summary":     "Import receipts exported from another system",
+            "description": "At most " + strconv.Itoa(maxImportSize) + " receipts per request. A receipt keeps its id when given one; receipts that are invalid, in the future, duplicates or whose id is taken are skipped. The imported receipts are stored together.",
+            "requestBody": gin.H{"required": true, "content": jsonContent(ref("ImportRequest"))},
+            "responses": gin.H{
+                "200": response("How many receipts were imported and why the others were skipped", ref("ImportResult")),
+                "400": response("The body is invalid or has too many receipts", ref("Error")),
+            },
+        }},
+        "/receipts": gin.H{"get": gin.H{
+            "summary": "List stored receipts in insertion order",
+            "parameters": []gin.H{
+                queryParam("limit", "integer", "Page size, 1 to 100, default 20"),
+                queryParam("offset", "integer", "Number of receipts to skip"),
+                queryParam("page", "integer", "1-based page number; can't be combined with offset"),
+                queryParam("includeVoided", "boolean", "List voided receipts too"),
+            },
+            "responses": gin.H{
+                "200": response("A page of receipts", receiptPage),
+                "400": response("Invalid paging parameters", ref("Error")),
+            },
+        }},
+        "/receipts/validate": gin.H{"post": gin.H{
+            "summary": "Check a receipt without storing it, reporting every problem",
+            "parameters": []gin.H{
+                queryParam("strict", "boolean", "Reject the receipt if the total doesn't equal the item sum"),
+            },
+            "requestBody": receiptBody,
+            "responses": gin.H{
+                "200": response("The receipt would be accepted", ref("ValidationResult")),
+                "400": response("The receipt is invalid", ref("ValidationResult")),
+                "413": response("Request body too large", ref("Error")),
+                "422": response("purchaseDate out of acceptable range", ref("ValidationResult")),
+            },
+        }},
+        "/receipts/search": gin.H{"get": gin.H{
+            "summary": "List stored receipts matching all given filters",
+            "parameters": []gin.H{
+                queryParam("retailer", "string", "Case-insensitive substring of the retailer name"),
+                queryParam("from", "string", "Earliest purchase date, YYYY-MM-DD, inclusive"),
+                queryParam("to", "string", "Latest purchase date, YYYY-MM-DD, inclusive"),
+                queryParam("minTotal", "string", "Smallest total in dollars, inclusive"),
+                queryParam("maxTotal", "string", "Largest total in dollars, inclusive"),
+                queryParam("limit", "integer", "Page size, 1 to 100, default 20"),
+                queryParam("offset", "integer", "Number of matching receipts to skip"),
+                queryParam("page", "integer", "1-based page number; can't be combined with offset"),
+            },
+            "responses": gin.H{
+                "200": response("A page of matching receipts", receiptPage),
+                "400": response("Invalid filter or paging parameter", ref("Error")),
+            },
+        }},
+        "/receipts/stats": gin.H{"get": gin.H{
+            "summary": "Aggregate statistics over the stored receipts",
+            "parameters": []gin.H{
+                queryParam("top", "integer", "How many retailers to list, 1 to 100, default 5"),
+            },
+            "responses": gin.H{
+                "200": response("Receipt and points statistics", schemaFor(reflect.TypeOf(receiptStats{}))),
+                "400": response("Invalid top", ref("Error")),
+            },
+        }},
+        "/receipts/{id}": gin.H{
+            "get": gin.H{
+                "summary":    "Get a stored receipt",
+                "parameters": []gin.H{idParam},
+                "responses":  gin.H{"200": response("The receipt", ref("ReceiptResponse")), "404": notFound},
+            },
+            "put": gin.H{
+                "summary": "Replace a stored receipt with a corrected one",
+                "parameters": []gin.H{
+                    idParam,
+                    queryParam("includePoints", "boolean", "Return the new points with the id"),
+                    queryParam("strict", "boolean", "Reject the receipt if the total doesn't equal the item sum"),
+                },
+                "requestBody": receiptBody,
+                "responses": gin.H{
+                    "200": response("Receipt replaced and rescored", ref("ProcessReceiptResponse")),
+                    "400": response("The receipt is invalid", ref("Error")),
+                    "404": notFound,
+                    "413": response("Request body too large", ref("Error")),
+                    "422": response("purchaseDate out of acceptable range", ref("Error")),
+                },
+            },
+            "patch": gin.H{
+                "summary": "Correct some fields of a stored receipt",
+                "parameters": []gin.H{
+                    idParam,
+                    queryParam("includePoints", "boolean", "Return the new points with the id"),
+                    queryParam("strict", "boolean", "Reject the receipt if the total doesn't equal the item sum"),
+                },
+                "requestBody": gin.H{"required": true, "content": jsonContent(ref("ReceiptPatch"))},
+                "responses": gin.H{
+                    "200": response("Receipt updated and rescored", ref("ProcessReceiptResponse")),
+                    "400": response("The patched receipt is invalid", ref("Error")),
+                    "404": notFound,
+                    "413": response("Request body too large", ref("Error")),
+                    "422": response("purchaseDate out of acceptable range", ref("Error")),
+                },
+            },
+            "delete": gin.H{
+                "summary":    "Delete a stored receipt",
+                "parameters": []gin.H{idParam},
+                "responses":  gin.H{"204": gin.H{"description": "Receipt deleted"}, "404": notFound},
+            },
+        },
+        "/receipts/{id}/points": gin.H{"get": gin.H{
+            "summary": "Get the points awarded to a receipt",
+            "parameters": []gin.H{
+                idParam,
+                queryParam("rulesVersion", "string", "current to score the receipt with the live rules instead of returning the stored points"),
+            },
+            "responses": gin.H{
+                "200": response("The points awarded and the version of the rules that awarded them", ref("GetPointsResponse")),
+                "400": response("Unsupported rulesVersion", ref("Error")),
+                "404": notFound,
+                "422": voided,
+            },
+        }},
+        "/receipts/{id}/points/breakdown": gin.H{"get": gin.H{
+            "summary":    "Get the points of a receipt per rule",
+            "parameters": []gin.H{idParam, breakdownVersion},
+            "responses": gin.H{
+                "200": response("The points and the rules that awarded them", gin.H{
+                    "type": "object",
+                    "properties": gin.H{
+                        "points": gin.H{"type": "integer"},
+                        "rules":  gin.H{"type": "array", "items": ref("RuleContribution")},
+                    },
+                }),
+                "400": response("Unsupported rulesVersion", ref("Error")),
+                "404": notFound,
+                "409": rulesChanged,
+                "422": voided,
+            },
+        }},
+        "/receipts/{id}/breakdown": gin.H{"get": gin.H{
+            "summary":    "Get the points of a receipt per rule as one object",
+            "parameters": []gin.H{idParam, breakdownVersion},
+            "responses": gin.H{
+                "200": response("Points per rule", ref("PointsBreakdown")),
+                "400": response("Unsupported rulesVersion", ref("Error")),
+                "404": notFound,
+                "409": rulesChanged,
+                "422": voided,
+            },
+        }},
+        "/receipts/{id}/recalculate": gin.H{"post": gin.H{
+            "summary":    "Rescore a receipt with the current rules",
+            "parameters": []gin.H{idParam},
+            "responses": gin.H{
+                "200": response("Points before and after", gin.H{
+                    "type": "object",
+                    "properties": gin.H{
+                        "id":        gin.H{"type": "string"},
+                        "oldPoints": gin.H{"type": "integer"},
+                        "newPoints": gin.H{"type": "integer"},
+                    },
+                }),
+                "404": notFound,
+            },
+        }},
+        "/receipts/{id}/void": gin.H{"post": gin.H{
+            "summary":    "Void a receipt, keeping it stored without points",
+            "parameters": []gin.H{idParam},
+            "responses": gin.H{
+                "200": response("The receipt is voided", gin.H{
+                    "type": "object",
+                    "properties": gin.H{
+                        "id":     gin.H{"type": "string"},
+                        "status": gin.H{"type": "string", "enum": []string{"voided"}},
+                    },
+                }),
+                "404": notFound,
+            },
+        }},
+        "/receipts/recalculate-all": gin.H{"post": recalculateAll},
+        "/admin/recalculate":        gin.H{"post": recalculateAll},
+        "/users/{id}/points": gin.H{"get": gin.H{
+            "summary":    "Get a user's points across their receipts",
+            "parameters": []gin.H{userParam},
+            "responses": gin.H{
+                "200": response("The points of the user's receipts that aren't voided, less the points redeemed", gin.H{
+                    "type": "object",
+                    "properties": gin.H{
+                        "userId":   gin.H{"type": "string"},
+                        "points":   gin.H{"type": "integer"},
+                        "redeemed": gin.H{"type": "integer"},
+                        "receipts": gin.H{"type": "integer"},
+                    },
+                    "example": gin.H{"userId": "alice", "points": 137, "redeemed": 150, "receipts": 3},
+                }),
+                "400": response("Invalid user id", ref("Error")),
+            },
+        }},
+        "/users/{id}/receipts": gin.H{"get": gin.H{
+            "summary": "List the ids of a user's receipts, oldest first",
+            "parameters": []gin.H{
+                userParam,
+                queryParam("includeVoided", "boolean", "List voided receipts too"),
+            },
+            "responses": gin.H{
+                "200": response("The user's receipt ids", gin.H{
+                    "type": "object",
+                    "properties": gin.H{
+                        "userId":   gin.H{"type": "string"},
+                        "receipts": gin.H{"type": "array", "items": gin.H{"type": "string", "format": "uuid"}},
+                        "count":    gin.H{"type": "integer"},
+                    },
+                }),
+                "400": response("Invalid user id", ref("Error")),
+            },
+        }},
+        "/users/{id}/redeem": gin.H{"post": gin.H{
+            "summary":    "Spend points from a user's balance",
+            "parameters": []gin.H{userParam},
+            "requestBody": gin.H{"required": true, "content": jsonContent(gin.H{
+                "type":     "object",
+                "required": []string{"points"},
+                "properties": gin.H{
+                    "points": gin.H{"type": "integer", "minimum": 1},
+                    "reason": gin.H{"type": "string", "maxLength": maxRedemptionReasonLength},
+                },
+                "example": gin.H{"points": 150, "reason": "gift card"},
+            })},
+            "responses": gin.H{
+                "200": response("The redemption and the balance left", gin.H{
+                    "type": "object",
+                    "properties": gin.H{
+                        "id":      gin.H{"type": "string", "format": "uuid"},
+                        "userId":  gin.H{"type": "string"},
+                        "points":  gin.H{"type": "integer"},
+                        "balance": gin.H{"type": "integer"},
+                    },
+                }),
+                "400": response("Invalid user id, points or reason", ref("Error")),
+                "403": response("The API key belongs to another user", ref("Error")),
+                "409": response("The balance doesn't cover the points", ref("Error")),
+            },
+        }},
+        "/users/{id}/ledger": gin.H{"get": gin.H{
+            "summary": "List the points a user earned and redeemed, oldest first",
+            "parameters": []gin.H{
+                userParam,
+                queryParam("limit", "integer", "Page size, 1 to 100, default 20"),
+                queryParam("offset", "integer", "Number of entries to skip"),
+                queryParam("page", "integer", "1-based page number; can't be combined with offset"),
+            },
+            "responses": gin.H{
+                "200": response("A page of the user's ledger", gin.H{
+                    "type": "object",
+                    "properties": gin.H{
+                        "userId":  gin.H{"type": "string"},
+                        "balance": gin.H{"type": "integer"},
+                        "entries": gin.H{"type": "array", "items": ref("LedgerEntry")},
+                        "count":   gin.H{"type": "integer"},
+                        "limit":   gin.H{"type": "integer"},
+                        "offset":  gin.H{"type": "integer"},
+                    },
+                }),
+                "400": response("Invalid user id or page", ref("Error")),
+            },
+        }},
+    }
+
+    spec := gin.H{
+        "openapi": "3.0.3",
+        "info": gin.H{
+            "title":       "Receipt Processor",
+            "description": "A simple receipt processor",
+            "version":     "1.0.0",
+        },
+        "paths":      paths,
+        "components": gin.H{"schemas": schemas},
+    }
+    if len(cfg.apiKeys()) > 0 || cfg.UserAPIKeys != "" {
+        spec["components"].(gin.H)["securitySchemes"] = gin.H{
+            "apiKey": gin.H{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+        }
+        for name, path := range paths {
+            // Validation stores nothing and needs no key
+            if name == "/receipts/validate" {
+                continue
+            }
+            for method, op := range path.(gin.H) {
+                if method != "get" || adminPath(name) {
+                    op.(gin.H)["security"] = []gin.H{{"apiKey": []string{}}}
+                } else if cfg.EnforceReceiptOwnership && ownedPath(name) {
+                    // Only owned receipts need a key, so it is optional
+                    op.(gin.H)["security"] = []gin.H{{}, {"apiKey": []string{}}}
+                }
+            }
+        }
+    }
+    return spec
+}
+
+// ownedPath reports whether a path serves a single user's data, which
+// EnforceReceiptOwnership guards
+// Input: OpenAPI path, e.g. /receipts/{id}/points
+// Output: true for a single receipt's paths and the /users paths
+func ownedPath(path string) bool {
+    return strings.HasPrefix(path, "/receipts/{id}") || strings.HasPrefix(path, "/users/")
+}
+
+// adminPath reports whether a GET path covers every user's receipts, so it
+// needs an admin key whenever keys are configured
+// Input: OpenAPI path
+// Output: true for the statistics and export paths
+func adminPath(path string) bool {
+    return path == "/receipts/stats" || strings.HasPrefix(path, "/receipts/export")
+}
+
+// errorSchema describes the error body in the layout LEGACY_ERRORS selects
+// Input: Config.LegacyErrors
+// Output: OpenAPI schema with a rejected receipt as its example
+func errorSchema(legacy bool) gin.H {
+    detail := gin.H{
+        "type":     "object",
+        "required": []string{"code", "message"},
+        "properties": gin.H{
+            "code":    gin.H{"type": "string", "enum": errorCodes()},
+            "message": gin.H{"type": "string"},
+            "field":   gin.H{"type": "string"},
+        },
+    }
+    properties := gin.H{
+        "error": detail,
+        // Only for rejected receipts
+        "errors": gin.H{"type": "array", "items": schemaFor(reflect.TypeOf(fieldError{}))},
+    }
+    if legacy {
+        properties["error"] = gin.H{"type": "string"}
+        properties["code"] = detail["properties"].(gin.H)["code"]
+        properties["field"] = gin.H{"type": "string"}
+    }
+    return gin.H{
+        "type":       "object",
+        "required":   []string{"error"},
+        "properties": properties,
+        "example": newRejectionBody(!legacy, validationErrors{
+            {field: "retailer", reason: "invalid_retailer", message: "invalid retailer"},
+            {field: "items[2].price", reason: "invalid_price", message: "invalid item price"},
+        }),
+    }
+}
+
+// schemaFor derives a JSON schema from a Go type using its json tags
+// Input: type encoded or decoded by a handler
+// Output: schema with a property per exported, tagged field
+func schemaFor(t reflect.Type) gin.H {
+    switch t.Kind() {
+    case reflect.Pointer:
+        return schemaFor(t.Elem())
+    case reflect.String:
+        return gin.H{"type": "string"}
+    case reflect.Bool:
+        return gin.H{"type": "boolean"}
+    case reflect.Int, reflect.Int32, reflect.Int64:
+        return gin.H{"type": "integer"}
+    case reflect.Float32, reflect.Float64:
+        return gin.H{"type": "number"}
+    case reflect.Slice:
+        return gin.H{"type": "array", "items": schemaFor(t.Elem())}
+    case reflect.Struct:
+        props := gin.H{}
+        for i := 0; i < t.NumField(); i++ {
+            field := t.Field(i)
+            name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+            if !field.IsExported() || name == "" || name == "-" {
+                continue
+            }
+            props[name] = schemaFor(field.Type)
+        }
+        return gin.H{"type": "object", "properties": props}
+    }
+    return gin.H{}
+}
+
+// amountSchema describes an Amount, a string like "12.25" or a number with
+// at most two decimals
+// Input: none
+// Output: OpenAPI schema
+func amountSchema() gin.H {
+    return gin.H{"oneOf": []gin.H{
+        {"type": "string", "pattern": amountPattern.String()},
+        {"type": "number", "minimum": 0, "multipleOf": 0.01},
+    }}
+}
+
+// setPattern adds a regular expression to a string property of a schema
+// Input: object schema from schemaFor, property name and pattern
+// Output: none, the schema is changed in place
+func setPattern(schema gin.H, property, pattern string) {
+    schema["properties"].(gin.H)[property].(gin.H)["pattern"] = pattern
+}
+
+// ref points at a schema under components
+// Input: schema name, e.g. "Receipt"
+// Output: {"$ref": "#/components/schemas/Receipt"}
+func ref(name string) gin.H {
+    return gin.H{"$ref": "#/components/schemas/" + name}
+}
+
+// jsonContent wraps a schema as an application/json content map
+// Input: schema
+// Output: {"application/json": {"schema": schema}}
+func jsonContent(schema gin.H) gin.H {
+    return gin.H{"application/json": gin.H{"schema": schema}}
+}
+
+// response describes a JSON response
+// Input: description and body schema
+// Output: OpenAPI response object
+func response(description string, schema gin.H) gin.H {
+    return gin.H{"description": description, "content": jsonContent(schema)}
+}
+
+// queryParam describes an optional query parameter
+// Input: name, schema type and description
+// Output: OpenAPI parameter object
+func queryParam(name, typ, description string) gin.H {
+    return gin.H{"name": name, "in": "query", "description": description, "schema": gin.H{"type": typ}}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "reflect"
+    "regexp"
+    "testing"
+
+    "github.com/google/uuid"
+)
+
+// specSchema returns a schema from the served document's components
+func specSchema(t *testing.T, spec map[string]any, name string) map[string]any {
+    t.Helper()
+    schema, ok := spec["components"].(map[string]any)["schemas"].(map[string]any)[name].(map[string]any)
+    if !ok {
+        t.Fatalf("spec has no %s schema", name)
+    }
+    return schema
+}
+
+// specExample returns a schema's example, encoded as a request body
+func specExample(t *testing.T, spec map[string]any, name string) string {
+    t.Helper()
+    example, ok := specSchema(t, spec, name)["example"]
+    if !ok {
+        t.Fatalf("spec has no example for %s", name)
+    }
+    body, err := json.Marshal(example)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(body)
+}
+
+// checkShape fails the test unless body has the schema's required fields
+// and no fields the schema doesn't list
+func checkShape(t *testing.T, spec map[string]any, name string, body map[string]any) {
+    t.Helper()
+    schema := specSchema(t, spec, name)
+    properties, _ := schema["properties"].(map[string]any)
+    for field := range body {
+        if _, ok := properties[field]; !ok {
+            t.Errorf("%s: response field %q is not in the schema", name, field)
+        }
+    }
+    required, _ := schema["required"].([]any)
+    for _, field := range required {
+        if _, ok := body[field.(string)]; !ok {
+            t.Errorf("%s: response lacks required field %q", name, field)
+        }
+    }
+}
+
+// checkPattern fails the test unless value matches a property's pattern
+func checkPattern(t *testing.T, schema map[string]any, property, value string) {
+    t.Helper()
+    pattern, _ := schema["properties"].(map[string]any)[property].(map[string]any)["pattern"].(string)
+    if !regexp.MustCompile(pattern).MatchString(value) {
+        t.Errorf("example %s %q doesn't match the spec's pattern %s", property, value, pattern)
+    }
+}
+
+func TestOpenAPIExamples(t *testing.T) {
+    router := newTestRouter(t)
+    _, spec := serve(t, router, http.MethodGet, "/openapi.json", "")
+
+    // The receipt example satisfies the patterns published next to it
+    receipt := specSchema(t, spec, "Receipt")
+    example := receipt["example"].(map[string]any)
+    checkPattern(t, receipt, "retailer", example["retailer"].(string))
+    item := specSchema(t, spec, "Item")
+    for _, it := range example["items"].([]any) {
+        checkPattern(t, item, "shortDescription", it.(map[string]any)["shortDescription"].(string))
+    }
+
+    // and is accepted by the handlers, earning the points the spec shows
+    status, body := serve(t, router, http.MethodPost, "/receipts/process", specExample(t, spec, "Receipt"))
+    if status != http.StatusOK {
+        t.Fatalf("process of the spec example returned %d %v", status, body)
+    }
+    checkShape(t, spec, "ProcessReceiptResponse", body)
+    id, _ := body["id"].(string)
+    if _, err := uuid.Parse(id); err != nil {
+        t.Fatalf("process returned id %q, want a UUID", id)
+    }
+    _, points := serve(t, router, http.MethodGet, "/receipts/"+id+"/points", "")
+    checkShape(t, spec, "GetPointsResponse", points)
+    if want := specSchema(t, spec, "GetPointsResponse")["example"].(map[string]any)["points"]; points["points"] != want {
+        t.Errorf("spec example scored %v, the spec says %v", points["points"], want)
+    }
+    if status, body := serve(t, router, http.MethodPost, "/receipts/validate", specExample(t, spec, "Receipt")); status != http.StatusOK || body["valid"] != true {
+        t.Errorf("validate of the spec example returned %d %v", status, body)
+    }
+    if status, body := serve(t, router, http.MethodPatch, "/receipts/"+id, specExample(t, spec, "ReceiptPatch")); status != http.StatusOK {
+        t.Errorf("patch with the spec example returned %d %v", status, body)
+    }
+
+    // The error examples are what the handlers answer for the same problems
+    invalid := exampleReceipt
+    invalid.Total = "35.3"
+    _, body = serve(t, router, http.MethodPost, "/receipts/validate", receiptJSON(t, invalid))
+    var want map[string]any
+    if err := json.Unmarshal([]byte(specExample(t, spec, "ValidationResult")), &want); err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(body, want) {
+        t.Errorf("validate of a bad total returned %v, the spec example is %v", body, want)
+    }
+
+    invalid = exampleReceipt
+    invalid.Retailer = "Target!"
+    invalid.Items = append([]ItemInput(nil), exampleReceipt.Items...)
+    invalid.Items[2].Price = "1.2"
+    status, body = serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, invalid))
+    want = nil
+    if err := json.Unmarshal([]byte(specExample(t, spec, "Error")), &want); err != nil {
+        t.Fatal(err)
+    }
+    if status != http.StatusBadRequest || !reflect.DeepEqual(body, want) {
+        t.Errorf("process of a bad retailer and price returned %d %v, the spec example is %v", status, body, want)
+    }
+    checkShape(t, spec, "Error", body)
+
+    // An import skipping a receipt reports it as the example does
+    skipped := exampleReceipt
+    skipped.PurchaseDate = "2022-13-01"
+    imported, err := json.Marshal(map[string]any{"receipts": []ReceiptInput{statsReceipt(1), statsReceipt(2), skipped}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, body = serve(t, router, http.MethodPost, "/receipts/import", string(imported))
+    checkShape(t, spec, "ImportResult", body)
+    want = nil
+    if err := json.Unmarshal([]byte(specExample(t, spec, "ImportResult")), &want); err != nil {
+        t.Fatal(err)
+    }
+    if got, want := body["errors"], want["errors"]; !reflect.DeepEqual(got, want) {
+        t.Errorf("import errors %v, the spec example has %v", got, want)
+    }
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// ownerIndex keeps every user's receipts and points balance up to date as
+// receipts are stored, so the /users endpoints don't scan the store
+type ownerIndex struct {
+    mu sync.Mutex
+    // owners[receipt id] = user id, for receipts with an owner
+    owners map[string]string
+    // users[user id] = that user's receipts
+    users map[string]*userReceipts
+}
+
+// userReceipts is one user's entry in the ownerIndex
+type userReceipts struct {
+    // points is the sum of the points of the receipts that aren't voided,
+    // and count the number of those receipts
+    points, count int
+    // receipts[receipt id] = what the index knows about the receipt
+    receipts map[string]ownedReceipt
+    // redeemed is the sum of the points of redemptions, oldest first
+    redeemed    int
+    redemptions []Redemption
+}
+
+// ownedReceipt is the part of a stored record the ownerIndex needs
+type ownedReceipt struct {
+    points   int
+    storedAt time.Time
+    voided   bool
+}
+
+// newOwnerIndex creates an index of the receipts already in store
+// Input: store to index; if it can't be read the index is partial and a
+//        warning is logged
+// Output: *ownerIndex ready for use
+func newOwnerIndex(store Store) *ownerIndex {
+    x := &ownerIndex{owners: make(map[string]string), users: make(map[string]*userReceipts)}
+    err := forEachRecord(context.Background(), store, func(id string, record ReceiptRecord) {
+        x.set(id, record)
+    })
+    if err != nil {
+        slog.Warn("user balances may miss stored receipts, failed to read them", "error", err.Error())
+    }
+    redemptions, err := store.Redemptions(context.Background())
+    if err != nil {
+        slog.Warn("user balances may miss redemptions, failed to read them", "error", err.Error())
+    }
+    for _, redemption := range redemptions {
+        x.redeem(redemption)
+    }
+    return x
+}
+
+// set records a receipt as it was just stored, replacing what the index
+// knew about it
+// Input: receipt id and its stored record
+// Output: none
+func (x *ownerIndex) set(id string, record ReceiptRecord) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.remove(id)
+    if record.UserID == "" {
+        return
+    }
+    user := x.user(record.UserID)
+    owned := ownedReceipt{points: record.Points, storedAt: record.StoredAt, voided: record.Voided}
+    user.receipts[id] = owned
+    if !owned.voided {
+        user.points += owned.points
+        user.count++
+    }
+    x.owners[id] = record.UserID
+}
+
+// user returns a user's entry, creating it if the user has none
+// The caller must hold x.mu
+func (x *ownerIndex) user(userID string) *userReceipts {
+    user, exists := x.users[userID]
+    if !exists {
+        user = &userReceipts{receipts: make(map[string]ownedReceipt)}
+        x.users[userID] = user
+    }
+    return user
+}
+
+// redeem records a redemption that was just stored
+// Input: the stored redemption
+// Output: none
+func (x *ownerIndex) redeem(redemption Redemption) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    user := x.user(redemption.UserID)
+    user.redeemed += redemption.Points
+    user.redemptions = append(user.redemptions, redemption)
+}
+
+// delete drops a receipt that was deleted or evicted from the store
+// Input: receipt id
+// Output: none
+func (x *ownerIndex) delete(id string) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.remove(id)
+}
+
+// remove drops a receipt from its owner's entry
+// The caller must hold x.mu
+func (x *ownerIndex) remove(id string) {
+    userID, exists := x.owners[id]
+    if !exists {
+        return
+    }
+    delete(x.owners, id)
+    user := x.users[userID]
+    if owned := user.receipts[id]; !owned.voided {
+        user.points -= owned.points
+        user.count--
+    }
+    delete(user.receipts, id)
+    // Redemptions are kept forever, and with them the user's entry
+    if len(user.receipts) == 0 && len(user.redemptions) == 0 {
+        delete(x.users, userID)
+    }
+}
+
+// dropExpired removes a user's receipts that are older than ttl, which the
+// janitor may not have swept yet
+// The caller must hold x.mu
+// Input: user id and the receipt TTL; 0 means receipts never expire
+// Output: none
+func (x *ownerIndex) dropExpired(userID string, ttl time.Duration) {
+    user, exists := x.users[userID]
+    if !exists || ttl == 0 {
+        return
+    }
+    for id, owned := range user.receipts {
+        if (ReceiptRecord{StoredAt: owned.storedAt}).expired(ttl) {
+            x.remove(id)
+        }
+    }
+}
+
+// balance returns a user's points across their receipts
+// Input: user id and the receipt TTL
+// Output: points of the receipts that aren't voided or expired less the
+//         points redeemed, the points redeemed, and the number of those
+//         receipts. The balance is below 0 when receipts that paid for a
+//         redemption were voided, deleted or expired since
+func (x *ownerIndex) balance(userID string, ttl time.Duration) (int, int, int) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.dropExpired(userID, ttl)
+    user, exists := x.users[userID]
+    if !exists {
+        return 0, 0, 0
+    }
+    return user.points - user.redeemed, user.redeemed, user.count
+}
+
+// receipts lists a user's receipt ids, oldest first
+// Input: user id, the receipt TTL and whether voided receipts are listed
+// Output: the ids; receipts stored at the same time are ordered by id
+func (x *ownerIndex) receipts(userID string, ttl time.Duration, includeVoided bool) []string {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.dropExpired(userID, ttl)
+    user, exists := x.users[userID]
+    if !exists {
+        return []string{}
+    }
+    ids := make([]string, 0, len(user.receipts))
+    for id, owned := range user.receipts {
+        if includeVoided || !owned.voided {
+            ids = append(ids, id)
+        }
+    }
+    sort.Slice(ids, func(i, j int) bool {
+        a, b := user.receipts[ids[i]].storedAt, user.receipts[ids[j]].storedAt
+        if !a.Equal(b) {
+            return a.Before(b)
+        }
+        return ids[i] < ids[j]
+    })
+    return ids
+}
+
+// ownerFor picks the user a receipt is stored under
+// Input: request context, the userId sent in the body, empty if none, and
+//        the receipt's current owner, empty for a new or unowned receipt
+// Output: the owner; a receipt without a userId keeps its owner, or goes to
+//         the user of the request's key. A validationError if a user's key
+//         names another user
+func ownerFor(c *gin.Context, named, current string) (string, error) {
+    who, _ := requestCaller(c)
+    if named == "" {
+        if current != "" {
+            return current, nil
+        }
+        return who.user, nil
+    }
+    if !who.admin() && named != who.user {
+        return "", &validationError{
+            field:   "userId",
+            reason:  "user_mismatch",
+            message: fmt.Sprintf("userId %s doesn't match the user of the API key", named),
+        }
+    }
+    return named, nil
+}
+
+// checkOwner enforces EnforceReceiptOwnership for a user's data
+// Input: request context and the user the data belongs to, empty for an
+//        unowned receipt, which anyone may use
+// Output: true if the request may go on, or false after a 401
+//         MISSING_API_KEY or 403 NOT_OWNER response was sent
+func (s *Server) checkOwner(c *gin.Context, owner string) bool {
+    if !s.cfg.EnforceReceiptOwnership || owner == "" {
+        return true
+    }
+    who, ok := requestCaller(c)
+    if !ok {
+        respondError(c, http.StatusUnauthorized, codeMissingAPIKey, "missing API key")
+        return false
+    }
+    if !who.admin() && who.user != owner {
+        respondError(c, http.StatusForbidden, codeNotOwner, "API key belongs to another user")
+        return false
+    }
+    return true
+}
+
+// mayRead reports whether the request may see a receipt in a listing,
+// under the same rule as checkOwner but without sending a response
+// Input: request context and the receipt's owner, empty for none
+// Output: true if ownership isn't enforced, the receipt is unowned, or the
+//         request's key is an admin key or the owner's
+func (s *Server) mayRead(c *gin.Context, owner string) bool {
+    if !s.cfg.EnforceReceiptOwnership || owner == "" {
+        return true
+    }
+    who, ok := requestCaller(c)
+    return ok && (who.admin() || who.user == owner)
+}
+
+// mayReadAll reports whether the request may see every receipt in a
+// listing, so it needn't be checked receipt by receipt
+// Input: request context
+// Output: true if ownership isn't enforced or the request's key is an admin key
+func (s *Server) mayReadAll(c *gin.Context) bool {
+    if !s.cfg.EnforceReceiptOwnership {
+        return true
+    }
+    who, ok := requestCaller(c)
+    return ok && who.admin()
+}
+
+// userID reads the user id from the URL path
+// Input: request context with an :id path parameter
+// Output: the id and true, or false after a 400 INVALID_USER_ID response
+//         was sent
+func userID(c *gin.Context) (string, bool) {
+    id := c.Param("id")
+    if !userIDPattern.MatchString(id) {
+        respondError(c, http.StatusBadRequest, codeInvalidUserID, "invalid user id")
+        return "", false
+    }
+    return id, true
+}
+
+// getUserPoints returns a user's points balance
+// Input: user id in the URL path
+// Output:
+//   - Success: JSON {"userId": "id", "points": number, "redeemed": number, "receipts": number};
+//              points is what's left after redemptions, voided receipts
+//              don't count, and a user without receipts has 0
+//   - Error: JSON with error message {"error": "message"}; 401 or 403 when
+//            ownership is enforced and the API key isn't the user's
+func (s *Server) getUserPoints(c *gin.Context) {
+    user, ok := userID(c)
+    if !ok || !s.checkOwner(c, user) {
+        return
+    }
+    points, redeemed, count := s.owners.balance(user, s.cfg.ReceiptTTL)
+    c.JSON(http.StatusOK, gin.H{"userId": user, "points": points, "redeemed": redeemed, "receipts": count})
+}
+
+// listUserReceipts lists the ids of a user's receipts
+// Input:
+//   - user id in the URL path
+//   - includeVoided: optional query parameter, true to list voided receipts too
+// Output:
+//   - Success: JSON {"userId": "id", "receipts": ["uuid-id", ...], "count": number},
+//              oldest first
+//   - Error: as getUserPoints
+func (s *Server) listUserReceipts(c *gin.Context) {
+    user, ok := userID(c)
+    if !ok || !s.checkOwner(c, user) {
+        return
+    }
+    ids := s.owners.receipts(user, s.cfg.ReceiptTTL, c.Query("includeVoided") == "true")
+    c.JSON(http.StatusOK, gin.H{"userId": user, "receipts": ids, "count": len(ids)})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// ReceiptPatch is the JSON body accepted by PATCH /receipts/:id
+// A nil field was left out of the body and keeps its stored value; a field
+// sent as "" is applied and then fails validation like any other bad value
+type ReceiptPatch struct {
+    Retailer     *string `json:"retailer"`
+    PurchaseDate *string `json:"purchaseDate"`
+    PurchaseTime *string `json:"purchaseTime"`
+    // PurchaseDateTime replaces the stored date and time unless
+    // PurchaseDate or PurchaseTime are patched too
+    PurchaseDateTime *string `json:"purchaseDateTime"`
+    // Timezone re-reads the stored date and time in another zone; "" goes
+    // back to the server's PURCHASE_TIMEZONE
+    Timezone *string `json:"timezone"`
+    // Notes replaces the stored notes; "" clears them
+    Notes *string `json:"notes"`
+    // Items replaces the whole item list; items can't be patched one by one
+    Items *[]ItemInput `json:"items"`
+    Total *Amount      `json:"total"`
+    // IncludePoints asks for the new points with the id
+    IncludePoints bool `json:"includePoints,omitempty"`
+}
+
+// apply merges the patch into a stored receipt
+// Input: stored Receipt
+// Output: ReceiptInput with the patched fields replaced, ready for parseReceipt
+func (p ReceiptPatch) apply(receipt Receipt) ReceiptInput {
+    // Start from the receipt as it was submitted
+    stored := newReceiptResponse(receipt)
+    input := ReceiptInput{
+        Retailer:     stored.Retailer,
+        PurchaseDate: stored.PurchaseDate,
+        PurchaseTime: stored.PurchaseTime,
+        Timezone:     stored.Timezone,
+        UserID:       stored.UserID,
+        Notes:        stored.Notes,
+        Items:        make([]ItemInput, len(stored.Items)),
+        Total:        Amount(stored.Total),
+    }
+    for i, item := range stored.Items {
+        input.Items[i] = ItemInput{ShortDescription: item.ShortDescription, Price: Amount(item.Price)}
+    }
+    if p.Retailer != nil {
+        input.Retailer = *p.Retailer
+    }
+    if p.PurchaseDate != nil {
+        input.PurchaseDate = *p.PurchaseDate
+    }
+    if p.PurchaseTime != nil {
+        input.PurchaseTime = *p.PurchaseTime
+    }
+    if p.PurchaseDateTime != nil {
+        input.PurchaseDateTime = *p.PurchaseDateTime
+        // The stored date and time would contradict the new timestamp
+        if p.PurchaseDate == nil && p.PurchaseTime == nil {
+            input.PurchaseDate, input.PurchaseTime = "", ""
+        }
+    }
+    if p.Timezone != nil {
+        input.Timezone = *p.Timezone
+    }
+    if p.Notes != nil {
+        input.Notes = *p.Notes
+    }
+    if p.Items != nil {
+        input.Items = *p.Items
+    }
+    if p.Total != nil {
+        input.Total = *p.Total
+    }
+    return input
+}
+
+// keepsPurchaseTime reports whether the patch leaves the purchase date and
+// time alone
+// Input: none
+// Output: true if none of purchaseDate, purchaseTime and purchaseDateTime is patched
+func (p ReceiptPatch) keepsPurchaseTime() bool {
+    return p.PurchaseDate == nil && p.PurchaseTime == nil && p.PurchaseDateTime == nil
+}
+
+// patchReceipt corrects some fields of a stored receipt
+// Input: 
+//   - [uuid-id]: receipt ID in URL path parameter
+//   - JSON ReceiptPatch with the fields to change, e.g. {"retailer": "Target"}
+// Output:
+//   - Success: JSON {"id": "uuid-id"}, with "points" when points are requested;
+//              the merged receipt is validated and rescored as a whole
+//   - Error: JSON with error message {"error": "message"}; 404 if the id
+//            doesn't exist, 400 or 422 if the merged receipt is invalid;
+//            MAX_RECEIPT_AGE_DAYS only applies if the purchase time changes
+func (s *Server) patchReceipt(c *gin.Context) {
+    id, ok := receiptID(c)
+    if !ok {
+        return
+    }
+    var patch ReceiptPatch
+    if err := s.bindJSON(c, &patch); err != nil {
+        respondBindError(c, err)
+        return
+    }
+
+    // Held from reading the stored receipt until the merged one is saved
+    unlock := s.lockForUpdate()
+    defer unlock()
+    old, ok := s.lookup(c, id)
+    if !ok {
+        return
+    }
+    receipt, err := parseReceipt(patch.apply(old.Receipt), s.parseOptions(c))
+    if err != nil {
+        recordRejection(c, rejectionReason(err), err)
+        c.JSON(http.StatusBadRequest, rejectionBody(c, err))
+        return
+    }
+    if patch.keepsPurchaseTime() {
+        // apply only carries the stored time to the minute, as purchaseTime;
+        // put back the seconds a purchaseDateTime may have had
+        at := old.PurchasedAt
+        receipt.PurchasedAt = receipt.PurchasedAt.Add(time.Duration(at.Second())*time.Second + time.Duration(at.Nanosecond()))
+    }
+    // Only a new purchase time must fall in the look-back window
+    if err := s.checkCorrectedPurchaseDate(receipt, old.Receipt); err != nil {
+        recordRejection(c, rejectionReason(err), err)
+        c.JSON(http.StatusUnprocessableEntity, rejectionBody(c, err))
+        return
+    }
+    s.respondReplaced(c, id, old, receipt, patch.IncludePoints)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+)
+
+func TestPatchReceipt(t *testing.T) {
+    tests := []struct {
+        name       string
+        patch      string
+        wantStatus int
+        wantPoints float64
+    }{
+        // "TargetStore" has 5 more alphanumeric characters than "Target"
+        {"retailer", `{"retailer": "Target Store"}`, http.StatusOK, 33},
+        // the 6 odd day points are lost
+        {"purchaseDate", `{"purchaseDate": "2022-01-02"}`, http.StatusOK, 22},
+        {"purchaseTime", `{"purchaseTime": "14:30"}`, http.StatusOK, 38},
+        // round dollar and multiple of 0.25
+        {"total", `{"total": "35.00"}`, http.StatusOK, 103},
+        {"items", `{"items": [{"shortDescription": "Pizza", "price": "35.35"}]}`, http.StatusOK, 12},
+        {"nothing", `{}`, http.StatusOK, 28},
+        {"empty retailer", `{"retailer": ""}`, http.StatusBadRequest, 0},
+        {"bad date", `{"purchaseDate": "2022-02-30"}`, http.StatusBadRequest, 0},
+        {"bad time", `{"purchaseTime": "2pm"}`, http.StatusBadRequest, 0},
+        {"bad total", `{"total": "35"}`, http.StatusBadRequest, 0},
+        {"no items", `{"items": []}`, http.StatusBadRequest, 0},
+        {"bad price", `{"items": [{"shortDescription": "Pizza", "price": "1"}]}`, http.StatusBadRequest, 0},
+        {"unknown field", `{"retailor": "Target"}`, http.StatusBadRequest, 0},
+        {"future date", `{"purchaseDate": "2999-01-01"}`, http.StatusUnprocessableEntity, 0},
+    }
+    for _, tt := range tests {
+        router := newTestRouter(t)
+        _, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt))
+        id, _ := body["id"].(string)
+
+        status, body := serve(t, router, http.MethodPatch, "/receipts/"+id+"?includePoints=true", tt.patch)
+        if status != tt.wantStatus {
+            t.Errorf("%s: got %d %v, want %d", tt.name, status, body, tt.wantStatus)
+            continue
+        }
+        // A rejected patch leaves the stored receipt alone
+        if status != http.StatusOK {
+            tt.wantPoints = 28
+        } else if body["points"] != tt.wantPoints {
+            t.Errorf("%s: patch returned %v points, want %v", tt.name, body["points"], tt.wantPoints)
+        }
+        if _, body = serve(t, router, http.MethodGet, "/receipts/"+id+"/points", ""); body["points"] != tt.wantPoints {
+            t.Errorf("%s: stored points are %v, want %v", tt.name, body["points"], tt.wantPoints)
+        }
+    }
+}
+
+func TestPatchKeepsPurchaseSeconds(t *testing.T) {
+    router := newTestRouter(t)
+    input := exampleReceipt
+    input.PurchaseDate, input.PurchaseTime = "", ""
+    // 30 seconds past 14:00 is inside the afternoon window, 14:00 itself isn't
+    input.PurchaseDateTime = "2022-01-01T14:00:30Z"
+    input.IncludePoints = true
+    _, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, input))
+    id, _ := body["id"].(string)
+    if body["points"] != 38.0 {
+        t.Fatalf("process: got %v points, want 38", body["points"])
+    }
+
+    for _, patch := range []string{`{"notes": "returned the gum"}`, `{"retailer": "Target"}`, `{"timezone": "UTC"}`} {
+        if status, body := serve(t, router, http.MethodPatch, "/receipts/"+id+"?includePoints=true", patch); status != http.StatusOK || body["points"] != 38.0 {
+            t.Errorf("PATCH %s: got %d %v, want 38 points", patch, status, body)
+        }
+    }
+    // Patching the time itself replaces the seconds too
+    if _, body := serve(t, router, http.MethodPatch, "/receipts/"+id+"?includePoints=true", `{"purchaseTime": "14:00"}`); body["points"] != 28.0 {
+        t.Errorf("PATCH purchaseTime 14:00: got %v points, want 28", body["points"])
+    }
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "math"
+    "net/http"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "golang.org/x/time/rate"
+)
+
+// limiterIdleTimeout is how long a client's limiter is kept after its last request
+const limiterIdleTimeout = 5 * time.Minute
+
+// clientLimiter is the token bucket of one client IP
+type clientLimiter struct {
+    limiter *rate.Limiter
+    // last request time in unix nanoseconds, read by the cleanup goroutine
+    lastSeen atomic.Int64
+}
+
+// rateLimiter hands out a token bucket per client IP
+type rateLimiter struct {
+    rps   rate.Limit
+    burst int
+    // limiters[clientIP] = *clientLimiter
+    limiters sync.Map
+}
+
+// newRateLimiter creates a rateLimiter and starts evicting idle clients
+// Input: context ending the eviction, tokens added per second and bucket
+//        size for each client
+// Output: *rateLimiter ready for use
+func newRateLimiter(ctx context.Context, rps float64, burst int) *rateLimiter {
+    l := &rateLimiter{rps: rate.Limit(rps), burst: burst}
+    go l.evictIdle(ctx)
+    return l
+}
+
+// get returns the limiter of a client, creating it on first use
+// Input: client IP
+// Output: *clientLimiter with lastSeen set to now
+func (l *rateLimiter) get(ip string) *clientLimiter {
+    value, ok := l.limiters.Load(ip)
+    if !ok {
+        value, _ = l.limiters.LoadOrStore(ip, &clientLimiter{limiter: rate.NewLimiter(l.rps, l.burst)})
+    }
+    client := value.(*clientLimiter)
+    client.lastSeen.Store(time.Now().UnixNano())
+    return client
+}
+
+// evictIdle drops limiters of clients that have been idle for
+// limiterIdleTimeout, once a minute until ctx is done
+// Input: context
+// Output: none
+func (l *rateLimiter) evictIdle(ctx context.Context) {
+    ticker := time.NewTicker(time.Minute)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-ticker.C:
+            l.dropIdle(now.Add(-limiterIdleTimeout))
+        }
+    }
+}
+
+// dropIdle drops limiters of clients not seen since cutoff
+// Input: cutoff time
+// Output: none
+func (l *rateLimiter) dropIdle(cutoff time.Time) {
+    l.limiters.Range(func(ip, value any) bool {
+        if value.(*clientLimiter).lastSeen.Load() < cutoff.UnixNano() {
+            l.limiters.Delete(ip)
+        }
+        return true
+    })
+}
+
+// middleware rejects requests from clients that exceeded their rate
+// Input: none
+// Output: gin middleware answering 429 with a Retry-After header and
+//         a RATE_LIMITED error with "retryAfterSeconds": n
+func (l *rateLimiter) middleware() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        reservation := l.get(c.ClientIP()).limiter.Reserve()
+        delay := reservation.Delay()
+        if delay == 0 {
+            c.Next()
+            return
+        }
+        // Give the token back, the request isn't going to wait for it
+        reservation.Cancel()
+        retryAfter := int(math.Ceil(delay.Seconds()))
+        slog.Warn("rate limit exceeded",
+            "clientIp", c.ClientIP(),
+            "requestId", c.GetString("requestId"),
+        )
+        c.Header("Retry-After", strconv.Itoa(retryAfter))
+        body := errorBody(c, codeRateLimited, "rate limit exceeded", "")
+        body["retryAfterSeconds"] = retryAfter
+        c.AbortWithStatusJSON(http.StatusTooManyRequests, body)
+    }
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "testing"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+func TestRateLimitPerClient(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.RateLimitRPS = 0.01
+    cfg.RateLimitBurst = 2
+    router := newTestRouterWith(t, cfg)
+    path := "/receipts/" + uuid.NewString() + "/points"
+
+    send := func(remoteAddr string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(http.MethodGet, path, nil)
+        req.RemoteAddr = remoteAddr
+        w := httptest.NewRecorder()
+        router.ServeHTTP(w, req)
+        return w
+    }
+    for i := range cfg.RateLimitBurst {
+        if w := send("192.0.2.1:1234"); w.Code != http.StatusNotFound {
+            t.Fatalf("request %d within the burst returned %d, want 404", i+1, w.Code)
+        }
+    }
+    w := send("192.0.2.1:1234")
+    if w.Code != http.StatusTooManyRequests {
+        t.Fatalf("request past the burst returned %d, want 429", w.Code)
+    }
+    // one token every 100s
+    if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter < 1 || retryAfter > 100 {
+        t.Fatalf("Retry-After = %q, want 1 to 100 seconds", w.Header().Get("Retry-After"))
+    }
+    // another client has its own bucket
+    if w := send("192.0.2.2:1234"); w.Code != http.StatusNotFound {
+        t.Fatalf("request from another client returned %d, want 404", w.Code)
+    }
+}
+
+func TestRateLimiterDropsIdleClients(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    l := newRateLimiter(ctx, 1, 1)
+    cancel()
+
+    l.get("192.0.2.1").lastSeen.Store(time.Now().Add(-time.Hour).UnixNano())
+    l.get("192.0.2.2")
+    l.dropIdle(time.Now().Add(-limiterIdleTimeout))
+    if _, ok := l.limiters.Load("192.0.2.1"); ok {
+        t.Fatal("client idle since before the cutoff was kept")
+    }
+    if _, ok := l.limiters.Load("192.0.2.2"); !ok {
+        t.Fatal("client seen after the cutoff was dropped")
+    }
+}
+
+func TestRateLimiterCleanupStops(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    l := &rateLimiter{rps: 1, burst: 1}
+    done := make(chan struct{})
+    go func() {
+        l.evictIdle(ctx)
+        close(done)
+    }()
+    cancel()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("cleanup kept running after its context ended")
+    }
+}
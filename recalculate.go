@@ -0,0 +1,126 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "net/http"
+    "sync"
+    "sync/atomic"
+
+    "github.com/gin-gonic/gin"
+)
+
+// recalculateWorkers bounds how many receipts POST /receipts/recalculate-all
+// rescores at once
+const recalculateWorkers = 8
+
+// recalculate rescores a stored receipt with the current rules and saves it
+// when its points or rules version changed
+// The record is read under lockForUpdate, so a receipt deleted, replaced
+// or voided meanwhile is neither brought back nor overwritten
+// Input: context for the store calls and receipt id
+// Output: the record's previous and new points and true, false if the
+//         receipt no longer exists or expired, or a store error
+func (s *Server) recalculate(ctx context.Context, id string) (int, int, bool, error) {
+    unlock := s.lockForUpdate()
+    defer unlock()
+    record, exists, err := s.store.Get(ctx, id)
+    if err != nil {
+        return 0, 0, false, err
+    }
+    if !exists || record.expired(s.cfg.ReceiptTTL) {
+        return 0, 0, false, nil
+    }
+    oldPoints := record.Points
+    record.Points = calculatePoints(record.Receipt, s.cfg.Rules, s.cfg.Values)
+    if record.Points == oldPoints && record.RulesVersion == s.rulesVersion {
+        return oldPoints, oldPoints, true, nil
+    }
+    record.RulesVersion = s.rulesVersion
+    // StoredAt is kept, so rescoring doesn't extend the receipt's TTL
+    if err := s.store.Put(ctx, id, record); err != nil {
+        return 0, 0, false, err
+    }
+    s.indexReceipt(id, record)
+    return oldPoints, record.Points, true, nil
+}
+
+// recalculateReceipt rescores one receipt after the points rules changed
+// Input: receipt id in the URL path
+// Output:
+//   - Success: JSON {"id": "uuid-id", "oldPoints": number, "newPoints": number}
+//   - Error: JSON with error message {"error": "message"}, 404 if the id doesn't exist
+func (s *Server) recalculateReceipt(c *gin.Context) {
+    id, ok := receiptID(c)
+    if !ok {
+        return
+    }
+    // For the 404 and ownership checks; recalculate reads it again under the lock
+    if _, ok := s.lookup(c, id); !ok {
+        return
+    }
+    oldPoints, newPoints, exists, err := s.recalculate(c.Request.Context(), id)
+    if err != nil {
+        respondStoreError(c, err, "failed to store receipt")
+        return
+    }
+    if !exists {
+        respondError(c, http.StatusNotFound, codeReceiptNotFound, "receipt not found")
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"id": id, "oldPoints": oldPoints, "newPoints": newPoints})
+}
+
+// recalculateAllReceipts rescores every stored receipt after the points rules changed
+// Input: none
+// Output:
+//   - Success: JSON {"recalculated": n, "changed": n, "failed": n}; receipts
+//              that failed are logged and can be retried one by one
+//   - Error: JSON with error message {"error": "message"} if the ids can't be listed
+func (s *Server) recalculateAllReceipts(c *gin.Context) {
+    // Not cancelled with the request, so a client giving up doesn't leave
+    // the rescoring half done; the route is exempt from -request-timeout
+    ctx := context.WithoutCancel(c.Request.Context())
+    ids, err := s.store.List(ctx)
+    if err != nil {
+        respondStoreError(c, err, "failed to list receipts")
+        return
+    }
+
+    var recalculated, changed, failed atomic.Int64
+    work := make(chan string)
+    var wg sync.WaitGroup
+    for range recalculateWorkers {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for id := range work {
+                oldPoints, newPoints, exists, err := s.recalculate(ctx, id)
+                if err == nil && !exists {
+                    // Deleted or expired since the ids were listed
+                    continue
+                }
+                if err != nil {
+                    slog.Error("failed to recalculate receipt", "id", id, "error", err.Error())
+                    failed.Add(1)
+                    continue
+                }
+                recalculated.Add(1)
+                if oldPoints != newPoints {
+                    changed.Add(1)
+                }
+            }
+        }()
+    }
+    for _, id := range ids {
+        work <- id
+    }
+    close(work)
+    wg.Wait()
+
+    c.JSON(http.StatusOK, gin.H{
+        "recalculated": recalculated.Load(),
+        "changed":      changed.Load(),
+        "failed":       failed.Load(),
+    })
+}
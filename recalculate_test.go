@@ -0,0 +1,142 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+// pausingStore is a MemoryStore whose next Get, once paused is set, blocks
+// after reading until resume is closed
+type pausingStore struct {
+    *MemoryStore
+    paused chan struct{}
+    resume chan struct{}
+}
+
+func (s *pausingStore) Get(ctx context.Context, id string) (ReceiptRecord, bool, error) {
+    record, exists, err := s.MemoryStore.Get(ctx, id)
+    if s.paused != nil {
+        paused := s.paused
+        s.paused = nil
+        close(paused)
+        <-s.resume
+    }
+    return record, exists, err
+}
+
+func TestRecalculateDoesNotRestoreDeletedReceipts(t *testing.T) {
+    store := &pausingStore{MemoryStore: NewMemoryStore()}
+    cfg := defaultConfig()
+    _, body := serve(t, newTestRouterOn(t, cfg, store), http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt))
+    id := body["id"].(string)
+
+    // New point values, so the receipt is rescored and written back
+    cfg.Values.OddDayBonus = 16
+    router := newTestRouterOn(t, cfg, store)
+    store.paused, store.resume = make(chan struct{}), make(chan struct{})
+    paused := store.paused
+    done := make(chan int)
+    go func() {
+        w := httptest.NewRecorder()
+        router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/receipts/recalculate-all", nil))
+        done <- w.Code
+    }()
+    // Delete the receipt after the rescoring read it; the delete has to wait
+    // for the rescoring to finish, else the rescoring stores it again
+    <-paused
+    deleted := make(chan int)
+    go func() {
+        w := httptest.NewRecorder()
+        router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/receipts/"+id, nil))
+        deleted <- w.Code
+    }()
+    select {
+    case status := <-deleted:
+        t.Errorf("DELETE finished with %d while the receipt was being rescored", status)
+        close(store.resume)
+    case <-time.After(50 * time.Millisecond):
+        close(store.resume)
+        if status := <-deleted; status != http.StatusNoContent {
+            t.Errorf("DELETE: got %d, want 204", status)
+        }
+    }
+    if status := <-done; status != http.StatusOK {
+        t.Errorf("recalculate-all: got %d", status)
+    }
+
+    if count, _ := store.Count(context.Background()); count != 0 {
+        t.Errorf("the rescoring stored the deleted receipt again")
+    }
+    if status, body := serve(t, router, http.MethodPost, "/receipts/"+id+"/recalculate", ""); status != http.StatusNotFound {
+        t.Errorf("rescoring a deleted receipt: got %d %v, want 404", status, body)
+    }
+}
+
+func TestRecalculateReceipt(t *testing.T) {
+    store := NewMemoryStore()
+    cfg := defaultConfig()
+    _, body := serve(t, newTestRouterOn(t, cfg, store), http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt))
+    id := body["id"].(string)
+
+    cfg.Values.OddDayBonus = 16
+    router := newTestRouterOn(t, cfg, store)
+    status, body := serve(t, router, http.MethodPost, "/receipts/"+id+"/recalculate", "")
+    if want := fmt.Sprint(map[string]any{"id": id, "oldPoints": 28.0, "newPoints": 38.0}); status != http.StatusOK || fmt.Sprint(body) != want {
+        t.Errorf("got %d %v, want %s", status, body, want)
+    }
+    if _, body := serve(t, router, http.MethodGet, "/receipts/"+id+"/points", ""); body["points"] != 38.0 {
+        t.Errorf("stored points after rescoring: %v, want 38", body)
+    }
+}
+
+func TestBreakdownMatchesStoredPoints(t *testing.T) {
+    store := NewMemoryStore()
+    cfg := defaultConfig()
+    _, body := serve(t, newTestRouterOn(t, cfg, store), http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt))
+    id := body["id"].(string)
+
+    // New point values don't change the stored 28 points, which the live
+    // rules would score 38 and so can't break down
+    cfg.Values.OddDayBonus = 16
+    router := newTestRouterOn(t, cfg, store)
+    for _, path := range []string{"/points/breakdown", "/breakdown"} {
+        if status, body := serve(t, router, http.MethodGet, "/receipts/"+id+path, ""); status != http.StatusConflict || errorDetail(body)["code"] != codeRulesChanged {
+            t.Errorf("%s after a rules change returned %d %v, want 409 %s", path, status, body, codeRulesChanged)
+        }
+        if status, body := serve(t, router, http.MethodGet, "/receipts/"+id+path+"?rulesVersion=old", ""); status != http.StatusBadRequest {
+            t.Errorf("%s with an unsupported rulesVersion returned %d %v, want 400", path, status, body)
+        }
+    }
+    // rulesVersion=current breaks down the points /points gives for it
+    _, current := serve(t, router, http.MethodGet, "/receipts/"+id+"/points?rulesVersion=current", "")
+    if _, body := serve(t, router, http.MethodGet, "/receipts/"+id+"/points/breakdown?rulesVersion=current", ""); body["points"] != current["points"] || ruleSum(body) != current["points"] {
+        t.Errorf("current points breakdown %v, want rules adding up to %v", body, current["points"])
+    }
+    if _, body := serve(t, router, http.MethodGet, "/receipts/"+id+"/breakdown?rulesVersion=current", ""); body["total"] != current["points"] || body["oddDay"] != 16.0 {
+        t.Errorf("current rule breakdown %v, want a total of %v", body, current["points"])
+    }
+
+    // once rescored, the breakdowns explain the stored points again
+    serve(t, router, http.MethodPost, "/receipts/"+id+"/recalculate", "")
+    _, stored := serve(t, router, http.MethodGet, "/receipts/"+id+"/points", "")
+    if _, body := serve(t, router, http.MethodGet, "/receipts/"+id+"/points/breakdown", ""); body["points"] != stored["points"] || ruleSum(body) != stored["points"] {
+        t.Errorf("points breakdown after rescoring %v, want rules adding up to %v", body, stored["points"])
+    }
+    if _, body := serve(t, router, http.MethodGet, "/receipts/"+id+"/breakdown", ""); body["total"] != stored["points"] {
+        t.Errorf("rule breakdown after rescoring %v, want a total of %v", body, stored["points"])
+    }
+}
+
+// ruleSum adds up the rule points of a GET /receipts/{id}/points/breakdown
+func ruleSum(breakdown map[string]any) any {
+    sum := 0.0
+    rules, _ := breakdown["rules"].([]any)
+    for _, rule := range rules {
+        sum += rule.(map[string]any)["points"].(float64)
+    }
+    return sum
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+)
+
+const (
+    // redisKeyPrefix prefixes every receipt key: receipt:<id>
+    redisKeyPrefix = "receipt:"
+    // redisOrderKey is a sorted set of receipt ids scored by insertion time
+    redisOrderKey = "receipts:order"
+    // redisRedemptionsKey is a list of JSON encoded redemptions, oldest first
+    redisRedemptionsKey = "redemptions"
+)
+
+// RedisStore is a Store backed by Redis, so several replicas can share receipts
+// The replicas don't share balances, statistics or the duplicate index, which
+// each builds in memory at startup, see newStore
+type RedisStore struct {
+    client *redis.Client
+}
+
+// NewRedisStore connects to the Redis server at addr
+// Input: host:port of the Redis server
+// Output: *RedisStore; the connection is not checked until it is used
+func NewRedisStore(addr string) *RedisStore {
+    client := redis.NewClient(&redis.Options{
+        Addr:         addr,
+        PoolSize:     10,
+        DialTimeout:  2 * time.Second,
+        ReadTimeout:  time.Second,
+        WriteTimeout: time.Second,
+    })
+    return &RedisStore{client: client}
+}
+
+// Put stores a record under id
+// Input: context, receipt id and record
+// Output: nil, or an error wrapping ErrUnavailable
+func (s *RedisStore) Put(ctx context.Context, id string, record ReceiptRecord) error {
+    return s.PutBatch(ctx, []string{id}, []ReceiptRecord{record})
+}
+
+// PutBatch stores several records in one MULTI/EXEC transaction
+// Input: context, receipt ids and records, matched by index
+// Output: nil, or an error wrapping ErrUnavailable
+func (s *RedisStore) PutBatch(ctx context.Context, ids []string, records []ReceiptRecord) error {
+    pipe := s.client.TxPipeline()
+    for i, id := range ids {
+        data, err := json.Marshal(records[i])
+        if err != nil {
+            return err
+        }
+        pipe.Set(ctx, redisKeyPrefix+id, data, 0)
+        // NX keeps the original position when an existing id is replaced
+        pipe.ZAddNX(ctx, redisOrderKey, redis.Z{Score: float64(time.Now().UnixNano()), Member: id})
+    }
+    if _, err := pipe.Exec(ctx); err != nil {
+        return unavailable(err)
+    }
+    return nil
+}
+
+// Get returns the record stored under id
+// Input: context and receipt id
+// Output: the record and true, an empty record and false if it doesn't exist,
+//         or an error wrapping ErrUnavailable
+func (s *RedisStore) Get(ctx context.Context, id string) (ReceiptRecord, bool, error) {
+    data, err := s.client.Get(ctx, redisKeyPrefix+id).Bytes()
+    if errors.Is(err, redis.Nil) {
+        return ReceiptRecord{}, false, nil
+    }
+    if err != nil {
+        return ReceiptRecord{}, false, unavailable(err)
+    }
+    var record ReceiptRecord
+    if err := json.Unmarshal(data, &record); err != nil {
+        return ReceiptRecord{}, false, err
+    }
+    return record, true, nil
+}
+
+// Delete removes the record stored under id
+// Input: context and receipt id
+// Output: nil, ErrNotFound if the id doesn't exist, or an error wrapping ErrUnavailable
+func (s *RedisStore) Delete(ctx context.Context, id string) error {
+    pipe := s.client.TxPipeline()
+    deleted := pipe.Del(ctx, redisKeyPrefix+id)
+    pipe.ZRem(ctx, redisOrderKey, id)
+    if _, err := pipe.Exec(ctx); err != nil {
+        return unavailable(err)
+    }
+    if deleted.Val() == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+// List returns all stored ids in insertion order
+// Input: context
+// Output: slice of ids, or an error wrapping ErrUnavailable
+func (s *RedisStore) List(ctx context.Context) ([]string, error) {
+    ids, err := s.client.ZRange(ctx, redisOrderKey, 0, -1).Result()
+    if err != nil {
+        return nil, unavailable(err)
+    }
+    return ids, nil
+}
+
+// Count returns the number of stored receipts
+// Input: context
+// Output: receipt count, or an error wrapping ErrUnavailable
+func (s *RedisStore) Count(ctx context.Context) (int, error) {
+    n, err := s.client.ZCard(ctx, redisOrderKey).Result()
+    if err != nil {
+        return 0, unavailable(err)
+    }
+    return int(n), nil
+}
+
+// PutRedemption stores a points redemption
+// Input: context and redemption
+// Output: nil, or an error wrapping ErrUnavailable
+func (s *RedisStore) PutRedemption(ctx context.Context, redemption Redemption) error {
+    data, err := json.Marshal(redemption)
+    if err != nil {
+        return err
+    }
+    if err := s.client.RPush(ctx, redisRedemptionsKey, data).Err(); err != nil {
+        return unavailable(err)
+    }
+    return nil
+}
+
+// Redemptions returns every stored redemption, oldest first
+// Input: context
+// Output: slice of redemptions, or an error wrapping ErrUnavailable
+func (s *RedisStore) Redemptions(ctx context.Context) ([]Redemption, error) {
+    entries, err := s.client.LRange(ctx, redisRedemptionsKey, 0, -1).Result()
+    if err != nil {
+        return nil, unavailable(err)
+    }
+    redemptions := make([]Redemption, 0, len(entries))
+    for _, data := range entries {
+        var redemption Redemption
+        if err := json.Unmarshal([]byte(data), &redemption); err != nil {
+            return nil, err
+        }
+        redemptions = append(redemptions, redemption)
+    }
+    return redemptions, nil
+}
+
+// Ping checks that the Redis server is reachable
+// Input: context
+// Output: nil, or an error wrapping ErrUnavailable
+func (s *RedisStore) Ping(ctx context.Context) error {
+    if err := s.client.Ping(ctx).Err(); err != nil {
+        return unavailable(err)
+    }
+    return nil
+}
+
+// unavailable marks a Redis error as the backend being unreachable
+// Input: error returned by the Redis client
+// Output: error wrapping both ErrUnavailable and err
+func unavailable(err error) error {
+    return fmt.Errorf("%w: %w", ErrUnavailable, err)
+}
+
+// Close closes the connection pool
+// Input: none
+// Output: nil, or an error from the Redis client
+func (s *RedisStore) Close() error {
+    return s.client.Close()
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "time"
+    "unicode"
+    "unicode/utf8"
+)
+
+// Rule names, as reported in points breakdowns
+const (
+    ruleRetailerAlphanumeric = "retailer_alphanumeric"
+    ruleRoundDollar          = "round_dollar"
+    ruleQuarterMultiple      = "quarter_multiple"
+    ruleItemPairs            = "item_pairs"
+    ruleItemDescription      = "item_description"
+    ruleOddDay               = "odd_day"
+    ruleAfternoon            = "afternoon"
+    ruleWeekend              = "weekend"
+    ruleLargePurchase        = "large_purchase"
+    ruleTotalOverTen         = "total_over_ten"
+)
+
+// Rule is one way a receipt earns points
+// Implementations must be safe for concurrent use
+type Rule interface {
+    // Name identifies the rule in breakdowns
+    // Input: none
+    // Output: name unique among the rules, e.g. "round_dollar"
+    Name() string
+    // Apply scores a receipt under this rule
+    // Input: receipt parsed by parseReceipt
+    // Output: the points earned, 0 if the rule doesn't apply, and a short
+    //         explanation of the points awarded, usually empty for 0
+    Apply(receipt Receipt) (int, string)
+}
+
+// itemRule is a Rule that awards points per item; breakdowns list its
+// points item by item
+type itemRule interface {
+    Rule
+    // ApplyItems returns the points each item earns, by item index
+    ApplyItems(receipt Receipt) []int
+}
+
+// registeredRules are extra rules appended to the configured ones
+var registeredRules []Rule
+
+// RegisterRule adds a rule applied to every receipt after the built-in ones
+// Call it from an init function, e.g. in a file behind a build tag, before
+// the server starts
+// Input: rule with a name not used by another rule
+// Output: none
+func RegisterRule(rule Rule) {
+    registeredRules = append(registeredRules, rule)
+}
+
+// buildRules lists the enabled built-in rules in order, then the registered ones
+// Input: the rules to enable and the points each awards
+// Output: rules to apply to a receipt
+func buildRules(rules PointsRuleConfig, values PointsValues) []Rule {
+    var ruleSet []Rule
+    if rules.EnableRetailerAlphanumeric {
+        ruleSet = append(ruleSet, retailerAlphanumericRule{})
+    }
+    if rules.EnableRoundDollar {
+        ruleSet = append(ruleSet, roundDollarRule{points: values.RoundDollarBonus})
+    }
+    if rules.EnableQuarterMultiple {
+        ruleSet = append(ruleSet, quarterMultipleRule{points: values.QuarterMultipleBonus})
+    }
+    if rules.EnableItemPairs {
+        ruleSet = append(ruleSet, itemPairsRule{points: values.ItemPairBonus})
+    }
+    if rules.EnableItemDescription {
+        ruleSet = append(ruleSet, itemDescriptionRule{multiplier: values.multiplierBasisPoints()})
+    }
+    if rules.EnableOddDay {
+        ruleSet = append(ruleSet, oddDayRule{points: values.OddDayBonus})
+    }
+    if rules.EnableAfternoon {
+        ruleSet = append(ruleSet, afternoonRule{
+            points:         values.AfternoonBonus,
+            start:          rules.AfternoonWindowStart,
+            end:            rules.AfternoonWindowEnd,
+            startInclusive: rules.AfternoonWindowStartInclusive,
+        })
+    }
+    if rules.EnableWeekendBonus {
+        ruleSet = append(ruleSet, weekendRule{points: values.WeekendBonus})
+    }
+    if rules.EnableLargePurchaseBonus {
+        ruleSet = append(ruleSet, largePurchaseRule{
+            points:    values.LargePurchaseBonus,
+            threshold: values.LargePurchaseThreshold,
+        })
+    }
+    if rules.EnableTotalOverTen {
+        ruleSet = append(ruleSet, totalOverTenRule{points: values.TotalOverTenBonus})
+    }
+    return append(ruleSet, registeredRules...)
+}
+
+// retailerAlphanumericRule is Rule 1: one point per alphanumeric retailer character
+type retailerAlphanumericRule struct{}
+
+// Name returns "retailer_alphanumeric"
+func (retailerAlphanumericRule) Name() string { return ruleRetailerAlphanumeric }
+
+// Apply counts letters and digits of any script, so "Café" earns 4
+func (retailerAlphanumericRule) Apply(receipt Receipt) (int, string) {
+    points := 0
+    for _, r := range receipt.Retailer {
+        if unicode.IsLetter(r) || unicode.IsDigit(r) {
+            points++
+        }
+    }
+    return points, fmt.Sprintf("%d alphanumeric characters in the retailer name", points)
+}
+
+// roundDollarRule is Rule 2: a bonus for a total with no cents
+type roundDollarRule struct{ points int }
+
+// Name returns "round_dollar"
+func (roundDollarRule) Name() string { return ruleRoundDollar }
+
+// Apply awards r.points when the total has no cents
+func (r roundDollarRule) Apply(receipt Receipt) (int, string) {
+    if receipt.Total%100 != 0 {
+        return 0, ""
+    }
+    return r.points, "total is a round dollar amount"
+}
+
+// quarterMultipleRule is Rule 3: a bonus for a total that is a multiple of 0.25
+type quarterMultipleRule struct{ points int }
+
+// Name returns "quarter_multiple"
+func (quarterMultipleRule) Name() string { return ruleQuarterMultiple }
+
+// Apply awards r.points when the total in cents divides by 25
+func (r quarterMultipleRule) Apply(receipt Receipt) (int, string) {
+    if receipt.Total%25 != 0 {
+        return 0, ""
+    }
+    return r.points, "total is a multiple of 0.25"
+}
+
+// itemPairsRule is Rule 4: points for every two items
+type itemPairsRule struct{ points int }
+
+// Name returns "item_pairs"
+func (itemPairsRule) Name() string { return ruleItemPairs }
+
+// Apply awards r.points per pair; an odd item out earns nothing
+func (r itemPairsRule) Apply(receipt Receipt) (int, string) {
+    pairs := len(receipt.Items) / 2
+    return pairs * r.points, fmt.Sprintf("%d pairs of items", pairs)
+}
+
+// itemDescriptionRule is Rule 5: price * multiplier, rounded up, for each
+// item whose trimmed description length is a multiple of 3
+type itemDescriptionRule struct {
+    // multiplier in basis points, so 0.2 is 2000
+    multiplier int64
+}
+
+// Name returns "item_description"
+func (itemDescriptionRule) Name() string { return ruleItemDescription }
+
+// Apply sums ApplyItems, reporting how many items earned points
+func (r itemDescriptionRule) Apply(receipt Receipt) (int, string) {
+    points, matched := 0, 0
+    for _, itemPoints := range r.ApplyItems(receipt) {
+        if itemPoints > 0 {
+            points += itemPoints
+            matched++
+        }
+    }
+    return points, fmt.Sprintf("%d items with a description length that is a multiple of 3", matched)
+}
+
+// ApplyItems scores each item on its own
+// Length is counted in runes, so "Café" is 4 characters; combining marks
+// (e.g. "e" followed by U+0301) count as separate runes
+func (r itemDescriptionRule) ApplyItems(receipt Receipt) []int {
+    points := make([]int, len(receipt.Items))
+    for i, item := range receipt.Items {
+        // TrimSpace removes leading and trailing white space
+        trimmed := strings.TrimSpace(item.ShortDescription)
+        // An empty description has length 0, which must not count as a multiple of 3
+        length := utf8.RuneCountInString(trimmed)
+        if length > 0 && length%3 == 0 {
+            // Whole-number arithmetic avoids float rounding, e.g. 5.00 * 0.2 is exactly 1;
+            // price * multiplier rounded up; cents * basis points is in millionths of a point
+            points[i] = int((item.Price*r.multiplier + 999999) / 1000000)
+        }
+    }
+    return points
+}
+
+// oddDayRule is Rule 6: a bonus for an odd purchase day
+type oddDayRule struct{ points int }
+
+// Name returns "odd_day"
+func (oddDayRule) Name() string { return ruleOddDay }
+
+// Apply awards r.points when the purchase day of the month is odd
+func (r oddDayRule) Apply(receipt Receipt) (int, string) {
+    day := receipt.PurchasedAt.Day()
+    if day%2 == 0 {
+        return 0, ""
+    }
+    return r.points, fmt.Sprintf("purchase day %d is odd", day)
+}
+
+// afternoonRule is Rule 7: a bonus for a purchase "after 2:00pm and before
+// 4:00pm"; both ends are exclusive, so 14:00:01 through 15:59:59 earn the
+// bonus and 14:00 and 16:00 don't, unless startInclusive lets 14:00 in too
+type afternoonRule struct {
+    points int
+    // offsets from midnight
+    start, end     time.Duration
+    startInclusive bool
+}
+
+// Name returns "afternoon"
+func (afternoonRule) Name() string { return ruleAfternoon }
+
+// Apply awards r.points when the purchase time falls in the window,
+// naming the window's ends in the detail
+func (r afternoonRule) Apply(receipt Receipt) (int, string) {
+    // Seconds count, so a purchaseDateTime of 14:00:01 is after 14:00
+    offset := time.Duration(receipt.PurchasedAt.Hour())*time.Hour +
+        time.Duration(receipt.PurchasedAt.Minute())*time.Minute +
+        time.Duration(receipt.PurchasedAt.Second())*time.Second
+    afterStart := offset > r.start || (r.startInclusive && offset == r.start)
+    if !afterStart || offset >= r.end {
+        return 0, ""
+    }
+    clock := receipt.PurchasedAt.Format("15:04")
+    if receipt.PurchasedAt.Second() != 0 {
+        clock = receipt.PurchasedAt.Format("15:04:05")
+    }
+    // Say which ends are exclusive, so 14:00 not earning it isn't a surprise
+    after := "after"
+    if r.startInclusive {
+        after = "at or after"
+    }
+    return r.points, fmt.Sprintf("purchased at %s, %s %s and before %s",
+        clock, after, formatClock(r.start), formatClock(r.end))
+}
+
+// weekendRule is Rule 8: a bonus for a purchase on a Saturday or Sunday
+type weekendRule struct{ points int }
+
+// Name returns "weekend"
+func (weekendRule) Name() string { return ruleWeekend }
+
+// Apply awards r.points for a Saturday or Sunday purchase, in the
+// receipt's own zone
+func (r weekendRule) Apply(receipt Receipt) (int, string) {
+    day := receipt.PurchasedAt.Weekday()
+    if day != time.Saturday && day != time.Sunday {
+        return 0, ""
+    }
+    return r.points, "purchased on a " + day.String()
+}
+
+// largePurchaseRule is Rule 9: a bonus for a total at or above the threshold
+type largePurchaseRule struct {
+    points int
+    // threshold in cents
+    threshold int64
+}
+
+// Name returns "large_purchase"
+func (largePurchaseRule) Name() string { return ruleLargePurchase }
+
+// Apply awards r.points when the total reaches the threshold
+func (r largePurchaseRule) Apply(receipt Receipt) (int, string) {
+    if receipt.Total < r.threshold {
+        return 0, ""
+    }
+    return r.points, fmt.Sprintf("total %s is at least %s", formatCents(receipt.Total), formatCents(r.threshold))
+}
+
+// totalOverTenRule is Rule 10: a bonus for a total strictly greater than 10.00,
+// so 10.00 earns nothing and 10.01 earns the bonus
+type totalOverTenRule struct{ points int }
+
+// Name returns "total_over_ten"
+func (totalOverTenRule) Name() string { return ruleTotalOverTen }
+
+// Apply awards r.points when the total exceeds 1000 cents
+func (r totalOverTenRule) Apply(receipt Receipt) (int, string) {
+    if receipt.Total <= 1000 {
+        return 0, ""
+    }
+    return r.points, "total " + formatCents(receipt.Total) + " is greater than 10.00"
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+
+    "gopkg.in/yaml.v3"
+)
+
+// toggleEntry is a rules file entry for a rule with nothing to tune
+type toggleEntry struct {
+    Enabled *bool `yaml:"enabled"`
+}
+
+// pointsEntry is a rules file entry for a rule awarding a fixed bonus
+type pointsEntry struct {
+    Enabled *bool `yaml:"enabled"`
+    Points  *int  `yaml:"points"`
+}
+
+// descriptionEntry is the rules file entry for Rule 5
+type descriptionEntry struct {
+    Enabled    *bool    `yaml:"enabled"`
+    Multiplier *float64 `yaml:"multiplier"`
+}
+
+// afternoonEntry is the rules file entry for Rule 7
+type afternoonEntry struct {
+    Enabled *bool `yaml:"enabled"`
+    Points  *int  `yaml:"points"`
+    // Start and End are HH:MM; the window excludes both unless
+    // StartInclusive is set
+    Start          *string `yaml:"start"`
+    End            *string `yaml:"end"`
+    StartInclusive *bool   `yaml:"startInclusive"`
+}
+
+// largePurchaseEntry is the rules file entry for Rule 9
+type largePurchaseEntry struct {
+    Enabled *bool `yaml:"enabled"`
+    Points  *int  `yaml:"points"`
+    // Threshold is in dollars, e.g. "100.00"
+    Threshold *string `yaml:"threshold"`
+}
+
+// rulesFile is the layout of the file given by RULES_FILE or -rules
+// Every entry and field is optional; missing ones keep their current value
+type rulesFile struct {
+    RetailerAlphanumeric *toggleEntry        `yaml:"retailerAlphanumeric"`
+    RoundDollar          *pointsEntry        `yaml:"roundDollar"`
+    QuarterMultiple      *pointsEntry        `yaml:"quarterMultiple"`
+    ItemPairs            *pointsEntry        `yaml:"itemPairs"`
+    ItemDescription      *descriptionEntry   `yaml:"itemDescription"`
+    OddDay               *pointsEntry        `yaml:"oddDay"`
+    Afternoon            *afternoonEntry     `yaml:"afternoon"`
+    Weekend              *pointsEntry        `yaml:"weekend"`
+    LargePurchase        *largePurchaseEntry `yaml:"largePurchase"`
+    TotalOverTen         *pointsEntry        `yaml:"totalOverTen"`
+}
+
+// loadRulesFile reads a YAML or JSON rules file over the current rules and values
+// Input: file path, and the rules and values to update
+// Output: nil, or an error naming the file for a missing file, an unknown
+//         rule or field, or a badly formatted value; nothing is changed on error
+//         Ranges, such as negative points, are checked later by validate
+func loadRulesFile(path string, rules *PointsRuleConfig, values *PointsValues) error {
+    content, err := os.ReadFile(path)
+    if err != nil {
+        return fmt.Errorf("rules file: %w", err)
+    }
+    var file rulesFile
+    decoder := yaml.NewDecoder(bytes.NewReader(content))
+    // A misspelled rule would otherwise be ignored silently
+    decoder.KnownFields(true)
+    // An empty file decodes to io.EOF and leaves everything as it is
+    if err := decoder.Decode(&file); err != nil && len(bytes.TrimSpace(content)) > 0 {
+        return fmt.Errorf("rules file %s: %w", path, err)
+    }
+
+    // Work on copies so a bad value halfway through changes nothing
+    r, v := *rules, *values
+    if e := file.RetailerAlphanumeric; e != nil {
+        setBool(&r.EnableRetailerAlphanumeric, e.Enabled)
+    }
+    if e := file.RoundDollar; e != nil {
+        setBool(&r.EnableRoundDollar, e.Enabled)
+        setInt(&v.RoundDollarBonus, e.Points)
+    }
+    if e := file.QuarterMultiple; e != nil {
+        setBool(&r.EnableQuarterMultiple, e.Enabled)
+        setInt(&v.QuarterMultipleBonus, e.Points)
+    }
+    if e := file.ItemPairs; e != nil {
+        setBool(&r.EnableItemPairs, e.Enabled)
+        setInt(&v.ItemPairBonus, e.Points)
+    }
+    if e := file.ItemDescription; e != nil {
+        setBool(&r.EnableItemDescription, e.Enabled)
+        if e.Multiplier != nil {
+            v.ItemDescriptionMultiplier = *e.Multiplier
+        }
+    }
+    if e := file.OddDay; e != nil {
+        setBool(&r.EnableOddDay, e.Enabled)
+        setInt(&v.OddDayBonus, e.Points)
+    }
+    if e := file.Afternoon; e != nil {
+        setBool(&r.EnableAfternoon, e.Enabled)
+        setInt(&v.AfternoonBonus, e.Points)
+        if e.Start != nil {
+            if r.AfternoonWindowStart, err = parseClock(*e.Start); err != nil {
+                return fmt.Errorf("rules file %s: afternoon start: %w", path, err)
+            }
+        }
+        if e.End != nil {
+            if r.AfternoonWindowEnd, err = parseClock(*e.End); err != nil {
+                return fmt.Errorf("rules file %s: afternoon end: %w", path, err)
+            }
+        }
+        setBool(&r.AfternoonWindowStartInclusive, e.StartInclusive)
+    }
+    if e := file.Weekend; e != nil {
+        setBool(&r.EnableWeekendBonus, e.Enabled)
+        setInt(&v.WeekendBonus, e.Points)
+    }
+    if e := file.LargePurchase; e != nil {
+        setBool(&r.EnableLargePurchaseBonus, e.Enabled)
+        setInt(&v.LargePurchaseBonus, e.Points)
+        if e.Threshold != nil {
+            if v.LargePurchaseThreshold, err = parseDollars(*e.Threshold); err != nil {
+                return fmt.Errorf("rules file %s: largePurchase threshold: %w", path, err)
+            }
+        }
+    }
+    if e := file.TotalOverTen; e != nil {
+        setBool(&r.EnableTotalOverTen, e.Enabled)
+        setInt(&v.TotalOverTenBonus, e.Points)
+    }
+    *rules, *values = r, v
+    return nil
+}
+
+// setBool copies a rules file value into dst when the file sets it
+func setBool(dst *bool, value *bool) {
+    if value != nil {
+        *dst = *value
+    }
+}
+
+// setInt copies a rules file value into dst when the file sets it
+func setInt(dst *int, value *int) {
+    if value != nil {
+        *dst = *value
+    }
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "net/http"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+// writeRulesFile writes a rules file into a temporary directory
+// Input: file name, whose extension is only for readers, and its content
+// Output: the file's path
+func writeRulesFile(t *testing.T, name, content string) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), name)
+    if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestRulesFileChangesScoring(t *testing.T) {
+    path := writeRulesFile(t, "rules.yaml", `
+retailerAlphanumeric:
+  enabled: false
+itemPairs:
+  points: 1
+itemDescription:
+  multiplier: 0.5
+oddDay:
+  points: 20
+afternoon:
+  points: 11
+  start: "13:00"
+totalOverTen:
+  enabled: true
+  points: 7
+`)
+    cfg := defaultConfig()
+    if err := loadRulesFile(path, &cfg.Rules, &cfg.Values); err != nil {
+        t.Fatal(err)
+    }
+    if err := cfg.validate(); err != nil {
+        t.Fatal(err)
+    }
+
+    receipt, err := parseReceipt(exampleReceipt, parseOptions{maxItems: 1000, loc: time.UTC})
+    if err != nil {
+        t.Fatal(err)
+    }
+    // The example earns 28 with the defaults
+    want := PointsBreakdown{
+        // two pairs at 1 point each
+        ItemPairBonus: 2,
+        // ceil(12.25 * 0.5) for the pizza and 12.00 * 0.5 for the Klarbrunn
+        ItemDescriptionBonus: 7 + 6,
+        OddDay:               20,
+        // 13:01 is after the 13:00 start
+        AfternoonWindow:   11,
+        TotalOverTenBonus: 7,
+        Total:             2 + 13 + 20 + 11 + 7,
+    }
+    if got := calculatePointsBreakdown(receipt, cfg.Rules, cfg.Values); !reflect.DeepEqual(got, want) {
+        t.Fatalf("custom rules scored %+v, want %+v", got, want)
+    }
+
+    // The server scores with the file too
+    router := newTestRouterWith(t, cfg)
+    if _, body := serve(t, router, http.MethodPost, "/receipts/process?includePoints=true", receiptJSON(t, exampleReceipt)); body["points"] != float64(want.Total) {
+        t.Fatalf("process with custom rules returned %v, want %d points", body, want.Total)
+    }
+
+    // A JSON file works too, and fields it leaves out keep their defaults
+    path = writeRulesFile(t, "rules.json", `{"oddDay": {"enabled": false}, "roundDollar": {"points": 75}}`)
+    cfg = defaultConfig()
+    if err := loadRulesFile(path, &cfg.Rules, &cfg.Values); err != nil {
+        t.Fatal(err)
+    }
+    if cfg.Rules.EnableOddDay || cfg.Values.RoundDollarBonus != 75 || cfg.Values.QuarterMultipleBonus != defaultValues().QuarterMultipleBonus {
+        t.Fatalf("JSON rules file loaded as %+v %+v", cfg.Rules, cfg.Values)
+    }
+    if got := calculatePoints(receipt, cfg.Rules, cfg.Values); got != 28-6 {
+        t.Fatalf("with the odd day rule off the example scored %d, want 22", got)
+    }
+}
+
+func TestRulesFileErrors(t *testing.T) {
+    tests := []struct {
+        name, content, wantErr string
+    }{
+        {"unknown rule", "oddDays:\n  points: 5\n", "oddDays"},
+        {"unknown field", "oddDay:\n  bonus: 5\n", "bonus"},
+        {"malformed value", "oddDay:\n  points: six\n", "six"},
+        {"bad clock", "afternoon:\n  start: 2pm\n", "afternoon start"},
+        {"bad threshold", "largePurchase:\n  threshold: lots\n", "largePurchase threshold"},
+    }
+    for _, tt := range tests {
+        path := writeRulesFile(t, "rules.yaml", "roundDollar:\n  points: 99\n"+tt.content)
+        cfg := defaultConfig()
+        err := loadRulesFile(path, &cfg.Rules, &cfg.Values)
+        if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), path) {
+            t.Errorf("%s: got %v, want an error naming %s and %q", tt.name, err, path, tt.wantErr)
+        }
+        // nothing is applied from a file with an error
+        if cfg.Values.RoundDollarBonus != defaultValues().RoundDollarBonus {
+            t.Errorf("%s: roundDollar points changed to %d by a rejected file", tt.name, cfg.Values.RoundDollarBonus)
+        }
+    }
+
+    // Ranges are checked at startup
+    t.Setenv("RULES_FILE", writeRulesFile(t, "rules.yaml", "oddDay:\n  points: -1\n"))
+    if _, err := LoadConfig(); err == nil {
+        t.Error("LoadConfig accepted negative odd day points from the rules file")
+    }
+    t.Setenv("RULES_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+    if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "rules file") {
+        t.Errorf("LoadConfig with a missing rules file: got %v", err)
+    }
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "slices"
+    "testing"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// ruleResult is what one rule returned for a receipt
+type ruleResult struct {
+    name   string
+    points int
+    detail string
+}
+
+// applyRules runs each rule of a rule set on a receipt, in order
+func applyRules(t *testing.T, input ReceiptInput, rules PointsRuleConfig) []ruleResult {
+    t.Helper()
+    receipt, err := parseReceipt(input, parseOptions{maxItems: 1000, loc: time.UTC})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var results []ruleResult
+    for _, rule := range buildRules(rules, defaultValues()) {
+        points, detail := rule.Apply(receipt)
+        results = append(results, ruleResult{rule.Name(), points, detail})
+    }
+    return results
+}
+
+// Receipts from the challenge's examples, with their points worked out by
+// hand from the rules as the challenge states them
+var (
+    mmReceipt = ReceiptInput{
+        Retailer:     "M&M Corner Market",
+        PurchaseDate: "2022-03-20",
+        PurchaseTime: "14:33",
+        Items: []ItemInput{
+            {ShortDescription: "Gatorade", Price: "2.25"},
+            {ShortDescription: "Gatorade", Price: "2.25"},
+            {ShortDescription: "Gatorade", Price: "2.25"},
+            {ShortDescription: "Gatorade", Price: "2.25"},
+        },
+        Total: "9.00",
+    }
+    walgreensReceipt = ReceiptInput{
+        Retailer:     "Walgreens",
+        PurchaseDate: "2022-01-02",
+        PurchaseTime: "08:13",
+        Items: []ItemInput{
+            {ShortDescription: "Pepsi - 12-oz", Price: "1.25"},
+            {ShortDescription: "Dasani", Price: "1.40"},
+        },
+        Total: "2.65",
+    }
+)
+
+func TestDefaultRulesGolden(t *testing.T) {
+    tests := []struct {
+        name  string
+        input ReceiptInput
+        want  []ruleResult
+        total int
+    }{
+        {"Target", exampleReceipt, []ruleResult{
+            {ruleRetailerAlphanumeric, 6, "6 alphanumeric characters in the retailer name"},
+            {ruleRoundDollar, 0, ""},
+            {ruleQuarterMultiple, 0, ""},
+            {ruleItemPairs, 10, "2 pairs of items"},
+            {ruleItemDescription, 6, "2 items with a description length that is a multiple of 3"},
+            {ruleOddDay, 6, "purchase day 1 is odd"},
+            {ruleAfternoon, 0, ""},
+        }, 28},
+        {"M&M Corner Market", mmReceipt, []ruleResult{
+            {ruleRetailerAlphanumeric, 14, "14 alphanumeric characters in the retailer name"},
+            {ruleRoundDollar, 50, "total is a round dollar amount"},
+            {ruleQuarterMultiple, 25, "total is a multiple of 0.25"},
+            {ruleItemPairs, 10, "2 pairs of items"},
+            {ruleItemDescription, 0, "0 items with a description length that is a multiple of 3"},
+            {ruleOddDay, 0, ""},
+            {ruleAfternoon, 10, "purchased at 14:33, after 14:00 and before 16:00"},
+        }, 109},
+        {"Walgreens", walgreensReceipt, []ruleResult{
+            {ruleRetailerAlphanumeric, 9, "9 alphanumeric characters in the retailer name"},
+            {ruleRoundDollar, 0, ""},
+            {ruleQuarterMultiple, 0, ""},
+            {ruleItemPairs, 5, "1 pairs of items"},
+            // ceil(1.40 * 0.2) for Dasani
+            {ruleItemDescription, 1, "1 items with a description length that is a multiple of 3"},
+            {ruleOddDay, 0, ""},
+            {ruleAfternoon, 0, ""},
+        }, 15},
+    }
+    for _, tt := range tests {
+        got := applyRules(t, tt.input, allRules())
+        if !slices.Equal(got, tt.want) {
+            t.Errorf("%s: rules returned\n%v\nwant\n%v", tt.name, got, tt.want)
+        }
+        receipt, _ := parseReceipt(tt.input, parseOptions{maxItems: 1000, loc: time.UTC})
+        if points := calculatePoints(receipt, allRules(), defaultValues()); points != tt.total {
+            t.Errorf("%s: calculatePoints = %d, want %d", tt.name, points, tt.total)
+        }
+    }
+}
+
+func TestOptionalRulesGolden(t *testing.T) {
+    rules := allRules()
+    rules.EnableWeekendBonus = true
+    rules.EnableLargePurchaseBonus = true
+    rules.EnableTotalOverTen = true
+    tests := []struct {
+        name  string
+        input ReceiptInput
+        want  []ruleResult
+    }{
+        // 2022-01-01 was a Saturday
+        {"Target", exampleReceipt, []ruleResult{
+            {ruleWeekend, 15, "purchased on a Saturday"},
+            {ruleLargePurchase, 0, ""},
+            {ruleTotalOverTen, 5, "total 35.35 is greater than 10.00"},
+        }},
+        // 2022-03-20 was a Sunday
+        {"M&M Corner Market", mmReceipt, []ruleResult{
+            {ruleWeekend, 15, "purchased on a Sunday"},
+            {ruleLargePurchase, 0, ""},
+            {ruleTotalOverTen, 0, ""},
+        }},
+    }
+    for _, tt := range tests {
+        // the optional rules come after the seven default ones
+        got := applyRules(t, tt.input, rules)
+        if len(got) != 10 || !slices.Equal(got[7:], tt.want) {
+            t.Errorf("%s: optional rules returned %v, want %v", tt.name, got[7:], tt.want)
+        }
+    }
+}
+
+// flatRule is a registered rule awarding the same points to every receipt
+type flatRule struct{ points int }
+
+func (flatRule) Name() string { return "flat" }
+
+func (r flatRule) Apply(Receipt) (int, string) { return r.points, "every receipt" }
+
+func TestRegisterRule(t *testing.T) {
+    saved := registeredRules
+    t.Cleanup(func() { registeredRules = saved })
+    RegisterRule(flatRule{points: 3})
+
+    got := applyRules(t, exampleReceipt, allRules())
+    if last := got[len(got)-1]; len(got) != 8 || last != (ruleResult{"flat", 3, "every receipt"}) {
+        t.Fatalf("registered rule ran as %v, want it last after the seven default rules", got)
+    }
+    receipt, _ := parseReceipt(exampleReceipt, parseOptions{maxItems: 1000, loc: time.UTC})
+    breakdown := calculatePointsBreakdown(receipt, allRules(), defaultValues())
+    if breakdown.Total != 31 || breakdown.Other["flat"] != 3 {
+        t.Fatalf("breakdown with a registered rule: %+v, want 31 with 3 under other", breakdown)
+    }
+}
+
+func TestTotalOverTenBreakdown(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.Rules.EnableTotalOverTen = true
+    router := newTestRouterWith(t, cfg)
+    // ruleLine stores a receipt with the given total and returns the total
+    // over ten line of its points breakdown, nil if it has none, and its
+    // per-rule breakdown
+    ruleLine := func(router *gin.Engine, total Amount) (map[string]any, map[string]any) {
+        input := walgreensReceipt
+        input.Total = total
+        _, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, input))
+        id, _ := body["id"].(string)
+        _, byRule := serve(t, router, http.MethodGet, "/receipts/"+id+"/breakdown", "")
+        _, lines := serve(t, router, http.MethodGet, "/receipts/"+id+"/points/breakdown", "")
+        for _, line := range lines["rules"].([]any) {
+            if line := line.(map[string]any); line["rule"] == ruleTotalOverTen {
+                return line, byRule
+            }
+        }
+        return nil, byRule
+    }
+
+    // strictly greater than 10.00
+    for _, total := range []Amount{"9.99", "10.00"} {
+        if line, byRule := ruleLine(router, total); line != nil || byRule["totalOverTenBonus"] != 0.0 {
+            t.Errorf("total %s: breakdown line %v and totalOverTenBonus %v, want none", total, line, byRule["totalOverTenBonus"])
+        }
+    }
+    line, byRule := ruleLine(router, "10.01")
+    if line == nil || line["points"] != 5.0 || line["detail"] != "total 10.01 is greater than 10.00" || byRule["totalOverTenBonus"] != 5.0 {
+        t.Errorf("total 10.01: breakdown line %v and totalOverTenBonus %v, want 5 points", line, byRule["totalOverTenBonus"])
+    }
+
+    // the rule is off unless enabled, so existing scores don't change
+    if line, _ := ruleLine(newTestRouter(t), "10.01"); line != nil {
+        t.Errorf("with the default rules, 10.01 has breakdown line %v", line)
+    }
+}
+
+// ruleBreakdown stores a receipt and returns its GET /receipts/{id}/breakdown
+func ruleBreakdown(t *testing.T, router *gin.Engine, input ReceiptInput) map[string]any {
+    t.Helper()
+    _, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, input))
+    _, breakdown := serve(t, router, http.MethodGet, fmt.Sprintf("/receipts/%s/breakdown", body["id"]), "")
+    return breakdown
+}
+
+func TestLargePurchaseBreakdown(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.Rules.EnableLargePurchaseBonus = true
+    router := newTestRouterWith(t, cfg)
+    for total, want := range map[Amount]float64{"99.99": 0, "100.00": 20, "1500.00": 20} {
+        input := walgreensReceipt
+        input.Total = total
+        if got := ruleBreakdown(t, router, input)["largePurchaseBonus"]; got != want {
+            t.Errorf("total %s: largePurchaseBonus %v, want %v", total, got, want)
+        }
+    }
+}
+
+func TestWeekendBreakdown(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.Rules.EnableWeekendBonus = true
+    router := newTestRouterWith(t, cfg)
+    // Monday, Saturday and Sunday
+    for date, want := range map[string]float64{"2022-01-03": 0, "2022-01-08": 15, "2022-01-09": 15} {
+        input := walgreensReceipt
+        input.PurchaseDate = date
+        if got := ruleBreakdown(t, router, input)["weekendBonus"]; got != want {
+            t.Errorf("%s: weekendBonus %v, want %v", date, got, want)
+        }
+    }
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// receiptFilter selects receipts for GET /receipts/search; zero fields match everything
+type receiptFilter struct {
+    // lower-cased substring of the retailer name
+    retailer string
+    // purchase date range, both inclusive
+    from, to time.Time
+    // total range in cents, both inclusive; nil leaves the side open
+    minTotal, maxTotal *int64
+}
+
+// parseReceiptFilter reads the search query parameters
+// Input: request context with optional retailer, from, to, minTotal and maxTotal
+// Output: the filter and true, or false after a 400 response was sent
+func parseReceiptFilter(c *gin.Context) (receiptFilter, bool) {
+    filter := receiptFilter{retailer: strings.ToLower(c.Query("retailer"))}
+    var ok bool
+    if filter.from, ok = dateParam(c, "from"); !ok {
+        return receiptFilter{}, false
+    }
+    if filter.to, ok = dateParam(c, "to"); !ok {
+        return receiptFilter{}, false
+    }
+    if !filter.from.IsZero() && !filter.to.IsZero() && filter.from.After(filter.to) {
+        c.AbortWithStatusJSON(http.StatusBadRequest, errorBody(c, codeInvalidParameter, "from must not be after to", "from"))
+        return receiptFilter{}, false
+    }
+    if filter.minTotal, ok = amountParam(c, "minTotal"); !ok {
+        return receiptFilter{}, false
+    }
+    if filter.maxTotal, ok = amountParam(c, "maxTotal"); !ok {
+        return receiptFilter{}, false
+    }
+    return filter, true
+}
+
+// dateParam reads an optional YYYY-MM-DD query parameter
+// Input: request context and parameter name
+// Output: the date, zero if absent, and true; or false after a 400 response
+func dateParam(c *gin.Context, name string) (time.Time, bool) {
+    v := c.Query(name)
+    if v == "" {
+        return time.Time{}, true
+    }
+    date, err := time.Parse("2006-01-02", v)
+    if err != nil {
+        c.AbortWithStatusJSON(http.StatusBadRequest, errorBody(c, codeInvalidParameter, "invalid "+name+" date, expected YYYY-MM-DD", name))
+        return time.Time{}, false
+    }
+    return date, true
+}
+
+// amountParam reads an optional dollar amount query parameter
+// Input: request context and parameter name
+// Output: the amount in cents, nil if absent, and true; or false after a 400 response
+func amountParam(c *gin.Context, name string) (*int64, bool) {
+    v := c.Query(name)
+    if v == "" {
+        return nil, true
+    }
+    cents, err := parseDollars(v)
+    if err != nil {
+        c.AbortWithStatusJSON(http.StatusBadRequest, errorBody(c, codeInvalidParameter, "invalid "+name+", expected an amount such as 10.00", name))
+        return nil, false
+    }
+    return &cents, true
+}
+
+// matches reports whether a receipt passes every filter that is set
+// Input: stored receipt
+// Output: true if it matches
+func (f receiptFilter) matches(receipt Receipt) bool {
+    if f.retailer != "" && !strings.Contains(strings.ToLower(receipt.Retailer), f.retailer) {
+        return false
+    }
+    if !f.from.IsZero() && receipt.purchaseDay().Before(f.from) {
+        return false
+    }
+    if !f.to.IsZero() && receipt.purchaseDay().After(f.to) {
+        return false
+    }
+    if f.minTotal != nil && receipt.Total < *f.minTotal {
+        return false
+    }
+    if f.maxTotal != nil && receipt.Total > *f.maxTotal {
+        return false
+    }
+    return true
+}
+
+// searchReceipts lists the stored receipts matching the query, in insertion order
+// Every stored receipt is read to apply the filter, O(n) in the number stored
+// Input: 
+//   - retailer: optional, case-insensitive substring of the retailer name
+//   - from, to: optional purchase date range (YYYY-MM-DD), both inclusive
+//   - minTotal, maxTotal: optional total range in dollars, both inclusive
+//   - limit, offset, page: paging, as for GET /receipts
+// Output:
+//   - Success: JSON {"receipts": [{id, retailer, total, points}], "count": number, "limit": number, "offset": number}
+//              count is the number of matching receipts; ownership
+//              narrows the results as for GET /receipts
+//   - Error: JSON with error message {"error": "message"}, 400 for an invalid parameter
+func (s *Server) searchReceipts(c *gin.Context) {
+    filter, ok := parseReceiptFilter(c)
+    if !ok {
+        return
+    }
+    limit, offset, ok := pagination(c)
+    if !ok {
+        return
+    }
+
+    var matches []receiptSummary
+    err := forEachRecord(c.Request.Context(), s.store, func(id string, record ReceiptRecord) {
+        if !record.expired(s.cfg.ReceiptTTL) && filter.matches(record.Receipt) && s.mayRead(c, record.UserID) {
+            matches = append(matches, summarize(id, record))
+        }
+    })
+    if err != nil {
+        respondStoreError(c, err, "failed to read receipts")
+        return
+    }
+    count := len(matches)
+    start := min(offset, count)
+    end := min(start+limit, count)
+
+    c.JSON(http.StatusOK, gin.H{
+        "receipts": append([]receiptSummary{}, matches[start:end]...),
+        "count":    count,
+        "limit":    limit,
+        "offset":   offset,
+    })
+}
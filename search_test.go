@@ -0,0 +1,79 @@
+package main
+
+import (
+    "net/http"
+    "slices"
+    "testing"
+)
+
+func TestSearchReceipts(t *testing.T) {
+    router := newTestRouter(t)
+    stored := []struct{ retailer, date, total string }{
+        {"Target", "2022-01-01", "35.35"},
+        {"Target Express", "2022-06-15", "10.00"},
+        {"Walgreens", "2022-06-16", "9.99"},
+        {"M&M Corner Market", "2023-03-20", "50.00"},
+    }
+    for _, r := range stored {
+        input := exampleReceipt
+        input.Retailer, input.PurchaseDate, input.Total = r.retailer, r.date, Amount(r.total)
+        if status, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, input)); status != http.StatusOK {
+            t.Fatalf("process %s returned %d %v", r.retailer, status, body)
+        }
+    }
+
+    tests := []struct {
+        query string
+        want  []string
+    }{
+        {"", []string{"Target", "Target Express", "Walgreens", "M&M Corner Market"}},
+        // retailer is a case-insensitive substring
+        {"retailer=target", []string{"Target", "Target Express"}},
+        {"retailer=EXPRESS", []string{"Target Express"}},
+        {"retailer=costco", nil},
+        // dates and totals are inclusive at both ends
+        {"from=2022-06-15", []string{"Target Express", "Walgreens", "M&M Corner Market"}},
+        {"to=2022-06-15", []string{"Target", "Target Express"}},
+        {"from=2022-06-15&to=2022-06-15", []string{"Target Express"}},
+        {"minTotal=10.00", []string{"Target", "Target Express", "M&M Corner Market"}},
+        {"maxTotal=10.00", []string{"Target Express", "Walgreens"}},
+        {"minTotal=9.99&maxTotal=35.35", []string{"Target", "Target Express", "Walgreens"}},
+        // every filter given must match
+        {"retailer=target&from=2022-02-01", []string{"Target Express"}},
+        {"retailer=e&minTotal=10.00&to=2022-12-31", []string{"Target", "Target Express"}},
+        {"retailer=target&from=2022-01-01&to=2022-12-31&minTotal=10.00&maxTotal=50.00", []string{"Target", "Target Express"}},
+        {"retailer=walgreens&minTotal=10.00", nil},
+    }
+    for _, tt := range tests {
+        status, body := serve(t, router, http.MethodGet, "/receipts/search?"+tt.query, "")
+        if status != http.StatusOK {
+            t.Errorf("search %q returned %d %v", tt.query, status, body)
+            continue
+        }
+        var got []string
+        for _, r := range body["receipts"].([]any) {
+            got = append(got, r.(map[string]any)["retailer"].(string))
+        }
+        if !slices.Equal(got, tt.want) || body["count"] != float64(len(tt.want)) {
+            t.Errorf("search %q found %v (count %v), want %v", tt.query, got, body["count"], tt.want)
+        }
+    }
+
+    // count covers every match while the page holds some of them
+    _, body := serve(t, router, http.MethodGet, "/receipts/search?minTotal=9.99&limit=1&offset=1", "")
+    if receipts := body["receipts"].([]any); body["count"] != 4.0 || len(receipts) != 1 || receipts[0].(map[string]any)["retailer"] != "Target Express" {
+        t.Errorf("second page of one: %v, want Target Express of 4", body)
+    }
+
+    for _, query := range []string{
+        "from=2022-13-01",
+        "to=yesterday",
+        "from=2022-06-16&to=2022-06-15",
+        "minTotal=ten",
+        "maxTotal=-1.00",
+    } {
+        if status, body := serve(t, router, http.MethodGet, "/receipts/search?"+query, ""); status != http.StatusBadRequest || errorDetail(body)["code"] != codeInvalidParameter {
+            t.Errorf("search %q returned %d %v, want 400 %s", query, status, body, codeInvalidParameter)
+        }
+    }
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "net"
+    "net/http"
+    "os"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// closeRecordingStore is a slowStore that records when it was closed
+type closeRecordingStore struct {
+    slowStore
+    closed *atomic.Bool
+}
+
+func (s closeRecordingStore) Close() error {
+    s.closed.Store(true)
+    return s.slowStore.Close()
+}
+
+// startRun runs the server on a free local port
+// Input: config and store for run
+// Output: the server's base URL and a channel receiving run's result
+func startRun(t *testing.T, cfg Config, store Store) (string, <-chan error) {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    done := make(chan error, 1)
+    go func() {
+        done <- run(cfg, store, ln)
+    }()
+    url := "http://" + ln.Addr().String()
+    // run has registered for signals once it answers
+    for deadline := time.Now().Add(5 * time.Second); ; {
+        resp, err := http.Get(url + "/healthz")
+        if err == nil {
+            resp.Body.Close()
+            return url, done
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("server didn't come up: %v", err)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+// interrupt sends SIGINT to the test process, which run catches
+func interrupt(t *testing.T) {
+    t.Helper()
+    self, err := os.FindProcess(os.Getpid())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := self.Signal(os.Interrupt); err != nil {
+        t.Skipf("can't send SIGINT on this platform: %v", err)
+    }
+}
+
+func TestRunDrainsRequestsOnSignal(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.ShutdownTimeout = 5 * time.Second
+    // The janitor runs too, and must be stopped before the store is closed
+    cfg.ReceiptTTL = time.Hour
+    var closed atomic.Bool
+    store := closeRecordingStore{slowStore{NewMemoryStore(), 300 * time.Millisecond}, &closed}
+    url, done := startRun(t, cfg, store)
+
+    // A request that is still reading the store when the signal arrives
+    status := make(chan int, 1)
+    go func() {
+        resp, err := http.Get(url + "/receipts/7fb1377b-b223-49d9-a31a-5a02701dd310")
+        if err != nil {
+            t.Errorf("in-flight request failed: %v", err)
+            status <- 0
+            return
+        }
+        resp.Body.Close()
+        if closed.Load() {
+            t.Error("the store was closed before the in-flight request finished")
+        }
+        status <- resp.StatusCode
+    }()
+    time.Sleep(100 * time.Millisecond)
+    interrupt(t)
+
+    if got := <-status; got != http.StatusNotFound {
+        t.Errorf("in-flight request: got %d, want 404 from the drained request", got)
+    }
+    select {
+    case err := <-done:
+        if err != nil {
+            t.Errorf("run returned %v after a signal, want nil", err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("run didn't return after SIGINT")
+    }
+    if !closed.Load() {
+        t.Error("run returned without closing the store")
+    }
+    if _, err := http.Get(url + "/healthz"); err == nil {
+        t.Error("the server still accepts connections after shutting down")
+    }
+}
+
+func TestRunReturnsServerErrors(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Serving on a closed listener fails at once
+    ln.Close()
+    var closed atomic.Bool
+    store := closeRecordingStore{slowStore{NewMemoryStore(), 0}, &closed}
+    done := make(chan error, 1)
+    go func() {
+        done <- run(defaultConfig(), store, ln)
+    }()
+    select {
+    case err := <-done:
+        if err == nil {
+            t.Error("run returned nil for a server that couldn't serve")
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("run didn't return after the server failed")
+    }
+    if !closed.Load() {
+        t.Error("run returned without closing the store")
+    }
+}
+
+func TestRunStopsWaitingAfterDrainTimeout(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.ShutdownTimeout = 200 * time.Millisecond
+    var closed atomic.Bool
+    store := closeRecordingStore{slowStore{NewMemoryStore(), time.Second}, &closed}
+    url, done := startRun(t, cfg, store)
+
+    // A request that outlasts the drain timeout
+    finished := make(chan struct{})
+    go func() {
+        defer close(finished)
+        if resp, err := http.Get(url + "/receipts/7fb1377b-b223-49d9-a31a-5a02701dd310"); err == nil {
+            resp.Body.Close()
+        }
+    }()
+    time.Sleep(100 * time.Millisecond)
+    start := time.Now()
+    interrupt(t)
+
+    select {
+    case err := <-done:
+        if err != nil {
+            t.Errorf("run returned %v after a signal, want nil", err)
+        }
+        if waited := time.Since(start); waited < cfg.ShutdownTimeout || waited > 800*time.Millisecond {
+            t.Errorf("run returned %v after the signal, want about the %v drain timeout", waited, cfg.ShutdownTimeout)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("run didn't return after SIGINT")
+    }
+    if !closed.Load() {
+        t.Error("run returned without closing the store")
+    }
+    <-finished
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log/slog"
+    "os"
+    "time"
+)
+
+// loadSnapshot restores the records saved by writeSnapshot
+// Input: snapshot path and the empty MemoryStore to fill
+// Output: none; a missing file is a first boot and a corrupt file is
+//         skipped with a warning, so the server starts either way
+//         The corrupt file is kept as <path>.corrupt so the next snapshot
+//         doesn't overwrite it
+func loadSnapshot(path string, mem *MemoryStore) {
+    content, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return
+    }
+    if err != nil {
+        slog.Warn("skipping unreadable snapshot", "path", path, "error", err.Error())
+        return
+    }
+    var data fileStoreData
+    if err := json.Unmarshal(content, &data); err != nil {
+        slog.Warn("skipping corrupt snapshot", "path", path, "error", err.Error())
+        if err := os.Rename(path, path+".corrupt"); err != nil {
+            slog.Warn("failed to move corrupt snapshot aside", "path", path, "error", err.Error())
+        }
+        return
+    }
+    mem.mu.Lock()
+    defer mem.mu.Unlock()
+    for _, id := range data.Order {
+        if record, exists := data.Receipts[id]; exists {
+            mem.put(id, record)
+        }
+    }
+    mem.redemptions = data.Redemptions
+    slog.Info("loaded snapshot", "path", path, "receipts", len(mem.receipts))
+}
+
+// writeSnapshot saves every record in mem to path atomically
+// Input: snapshot path and the store to save
+// Output: nil, or an error if the snapshot can't be written
+func writeSnapshot(path string, mem *MemoryStore) error {
+    content, err := json.Marshal(mem.snapshot())
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(path, content)
+}
+
+// runSnapshots saves mem to path every interval until ctx is done
+// Input: context, store to save, snapshot path and interval between snapshots
+// Output: none, failed snapshots are logged and retried on the next tick;
+//         closeStore writes the final snapshot
+func runSnapshots(ctx context.Context, mem *MemoryStore, path string, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+        if err := writeSnapshot(path, mem); err != nil {
+            slog.Error("failed to write snapshot", "path", path, "error", err.Error())
+        }
+    }
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "os"
+    "path/filepath"
+    "reflect"
+    "slices"
+    "testing"
+    "time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+    ctx := context.Background()
+    path := filepath.Join(t.TempDir(), "snapshot.json")
+    mem := NewMemoryStore()
+    router := newTestRouterOn(t, defaultConfig(), mem)
+    withSeconds := walgreensReceipt
+    withSeconds.PurchaseDateTime = "2022-01-02T14:00:30-05:00"
+    withSeconds.PurchaseDate, withSeconds.PurchaseTime = "", ""
+    var ids []string
+    for _, input := range []ReceiptInput{exampleReceipt, mmReceipt, withSeconds} {
+        status, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, input))
+        if status != http.StatusOK {
+            t.Fatalf("process %s returned %d %v", input.Retailer, status, body)
+        }
+        ids = append(ids, body["id"].(string))
+    }
+    if err := writeSnapshot(path, mem); err != nil {
+        t.Fatal(err)
+    }
+
+    // The loaded store has every receipt, in order, with its items and times
+    loaded := NewMemoryStore()
+    loadSnapshot(path, loaded)
+    if got, _ := loaded.List(ctx); !slices.Equal(got, ids) {
+        t.Fatalf("loaded snapshot lists %v, want %v", got, ids)
+    }
+    for _, id := range ids {
+        want, _, _ := mem.Get(ctx, id)
+        got, _, _ := loaded.Get(ctx, id)
+        if !got.PurchasedAt.Equal(want.PurchasedAt) || !got.StoredAt.Equal(want.StoredAt) {
+            t.Errorf("receipt %s times loaded as %v and %v, want %v and %v", id, got.PurchasedAt, got.StoredAt, want.PurchasedAt, want.StoredAt)
+        }
+        // the zone offset is kept with the purchase time
+        _, gotOffset := got.PurchasedAt.Zone()
+        if _, wantOffset := want.PurchasedAt.Zone(); gotOffset != wantOffset {
+            t.Errorf("receipt %s purchase offset loaded as %d, want %d", id, gotOffset, wantOffset)
+        }
+        got.PurchasedAt, got.StoredAt = want.PurchasedAt, want.StoredAt
+        if !reflect.DeepEqual(got, want) {
+            t.Errorf("receipt %s loaded as %+v, want %+v", id, got, want)
+        }
+    }
+
+    // and serves the same receipts after a restart
+    router = newTestRouterOn(t, defaultConfig(), loaded)
+    _, before := serve(t, newTestRouterOn(t, defaultConfig(), mem), http.MethodGet, "/receipts/"+ids[2], "")
+    if _, after := serve(t, router, http.MethodGet, "/receipts/"+ids[2], ""); !reflect.DeepEqual(after, before) {
+        t.Errorf("receipt after loading the snapshot: %v, want %v", after, before)
+    }
+}
+
+func TestLoadSnapshotMissingOrCorrupt(t *testing.T) {
+    dir := t.TempDir()
+    // a first boot has no snapshot yet
+    mem := NewMemoryStore()
+    loadSnapshot(filepath.Join(dir, "missing.json"), mem)
+    if count, _ := mem.Count(context.Background()); count != 0 {
+        t.Errorf("missing snapshot loaded %d receipts", count)
+    }
+
+    // a corrupt one is skipped and kept aside for a look
+    path := filepath.Join(dir, "snapshot.json")
+    if err := os.WriteFile(path, []byte(`{"order": ["a"], "receipts": {"a": `), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    loadSnapshot(path, mem)
+    if count, _ := mem.Count(context.Background()); count != 0 {
+        t.Errorf("corrupt snapshot loaded %d receipts", count)
+    }
+    if _, err := os.Stat(path + ".corrupt"); err != nil {
+        t.Errorf("corrupt snapshot wasn't moved aside: %v", err)
+    }
+}
+
+func TestRunSnapshots(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "snapshot.json")
+    mem := NewMemoryStore()
+    mem.Put(context.Background(), "a", storeRecord("Target"))
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan struct{})
+    go func() {
+        runSnapshots(ctx, mem, path, 10*time.Millisecond)
+        close(done)
+    }()
+
+    // the first tick writes the snapshot
+    deadline := time.Now().Add(time.Second)
+    for {
+        if _, err := os.Stat(path); err == nil {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("no snapshot written after a second")
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    cancel()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("runSnapshots didn't return after its context ended")
+    }
+    loaded := NewMemoryStore()
+    loadSnapshot(path, loaded)
+    if record, ok, _ := loaded.Get(context.Background(), "a"); !ok || record.Retailer != "Target" {
+        t.Errorf("periodic snapshot holds %+v, want the Target receipt", record)
+    }
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+
+    _ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema creates the receipts table if it doesn't exist
+// seq keeps the insertion order; data holds the JSON encoded ReceiptRecord,
+// including its items
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS receipts (
+    seq  INTEGER PRIMARY KEY AUTOINCREMENT,
+    id   TEXT NOT NULL UNIQUE,
+    data TEXT NOT NULL
+)`
+
+// sqliteRedemptionsSchema creates the redemptions table if it doesn't exist
+// seq keeps the order redemptions were made in; data holds the JSON
+// encoded Redemption
+const sqliteRedemptionsSchema = `
+CREATE TABLE IF NOT EXISTS redemptions (
+    seq  INTEGER PRIMARY KEY AUTOINCREMENT,
+    data TEXT NOT NULL
+)`
+
+// SQLiteStore is a Store backed by a SQLite database file
+type SQLiteStore struct {
+    db *sql.DB
+}
+
+// NewSQLiteStore opens the SQLite database at path and migrates its schema
+// Input: path of the database file; it is created if it doesn't exist
+// Output: *SQLiteStore, or an error if the database can't be opened or migrated
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+    // busy_timeout makes concurrent writers wait for each other instead of failing
+    db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL")
+    if err != nil {
+        return nil, err
+    }
+    for _, schema := range []string{sqliteSchema, sqliteRedemptionsSchema} {
+        if _, err := db.Exec(schema); err != nil {
+            db.Close()
+            return nil, err
+        }
+    }
+    return &SQLiteStore{db: db}, nil
+}
+
+// Put stores a record under id
+// Input: context, receipt id and record
+// Output: nil, or a database error
+func (s *SQLiteStore) Put(ctx context.Context, id string, record ReceiptRecord) error {
+    return s.PutBatch(ctx, []string{id}, []ReceiptRecord{record})
+}
+
+// PutBatch stores several records in one transaction
+// Input: context, receipt ids and records, matched by index
+// Output: nil, or a database or context error; on error nothing is stored
+func (s *SQLiteStore) PutBatch(ctx context.Context, ids []string, records []ReceiptRecord) error {
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    // Updating an existing id keeps its seq, and with it its place in List
+    stmt, err := tx.PrepareContext(ctx, `INSERT INTO receipts (id, data) VALUES (?, ?)
+        ON CONFLICT(id) DO UPDATE SET data = excluded.data`)
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+    for i, id := range ids {
+        data, err := json.Marshal(records[i])
+        if err != nil {
+            return err
+        }
+        if _, err := stmt.ExecContext(ctx, id, data); err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+// Get returns the record stored under id
+// Input: context and receipt id
+// Output: the record and true, an empty record and false if it doesn't exist,
+//         or a database or context error
+func (s *SQLiteStore) Get(ctx context.Context, id string) (ReceiptRecord, bool, error) {
+    var data []byte
+    err := s.db.QueryRowContext(ctx, `SELECT data FROM receipts WHERE id = ?`, id).Scan(&data)
+    if errors.Is(err, sql.ErrNoRows) {
+        return ReceiptRecord{}, false, nil
+    }
+    if err != nil {
+        return ReceiptRecord{}, false, err
+    }
+    var record ReceiptRecord
+    if err := json.Unmarshal(data, &record); err != nil {
+        return ReceiptRecord{}, false, err
+    }
+    return record, true, nil
+}
+
+// Delete removes the record stored under id
+// Input: context and receipt id
+// Output: nil, ErrNotFound if the id doesn't exist, or a database or context error
+func (s *SQLiteStore) Delete(ctx context.Context, id string) error {
+    result, err := s.db.ExecContext(ctx, `DELETE FROM receipts WHERE id = ?`, id)
+    if err != nil {
+        return err
+    }
+    n, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+// List returns all stored ids in insertion order
+// Input: context
+// Output: slice of ids, or a database or context error
+func (s *SQLiteStore) List(ctx context.Context) ([]string, error) {
+    rows, err := s.db.QueryContext(ctx, `SELECT id FROM receipts ORDER BY seq`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    ids := []string{}
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil {
+            return nil, err
+        }
+        ids = append(ids, id)
+    }
+    return ids, rows.Err()
+}
+
+// Count returns the number of stored receipts
+// Input: context
+// Output: receipt count, or a database or context error
+func (s *SQLiteStore) Count(ctx context.Context) (int, error) {
+    var n int
+    err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM receipts`).Scan(&n)
+    return n, err
+}
+
+// PutRedemption stores a points redemption
+// Input: context and redemption
+// Output: nil, or a database or context error
+func (s *SQLiteStore) PutRedemption(ctx context.Context, redemption Redemption) error {
+    data, err := json.Marshal(redemption)
+    if err != nil {
+        return err
+    }
+    _, err = s.db.ExecContext(ctx, `INSERT INTO redemptions (data) VALUES (?)`, data)
+    return err
+}
+
+// Redemptions returns every stored redemption, oldest first
+// Input: context
+// Output: slice of redemptions, or a database or context error
+func (s *SQLiteStore) Redemptions(ctx context.Context) ([]Redemption, error) {
+    rows, err := s.db.QueryContext(ctx, `SELECT data FROM redemptions ORDER BY seq`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    redemptions := []Redemption{}
+    for rows.Next() {
+        var data []byte
+        if err := rows.Scan(&data); err != nil {
+            return nil, err
+        }
+        var redemption Redemption
+        if err := json.Unmarshal(data, &redemption); err != nil {
+            return nil, err
+        }
+        redemptions = append(redemptions, redemption)
+    }
+    return redemptions, rows.Err()
+}
+
+// Ping checks that the database is reachable
+// Input: context
+// Output: nil, or a database or context error
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+    return s.db.PingContext(ctx)
+}
+
+// Close closes the database
+// Input: none
+// Output: nil, or a database error
+func (s *SQLiteStore) Close() error {
+    return s.db.Close()
+}
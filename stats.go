@@ -0,0 +1,305 @@
+package main
+
+import (
+    "container/heap"
+    "context"
+    "log/slog"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// topRetailersLimit is how many retailers GET /receipts/stats lists by default
+const topRetailersLimit = 5
+
+// pointsBuckets are the lower bounds of the points histogram buckets; each
+// bucket ends where the next begins, and the last has no upper bound
+var pointsBuckets = []int{0, 25, 50, 100, 250}
+
+// retailerCount is the number of receipts stored for one retailer
+type retailerCount struct {
+    Retailer string `json:"retailer"`
+    Receipts int    `json:"receipts"`
+}
+
+// pointsBucket is one bar of the points histogram
+type pointsBucket struct {
+    Min int `json:"min"`
+    // Max is inclusive; nil for the last bucket
+    Max      *int `json:"max,omitempty"`
+    Receipts int  `json:"receipts"`
+}
+
+// receiptStats aggregates the stored receipts
+type receiptStats struct {
+    Receipts      int     `json:"receipts"`
+    TotalPoints   int     `json:"totalPoints"`
+    AveragePoints float64 `json:"averagePoints"`
+    MinPoints     int     `json:"minPoints"`
+    MaxPoints     int     `json:"maxPoints"`
+    // TotalAmount is the sum of the receipt totals in dollars, e.g. "41.84"
+    TotalAmount  string          `json:"totalAmount"`
+    Histogram    []pointsBucket  `json:"histogram"`
+    TopRetailers []retailerCount `json:"topRetailers"`
+}
+
+// statsIndex keeps the aggregates of GET /receipts/stats up to date as
+// receipts are stored and removed, so the endpoint doesn't scan the store
+// Voided receipts aren't in the aggregates, as they don't count towards user
+// balances or show up in GET /receipts by default; they are only kept for
+// the count GET /receipts?includeVoided=true returns
+type statsIndex struct {
+    mu  sync.Mutex
+    ttl time.Duration
+    // receipts[id] = what the index counted for the receipt
+    receipts map[string]statsEntry
+    // voided[id] = when the voided receipt was stored
+    voided map[string]time.Time
+    totalPoints int
+    // totalCents is the sum of the receipt totals
+    totalCents int64
+    // points[n] = number of receipts with n points, for the min and max
+    points map[int]int
+    // buckets[i] = number of receipts in the bucket starting at pointsBuckets[i]
+    buckets []int
+    // retailers[name] = number of receipts
+    retailers map[string]int
+    // expiry orders the receipts by when they expire; only kept when ttl is set
+    expiry expiryHeap
+}
+
+// statsEntry is the part of a stored record the statsIndex needs
+type statsEntry struct {
+    points   int
+    cents    int64
+    retailer string
+    storedAt time.Time
+}
+
+// newStatsIndex creates an index of the receipts already in store
+// Input: store to index, and the receipt TTL; 0 means receipts never expire.
+//        If the store can't be read the index is partial and a warning is logged
+// Output: *statsIndex ready for use
+func newStatsIndex(store Store, ttl time.Duration) *statsIndex {
+    x := &statsIndex{
+        ttl:       ttl,
+        receipts:  make(map[string]statsEntry),
+        voided:    make(map[string]time.Time),
+        points:    make(map[int]int),
+        buckets:   make([]int, len(pointsBuckets)),
+        retailers: make(map[string]int),
+    }
+    err := forEachRecord(context.Background(), store, func(id string, record ReceiptRecord) {
+        x.set(id, record)
+    })
+    if err != nil {
+        slog.Warn("statistics may miss stored receipts, failed to read them", "error", err.Error())
+    }
+    return x
+}
+
+// set counts a receipt as it was just stored, replacing what the index
+// counted for it
+// Input: receipt id and its stored record; a voided record is left out of
+//        the aggregates
+// Output: none
+func (x *statsIndex) set(id string, record ReceiptRecord) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    oldStoredAt, existed := x.storedAt(id)
+    x.remove(id)
+    // Records without StoredAt, from before TTLs existed, never expire
+    if x.ttl > 0 && !record.StoredAt.IsZero() && !(existed && oldStoredAt.Equal(record.StoredAt)) {
+        heap.Push(&x.expiry, expiringReceipt{id: id, storedAt: record.StoredAt})
+    }
+    if record.Voided {
+        x.voided[id] = record.StoredAt
+        return
+    }
+    entry := statsEntry{points: record.Points, cents: record.Total, retailer: record.Retailer, storedAt: record.StoredAt}
+    x.receipts[id] = entry
+    x.totalPoints += entry.points
+    x.totalCents += entry.cents
+    x.points[entry.points]++
+    x.buckets[bucketOf(entry.points)]++
+    x.retailers[entry.retailer]++
+}
+
+// storedAt looks up when a receipt the index holds, voided or not, was stored
+// The caller must hold x.mu
+// Input: receipt id
+// Output: its StoredAt and true, or false if the index doesn't hold it
+func (x *statsIndex) storedAt(id string) (time.Time, bool) {
+    if entry, exists := x.receipts[id]; exists {
+        return entry.storedAt, true
+    }
+    storedAt, exists := x.voided[id]
+    return storedAt, exists
+}
+
+// delete drops a receipt that was deleted or evicted from the store
+// Input: receipt id
+// Output: none
+func (x *statsIndex) delete(id string) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.remove(id)
+}
+
+// remove takes a receipt out of every aggregate, if it is counted, or out
+// of the voided receipts
+// Its entry in expiry is left behind and skipped once it comes up
+// The caller must hold x.mu
+func (x *statsIndex) remove(id string) {
+    delete(x.voided, id)
+    entry, exists := x.receipts[id]
+    if !exists {
+        return
+    }
+    delete(x.receipts, id)
+    x.totalPoints -= entry.points
+    x.totalCents -= entry.cents
+    if x.points[entry.points]--; x.points[entry.points] == 0 {
+        delete(x.points, entry.points)
+    }
+    x.buckets[bucketOf(entry.points)]--
+    if x.retailers[entry.retailer]--; x.retailers[entry.retailer] == 0 {
+        delete(x.retailers, entry.retailer)
+    }
+}
+
+// dropExpired removes the receipts older than the TTL, which the janitor
+// may not have swept yet
+// The caller must hold x.mu
+func (x *statsIndex) dropExpired() {
+    for len(x.expiry) > 0 {
+        next := x.expiry[0]
+        if !(ReceiptRecord{StoredAt: next.storedAt}).expired(x.ttl) {
+            return
+        }
+        heap.Pop(&x.expiry)
+        // Skip receipts deleted since, or stored again under the same id
+        if storedAt, exists := x.storedAt(next.id); exists && storedAt.Equal(next.storedAt) {
+            x.remove(next.id)
+        }
+    }
+}
+
+// listed counts the receipts GET /receipts lists for a caller who may see
+// every receipt
+// Input: true to count voided receipts too
+// Output: number of receipts that haven't expired
+func (x *statsIndex) listed(includeVoided bool) int {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.dropExpired()
+    if includeVoided {
+        return len(x.receipts) + len(x.voided)
+    }
+    return len(x.receipts)
+}
+
+// stats returns the aggregates of the receipts that haven't expired
+// Input: how many retailers to list
+// Output: receiptStats; the points fields are 0 when nothing is stored.
+//         O(p + r log r) for p distinct points values and r retailers
+func (x *statsIndex) stats(top int) receiptStats {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.dropExpired()
+    stats := receiptStats{
+        Receipts:     len(x.receipts),
+        TotalPoints:  x.totalPoints,
+        TotalAmount:  formatCents(x.totalCents),
+        Histogram:    make([]pointsBucket, len(pointsBuckets)),
+        TopRetailers: make([]retailerCount, 0, len(x.retailers)),
+    }
+    if stats.Receipts > 0 {
+        stats.AveragePoints = math.Round(float64(stats.TotalPoints)/float64(stats.Receipts)*100) / 100
+        first := true
+        for points := range x.points {
+            if first || points < stats.MinPoints {
+                stats.MinPoints = points
+            }
+            if first || points > stats.MaxPoints {
+                stats.MaxPoints = points
+            }
+            first = false
+        }
+    }
+    for i, min := range pointsBuckets {
+        stats.Histogram[i] = pointsBucket{Min: min, Receipts: x.buckets[i]}
+        if i+1 < len(pointsBuckets) {
+            max := pointsBuckets[i+1] - 1
+            stats.Histogram[i].Max = &max
+        }
+    }
+    for retailer, n := range x.retailers {
+        stats.TopRetailers = append(stats.TopRetailers, retailerCount{Retailer: retailer, Receipts: n})
+    }
+    // Most receipts first, ties broken by name so the order is stable
+    sort.Slice(stats.TopRetailers, func(i, j int) bool {
+        a, b := stats.TopRetailers[i], stats.TopRetailers[j]
+        if a.Receipts != b.Receipts {
+            return a.Receipts > b.Receipts
+        }
+        return a.Retailer < b.Retailer
+    })
+    if len(stats.TopRetailers) > top {
+        stats.TopRetailers = stats.TopRetailers[:top]
+    }
+    return stats
+}
+
+// bucketOf finds the histogram bucket of a receipt
+// Input: the receipt's points
+// Output: index into pointsBuckets; points below 0 go in the first bucket
+func bucketOf(points int) int {
+    return max(sort.SearchInts(pointsBuckets, points+1)-1, 0)
+}
+
+// expiringReceipt is a receipt waiting in statsIndex.expiry
+type expiringReceipt struct {
+    id       string
+    storedAt time.Time
+}
+
+// expiryHeap is a min-heap of receipts by StoredAt, for container/heap
+type expiryHeap []expiringReceipt
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].storedAt.Before(h[j].storedAt) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiringReceipt)) }
+func (h *expiryHeap) Pop() any {
+    old := *h
+    last := old[len(old)-1]
+    *h = old[:len(old)-1]
+    return last
+}
+
+// getStats reports aggregate statistics over all stored receipts that
+// aren't voided
+// The figures come from the statsIndex rather than a scan of the store
+// Input: top: optional query parameter, how many retailers to list, 1 to
+//        maxPageLimit, default topRetailersLimit
+// Output:
+//   - Success: JSON {"receipts": n, "totalPoints": n, "averagePoints": n,
+//              "minPoints": n, "maxPoints": n, "totalAmount": "0.00",
+//              "histogram": [{"min": n, "max": n, "receipts": n}],
+//              "topRetailers": [{"retailer": name, "receipts": n}]}
+//              points fields are 0 when nothing is stored
+//   - Error: JSON with error message {"error": "message"} if top is invalid
+func (s *Server) getStats(c *gin.Context) {
+    top, err := strconv.Atoi(c.DefaultQuery("top", strconv.Itoa(topRetailersLimit)))
+    if err != nil || top < 1 || top > maxPageLimit {
+        respondError(c, http.StatusBadRequest, codeInvalidParameter, "invalid top")
+        return
+    }
+    c.JSON(http.StatusOK, s.stats.stats(top))
+}
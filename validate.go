@@ -0,0 +1,35 @@
+package main
+
+import (
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+)
+
+// validateReceipt checks a receipt the way processReceipt does, without storing it
+// Every problem is reported, not just the first, so a client can flag all
+// of them at once; nothing is counted in receipts_rejected_total
+// Input: JSON receipt in the same format as processReceipt; the strict query
+//        parameter applies as it does there
+// Output:
+//   - Valid: 200 JSON {"valid": true}
+//   - Invalid: JSON {"valid": false, "errors": [{"field": "total", "message": "invalid total"}]},
+//              400 for malformed fields and 422 for a purchaseDate out of
+//              range, the statuses processReceipt would return
+func (s *Server) validateReceipt(c *gin.Context) {
+    var input ReceiptInput
+    if err := s.bindJSON(c, &input); err != nil {
+        respondBindError(c, err)
+        return
+    }
+    receipt, err := parseReceipt(input, s.parseOptions(c))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"valid": false, "errors": fieldErrors(err)})
+        return
+    }
+    if err := s.checkPurchaseDate(receipt); err != nil {
+        c.JSON(http.StatusUnprocessableEntity, gin.H{"valid": false, "errors": fieldErrors(err)})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"valid": true})
+}
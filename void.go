@@ -0,0 +1,48 @@
+package main
+
+import (
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+)
+
+// voidReceipt marks a stored receipt as voided, e.g. for a returned purchase
+// The receipt is kept, unlike DELETE, but no longer earns points and is left
+// out of GET /receipts; voiding it again has no further effect
+// Input: receipt ID in URL path parameter
+// Output:
+//   - Success: JSON {"id": "uuid-id", "status": "voided"}
+//   - Error: JSON with error message {"error": "message"}, 404 if the id doesn't exist
+func (s *Server) voidReceipt(c *gin.Context) {
+    id, ok := receiptID(c)
+    if !ok {
+        return
+    }
+    // Held so a concurrent PUT or PATCH can't store over the voided record
+    defer s.lockForUpdate()()
+    record, ok := s.lookup(c, id)
+    if !ok {
+        return
+    }
+    if !record.Voided {
+        record.Voided = true
+        if err := s.store.Put(c.Request.Context(), id, record); err != nil {
+            respondStoreError(c, err, "failed to store receipt")
+            return
+        }
+        s.indexReceipt(id, record)
+    }
+    c.JSON(http.StatusOK, gin.H{"id": id, "status": "voided"})
+}
+
+// rejectVoided answers requests for the points of a voided receipt
+// Input: request context and the receipt's record
+// Output: true after a 422 RECEIPT_VOIDED response was sent, false if the
+//         receipt isn't voided
+func rejectVoided(c *gin.Context, record ReceiptRecord) bool {
+    if !record.Voided {
+        return false
+    }
+    respondError(c, http.StatusUnprocessableEntity, codeReceiptVoided, "receipt has been voided")
+    return true
+}
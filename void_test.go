@@ -0,0 +1,60 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+)
+
+func TestVoidReceipt(t *testing.T) {
+    router := newTestRouter(t)
+    other := exampleReceipt
+    other.Retailer = "Walgreens"
+    _, body := serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, exampleReceipt))
+    id, _ := body["id"].(string)
+    serve(t, router, http.MethodPost, "/receipts/process", receiptJSON(t, other))
+
+    // Voiding twice gives the same answer
+    for range 2 {
+        status, body := serve(t, router, http.MethodPost, "/receipts/"+id+"/void", "")
+        if status != http.StatusOK || body["id"] != id || body["status"] != "voided" {
+            t.Fatalf("void: got %d %v, want 200 voided", status, body)
+        }
+    }
+
+    for _, path := range []string{"/points", "/points/breakdown", "/breakdown"} {
+        status, body := serve(t, router, http.MethodGet, "/receipts/"+id+path, "")
+        if status != http.StatusUnprocessableEntity || errorDetail(body)["message"] != "receipt has been voided" || errorDetail(body)["code"] != codeReceiptVoided {
+            t.Errorf("GET %s: got %d %v, want 422 receipt has been voided", path, status, body)
+        }
+    }
+    // The receipt itself is still stored
+    if status, body := serve(t, router, http.MethodGet, "/receipts/"+id, ""); status != http.StatusOK {
+        t.Errorf("GET receipt: got %d %v, want 200", status, body)
+    }
+    // A correction keeps it voided
+    serve(t, router, http.MethodPatch, "/receipts/"+id, `{"retailer": "Target Store"}`)
+    if status, _ := serve(t, router, http.MethodGet, "/receipts/"+id+"/points", ""); status != http.StatusUnprocessableEntity {
+        t.Errorf("points after PATCH: got %d, want 422", status)
+    }
+
+    _, list := serve(t, router, http.MethodGet, "/receipts", "")
+    receipts, _ := list["receipts"].([]any)
+    if list["count"] != 1.0 || len(receipts) != 1 || receipts[0].(map[string]any)["retailer"] != "Walgreens" {
+        t.Errorf("list: got %v, want only the receipt that isn't voided", list)
+    }
+    _, list = serve(t, router, http.MethodGet, "/receipts?includeVoided=true", "")
+    receipts, _ = list["receipts"].([]any)
+    if list["count"] != 2.0 || len(receipts) != 2 || receipts[0].(map[string]any)["voided"] != true {
+        t.Errorf("list with includeVoided: got %v, want both receipts, the first marked voided", list)
+    }
+}
+
+func TestVoidUnknownReceipt(t *testing.T) {
+    router := newTestRouter(t)
+    if status, body := serve(t, router, http.MethodPost, "/receipts/00000000-0000-0000-0000-000000000000/void", ""); status != http.StatusNotFound || errorDetail(body)["code"] != codeReceiptNotFound {
+        t.Errorf("missing receipt: got %d %v, want 404", status, body)
+    }
+    if status, body := serve(t, router, http.MethodPost, "/receipts/not-a-uuid/void", ""); status != http.StatusBadRequest || errorDetail(body)["code"] != codeInvalidReceiptID {
+        t.Errorf("invalid id: got %d %v, want 400", status, body)
+    }
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+    "context"
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// WAL fsync policies
+const (
+    // walSyncAlways fsyncs every entry before the request returns
+    walSyncAlways = "always"
+    // walSyncInterval fsyncs once a second; a crash loses at most the last second
+    walSyncInterval = "interval"
+)
+
+// walEntry is one line of the write-ahead log
+type walEntry struct {
+    // Op is "put", "delete" or "redeem"
+    Op     string         `json:"op"`
+    ID     string         `json:"id"`
+    Record *ReceiptRecord `json:"record,omitempty"`
+    // Redemption is set for "redeem"
+    Redemption *Redemption `json:"redemption,omitempty"`
+}
+
+// WALStore is a Store that keeps receipts in memory and appends every
+// change to a log file, which is replayed on startup
+type WALStore struct {
+    // serializes appends so the log order matches the in-memory order
+    mu       sync.Mutex
+    path     string
+    syncMode string
+    file     *os.File
+    mem      *MemoryStore
+    // closed by Close to stop syncEverySecond
+    done     chan struct{}
+    // waits for syncEverySecond to return before the log is closed
+    syncer   sync.WaitGroup
+    closing  sync.Once
+}
+
+// NewWALStore replays the log at path and opens it for appending
+// Input: path of the log file, created if it doesn't exist, and the fsync
+//        policy, walSyncAlways or walSyncInterval
+// Output: *WALStore, or an error if the log can't be read or has a corrupt entry
+//         A truncated last line, left by a crash mid-write, is dropped
+func NewWALStore(path, syncMode string) (*WALStore, error) {
+    s := &WALStore{path: path, syncMode: syncMode, mem: NewMemoryStore(), done: make(chan struct{})}
+    if err := s.replay(); err != nil {
+        return nil, err
+    }
+    // Start from a compact log so replay time tracks the live receipts
+    if err := s.Compact(); err != nil {
+        return nil, err
+    }
+    if syncMode == walSyncInterval {
+        s.syncer.Add(1)
+        go s.syncEverySecond()
+    }
+    return s, nil
+}
+
+// replay applies every complete entry in the log to the in-memory store
+// Input: none
+// Output: nil, or an error if the log can't be read or an entry before
+//         the last line is corrupt
+func (s *WALStore) replay() error {
+    content, err := os.ReadFile(s.path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    s.mem.mu.Lock()
+    defer s.mem.mu.Unlock()
+    lineNo := 0
+    for len(content) > 0 {
+        lineNo++
+        end := bytes.IndexByte(content, '\n')
+        if end < 0 {
+            // No newline: the last write was cut short
+            slog.Warn("ignoring truncated write-ahead log entry", "path", s.path, "line", lineNo)
+            return nil
+        }
+        line := content[:end]
+        content = content[end+1:]
+
+        var entry walEntry
+        if err := json.Unmarshal(line, &entry); err != nil {
+            if len(content) == 0 {
+                slog.Warn("ignoring truncated write-ahead log entry", "path", s.path, "line", lineNo)
+                return nil
+            }
+            return fmt.Errorf("corrupt write-ahead log entry on line %d: %w", lineNo, err)
+        }
+        switch entry.Op {
+        case "put":
+            if entry.Record != nil {
+                s.mem.put(entry.ID, *entry.Record)
+            }
+        case "delete":
+            s.mem.remove(entry.ID)
+        case "redeem":
+            if entry.Redemption != nil {
+                s.mem.redemptions = append(s.mem.redemptions, *entry.Redemption)
+            }
+        }
+    }
+    return nil
+}
+
+// Compact rewrites the log with one entry per stored receipt and redemption, dropping
+// replaced and deleted receipts, then reopens it for appending
+// Input: none
+// Output: nil, or an error if the new log can't be written; the old log
+//         stays in place on error
+func (s *WALStore) Compact() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    data := s.mem.snapshot()
+    tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    w := bufio.NewWriter(tmp)
+    for _, id := range data.Order {
+        record := data.Receipts[id]
+        if err := writeWALEntry(w, walEntry{Op: "put", ID: id, Record: &record}); err != nil {
+            tmp.Close()
+            return err
+        }
+    }
+    for i := range data.Redemptions {
+        if err := writeWALEntry(w, walEntry{Op: "redeem", ID: data.Redemptions[i].ID, Redemption: &data.Redemptions[i]}); err != nil {
+            tmp.Close()
+            return err
+        }
+    }
+    if err := w.Flush(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp.Name(), s.path); err != nil {
+        return err
+    }
+
+    file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    if s.file != nil {
+        s.file.Close()
+    }
+    s.file = file
+    return nil
+}
+
+// append writes entries to the log, fsyncing them under walSyncAlways
+// The caller must hold mu
+func (s *WALStore) append(entries ...walEntry) error {
+    var buf bytes.Buffer
+    for _, entry := range entries {
+        if err := writeWALEntry(&buf, entry); err != nil {
+            return err
+        }
+    }
+    // One write per call keeps a batch from being split across lines on a crash
+    if _, err := s.file.Write(buf.Bytes()); err != nil {
+        return err
+    }
+    if s.syncMode == walSyncAlways {
+        return s.file.Sync()
+    }
+    return nil
+}
+
+// writeWALEntry encodes entry as a single JSON line
+// Input: destination writer and entry
+// Output: nil, or an encoding or write error
+func writeWALEntry(w io.Writer, entry walEntry) error {
+    line, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(append(line, '\n'))
+    return err
+}
+
+// syncEverySecond fsyncs the log once a second, for walSyncInterval
+// Input: none
+// Output: none, runs until Close and logs failed syncs
+func (s *WALStore) syncEverySecond() {
+    defer s.syncer.Done()
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.done:
+            return
+        case <-ticker.C:
+        }
+        s.mu.Lock()
+        err := s.file.Sync()
+        s.mu.Unlock()
+        if err != nil {
+            slog.Error("failed to sync write-ahead log", "path", s.path, "error", err.Error())
+        }
+    }
+}
+
+// Put logs a record and then stores it under id
+// Input: context, receipt id and record
+// Output: nil, or an error if the log can't be written; nothing is stored on error
+func (s *WALStore) Put(ctx context.Context, id string, record ReceiptRecord) error {
+    return s.PutBatch(ctx, []string{id}, []ReceiptRecord{record})
+}
+
+// PutBatch logs several records and then stores them
+// Input: context, receipt ids and records, matched by index
+// Output: nil, or an error if the log can't be written or the context ended
+//         while waiting for another write; nothing is stored on error
+func (s *WALStore) PutBatch(ctx context.Context, ids []string, records []ReceiptRecord) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    // Once logged the records must be stored, so the context is only checked before
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    entries := make([]walEntry, len(ids))
+    for i, id := range ids {
+        entries[i] = walEntry{Op: "put", ID: id, Record: &records[i]}
+    }
+    if err := s.append(entries...); err != nil {
+        return err
+    }
+    return s.mem.PutBatch(context.WithoutCancel(ctx), ids, records)
+}
+
+// PutRedemption logs a points redemption and then stores it
+// Input: context and redemption
+// Output: nil, or an error if the log can't be written or the context ended
+//         while waiting for another write; nothing is stored on error
+func (s *WALStore) PutRedemption(ctx context.Context, redemption Redemption) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if err := s.append(walEntry{Op: "redeem", ID: redemption.ID, Redemption: &redemption}); err != nil {
+        return err
+    }
+    return s.mem.PutRedemption(context.WithoutCancel(ctx), redemption)
+}
+
+// Redemptions returns every stored redemption, oldest first
+// Input: context
+// Output: slice owned by the caller
+func (s *WALStore) Redemptions(ctx context.Context) ([]Redemption, error) {
+    return s.mem.Redemptions(ctx)
+}
+
+// Get returns the record stored under id
+// Input: context and receipt id
+// Output: the record and true, or an empty record and false if it doesn't exist
+func (s *WALStore) Get(ctx context.Context, id string) (ReceiptRecord, bool, error) {
+    return s.mem.Get(ctx, id)
+}
+
+// Delete logs the removal of id and then removes it
+// Input: context and receipt id
+// Output: nil, ErrNotFound if the id doesn't exist, or a log write or context error
+func (s *WALStore) Delete(ctx context.Context, id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    _, exists, err := s.mem.Get(ctx, id)
+    if err != nil {
+        return err
+    }
+    if !exists {
+        return ErrNotFound
+    }
+    if err := s.append(walEntry{Op: "delete", ID: id}); err != nil {
+        return err
+    }
+    return s.mem.Delete(context.WithoutCancel(ctx), id)
+}
+
+// List returns a snapshot of all stored ids in insertion order
+// Input: context
+// Output: slice of ids owned by the caller
+func (s *WALStore) List(ctx context.Context) ([]string, error) {
+    return s.mem.List(ctx)
+}
+
+// Count returns the number of stored receipts
+// Input: context
+// Output: receipt count
+func (s *WALStore) Count(ctx context.Context) (int, error) {
+    return s.mem.Count(ctx)
+}
+
+// Ping reports whether the store is initialized
+// Input: context
+// Output: nil, or an error if the in-memory copy is not initialized
+func (s *WALStore) Ping(ctx context.Context) error {
+    return s.mem.Ping(ctx)
+}
+
+// Close stops the interval sync, then fsyncs and closes the log
+// Input: none
+// Output: nil, or an error if the log can't be synced or closed
+func (s *WALStore) Close() error {
+    s.closing.Do(func() { close(s.done) })
+    // Wait outside the lock, which a sync in progress holds
+    s.syncer.Wait()
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    // Under walSyncInterval the last second of entries may not be synced yet
+    if err := s.file.Sync(); err != nil {
+        s.file.Close()
+        return err
+    }
+    return s.file.Close()
+}
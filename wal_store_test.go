@@ -0,0 +1,68 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "log/slog"
+    "path/filepath"
+    "reflect"
+    "slices"
+    "testing"
+    "time"
+)
+
+func TestWALStoreRoundTrip(t *testing.T) {
+    ctx := context.Background()
+    path := filepath.Join(t.TempDir(), "receipts.wal")
+    store, err := NewWALStore(path, walSyncAlways)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, id := range []string{"a", "b", "c"} {
+        if err := store.Put(ctx, id, storeRecord("Target")); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := store.Delete(ctx, "b"); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    // Replaying the log gives back the same receipts in the same order
+    store, err = NewWALStore(path, walSyncAlways)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+    if ids, err := store.List(ctx); err != nil || !slices.Equal(ids, []string{"a", "c"}) {
+        t.Fatalf("replayed store lists %v (%v), want [a c]", ids, err)
+    }
+    if record, ok, err := store.Get(ctx, "c"); err != nil || !ok || !reflect.DeepEqual(record, storeRecord("Target")) {
+        t.Errorf("receipt c replayed as %+v (%v)", record, err)
+    }
+}
+
+func TestWALStoreCloseStopsIntervalSync(t *testing.T) {
+    var logs bytes.Buffer
+    logger := slog.Default()
+    slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+    t.Cleanup(func() { slog.SetDefault(logger) })
+
+    store, err := NewWALStore(filepath.Join(t.TempDir(), "receipts.wal"), walSyncInterval)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Put(context.Background(), "a", storeRecord("Target")); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Close(); err != nil {
+        t.Fatal(err)
+    }
+    // A sync still running after Close would fail on the closed log every second
+    time.Sleep(1200 * time.Millisecond)
+    if logs.Len() != 0 {
+        t.Errorf("interval sync kept running after Close: %s", logs.String())
+    }
+}